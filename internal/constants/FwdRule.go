@@ -9,8 +9,24 @@ const (
 	AccessBlockedNotAuthenticated uint16 = 1
 	AccessBlockedUnauthorised     uint16 = 2
 	AccessBlockedRule             uint16 = 3
+	AccessBlockedCategory         uint16 = 4
+	AccessBlockedRebinding        uint16 = 5
+	AccessBlockedQuarantined      uint16 = 6
+	AccessBlockedBypass           uint16 = 7
 )
 
+// AccessReasons describes the reason codes
+var AccessReasons = map[uint16]string{
+	AccessAllowed:                 "Allowed",
+	AccessBlockedNotAuthenticated: "Not authenticated",
+	AccessBlockedUnauthorised:     "Unauthorised",
+	AccessBlockedRule:             "Blocked by rule",
+	AccessBlockedCategory:         "Blocked category",
+	AccessBlockedRebinding:        "Blocked DNS rebinding",
+	AccessBlockedQuarantined:      "Quarantined for excessive queries",
+	AccessBlockedBypass:           "Blocked DNS bypass",
+}
+
 type FwdRule struct {
 	ClientIP    string
 	InterfaceIP string
@@ -18,12 +34,16 @@ type FwdRule struct {
 	ReasonCode  uint16
 	TargetIP    string
 	AllocatedIP string
+	// MacAddress identifies the client of IPv6 forwards, its IPv6 source address is not known
+	MacAddress string
 }
 
 type DNSSession struct {
-	Since       time.Time
-	ClientIP    string
-	InterfaceIP string
+	Since         time.Time
+	ClientIP      string
+	MacAddress    string
+	InterfaceIP   string
+	InterfaceIPv6 string
 	//OrigIP       string
 	//DestIP       string
 	//DestIPOffset uint16
@@ -34,7 +54,14 @@ type DNSSession struct {
 	DNSExpiry     time.Time
 	BytesUsed     uint64
 	ReasonCode    uint16
+	Category      string
+	BlockedBy     string
 	IsLocal       bool
+	Rcode         int
+	TTL           uint32
+	Hits          uint32
+	DNSSEC        string
+	SafeSearch    string
 	DNSResponse   DNSResponse
 }
 
@@ -55,7 +82,7 @@ type DNSResponse struct {
 type ReverseDNS struct {
 	IP           string
 	DestIP       string
-	DestIPOffset uint16
+	DestIPOffset uint32
 	Hostname     string
 }
 
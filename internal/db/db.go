@@ -8,6 +8,9 @@ import (
 	"sleuth/internal/constants"
 	"sleuth/internal/log"
 	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/dgraph-io/badger/v4"
@@ -15,6 +18,8 @@ import (
 
 type Db struct {
 	dbInstance *badger.DB
+	// categories counts the writes of DNS categories, structures built from them are rebuilt when it changes
+	categories atomic.Uint64
 }
 
 func InitDB(path string) *Db {
@@ -94,6 +99,24 @@ func (d *Db) SaveSettings(s Settings) error {
 	})
 }
 
+// settingsLock guards the settings shared by the portal, the DNS server and the firewall manager, the
+// services read them while the admin UI and the API change them
+var settingsLock sync.RWMutex
+
+// Snapshot returns a copy of the shared settings taken under the settings lock
+func (s *Settings) Snapshot() Settings {
+	settingsLock.RLock()
+	defer settingsLock.RUnlock()
+	return *s
+}
+
+// Update changes the shared settings under the settings lock
+func (s *Settings) Update(change func(*Settings)) {
+	settingsLock.Lock()
+	defer settingsLock.Unlock()
+	change(s)
+}
+
 /****   Users     *****/
 
 func (d *Db) GetUsers() []UserProfile {
@@ -128,7 +151,30 @@ func (d *Db) GetUsers() []UserProfile {
 	return users
 }
 
+// UpdateUser updates the user, a password other than the stored one is a new password and is hashed
 func (d *Db) UpdateUser(u *UserProfile) error {
+	current := d.GetUser(u.UserName)
+	if current == nil {
+		return fmt.Errorf("user %s does not exists", u.UserName)
+	}
+	if u.Password != current.Password {
+		password := u.Password
+		u.Password = current.Password
+		u.PasswordHistory = current.PasswordHistory
+		if password != "" {
+			if err := d.checkPasswordPolicy(u, password); err != nil {
+				return err
+			}
+			if err := d.setPassword(u, password); err != nil {
+				return err
+			}
+		}
+	}
+	return d.saveUser(u)
+}
+
+// saveUser stores the existing user as is
+func (d *Db) saveUser(u *UserProfile) error {
 	return d.dbInstance.Update(func(txn *badger.Txn) error {
 		user, err := txn.Get([]byte("user:" + u.UserName))
 		if user == nil {
@@ -149,28 +195,31 @@ func (d *Db) UpdateUser(u *UserProfile) error {
 }
 
 func (d *Db) SetPassword(username string, password string) error {
-	return d.dbInstance.Update(func(txn *badger.Txn) error {
-		u := d.GetUser(username)
-		if u == nil {
-			return fmt.Errorf("user %s does not exists", username)
-		}
-		u.Password = password
-		u.PasswordReset = time.Time{}
+	u := d.GetUser(username)
+	if u == nil {
+		return fmt.Errorf("user %s does not exists", username)
+	}
+	if err := d.checkPasswordPolicy(u, password); err != nil {
+		return err
+	}
+	if err := d.setPassword(u, password); err != nil {
+		return err
+	}
+	u.PasswordReset = time.Time{}
+	return d.saveUser(u)
+}
 
-		key := "user:" + u.UserName
-		val, err := json.Marshal(u)
-		if err != nil {
+// CreateUser creates the user, the password is always hashed even when it looks like a hash
+func (d *Db) CreateUser(u *UserProfile) error {
+	if u.Password != "" {
+		if err := d.checkPasswordPolicy(nil, u.Password); err != nil {
 			return err
 		}
-		err = txn.Set([]byte(key), val)
-		if err != nil {
-			panic(err)
+		if err := d.setPassword(u, u.Password); err != nil {
+			return err
 		}
-		return nil
-	})
-}
-
-func (d *Db) CreateUser(u *UserProfile) error {
+		u.PasswordHistory = nil
+	}
 	return d.dbInstance.Update(func(txn *badger.Txn) error {
 		user, err := txn.Get([]byte("user:" + u.UserName))
 		if user != nil {
@@ -586,11 +635,58 @@ func (d *Db) FlushDNSSessions(clientIP string) error {
 	return err
 }
 
+// ExpireDNSSessions expires the cached answers of the sessions of the hostname, of all sessions when the
+// hostname is empty, so that the next queries are resolved again
+func (d *Db) ExpireDNSSessions(hostname string) (int, error) {
+	prefix := []byte("dns:")
+	count := 0
+	// a write batch commits in as many transactions as needed, flushing every session would not fit in one
+	wb := d.dbInstance.NewWriteBatch()
+	defer wb.Cancel()
+	err := d.dbInstance.View(func(txn *badger.Txn) error {
+		opts := badger.DefaultIteratorOptions
+		opts.Prefix = prefix
+		it := txn.NewIterator(opts)
+		defer it.Close()
+
+		for it.Seek(prefix); it.ValidForPrefix(prefix); it.Next() {
+			var s constants.DNSSession
+			err := it.Item().Value(func(val []byte) error {
+				return json.Unmarshal(val, &s)
+			})
+			if err != nil {
+				return err
+			}
+			if hostname != "" && !strings.EqualFold(s.Hostname, hostname) || s.DNSExpiry.IsZero() {
+				continue
+			}
+			// a zero expiry is not served stale either
+			s.DNSExpiry = time.Time{}
+			val, err := json.Marshal(s)
+			if err != nil {
+				return err
+			}
+			if err := wb.Set(it.Item().KeyCopy(nil), val); err != nil {
+				return err
+			}
+			count++
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	if err := wb.Flush(); err != nil {
+		return 0, err
+	}
+	return count, nil
+}
+
 func (d *Db) CreateReverseDNS(clientIP string, qtype uint16, rdns *constants.ReverseDNS) error {
 	return create(d, fmt.Sprintf("rev:%s:%d:%d", clientIP, qtype, rdns.DestIPOffset), rdns, 0)
 }
 
-func (d *Db) DeleteReverseDNS(clientIP string, qtype uint16, DestIPOffset uint16) error {
+func (d *Db) DeleteReverseDNS(clientIP string, qtype uint16, DestIPOffset uint32) error {
 	return delete(d, fmt.Sprintf("rev:%s:%d:%d", clientIP, qtype, DestIPOffset))
 }
 
@@ -598,7 +694,7 @@ func (d *Db) DeleteReverseDNS(clientIP string, qtype uint16, DestIPOffset uint16
 	return getAll[constants.ReverseDNS](d, fmt.Sprintf("rev:"))
 }*/
 
-func (d *Db) GetReverseDNS(clientIP string, qtype uint16, DestIPOffset uint16) *constants.ReverseDNS {
+func (d *Db) GetReverseDNS(clientIP string, qtype uint16, DestIPOffset uint32) *constants.ReverseDNS {
 	return get[constants.ReverseDNS](d, fmt.Sprintf("rev:%s:%d:%d", clientIP, qtype, DestIPOffset))
 }
 
@@ -606,6 +702,39 @@ func (d *Db) GetReverseDNSByClientType(clientIP string, qtype uint16) []constant
 	return getAll[constants.ReverseDNS](d, fmt.Sprintf("rev:%s:%d", clientIP, qtype))
 }
 
+// DeleteAllReverseDNS deletes the allocated forwarding addresses of every client
+func (d *Db) DeleteAllReverseDNS() error {
+	return d.dbInstance.DropPrefix([]byte("rev:"))
+}
+
+// CountReverseDNS returns the number of allocated forwarding addresses of every client
+func (d *Db) CountReverseDNS() map[string]int {
+	prefix := []byte("rev:")
+	counts := make(map[string]int)
+	err := d.dbInstance.View(func(txn *badger.Txn) error {
+		opts := badger.DefaultIteratorOptions
+		opts.Prefix = prefix
+		opts.PrefetchValues = false
+		it := txn.NewIterator(opts)
+		defer it.Close()
+
+		for it.Seek(prefix); it.ValidForPrefix(prefix); it.Next() {
+			// rev:<client>:<qtype>:<offset>
+			key := strings.TrimPrefix(string(it.Item().Key()), "rev:")
+			if i := strings.LastIndex(key, ":"); i > 0 {
+				if i = strings.LastIndex(key[:i], ":"); i > 0 {
+					counts[key[:i]]++
+				}
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		panic(err)
+	}
+	return counts
+}
+
 /*             Session                            */
 
 func (d *Db) GetSessions() []Session {
@@ -773,7 +902,16 @@ func (d *Db) CreateDNSCategory(c *DNSCategory) error {
 		}
 		c.CategoryId = id
 	}
-	return create(d, fmt.Sprintf("dnscategory:%s", c.CategoryId), c, 0)
+	err := create(d, fmt.Sprintf("dnscategory:%s", c.CategoryId), c, 0)
+	if err == nil {
+		d.categories.Add(1)
+	}
+	return err
+}
+
+// DNSCategoriesVersion changes whenever a DNS category is created, updated or deleted
+func (d *Db) DNSCategoriesVersion() uint64 {
+	return d.categories.Load()
 }
 
 func (d *Db) EnsureDNSCategory(c *DNSCategory) error {
@@ -788,7 +926,11 @@ func (d *Db) EnsureDNSCategory(c *DNSCategory) error {
 }
 
 func (d *Db) UpdateDNSCategory(c *DNSCategory) error {
-	return update(d, fmt.Sprintf("dnscategory:%s", c.CategoryId), c)
+	err := update(d, fmt.Sprintf("dnscategory:%s", c.CategoryId), c)
+	if err == nil {
+		d.categories.Add(1)
+	}
+	return err
 }
 
 func (d *Db) DeleteDNSCategory(categoryid string) error {
@@ -798,7 +940,11 @@ func (d *Db) DeleteDNSCategory(categoryid string) error {
 			return fmt.Errorf("Category in use by %s rule set", rule.RuleSetName)
 		}
 	}
-	return delete(d, fmt.Sprintf("dnscategory:%s", categoryid))
+	err := delete(d, fmt.Sprintf("dnscategory:%s", categoryid))
+	if err == nil {
+		d.categories.Add(1)
+	}
+	return err
 }
 
 /***************** DNS Config - RuleSet **************************/
@@ -858,6 +1004,10 @@ func (d *Db) SetDnsHostRule(hr *DNSHostRule) error {
 	return set(d, fmt.Sprintf("dnsrule:%s", hr.Name), hr)
 }
 
+func (d *Db) DeleteDnsHostRule(hostname string) error {
+	return delete(d, fmt.Sprintf("dnsrule:%s", hostname))
+}
+
 func (d *Db) ClearDnsHostRules() error {
 	prefix := []byte("dnsrule:")
 
@@ -974,6 +1124,122 @@ func (d *Db) DeleteDNSConfiguration(profileid string) error {
 	return delete(d, fmt.Sprintf("DNSConfiguration:%s", profileid))
 }
 
+/***************** DNS Forwarders **************************/
+
+func (d *Db) GetDNSForwarder(forwarderid string) *DNSForwarder {
+	return get[DNSForwarder](d, fmt.Sprintf("DNSForwarder:%s", forwarderid))
+}
+
+func (d *Db) GetDNSForwarders() []DNSForwarder {
+	return getAll[DNSForwarder](d, "DNSForwarder:")
+}
+
+func (d *Db) CreateDNSForwarder(f *DNSForwarder) error {
+	if f.ForwarderId == "" {
+		id, err := generateUID()
+		if err != nil {
+			return err
+		}
+		f.ForwarderId = id[:6]
+	}
+	return create(d, fmt.Sprintf("DNSForwarder:%s", f.ForwarderId), f, 0)
+}
+
+func (d *Db) UpdateDNSForwarder(f *DNSForwarder) error {
+	return update(d, fmt.Sprintf("DNSForwarder:%s", f.ForwarderId), f)
+}
+
+func (d *Db) DeleteDNSForwarder(forwarderid string) error {
+	return delete(d, fmt.Sprintf("DNSForwarder:%s", forwarderid))
+}
+
+/***************** DNS Records **************************/
+
+func (d *Db) GetDNSRecord(recordid string) *DNSRecord {
+	return get[DNSRecord](d, fmt.Sprintf("DNSRecord:%s", recordid))
+}
+
+func (d *Db) GetDNSRecords() []DNSRecord {
+	return getAll[DNSRecord](d, "DNSRecord:")
+}
+
+func (d *Db) CreateDNSRecord(r *DNSRecord) error {
+	if r.RecordId == "" {
+		id, err := generateUID()
+		if err != nil {
+			return err
+		}
+		r.RecordId = id[:6]
+	}
+	return create(d, fmt.Sprintf("DNSRecord:%s", r.RecordId), r, 0)
+}
+
+func (d *Db) UpdateDNSRecord(r *DNSRecord) error {
+	return update(d, fmt.Sprintf("DNSRecord:%s", r.RecordId), r)
+}
+
+func (d *Db) DeleteDNSRecord(recordid string) error {
+	return delete(d, fmt.Sprintf("DNSRecord:%s", recordid))
+}
+
+/***************** Safe Search Mappings **************************/
+
+func (d *Db) GetSafeSearchMapping(mappingid string) *SafeSearchMapping {
+	return get[SafeSearchMapping](d, fmt.Sprintf("SafeSearchMapping:%s", mappingid))
+}
+
+func (d *Db) GetSafeSearchMappings() []SafeSearchMapping {
+	return getAll[SafeSearchMapping](d, "SafeSearchMapping:")
+}
+
+func (d *Db) CreateSafeSearchMapping(m *SafeSearchMapping) error {
+	if m.MappingId == "" {
+		id, err := generateUID()
+		if err != nil {
+			return err
+		}
+		m.MappingId = id[:6]
+	}
+	return create(d, fmt.Sprintf("SafeSearchMapping:%s", m.MappingId), m, 0)
+}
+
+func (d *Db) UpdateSafeSearchMapping(m *SafeSearchMapping) error {
+	return update(d, fmt.Sprintf("SafeSearchMapping:%s", m.MappingId), m)
+}
+
+func (d *Db) DeleteSafeSearchMapping(mappingid string) error {
+	return delete(d, fmt.Sprintf("SafeSearchMapping:%s", mappingid))
+}
+
+/***************** Bypass Endpoints **************************/
+
+func (d *Db) GetBypassEndpoint(endpointid string) *BypassEndpoint {
+	return get[BypassEndpoint](d, fmt.Sprintf("BypassEndpoint:%s", endpointid))
+}
+
+func (d *Db) GetBypassEndpoints() []BypassEndpoint {
+	return getAll[BypassEndpoint](d, "BypassEndpoint:")
+}
+
+func (d *Db) CreateBypassEndpoint(e *BypassEndpoint) error {
+	if e.EndpointId == "" {
+		id, err := generateUID()
+		if err != nil {
+			return err
+		}
+		e.EndpointId = id[:6]
+	}
+	return create(d, fmt.Sprintf("BypassEndpoint:%s", e.EndpointId), e, 0)
+}
+
+func (d *Db) UpdateBypassEndpoint(e *BypassEndpoint) error {
+	return update(d, fmt.Sprintf("BypassEndpoint:%s", e.EndpointId), e)
+}
+
+func (d *Db) DeleteBypassEndpoint(endpointid string) error {
+	return delete(d, fmt.Sprintf("BypassEndpoint:%s", endpointid))
+}
+
 /***************** HTTP Proxy **************************/
 
 func (d *Db) GetHTTPProxyConfiguration(domain string) *HttpProxy {
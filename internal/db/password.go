@@ -0,0 +1,163 @@
+package db
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"fmt"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// argon2id parameters of new password hashes
+const (
+	argonTime    uint32 = 1
+	argonMemory  uint32 = 64 * 1024
+	argonThreads uint8  = 4
+	argonKeyLen  uint32 = 32
+	argonSaltLen        = 16
+)
+
+const argonPrefix = "$argon2id$"
+
+// dummyHash is verified for unknown users so that the response time does not reveal whether a user exists
+var dummyHash, _ = HashPassword("sleuth")
+
+// HashPassword returns the argon2id hash of the password in the PHC string format
+func HashPassword(password string) (string, error) {
+	salt := make([]byte, argonSaltLen)
+	if _, err := rand.Read(salt); err != nil {
+		return "", err
+	}
+	key := argon2.IDKey([]byte(password), salt, argonTime, argonMemory, argonThreads, argonKeyLen)
+	return fmt.Sprintf("%sv=%d$m=%d,t=%d,p=%d$%s$%s", argonPrefix, argon2.Version, argonMemory, argonTime, argonThreads,
+		base64.RawStdEncoding.EncodeToString(salt), base64.RawStdEncoding.EncodeToString(key)), nil
+}
+
+// IsPasswordHash reports whether the stored password is an argon2id or bcrypt hash
+func IsPasswordHash(stored string) bool {
+	return strings.HasPrefix(stored, argonPrefix) || strings.HasPrefix(stored, "$2a$") ||
+		strings.HasPrefix(stored, "$2b$") || strings.HasPrefix(stored, "$2y$")
+}
+
+// comparePassword compares the password with a stored argon2id hash, bcrypt hash or legacy plaintext
+// password in constant time
+func comparePassword(stored string, password string) bool {
+	switch {
+	case stored == "":
+		return false
+	case strings.HasPrefix(stored, argonPrefix):
+		var version int
+		var memory, iterations uint32
+		var threads uint8
+		parts := strings.Split(stored, "$")
+		if len(parts) != 6 {
+			return false
+		}
+		if _, err := fmt.Sscanf(parts[2], "v=%d", &version); err != nil || version != argon2.Version {
+			return false
+		}
+		if _, err := fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &memory, &iterations, &threads); err != nil {
+			return false
+		}
+		salt, err := base64.RawStdEncoding.DecodeString(parts[4])
+		if err != nil {
+			return false
+		}
+		key, err := base64.RawStdEncoding.DecodeString(parts[5])
+		if err != nil {
+			return false
+		}
+		other := argon2.IDKey([]byte(password), salt, iterations, memory, threads, uint32(len(key)))
+		return subtle.ConstantTimeCompare(key, other) == 1
+	case IsPasswordHash(stored):
+		return bcrypt.CompareHashAndPassword([]byte(stored), []byte(password)) == nil
+	}
+	return subtle.ConstantTimeCompare([]byte(stored), []byte(password)) == 1
+}
+
+// VerifyPassword checks the password of the user, legacy plaintext passwords are replaced
+// by their hash on the first successful login
+func (d *Db) VerifyPassword(u *UserProfile, password string) bool {
+	if u == nil {
+		comparePassword(dummyHash, password)
+		return false
+	}
+	if !comparePassword(u.Password, password) {
+		return false
+	}
+	if !IsPasswordHash(u.Password) {
+		if hash, err := HashPassword(password); err == nil {
+			u.Password = hash
+			if u.PasswordChanged.IsZero() {
+				u.PasswordChanged = time.Now()
+			}
+			d.saveUser(u)
+		}
+	}
+	return true
+}
+
+// IsPasswordExpired reports whether the password of the user is older than the policy allows
+func (d *Db) IsPasswordExpired(u *UserProfile) bool {
+	policy := d.passwordPolicy()
+	if policy.ExpiryDays <= 0 || u.PasswordChanged.IsZero() {
+		return false
+	}
+	return time.Now().After(u.PasswordChanged.AddDate(0, 0, policy.ExpiryDays))
+}
+
+func (d *Db) passwordPolicy() PasswordPolicy {
+	if s := d.GetSettings(); s != nil {
+		return s.PasswordPolicy
+	}
+	return PasswordPolicy{}
+}
+
+// checkPasswordPolicy validates a new password of the user against the password policy
+func (d *Db) checkPasswordPolicy(u *UserProfile, password string) error {
+	policy := d.passwordPolicy()
+	if password == "" {
+		return fmt.Errorf("password not specified")
+	}
+	if len([]rune(password)) < policy.MinLength {
+		return fmt.Errorf("password must be at least %d characters", policy.MinLength)
+	}
+	if policy.History > 0 && u != nil {
+		previous := append([]string{u.Password}, u.PasswordHistory...)
+		for i := 0; i < len(previous) && i < policy.History; i++ {
+			if comparePassword(previous[i], password) {
+				return fmt.Errorf("password may not be one of the last %d passwords", policy.History)
+			}
+		}
+	}
+	return nil
+}
+
+// setPassword hashes the new password and records the previous one in the password history
+func (d *Db) setPassword(u *UserProfile, password string) error {
+	hash, err := HashPassword(password)
+	if err != nil {
+		return err
+	}
+	if history := d.passwordPolicy().History; history > 0 && u.Password != "" {
+		previous := u.Password
+		if !IsPasswordHash(previous) {
+			if previous, err = HashPassword(previous); err != nil {
+				return err
+			}
+		}
+		u.PasswordHistory = append([]string{previous}, u.PasswordHistory...)
+		if len(u.PasswordHistory) > history {
+			u.PasswordHistory = u.PasswordHistory[:history]
+		}
+	} else {
+		u.PasswordHistory = nil
+	}
+	u.Password = hash
+	u.PasswordChanged = time.Now()
+	return nil
+}
@@ -0,0 +1,88 @@
+package db
+
+import (
+	"testing"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+func TestComparePassword(t *testing.T) {
+	hash, err := HashPassword("correct horse")
+	if err != nil {
+		t.Fatal(err)
+	}
+	legacy, _ := bcrypt.GenerateFromPassword([]byte("correct horse"), bcrypt.MinCost)
+
+	tests := []struct {
+		stored   string
+		password string
+		expected bool
+	}{
+		{hash, "correct horse", true},
+		{hash, "battery staple", false},
+		{string(legacy), "correct horse", true},
+		{string(legacy), "battery staple", false},
+		{"correct horse", "correct horse", true},
+		{"correct horse", "correct", false},
+		{"", "", false},
+	}
+	for _, test := range tests {
+		if comparePassword(test.stored, test.password) != test.expected {
+			t.Errorf("comparePassword(%q, %q) expected %v", test.stored, test.password, test.expected)
+		}
+	}
+	if !IsPasswordHash(hash) || !IsPasswordHash(string(legacy)) || IsPasswordHash("correct horse") {
+		t.Error("IsPasswordHash did not identify the stored passwords")
+	}
+}
+
+func TestUserPasswords(t *testing.T) {
+	d := InitDB(t.TempDir())
+	t.Cleanup(d.Close)
+
+	// passwords that look like a hash are hashed as well
+	legacy, _ := bcrypt.GenerateFromPassword([]byte("correct horse"), bcrypt.MinCost)
+	if err := d.CreateUser(&UserProfile{UserName: "alice", Password: string(legacy), Enabled: true}); err != nil {
+		t.Fatal(err)
+	}
+	u := d.GetUser("alice")
+	if u.Password == string(legacy) || !IsPasswordHash(u.Password) {
+		t.Errorf("CreateUser stored %q", u.Password)
+	}
+	if !d.VerifyPassword(u, string(legacy)) || d.VerifyPassword(u, "correct horse") {
+		t.Error("VerifyPassword did not verify the created password")
+	}
+
+	// updates keep the stored hash and hash a changed password
+	stored := u.Password
+	u.FullName = "Alice"
+	if err := d.UpdateUser(u); err != nil || d.GetUser("alice").Password != stored {
+		t.Errorf("UpdateUser replaced the unchanged password: %v", err)
+	}
+	u.Password = "battery staple"
+	if err := d.UpdateUser(u); err != nil {
+		t.Fatal(err)
+	}
+	u = d.GetUser("alice")
+	if !IsPasswordHash(u.Password) || !d.VerifyPassword(u, "battery staple") {
+		t.Errorf("UpdateUser stored %q", u.Password)
+	}
+
+	// legacy plaintext passwords are replaced by their hash on the first successful login
+	if err := d.CreateUser(&UserProfile{UserName: "bob", Enabled: true}); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.saveUser(&UserProfile{UserName: "bob", Password: "correct horse", Enabled: true}); err != nil {
+		t.Fatal(err)
+	}
+	if d.VerifyPassword(d.GetUser("bob"), "battery staple") || IsPasswordHash(d.GetUser("bob").Password) {
+		t.Error("VerifyPassword migrated a failed login")
+	}
+	if !d.VerifyPassword(d.GetUser("bob"), "correct horse") {
+		t.Error("VerifyPassword did not verify the legacy password")
+	}
+	u = d.GetUser("bob")
+	if !IsPasswordHash(u.Password) || !d.VerifyPassword(u, "correct horse") {
+		t.Errorf("VerifyPassword stored %q", u.Password)
+	}
+}
@@ -0,0 +1,218 @@
+package db
+
+import (
+	"encoding/json"
+	"fmt"
+	"slices"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/dgraph-io/badger/v4"
+)
+
+// query log keys, the entry is stored under qlog: and indexed by client and by reversed domain name:
+//
+//	qlog:<time>:<seq>                  -> QueryLogEntry
+//	qlogc:<client>:<time>:<seq>        -> qlog key
+//	qlogd:<reversed name>:<time>:<seq> -> qlog key
+const (
+	queryLogPrefix       = "qlog:"
+	queryLogClientPrefix = "qlogc:"
+	queryLogDomainPrefix = "qlogd:"
+)
+
+// query log result sources
+const (
+	QuerySourceCache     = "cache"
+	QuerySourceLocal     = "local"
+	QuerySourceUpstream  = "upstream"
+	QuerySourceForwarder = "forwarder"
+	QuerySourceStale     = "stale"
+	QuerySourceNone      = "none"
+)
+
+// DNSSEC validation results, answers of configurations without validation have none
+const (
+	DNSSECSecure   = "secure"
+	DNSSECInsecure = "insecure"
+	DNSSECBogus    = "bogus"
+)
+
+type QueryLogEntry struct {
+	Time       time.Time
+	ClientIP   string
+	MacAddress string
+	Username   string
+	Name       string
+	QType      uint16
+	Source     string
+	Rcode      int
+	ReasonCode uint16
+	Category   string
+	BlockedBy  string
+	BlockMode  string
+	DNSSEC     string
+	Latency    time.Duration
+}
+
+type QueryLogFilter struct {
+	ClientIP string
+	// Domain matches the name and its subdomains
+	Domain string
+	From   time.Time
+	To     time.Time
+	Offset int
+	Limit  int
+}
+
+var queryLogSeq atomic.Uint32
+
+// queryLogTime is the sortable time component of the query log keys
+func queryLogTime(t time.Time) string {
+	return fmt.Sprintf("%019d", t.UnixNano())
+}
+
+// reverseDomain returns the labels of the name in reverse order ("www.example.com." -> "com.example.www.")
+// so that a domain and its subdomains share a key prefix
+func reverseDomain(name string) string {
+	labels := strings.Split(strings.TrimSuffix(strings.ToLower(name), "."), ".")
+	slices.Reverse(labels)
+	return strings.Join(labels, ".") + "."
+}
+
+// AppendQueryLog writes the entries to the query log, entries expire after the retention period
+func (d *Db) AppendQueryLog(entries []QueryLogEntry, retention time.Duration) error {
+	wb := d.dbInstance.NewWriteBatch()
+	defer wb.Cancel()
+	for i := range entries {
+		e := &entries[i]
+		suffix := fmt.Sprintf("%s:%08x", queryLogTime(e.Time), queryLogSeq.Add(1))
+		key := queryLogPrefix + suffix
+		val, err := json.Marshal(e)
+		if err != nil {
+			return err
+		}
+		for k, v := range map[string][]byte{
+			key: val,
+			queryLogClientPrefix + e.ClientIP + ":" + suffix:      []byte(key),
+			queryLogDomainPrefix + reverseDomain(e.Name) + suffix: []byte(key),
+		} {
+			entry := badger.NewEntry([]byte(k), v)
+			if retention > 0 {
+				entry = entry.WithTTL(retention)
+			}
+			if err := wb.SetEntry(entry); err != nil {
+				return err
+			}
+		}
+	}
+	return wb.Flush()
+}
+
+// SearchQueryLog returns the entries matching the filter with the most recent first, more reports
+// whether entries beyond the requested page exist
+func (d *Db) SearchQueryLog(f QueryLogFilter) (entries []QueryLogEntry, more bool, err error) {
+	if f.Limit <= 0 {
+		f.Limit = 50
+	}
+	from := queryLogTime(f.From)
+	to := queryLogTime(time.Now().Add(time.Hour))
+	if !f.To.IsZero() {
+		to = queryLogTime(f.To)
+	}
+
+	// select the index, a domain search spans several names and is not ordered by time
+	prefix := queryLogPrefix
+	sorted := true
+	switch {
+	case f.ClientIP != "":
+		prefix = queryLogClientPrefix + f.ClientIP + ":"
+	case f.Domain != "":
+		prefix = queryLogDomainPrefix + reverseDomain(f.Domain)
+		sorted = false
+	}
+
+	type candidate struct {
+		time string
+		key  []byte
+	}
+	entries = make([]QueryLogEntry, 0, f.Limit)
+	err = d.dbInstance.View(func(txn *badger.Txn) error {
+		opts := badger.DefaultIteratorOptions
+		opts.Prefix = []byte(prefix)
+		opts.PrefetchValues = false
+		opts.Reverse = sorted
+		it := txn.NewIterator(opts)
+		defer it.Close()
+
+		start := []byte(prefix)
+		if sorted {
+			start = []byte(prefix + to + ":\xff")
+		}
+		candidates := make([]candidate, 0)
+		for it.Seek(start); it.ValidForPrefix([]byte(prefix)); it.Next() {
+			key := string(it.Item().Key())
+			// the time component precedes the sequence at the end of every key
+			rest := key[len(prefix):]
+			if len(rest) < 28 || (f.ClientIP != "" && len(rest) != 28) {
+				continue
+			}
+			t := rest[len(rest)-28 : len(rest)-9]
+			if t > to {
+				continue
+			}
+			if t < from {
+				if sorted {
+					break
+				}
+				continue
+			}
+			ref := []byte(key)
+			if prefix != queryLogPrefix {
+				if ref, err = it.Item().ValueCopy(nil); err != nil {
+					return err
+				}
+			}
+			candidates = append(candidates, candidate{time: t, key: ref})
+			if sorted && f.Domain == "" && len(candidates) > f.Offset+f.Limit {
+				break
+			}
+		}
+		if !sorted {
+			slices.SortStableFunc(candidates, func(a, b candidate) int {
+				return strings.Compare(b.time, a.time)
+			})
+		}
+
+		skipped := 0
+		for _, c := range candidates {
+			item, err := txn.Get(c.key)
+			if err == badger.ErrKeyNotFound {
+				continue
+			} else if err != nil {
+				return err
+			}
+			var e QueryLogEntry
+			if err := item.Value(func(val []byte) error {
+				return json.Unmarshal(val, &e)
+			}); err != nil {
+				return err
+			}
+			if f.Domain != "" && !strings.HasPrefix(reverseDomain(e.Name), reverseDomain(f.Domain)) {
+				continue
+			}
+			if skipped < f.Offset {
+				skipped++
+				continue
+			}
+			if len(entries) == f.Limit {
+				more = true
+				break
+			}
+			entries = append(entries, e)
+		}
+		return nil
+	})
+	return entries, more, err
+}
@@ -0,0 +1,62 @@
+package db
+
+import (
+	"testing"
+	"time"
+
+	"github.com/dgraph-io/badger/v4"
+)
+
+func TestSearchQueryLog(t *testing.T) {
+	instance, err := badger.Open(badger.DefaultOptions("").WithInMemory(true).WithLogger(nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	d := &Db{dbInstance: instance}
+	defer d.Close()
+
+	now := time.Now()
+	entries := []QueryLogEntry{
+		{Time: now.Add(-3 * time.Hour), ClientIP: "10.0.0.1", Name: "www.example.com."},
+		{Time: now.Add(-2 * time.Hour), ClientIP: "10.0.0.10", Name: "example.com."},
+		{Time: now.Add(-1 * time.Hour), ClientIP: "10.0.0.1", Name: "ads.example.net."},
+		{Time: now, ClientIP: "10.0.0.1", Name: "notexample.com."},
+	}
+	if err := d.AppendQueryLog(entries, 0); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		filter   QueryLogFilter
+		expected []string
+		more     bool
+	}{
+		{QueryLogFilter{}, []string{"notexample.com.", "ads.example.net.", "example.com.", "www.example.com."}, false},
+		{QueryLogFilter{Limit: 2}, []string{"notexample.com.", "ads.example.net."}, true},
+		{QueryLogFilter{Limit: 2, Offset: 2}, []string{"example.com.", "www.example.com."}, false},
+		{QueryLogFilter{ClientIP: "10.0.0.1"}, []string{"notexample.com.", "ads.example.net.", "www.example.com."}, false},
+		{QueryLogFilter{Domain: "example.com"}, []string{"example.com.", "www.example.com."}, false},
+		{QueryLogFilter{ClientIP: "10.0.0.1", Domain: "example.com."}, []string{"www.example.com."}, false},
+		{QueryLogFilter{From: now.Add(-150 * time.Minute), To: now.Add(-30 * time.Minute)}, []string{"ads.example.net.", "example.com."}, false},
+	}
+	for _, test := range tests {
+		result, more, err := d.SearchQueryLog(test.filter)
+		if err != nil {
+			t.Fatal(err)
+		}
+		names := make([]string, 0)
+		for _, e := range result {
+			names = append(names, e.Name)
+		}
+		if len(names) != len(test.expected) || more != test.more {
+			t.Errorf("%+v: %v more %t, expected %v more %t", test.filter, names, more, test.expected, test.more)
+			continue
+		}
+		for i := range names {
+			if names[i] != test.expected[i] {
+				t.Errorf("%+v: %v, expected %v", test.filter, names, test.expected)
+				break
+			}
+		}
+	}
+}
@@ -17,11 +17,32 @@ type DNSRuleSet struct {
 	CategoryName string
 	External     bool
 	Source       string
+	Format       string
 	Schedule     string
 	//	Rules       []string
 	Count       uint
 	Enabled     bool
 	LastUpdated time.Time
+	History     []DNSRuleSetUpdate
+	Report      DNSRuleSetReport
+}
+
+type DNSRuleSetReport struct {
+	Format     string
+	Accepted   uint
+	Rejected   uint
+	Duplicate  uint
+	Exceptions uint
+}
+
+type DNSRuleSetUpdate struct {
+	Time     time.Time
+	Success  bool
+	Count    uint
+	Added    uint
+	Removed  uint
+	Error    string
+	Schedule bool
 }
 
 type DNSHostRule struct {
@@ -29,4 +50,6 @@ type DNSHostRule struct {
 	DomScanCategories  []string
 	ExactCategories    []string
 	WildcardCategories []string
+	ExactExceptions    []string
+	WildcardExceptions []string
 }
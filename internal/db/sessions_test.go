@@ -0,0 +1,62 @@
+package db
+
+import (
+	"encoding/json"
+	"fmt"
+	"sleuth/internal/constants"
+	"testing"
+	"time"
+
+	"github.com/dgraph-io/badger/v4"
+)
+
+func TestExpireDNSSessions(t *testing.T) {
+	// a small memtable keeps the transaction limit low, flushing every session would not fit in one
+	instance, err := badger.Open(badger.DefaultOptions("").WithInMemory(true).WithLogger(nil).WithMemTableSize(1 << 20).WithValueThreshold(1 << 10))
+	if err != nil {
+		t.Fatal(err)
+	}
+	d := &Db{dbInstance: instance}
+	defer d.Close()
+
+	const sessions = 5000
+	expiry := time.Now().Add(time.Hour)
+	wb := d.dbInstance.NewWriteBatch()
+	for i := 0; i < sessions; i++ {
+		s := constants.DNSSession{
+			ClientIP:  "10.0.0.1",
+			Hostname:  fmt.Sprintf("host%d.example.com.", i),
+			QType:     1,
+			DNSExpiry: expiry,
+		}
+		val, err := json.Marshal(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := wb.Set([]byte(d.dnsFwdKey(s.ClientIP, s.Hostname, s.QType)), val); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := wb.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	count, err := d.ExpireDNSSessions("HOST1.example.com.")
+	if err != nil || count != 1 {
+		t.Fatalf("ExpireDNSSessions(host1) = %d, %v, want 1", count, err)
+	}
+	if s := d.GetDNSSession("10.0.0.1", "host1.example.com.", 1); s == nil || !s.DNSExpiry.IsZero() {
+		t.Errorf("session of host1 not expired: %+v", s)
+	}
+	if s := d.GetDNSSession("10.0.0.1", "host2.example.com.", 1); s == nil || s.DNSExpiry.IsZero() {
+		t.Errorf("session of host2 expired: %+v", s)
+	}
+
+	count, err = d.ExpireDNSSessions("")
+	if err != nil || count != sessions-1 {
+		t.Fatalf("ExpireDNSSessions() = %d, %v, want %d", count, err, sessions-1)
+	}
+	if s := d.GetDNSSession("10.0.0.1", fmt.Sprintf("host%d.example.com.", sessions-1), 1); s == nil || !s.DNSExpiry.IsZero() {
+		t.Errorf("last session not expired: %+v", s)
+	}
+}
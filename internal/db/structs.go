@@ -5,14 +5,16 @@ import (
 )
 
 type UserProfile struct {
-	UserName      string
-	FullName      string
-	EmailAddress  string
-	Password      string
-	PasswordReset time.Time
-	Enabled       bool
-	Role          string
-	AccessProfile string
+	UserName        string
+	FullName        string
+	EmailAddress    string
+	Password        string
+	PasswordReset   time.Time
+	PasswordChanged time.Time
+	PasswordHistory []string `json:",omitempty"`
+	Enabled         bool
+	Role            string
+	AccessProfile   string
 }
 
 type DeviceProfile struct {
@@ -25,9 +27,13 @@ type DeviceProfile struct {
 }
 
 type AccessProfile struct {
-	Name           string
-	AllowedDomains []string
-	BlockedDomains []string
+	Name              string
+	AllowedDomains    []string
+	BlockedDomains    []string
+	AllowedCategories []string
+	BlockedCategories []string
+	SafeSearch        bool
+	BlockResponse     BlockResponse
 }
 
 type RoleAccessTime struct {
@@ -44,6 +50,15 @@ type RoleAccessSchedule struct {
 type RoleAccess struct {
 	DefaultAccessProfile string
 	Schedule             []RoleAccessSchedule
+	BlockResponse        BlockResponse
+}
+
+// BlockResponse is the answer to blocked lookups, the access profile takes precedence over the role and
+// the default redirects to the portal
+type BlockResponse struct {
+	Mode enumBlockMode
+	// TTL of the blocked answer in seconds, 0 is the default
+	TTL uint32
 }
 
 type Role struct {
@@ -60,18 +75,79 @@ type Role struct {
 }
 
 type Settings struct {
-	Mode           enumPortalMode
-	DefaultRole    string
-	FallbackDNS    string
-	LocalDomain    string
-	SelfRegEnabled bool
-	Firewall       string
+	Mode               enumPortalMode
+	DefaultRole        string
+	FallbackDNS        string
+	LocalDomain        string
+	SelfRegEnabled     bool
+	Firewall           string
+	ForwardingPoolIPv4 string
+	ForwardingPoolIPv6 string
+	PasswordPolicy     PasswordPolicy
+	QueryLog           QueryLogSettings
+	Cache              CacheSettings
+	Rebinding          RebindingSettings
+	RateLimit          RateLimitSettings
+	Bypass             BypassSettings
 	//	SSL            []string
 	APIs struct {
 		DomScan API_DomScan
 	}
 }
 
+type PasswordPolicy struct {
+	MinLength  int
+	History    int
+	ExpiryDays int
+}
+
+type QueryLogSettings struct {
+	Enabled       bool
+	RetentionDays int
+}
+
+type CacheSettings struct {
+	// ServeStale answers from expired sessions for StaleHours when the upstreams fail (RFC 8767)
+	ServeStale bool
+	StaleHours int
+	// Prefetch refreshes frequently queried sessions before they expire
+	Prefetch bool
+	// SizeMB is the memory budget of the shared answer cache, MinTTL and MaxTTL clamp the TTL of the
+	// upstream answers, a MaxTTL of zero does not limit
+	SizeMB int
+	MinTTL int
+	MaxTTL int
+}
+
+type RebindingSettings struct {
+	// Mode strips or blocks upstream answers with private, loopback, link-local or own addresses
+	Mode enumRebindingMode
+	// AllowedDomains and their subdomains may resolve to internal addresses
+	AllowedDomains []string
+}
+
+type RateLimitSettings struct {
+	// Enabled limits the queries of every client to ClientQPS with bursts of ClientBurst and of every /24
+	// or /64 subnet to SubnetQPS, queries beyond the limits are dropped
+	Enabled     bool
+	ClientQPS   int
+	ClientBurst int
+	SubnetQPS   int
+	// ResponseQPS limits identical UDP responses to a subnet or a private client (RRL)
+	ResponseQPS int
+	// QuarantineDrops dropped queries within a minute quarantine the client for QuarantineMinutes
+	QuarantineDrops   int
+	QuarantineMinutes int
+}
+
+type BypassSettings struct {
+	// Enabled answers the domains of the bypass endpoints with NXDOMAIN and drops the forwarded traffic
+	// to their addresses
+	Enabled bool
+	// RedirectDNS redirects the DNS (53) and DNS over TLS (853) traffic of the clients to the portal
+	RedirectDNS bool
+}
+
 type API_DomScan struct {
 	Key      string
 	Enabled  bool
@@ -83,8 +159,79 @@ type API_DomScan struct {
 type DNSConfiguration struct {
 	ProfileId string
 	Name      string
+	// Type and Address hold the first upstream
 	Type      enumDNSMode
 	Address   string
+	Upstreams []DNSUpstream
+	Strategy  enumUpstreamStrategy
+	// DNSSEC validates the answers of the upstreams, bogus answers are refused with SERVFAIL
+	DNSSEC bool
+	// DeviceName is prepended to the upstream host name of the session, it is not stored
+	DeviceName string `json:"-"`
+}
+
+type DNSUpstream struct {
+	Type    enumDNSMode
+	Address string
+}
+
+// UpstreamScheme is the URL prefix of an upstream mode, as in tls://dns.example.com
+type UpstreamScheme struct {
+	Prefix string
+	Mode   enumDNSMode
+}
+
+// GetUpstreams returns the upstreams in their configured order, configurations without
+// upstreams resolve via their address
+func (c *DNSConfiguration) GetUpstreams() []DNSUpstream {
+	if c == nil {
+		return nil
+	}
+	if len(c.Upstreams) > 0 {
+		return c.Upstreams
+	}
+	if c.Address == "" {
+		return nil
+	}
+	return []DNSUpstream{{Type: c.Type, Address: c.Address}}
+}
+
+// DNSForwarder sends the queries for a domain and its subdomains to its upstreams instead of the DNS
+// configuration of the role, a forwarder without roles applies to all roles
+type DNSForwarder struct {
+	ForwarderId string
+	Domain      string
+	Upstreams   []DNSUpstream
+	Roles       []string
+	Enabled     bool
+}
+
+// DNSRecord is a static record of the local domain, the name is relative to the local domain with @
+// for the domain itself and the value is in zone file format
+type DNSRecord struct {
+	RecordId string
+	Name     string
+	Type     string
+	Value    string
+	TTL      uint32
+}
+
+// BypassEndpoint is a public DoH/DoT resolver or VPN service that clients use to resolve past the portal
+type BypassEndpoint struct {
+	EndpointId string
+	Name       string
+	Domains    []string
+	Addresses  []string
+	Enabled    bool
+}
+
+// SafeSearchMapping rewrites the lookups of the domain to the safe-search or restricted target of the
+// service for access profiles enforcing safe search, the domain may contain wildcards, e.g. www.google.*
+type SafeSearchMapping struct {
+	MappingId string
+	Domain    string
+	Target    string
+	Enabled   bool
 }
 
 type enumPortalMode int
@@ -98,9 +245,41 @@ const (
 type enumDNSMode uint
 
 const (
-	ModeUDP enumDNSMode = iota
-	ModeTCP             = 1
-	ModeTLS             = 2
+	ModeUDP   enumDNSMode = iota
+	ModeTCP               = 1
+	ModeTLS               = 2
+	ModeHTTPS             = 3
+	ModeQUIC              = 4
+)
+
+type enumUpstreamStrategy uint
+
+const (
+	StrategyFailover   enumUpstreamStrategy = iota
+	StrategyRoundRobin                      = 1
+	StrategyFastest                         = 2
+)
+
+type enumBlockMode uint
+
+const (
+	BlockModeDefault  enumBlockMode = iota
+	BlockModePortal                 = 1
+	BlockModeNXDomain               = 2
+	BlockModeNoData                 = 3
+	BlockModeNullIP                 = 4
+	BlockModeRefused                = 5
+)
+
+// BlockModes names the block modes in the query log
+var BlockModes = []string{"default", "portal", "nxdomain", "nodata", "null", "refused"}
+
+type enumRebindingMode uint
+
+const (
+	RebindingOff   enumRebindingMode = iota
+	RebindingStrip                   = 1
+	RebindingBlock                   = 2
 )
 
 type Session struct {
@@ -0,0 +1,255 @@
+package dns
+
+import (
+	"container/list"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+const (
+	// answerCacheSizeMB is the memory budget of the answer cache without a setting
+	answerCacheSizeMB = 16
+	// answerEntryOverhead approximates the memory of an entry besides its records
+	answerEntryOverhead = 128
+)
+
+// AnswerCacheEntry is an answer of the shared cache as shown by the admin UI
+type AnswerCacheEntry struct {
+	Key      string
+	Upstream string
+	Name     string
+	QType    uint16
+	Rcode    int
+	DNSSEC   string
+	Records  int
+	Size     int
+	Hits     uint64
+	Expires  time.Time
+}
+
+// AnswerCacheStats summarises the usage of the shared cache
+type AnswerCacheStats struct {
+	Entries  int
+	Bytes    int
+	MaxBytes int
+	Hits     uint64
+	Misses   uint64
+}
+
+// HitRatio is the share of lookups answered from the cache
+func (s AnswerCacheStats) HitRatio() float64 {
+	if s.Hits+s.Misses == 0 {
+		return 0
+	}
+	return float64(s.Hits) / float64(s.Hits+s.Misses)
+}
+
+type answerEntry struct {
+	AnswerCacheEntry
+	answer   []dns.RR
+	negative *negativeAnswer
+}
+
+// answerCache holds the upstream answers of all clients by upstream configuration, name and query type,
+// the least recently used answers are evicted when the answers exceed the memory budget
+type answerCache struct {
+	mu      sync.Mutex
+	entries map[string]*list.Element
+	lru     *list.List
+	bytes   int
+	hits    uint64
+	misses  uint64
+}
+
+func newAnswerCache() *answerCache {
+	return &answerCache{
+		entries: make(map[string]*list.Element),
+		lru:     list.New(),
+	}
+}
+
+// answerKey identifies an answer by the upstreams it was resolved by
+func answerKey(upstream string, name string, qtype uint16) string {
+	return upstream + "|" + name + "|" + strconv.Itoa(int(qtype))
+}
+
+// get returns a copy of the cached answer or the negative answer with the remaining TTL and the DNSSEC status
+func (c *answerCache) get(key string) ([]dns.RR, *negativeAnswer, string, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	el, ok := c.entries[key]
+	if !ok {
+		c.misses++
+		return nil, nil, "", false
+	}
+	e := el.Value.(*answerEntry)
+	remaining := time.Until(e.Expires)
+	if remaining < time.Second {
+		c.remove(el)
+		c.misses++
+		return nil, nil, "", false
+	}
+	c.hits++
+	e.Hits++
+	c.lru.MoveToFront(el)
+
+	ttl := uint32(remaining / time.Second)
+	if e.negative != nil {
+		return nil, &negativeAnswer{Rcode: e.negative.Rcode, TTL: ttl, DNSSEC: e.DNSSEC}, e.DNSSEC, true
+	}
+	answer := make([]dns.RR, len(e.answer))
+	for i, rr := range e.answer {
+		answer[i] = dns.Copy(rr)
+		answer[i].Header().Ttl = min(rr.Header().Ttl, ttl)
+	}
+	return answer, nil, e.DNSSEC, true
+}
+
+// put stores an answer or a negative answer for its TTL and evicts answers beyond the budget
+func (c *answerCache) put(key string, upstream string, name string, qtype uint16, answer []dns.RR, negative *negativeAnswer, dnssec string, ttl uint32, maxBytes int) {
+	if ttl == 0 {
+		return
+	}
+	e := &answerEntry{
+		AnswerCacheEntry: AnswerCacheEntry{
+			Key:      key,
+			Upstream: upstream,
+			Name:     name,
+			QType:    qtype,
+			DNSSEC:   dnssec,
+			Records:  len(answer),
+			Size:     answerEntryOverhead + len(key),
+			Expires:  time.Now().Add(time.Duration(ttl) * time.Second),
+		},
+		answer:   make([]dns.RR, len(answer)),
+		negative: negative,
+	}
+	if negative != nil {
+		e.Rcode = negative.Rcode
+	}
+	for i, rr := range answer {
+		e.answer[i] = dns.Copy(rr)
+		e.Size += dns.Len(rr)
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if el, ok := c.entries[key]; ok {
+		c.remove(el)
+	}
+	c.entries[key] = c.lru.PushFront(e)
+	c.bytes += e.Size
+	for c.bytes > maxBytes && c.lru.Len() > 1 {
+		c.remove(c.lru.Back())
+	}
+}
+
+func (c *answerCache) remove(el *list.Element) {
+	e := c.lru.Remove(el).(*answerEntry)
+	delete(c.entries, e.Key)
+	c.bytes -= e.Size
+}
+
+// flush removes the answers of the name, all answers when the name is empty
+func (c *answerCache) flush(name string) int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	count := 0
+	for _, el := range c.entries {
+		if name == "" || el.Value.(*answerEntry).Name == name {
+			c.remove(el)
+			count++
+		}
+	}
+	return count
+}
+
+func (c *answerCache) stats(maxBytes int) AnswerCacheStats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return AnswerCacheStats{
+		Entries:  len(c.entries),
+		Bytes:    c.bytes,
+		MaxBytes: maxBytes,
+		Hits:     c.hits,
+		Misses:   c.misses,
+	}
+}
+
+// list returns the unexpired answers whose name contains the filter, the most used first
+func (c *answerCache) list(filter string, limit int) []AnswerCacheEntry {
+	c.mu.Lock()
+	entries := make([]AnswerCacheEntry, 0)
+	for _, el := range c.entries {
+		e := el.Value.(*answerEntry)
+		if time.Until(e.Expires) > 0 && strings.Contains(e.Name, filter) {
+			entries = append(entries, e.AnswerCacheEntry)
+		}
+	}
+	c.mu.Unlock()
+
+	sort.Slice(entries, func(i, j int) bool {
+		if entries[i].Hits == entries[j].Hits {
+			return entries[i].Name < entries[j].Name
+		}
+		return entries[i].Hits > entries[j].Hits
+	})
+	if limit > 0 && len(entries) > limit {
+		entries = entries[:limit]
+	}
+	return entries
+}
+
+// clampTTL limits the TTL to the minimum and maximum of the cache settings, a maximum of zero does not limit
+func (s *DnsServer) clampTTL(ttl uint32) uint32 {
+	if s.settings == nil {
+		return ttl
+	}
+	settings := s.settings.Snapshot().Cache
+	ttl = max(ttl, uint32(max(settings.MinTTL, 0)))
+	if settings.MaxTTL > 0 {
+		ttl = min(ttl, uint32(settings.MaxTTL))
+	}
+	return ttl
+}
+
+func (s *DnsServer) answerCacheBytes() int {
+	if s.settings == nil {
+		return answerCacheSizeMB << 20
+	}
+	if size := s.settings.Snapshot().Cache.SizeMB; size > 0 {
+		return size << 20
+	}
+	return answerCacheSizeMB << 20
+}
+
+// AnswerCacheStats returns the usage of the shared answer cache
+func (s *DnsServer) AnswerCacheStats() AnswerCacheStats {
+	return s.answers.stats(s.answerCacheBytes())
+}
+
+// AnswerCacheEntries returns up to limit cached answers whose name contains the filter
+func (s *DnsServer) AnswerCacheEntries(filter string, limit int) []AnswerCacheEntry {
+	return s.answers.list(strings.ToLower(filter), limit)
+}
+
+// FlushAnswerCache removes the cached answers of the name, or all answers when the name is empty, and
+// expires the answers cached in the sessions of the clients
+func (s *DnsServer) FlushAnswerCache(name string) (int, int, error) {
+	if name != "" {
+		name = dns.Fqdn(strings.ToLower(name))
+	}
+	flushed := s.answers.flush(name)
+	if s.db == nil {
+		return flushed, 0, nil
+	}
+	expired, err := s.db.ExpireDNSSessions(name)
+	return flushed, expired, err
+}
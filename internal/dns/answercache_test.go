@@ -0,0 +1,66 @@
+package dns
+
+import (
+	"net"
+	"sleuth/internal/constants"
+	"sleuth/internal/db"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+func testAnswer(name string) []dns.RR {
+	return []dns.RR{&dns.A{Hdr: dns.RR_Header{Name: name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 300}, A: net.ParseIP("10.0.0.1")}}
+}
+
+func TestAnswerCacheEviction(t *testing.T) {
+	c := newAnswerCache()
+	c.put(answerKey("u", "a.example.", dns.TypeA), "u", "a.example.", dns.TypeA, testAnswer("a.example."), nil, "", 300, 0)
+	c.put(answerKey("u", "b.example.", dns.TypeA), "u", "b.example.", dns.TypeA, testAnswer("b.example."), nil, "", 300, 0)
+	// the most recent answer is kept even when it exceeds the budget
+	checkTestInt(t, 1, c.stats(0).Entries)
+	_, _, _, ok := c.get(answerKey("u", "a.example.", dns.TypeA))
+	checkTestBool(t, false, ok)
+	answer, _, _, ok := c.get(answerKey("u", "b.example.", dns.TypeA))
+	checkTestBool(t, true, ok)
+	checkTestInt(t, 1, len(answer))
+
+	// the cached answer is a copy of the records of the caller
+	records := testAnswer("c.example.")
+	key := answerKey("u", "c.example.", dns.TypeA)
+	c.put(key, "u", "c.example.", dns.TypeA, records, nil, "", 300, 1<<20)
+	records[0].(*dns.A).A = net.ParseIP("10.0.0.2")
+	answer, _, _, _ = c.get(key)
+	checkTestString(t, "10.0.0.1", answer[0].(*dns.A).A.String())
+}
+
+func TestAnswerCacheNegative(t *testing.T) {
+	c := newAnswerCache()
+	key := answerKey("u", "none.example.", dns.TypeA)
+	c.put(key, "u", "none.example.", dns.TypeA, nil, &negativeAnswer{Rcode: dns.RcodeNameError, TTL: 60, DNSSEC: db.DNSSECSecure}, db.DNSSECSecure, 60, 1<<20)
+	_, negative, dnssec, ok := c.get(key)
+	checkTestBool(t, true, ok)
+	checkTestString(t, db.DNSSECSecure, dnssec)
+	checkTestInt(t, dns.RcodeNameError, negative.Rcode)
+	checkTestBool(t, true, negative.TTL <= 60)
+
+	checkTestInt(t, 1, c.flush("none.example."))
+	checkTestInt(t, 0, c.stats(1<<20).Entries)
+	checkTestInt(t, 0, c.stats(1<<20).Bytes)
+}
+
+func TestFlushAnswerCacheSessions(t *testing.T) {
+	s := newTestServer(t)
+	for _, name := range []string{"a.example.", "b.example."} {
+		s.db.CreateDNSSession(&constants.DNSSession{ClientIP: "10.0.0.5", Hostname: name, QType: dns.TypeA, DNSExpiry: time.Now().Add(time.Hour)})
+	}
+	_, expired, err := s.FlushAnswerCache("A.example")
+	checkTestBool(t, true, err == nil)
+	checkTestInt(t, 1, expired)
+	checkTestBool(t, true, s.db.GetDNSSession("10.0.0.5", "a.example.", dns.TypeA).DNSExpiry.IsZero())
+	checkTestBool(t, false, s.db.GetDNSSession("10.0.0.5", "b.example.", dns.TypeA).DNSExpiry.IsZero())
+
+	_, expired, _ = s.FlushAnswerCache("")
+	checkTestInt(t, 1, expired)
+}
@@ -0,0 +1,72 @@
+package dns
+
+import (
+	"net"
+	"sleuth/internal/constants"
+	"sleuth/internal/db"
+	"sleuth/internal/security"
+
+	"github.com/miekg/dns"
+)
+
+// blockTTL is the TTL of blocked answers when the block response has none
+const blockTTL = 10
+
+// blockResponse returns the block mode and TTL of the access profile of the session or else of its role,
+// clients that are not authenticated or authorised are always redirected to the portal to sign in
+func (s *DnsServer) blockResponse(ses security.SessionInfo, reason uint16) (uint, uint32) {
+	response := db.BlockResponse{}
+	if reason != constants.AccessBlockedNotAuthenticated && reason != constants.AccessBlockedUnauthorised {
+		if ses.AccessProfile != nil && ses.AccessProfile.BlockResponse.Mode != db.BlockModeDefault {
+			response = ses.AccessProfile.BlockResponse
+		} else if s.db != nil && ses.Role != "" {
+			if role := s.db.GetRole(ses.Role); role != nil {
+				response = role.Access.BlockResponse
+			}
+		}
+	}
+	mode := uint(response.Mode)
+	if response.Mode == db.BlockModeDefault || mode >= uint(len(db.BlockModes)) {
+		mode = db.BlockModePortal
+	}
+	ttl := response.TTL
+	if ttl == 0 {
+		ttl = blockTTL
+	}
+	return mode, ttl
+}
+
+// blockedAnswer returns the answer and rcode of a blocked lookup in the block mode, redirects to the portal
+// keep the answer of processResponse with the TTL. Negative answers carry an SOA with the TTL (RFC 2308) that
+// parseQuery moves to the authority section.
+func blockedAnswer(name string, qtype uint16, resp []dns.RR, mode uint, ttl uint32) ([]dns.RR, int) {
+	switch mode {
+	case db.BlockModeNXDomain:
+		return []dns.RR{blockedSOA(name, ttl)}, dns.RcodeNameError
+	case db.BlockModeNoData:
+		return []dns.RR{blockedSOA(name, ttl)}, dns.RcodeSuccess
+	case db.BlockModeRefused:
+		return []dns.RR{}, dns.RcodeRefused
+	case db.BlockModeNullIP:
+		hdr := dns.RR_Header{Name: dns.Fqdn(name), Rrtype: qtype, Class: dns.ClassINET, Ttl: ttl}
+		switch qtype {
+		case dns.TypeA:
+			return []dns.RR{&dns.A{Hdr: hdr, A: net.IPv4zero.To4()}}, dns.RcodeSuccess
+		case dns.TypeAAAA:
+			return []dns.RR{&dns.AAAA{Hdr: hdr, AAAA: net.IPv6zero}}, dns.RcodeSuccess
+		}
+		return []dns.RR{blockedSOA(name, ttl)}, dns.RcodeSuccess
+	}
+	for _, rr := range resp {
+		rr.Header().Ttl = ttl
+	}
+	return resp, dns.RcodeSuccess
+}
+
+// blockedSOA returns the SOA of a negative blocked answer, its minimum TTL limits the negative caching
+func blockedSOA(name string, ttl uint32) *dns.SOA {
+	soa := localSOA(dns.Fqdn(name))
+	soa.Hdr.Ttl = ttl
+	soa.Minttl = ttl
+	return soa
+}
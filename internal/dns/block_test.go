@@ -0,0 +1,31 @@
+package dns
+
+import (
+	"sleuth/internal/db"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func TestBlockedAnswer(t *testing.T) {
+	portal := []dns.RR{testRR(t, "ads.example.com. 60 IN A 10.1.1.1")}
+
+	resp, rcode := blockedAnswer("ads.example.com", dns.TypeA, portal, db.BlockModePortal, 10)
+	checkTestInt(t, dns.RcodeSuccess, rcode)
+	checkTestString(t, "ads.example.com.\t10\tIN\tA\t10.1.1.1", resp[0].String())
+
+	resp, rcode = blockedAnswer("ads.example.com", dns.TypeA, portal, db.BlockModeNXDomain, 10)
+	checkTestInt(t, dns.RcodeNameError, rcode)
+	checkTestInt(t, 10, int(resp[0].(*dns.SOA).Minttl))
+
+	resp, rcode = blockedAnswer("ads.example.com", dns.TypeA, portal, db.BlockModeNullIP, 30)
+	checkTestInt(t, dns.RcodeSuccess, rcode)
+	checkTestString(t, "ads.example.com.\t30\tIN\tA\t0.0.0.0", resp[0].String())
+
+	resp, _ = blockedAnswer("ads.example.com", dns.TypeAAAA, portal, db.BlockModeNullIP, 30)
+	checkTestString(t, "ads.example.com.\t30\tIN\tAAAA\t::", resp[0].String())
+
+	resp, rcode = blockedAnswer("ads.example.com", dns.TypeA, portal, db.BlockModeRefused, 10)
+	checkTestInt(t, dns.RcodeRefused, rcode)
+	checkTestInt(t, 0, len(resp))
+}
@@ -0,0 +1,41 @@
+package dns
+
+import (
+	"sleuth/internal/db"
+	"strings"
+)
+
+// bypassDomain reports whether the name belongs to an enabled bypass endpoint, e.g. a public DoH resolver
+// or the use-application-dns.net canary that disables DoH in Firefox
+func (s *DnsServer) bypassDomain(name string) bool {
+	if s.db == nil || s.settings == nil || !s.settings.Snapshot().Bypass.Enabled {
+		return false
+	}
+	return matchBypass(name, s.bypassEndpoints.get(s.db.GetBypassEndpoints))
+}
+
+func newBypassCache() *reloadCache[db.BypassEndpoint] {
+	return &reloadCache[db.BypassEndpoint]{}
+}
+
+// ReloadBypassEndpoints drops the bypass endpoints in memory after they were edited
+func (s *DnsServer) ReloadBypassEndpoints() {
+	s.bypassEndpoints.reload()
+}
+
+// matchBypass reports whether the name is a domain of an enabled endpoint or one of its subdomains
+func matchBypass(name string, endpoints []db.BypassEndpoint) bool {
+	name = strings.TrimSuffix(strings.ToLower(name), ".")
+	for _, e := range endpoints {
+		if !e.Enabled {
+			continue
+		}
+		for _, domain := range e.Domains {
+			domain = strings.Trim(strings.ToLower(domain), ".")
+			if domain != "" && (name == domain || strings.HasSuffix(name, "."+domain)) {
+				return true
+			}
+		}
+	}
+	return false
+}
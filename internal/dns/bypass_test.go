@@ -0,0 +1,31 @@
+package dns
+
+import (
+	"sleuth/internal/db"
+	"testing"
+)
+
+func TestMatchBypass(t *testing.T) {
+	endpoints := []db.BypassEndpoint{
+		{Name: "Firefox DoH canary", Domains: []string{"use-application-dns.net"}, Enabled: true},
+		{Name: "Google Public DNS", Domains: []string{"dns.google"}, Enabled: true},
+		{Name: "VPN services", Domains: []string{"nordvpn.com"}, Enabled: false},
+	}
+	checkTestBool(t, true, matchBypass("use-application-dns.net.", endpoints))
+	checkTestBool(t, true, matchBypass("8888.DNS.google.", endpoints))
+	checkTestBool(t, false, matchBypass("notdns.google.", endpoints))
+	checkTestBool(t, false, matchBypass("nordvpn.com.", endpoints))
+}
+
+func TestBypassDomain(t *testing.T) {
+	s := newTestServer(t)
+	s.settings.Bypass.Enabled = true
+	s.db.CreateBypassEndpoint(&db.BypassEndpoint{Name: "Google Public DNS", Domains: []string{"dns.google"}, Enabled: true})
+	checkTestBool(t, true, s.bypassDomain("dns.google."))
+
+	// the endpoints in memory are replaced after an edit
+	s.db.CreateBypassEndpoint(&db.BypassEndpoint{Name: "Cloudflare", Domains: []string{"cloudflare-dns.com"}, Enabled: true})
+	checkTestBool(t, false, s.bypassDomain("cloudflare-dns.com."))
+	s.ReloadBypassEndpoints()
+	checkTestBool(t, true, s.bypassDomain("cloudflare-dns.com."))
+}
@@ -0,0 +1,59 @@
+package dns
+
+import (
+	"sleuth/internal/constants"
+	"sleuth/internal/security"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// cnameChain returns the targets of the CNAME chain of the name in the raw records in order, loops end the chain
+func cnameChain(name string, raw []string) []string {
+	targets := make(map[string]string)
+	for _, str := range raw {
+		rr, err := dns.NewRR(str)
+		if err != nil {
+			continue
+		}
+		if cname, ok := rr.(*dns.CNAME); ok {
+			targets[strings.ToLower(cname.Hdr.Name)] = strings.ToLower(dns.Fqdn(cname.Target))
+		}
+	}
+	chain := make([]string, 0)
+	seen := make(map[string]bool)
+	current := strings.ToLower(dns.Fqdn(name))
+	seen[current] = true
+	for {
+		next, ok := targets[current]
+		if !ok || seen[next] {
+			return chain
+		}
+		seen[next] = true
+		chain = append(chain, next)
+		current = next
+	}
+}
+
+// verifyChain verifies the access to the targets of the CNAME chain of the session so that first-party names
+// cannot cloak blocked trackers, the first blocked target is recorded in BlockedBy. The targets of allowed
+// names of allowlist profiles are only verified against the blocked domains and categories.
+func verifyChain(ses security.SessionInfo, cache *constants.DNSSession) uint16 {
+	if cache.IsLocal || ses.AccessProfile == nil {
+		return constants.AccessAllowed
+	}
+	if len(ses.AccessProfile.AllowedDomains) > 0 {
+		profile := *ses.AccessProfile
+		profile.AllowedDomains = nil
+		ses.AccessProfile = &profile
+	}
+	for _, target := range cnameChain(cache.Hostname, cache.DNSResponse.Raw) {
+		link := constants.DNSSession{Hostname: target}
+		if reason := security.VerifyDomainAccess(ses, &link); reason != constants.AccessAllowed {
+			cache.BlockedBy = strings.TrimSuffix(target, ".")
+			cache.Category = link.Category
+			return reason
+		}
+	}
+	return constants.AccessAllowed
+}
@@ -0,0 +1,39 @@
+package dns
+
+import (
+	"sleuth/internal/constants"
+	"sleuth/internal/db"
+	"sleuth/internal/security"
+	"strings"
+	"testing"
+)
+
+func TestCnameChain(t *testing.T) {
+	raw := []string{
+		"metrics.shop.example.\t300\tIN\tCNAME\tshop.tracker.example.",
+		"shop.tracker.example.\t300\tIN\tCNAME\tedge.cdn.example.",
+		"edge.cdn.example.\t300\tIN\tCNAME\tmetrics.shop.example.",
+	}
+	// the loop back to the queried name ends the chain
+	checkTestString(t, "shop.tracker.example.,edge.cdn.example.", strings.Join(cnameChain("Metrics.Shop.example.", raw), ","))
+	checkTestInt(t, 0, len(cnameChain("www.shop.example.", raw)))
+}
+
+func TestVerifyChain(t *testing.T) {
+	ses := security.SessionInfo{AccessProfile: &db.AccessProfile{BlockedDomains: []string{"tracker.example"}}}
+	cache := &constants.DNSSession{
+		Hostname: "metrics.shop.example.",
+		DNSResponse: constants.DNSResponse{Raw: []string{
+			"metrics.shop.example.\t300\tIN\tCNAME\tshop.tracker.example.",
+		}},
+	}
+	checkTestInt(t, int(constants.AccessBlockedRule), int(verifyChain(ses, cache)))
+	checkTestString(t, "shop.tracker.example", cache.BlockedBy)
+
+	// the targets of allowlisted names are verified against the blocked domains only
+	ses.AccessProfile.AllowedDomains = []string{"shop.example"}
+	checkTestInt(t, int(constants.AccessBlockedRule), int(verifyChain(ses, cache)))
+	ses.AccessProfile.BlockedDomains = nil
+	checkTestInt(t, int(constants.AccessAllowed), int(verifyChain(ses, cache)))
+	checkTestInt(t, 1, len(ses.AccessProfile.AllowedDomains))
+}
@@ -5,6 +5,8 @@ import (
 	"runtime/debug"
 	"sleuth/internal/db"
 	"sleuth/internal/firewall"
+	"sleuth/internal/network"
+	"sleuth/internal/security"
 	"testing"
 )
 
@@ -41,6 +43,21 @@ func TestMain(m *testing.M) {
 	os.Exit(code)
 }
 
+// newTestServer returns a DNS server backed by a temporary database that allows every client, the fallback
+// resolver is unreachable so that only names of the local domain resolve
+func newTestServer(t *testing.T) *DnsServer {
+	database := db.InitDB(t.TempDir())
+	t.Cleanup(database.Close)
+	settings := &db.Settings{FallbackDNS: "127.0.0.1:1", LocalDomain: "local", Mode: db.ModeAllow, DefaultRole: "test"}
+	if err := database.CreateRole(&db.Role{RoleName: "test"}); err != nil {
+		t.Fatal(err)
+	}
+	fw := firewall.LoadFirewallManager()
+	fw.Init(database, settings)
+	lan := &network.Network{}
+	return InitDnsServer(fw, database, security.InitSession(database, lan, settings), lan, settings)
+}
+
 func checkTestBool(t *testing.T, expected, actual bool) {
 	if expected != actual {
 		t.Fatalf("Expected '%t', but got '%t' at:\n%s", expected, actual, debug.Stack())
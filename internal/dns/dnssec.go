@@ -0,0 +1,512 @@
+package dns
+
+import (
+	"errors"
+	"fmt"
+	"sleuth/internal/db"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/jellydator/ttlcache/v3"
+	"github.com/miekg/dns"
+)
+
+const (
+	// maxKeyTTL caps the caching of validated zone keys and of insecure names
+	maxKeyTTL = 3600
+	// maxValidatorEntries caps the cached zones and insecure names, the least recently used are evicted
+	maxValidatorEntries = 10000
+	// maxChainDepth limits the zones followed to validate an answer
+	maxChainDepth = 16
+	// dnssecUDPSize is the buffer advertised to the upstreams for signed answers
+	dnssecUDPSize = 4096
+)
+
+// rootAnchors are the DS records of the root key signing keys KSK-2017 and KSK-2024 published by IANA
+var rootAnchors = []string{
+	". 172800 IN DS 20326 8 2 E06D44B80B8F1D39A95C0B0D7C65D08458E880409BBC683457104237C7F8EC8D",
+	". 172800 IN DS 38696 8 2 683D2D0ACB8C9B712A1948B27F741219298D0A450D612C483AF444A4C0FB2B16",
+}
+
+var errBogus = errors.New("DNSSEC validation failed")
+
+// lookupFunc queries an upstream with the DO and CD bits set
+type lookupFunc func(name string, qtype uint16) (*dns.Msg, error)
+
+// validator verifies the chain of trust of upstream answers from the root trust anchors, the validated
+// keys are shared by all upstreams
+type validator struct {
+	anchors []*dns.DS
+
+	// zones holds the keys of the validated zones, nil for insecure zones
+	zones    *ttlcache.Cache[string, []*dns.DNSKEY]
+	insecure *ttlcache.Cache[string, struct{}]
+}
+
+func newValidator() *validator {
+	v := &validator{
+		zones: ttlcache.New(
+			ttlcache.WithCapacity[string, []*dns.DNSKEY](maxValidatorEntries),
+			ttlcache.WithDisableTouchOnHit[string, []*dns.DNSKEY](),
+		),
+		insecure: ttlcache.New(
+			ttlcache.WithCapacity[string, struct{}](maxValidatorEntries),
+			ttlcache.WithDisableTouchOnHit[string, struct{}](),
+		),
+	}
+	for _, anchor := range rootAnchors {
+		rr, err := dns.NewRR(anchor)
+		if err != nil {
+			panic(err)
+		}
+		v.anchors = append(v.anchors, rr.(*dns.DS))
+	}
+	return v
+}
+
+// lookupSigned returns a lookup through the upstream, truncated UDP answers are repeated over TCP
+func (s *DnsServer) lookupSigned(u db.DNSUpstream, deviceName string) lookupFunc {
+	return func(name string, qtype uint16) (*dns.Msg, error) {
+		m := new(dns.Msg)
+		m.SetQuestion(name, qtype)
+		m.SetEdns0(dnssecUDPSize, true)
+		m.CheckingDisabled = true
+		in, _, err := s.exchange(m, u, deviceName)
+		if err == nil && in.Truncated && u.Type == db.ModeUDP {
+			in, _, err = s.exchange(m, db.DNSUpstream{Type: db.ModeTCP, Address: u.Address}, deviceName)
+		}
+		if err == nil && in.Rcode != dns.RcodeSuccess && in.Rcode != dns.RcodeNameError {
+			err = fmt.Errorf("%s answered %s", u.Address, dns.RcodeToString[in.Rcode])
+		}
+		return in, err
+	}
+}
+
+// rrsets groups the records by name and type, the signatures by name and covered type
+func rrsets(rrs []dns.RR) (map[string][]dns.RR, map[string][]*dns.RRSIG) {
+	sets := make(map[string][]dns.RR)
+	sigs := make(map[string][]*dns.RRSIG)
+	for _, rr := range rrs {
+		if sig, ok := rr.(*dns.RRSIG); ok {
+			key := strings.ToLower(sig.Hdr.Name) + "/" + dns.TypeToString[sig.TypeCovered]
+			sigs[key] = append(sigs[key], sig)
+			continue
+		}
+		if rr.Header().Rrtype == dns.TypeOPT {
+			continue
+		}
+		key := strings.ToLower(rr.Header().Name) + "/" + dns.TypeToString[rr.Header().Rrtype]
+		sets[key] = append(sets[key], rr)
+	}
+	return sets, sigs
+}
+
+// validate returns whether the answer to the query is secure or insecure, bogus answers return errBogus
+func (v *validator) validate(name string, qtype uint16, m *dns.Msg, lookup lookupFunc, depth int) (string, error) {
+	if depth > maxChainDepth {
+		return db.DNSSECBogus, fmt.Errorf("%w: chain of trust of %s too long", errBogus, name)
+	}
+
+	status := db.DNSSECSecure
+	sets, sigs := rrsets(m.Answer)
+	if len(sets) > 0 {
+		var err error
+		if status, err = v.verifySets(sets, sigs, lookup, depth); err != nil {
+			return status, err
+		}
+	}
+	// aliases are followed to the name that has no records of the type
+	target := name
+	for _, rr := range m.Answer {
+		if cname, ok := rr.(*dns.CNAME); ok && strings.EqualFold(cname.Hdr.Name, target) {
+			target = strings.ToLower(cname.Target)
+		}
+	}
+	positive := m.Rcode == dns.RcodeSuccess && (qtype == dns.TypeANY || slices.ContainsFunc(m.Answer, func(rr dns.RR) bool {
+		return rr.Header().Rrtype == qtype
+	}))
+	wildcards := expansions(m.Answer)
+	if positive && (status == db.DNSSECInsecure || len(wildcards) == 0) {
+		return status, nil
+	}
+
+	// negative answers and wildcard expansions are proven by the signed NSEC or NSEC3 records of the
+	// authority section
+	sets, sigs = rrsets(slices.DeleteFunc(slices.Clone(m.Ns), func(rr dns.RR) bool {
+		t := rr.Header().Rrtype
+		if sig, ok := rr.(*dns.RRSIG); ok {
+			t = sig.TypeCovered
+		}
+		return t != dns.TypeSOA && t != dns.TypeNSEC && t != dns.TypeNSEC3
+	}))
+	if positive && len(sigs) == 0 {
+		return db.DNSSECBogus, fmt.Errorf("%w: wildcard expansion of %s not proven", errBogus, name)
+	}
+	if len(sigs) == 0 {
+		if qtype == dns.TypeDS {
+			// the absent DS records of a zone are answered by its parent
+			target = parentName(target)
+		}
+		return v.unsigned(target, lookup, depth)
+	}
+	st, err := v.verifySets(sets, sigs, lookup, depth)
+	if err != nil {
+		return st, err
+	}
+	if st == db.DNSSECInsecure || status == db.DNSSECInsecure {
+		return db.DNSSECInsecure, nil
+	}
+	for owner, labels := range wildcards {
+		if !expanded(m, owner, labels) {
+			return db.DNSSECBogus, fmt.Errorf("%w: wildcard expansion of %s not proven", errBogus, owner)
+		}
+	}
+	if positive {
+		return db.DNSSECSecure, nil
+	}
+	if !denies(m, target, qtype) {
+		return db.DNSSECBogus, fmt.Errorf("%w: non-existence of %s %s not proven", errBogus, target, dns.TypeToString[qtype])
+	}
+	return db.DNSSECSecure, nil
+}
+
+// verifySets returns secure when all record sets are secure
+func (v *validator) verifySets(sets map[string][]dns.RR, sigs map[string][]*dns.RRSIG, lookup lookupFunc, depth int) (string, error) {
+	status := db.DNSSECSecure
+	for key, set := range sets {
+		st, err := v.verifySet(set, sigs[key], lookup, depth)
+		if err != nil {
+			return db.DNSSECBogus, err
+		}
+		if st == db.DNSSECInsecure {
+			status = db.DNSSECInsecure
+		}
+	}
+	return status, nil
+}
+
+// verifySet verifies a record set with the keys of the zone that signed it, unsigned sets are insecure
+// when their zone has no chain of trust
+func (v *validator) verifySet(set []dns.RR, sigs []*dns.RRSIG, lookup lookupFunc, depth int) (string, error) {
+	name := strings.ToLower(set[0].Header().Name)
+	rrtype := set[0].Header().Rrtype
+	if len(sigs) == 0 && rrtype == dns.TypeDS {
+		return v.unsigned(parentName(name), lookup, depth)
+	}
+	if len(sigs) == 0 {
+		return v.unsigned(name, lookup, depth)
+	}
+	for _, sig := range sigs {
+		signer := strings.ToLower(sig.SignerName)
+		// the DS records of a zone are signed by its parent
+		if !dns.IsSubDomain(signer, name) || rrtype == dns.TypeDS && signer == name {
+			continue
+		}
+		keys, err := v.zoneKeys(signer, lookup, depth+1)
+		if err != nil {
+			return db.DNSSECBogus, err
+		}
+		if keys == nil {
+			return db.DNSSECInsecure, nil
+		}
+		if verify(sig, keys, set) {
+			return db.DNSSECSecure, nil
+		}
+	}
+	return db.DNSSECBogus, fmt.Errorf("%w: no valid signature of %s %s", errBogus, name, dns.TypeToString[rrtype])
+}
+
+// verify reports whether the signature of the set is valid and made by one of the keys
+func verify(sig *dns.RRSIG, keys []*dns.DNSKEY, set []dns.RR) bool {
+	if !sig.ValidityPeriod(time.Now()) {
+		return false
+	}
+	for _, key := range keys {
+		if key.KeyTag() == sig.KeyTag && key.Algorithm == sig.Algorithm && sig.Verify(key, set) == nil {
+			return true
+		}
+	}
+	return false
+}
+
+// unsigned returns insecure when the zone of the name is proven to have no chain of trust, unsigned
+// records of a signed zone are bogus
+func (v *validator) unsigned(name string, lookup lookupFunc, depth int) (string, error) {
+	if v.insecure.Get(name) != nil {
+		return db.DNSSECInsecure, nil
+	}
+
+	zone, err := findZone(name, lookup)
+	if err != nil {
+		return db.DNSSECBogus, err
+	}
+	keys, err := v.zoneKeys(zone, lookup, depth+1)
+	if err != nil {
+		return db.DNSSECBogus, err
+	}
+	if keys != nil {
+		return db.DNSSECBogus, fmt.Errorf("%w: unsigned records of %s in signed zone %s", errBogus, name, zone)
+	}
+	v.insecure.DeleteExpired()
+	v.insecure.Set(name, struct{}{}, maxKeyTTL*time.Second)
+	return db.DNSSECInsecure, nil
+}
+
+// findZone returns the zone of the name from the SOA record of the name or of the authority section,
+// aliases are skipped as their SOA is the one of the target
+func findZone(name string, lookup lookupFunc) (string, error) {
+	for zone := name; ; {
+		m, err := lookup(zone, dns.TypeSOA)
+		if err != nil {
+			return "", err
+		}
+		alias := false
+		for _, rr := range m.Answer {
+			switch rr := rr.(type) {
+			case *dns.SOA:
+				if strings.EqualFold(rr.Hdr.Name, zone) {
+					return strings.ToLower(rr.Hdr.Name), nil
+				}
+			case *dns.CNAME:
+				alias = alias || strings.EqualFold(rr.Hdr.Name, zone)
+			}
+		}
+		for _, rr := range m.Ns {
+			if soa, ok := rr.(*dns.SOA); ok && !alias && dns.IsSubDomain(soa.Hdr.Name, zone) {
+				return strings.ToLower(soa.Hdr.Name), nil
+			}
+		}
+		if zone == "." {
+			return "", fmt.Errorf("%w: no zone of %s", errBogus, name)
+		}
+		zone = parentName(zone)
+	}
+}
+
+// parentName returns the name without its first label
+func parentName(name string) string {
+	off, end := dns.NextLabel(name, 0)
+	if end {
+		return "."
+	}
+	return name[off:]
+}
+
+// zoneKeys returns the keys of the zone authenticated by the DS records of its parent or by the trust
+// anchors, insecure zones have no keys
+func (v *validator) zoneKeys(zone string, lookup lookupFunc, depth int) ([]*dns.DNSKEY, error) {
+	if item := v.zones.Get(zone); item != nil {
+		return item.Value(), nil
+	}
+	if depth > maxChainDepth {
+		return nil, fmt.Errorf("%w: chain of trust of %s too long", errBogus, zone)
+	}
+
+	ttl := uint32(maxKeyTTL)
+	ds := v.anchors
+	if zone != "." {
+		m, err := lookup(zone, dns.TypeDS)
+		if err != nil {
+			return nil, err
+		}
+		status, err := v.validate(zone, dns.TypeDS, m, lookup, depth+1)
+		if err != nil {
+			return nil, err
+		}
+		ds = nil
+		for _, rr := range m.Answer {
+			if d, ok := rr.(*dns.DS); ok && strings.EqualFold(d.Hdr.Name, zone) {
+				ds = append(ds, d)
+				ttl = min(ttl, d.Hdr.Ttl)
+			}
+		}
+		if status == db.DNSSECInsecure || len(ds) == 0 {
+			// a proven absence of DS records is an insecure delegation
+			if status == db.DNSSECSecure && !delegated(m, zone) {
+				return nil, fmt.Errorf("%w: %s is not a delegation", errBogus, zone)
+			}
+			v.cacheKeys(zone, nil, ttl)
+			return nil, nil
+		}
+	}
+
+	m, err := lookup(zone, dns.TypeDNSKEY)
+	if err != nil {
+		return nil, err
+	}
+	set := make([]dns.RR, 0)
+	keys := make([]*dns.DNSKEY, 0)
+	for _, rr := range m.Answer {
+		if key, ok := rr.(*dns.DNSKEY); ok && strings.EqualFold(key.Hdr.Name, zone) {
+			set = append(set, key)
+			keys = append(keys, key)
+			ttl = min(ttl, key.Hdr.Ttl)
+		}
+	}
+	// the key set is signed by a key signing key matching a DS record
+	ksks := slices.DeleteFunc(slices.Clone(keys), func(key *dns.DNSKEY) bool {
+		return !slices.ContainsFunc(ds, func(d *dns.DS) bool {
+			k := key.ToDS(d.DigestType)
+			return k != nil && k.KeyTag == d.KeyTag && strings.EqualFold(k.Digest, d.Digest)
+		})
+	})
+	for _, rr := range m.Answer {
+		if sig, ok := rr.(*dns.RRSIG); ok && sig.TypeCovered == dns.TypeDNSKEY && verify(sig, ksks, set) {
+			v.cacheKeys(zone, keys, ttl)
+			return keys, nil
+		}
+	}
+	return nil, fmt.Errorf("%w: no trusted key of %s", errBogus, zone)
+}
+
+// cacheKeys caches the keys of the zone, the expired zones are removed first
+func (v *validator) cacheKeys(zone string, keys []*dns.DNSKEY, ttl uint32) {
+	if ttl == 0 {
+		// a zero TTL never expires in the cache
+		return
+	}
+	v.zones.DeleteExpired()
+	v.zones.Set(zone, keys, time.Duration(ttl)*time.Second)
+}
+
+// canonicalCompare orders names by their labels from the root (RFC 4034 section 6.1)
+func canonicalCompare(a string, b string) int {
+	la := dns.SplitDomainName(strings.ToLower(a))
+	lb := dns.SplitDomainName(strings.ToLower(b))
+	slices.Reverse(la)
+	slices.Reverse(lb)
+	return slices.Compare(la, lb)
+}
+
+// covers reports whether the name is between the owner and the next name of an NSEC record
+func covers(nsec *dns.NSEC, name string) bool {
+	after := canonicalCompare(nsec.Hdr.Name, name) < 0
+	before := canonicalCompare(name, nsec.NextDomain) < 0
+	if canonicalCompare(nsec.Hdr.Name, nsec.NextDomain) < 0 {
+		return after && before
+	}
+	// the last NSEC record of the zone wraps to the apex
+	return after || before
+}
+
+// denials returns the NSEC and NSEC3 records of the authority section
+func denials(m *dns.Msg) ([]*dns.NSEC, []*dns.NSEC3) {
+	nsecs := make([]*dns.NSEC, 0)
+	nsec3s := make([]*dns.NSEC3, 0)
+	for _, rr := range m.Ns {
+		switch rr := rr.(type) {
+		case *dns.NSEC:
+			nsecs = append(nsecs, rr)
+		case *dns.NSEC3:
+			nsec3s = append(nsec3s, rr)
+		}
+	}
+	return nsecs, nsec3s
+}
+
+// expansions returns the owner names of the answer signed as the expansion of a wildcard with the
+// number of labels of the wildcard without its asterisk
+func expansions(answer []dns.RR) map[string]int {
+	wildcards := make(map[string]int)
+	for _, rr := range answer {
+		if sig, ok := rr.(*dns.RRSIG); ok && int(sig.Labels) < dns.CountLabel(sig.Hdr.Name) {
+			wildcards[strings.ToLower(sig.Hdr.Name)] = int(sig.Labels)
+		}
+	}
+	return wildcards
+}
+
+// expanded reports whether the NSEC or NSEC3 records prove that no closer name than the wildcard with
+// the labels matches the name (RFC 4035 section 5.3.4, RFC 5155 section 8.8)
+func expanded(m *dns.Msg, name string, labels int) bool {
+	nsecs, nsec3s := denials(m)
+	if slices.ContainsFunc(nsecs, func(n *dns.NSEC) bool { return covers(n, name) }) {
+		return true
+	}
+	idx := dns.Split(name)
+	nextCloser := name[idx[len(idx)-labels-1]:]
+	return slices.ContainsFunc(nsec3s, func(n *dns.NSEC3) bool { return n.Cover(nextCloser) })
+}
+
+// wildcardOf returns the wildcard of the closest encloser with the number of labels
+func wildcardOf(name string, labels int) string {
+	if labels == 0 {
+		return "*."
+	}
+	idx := dns.Split(name)
+	return "*." + name[idx[len(idx)-labels]:]
+}
+
+// denies reports whether the NSEC or NSEC3 records prove the non-existence of the name or of the type,
+// absent names also require the proof that no wildcard of their closest encloser exists
+func denies(m *dns.Msg, name string, qtype uint16) bool {
+	nsecs, nsec3s := denials(m)
+	absent := func(types []uint16) bool {
+		return !slices.Contains(types, qtype) && !slices.Contains(types, dns.TypeCNAME)
+	}
+
+	if m.Rcode == dns.RcodeNameError {
+		for _, nsec := range nsecs {
+			if !covers(nsec, name) {
+				continue
+			}
+			// the closest encloser is the longest ancestor shared with the names around the gap
+			encloser := max(dns.CompareDomainName(name, nsec.Hdr.Name), dns.CompareDomainName(name, nsec.NextDomain))
+			wildcard := wildcardOf(name, encloser)
+			return slices.ContainsFunc(nsecs, func(n *dns.NSEC) bool { return covers(n, wildcard) })
+		}
+		// the closest encloser exists, the next closer name and the wildcard are covered (RFC 5155
+		// section 8.4)
+		nextCloser := name
+		for off, end := dns.NextLabel(name, 0); !end; off, end = dns.NextLabel(name, off) {
+			encloser := name[off:]
+			if slices.ContainsFunc(nsec3s, func(n *dns.NSEC3) bool { return n.Match(encloser) }) {
+				return slices.ContainsFunc(nsec3s, func(n *dns.NSEC3) bool { return n.Cover(nextCloser) }) &&
+					slices.ContainsFunc(nsec3s, func(n *dns.NSEC3) bool { return n.Cover("*." + encloser) })
+			}
+			nextCloser = encloser
+		}
+		return false
+	}
+
+	for _, nsec := range nsecs {
+		if strings.EqualFold(nsec.Hdr.Name, name) && absent(nsec.TypeBitMap) {
+			return true
+		}
+		// empty non-terminals have no records of their own
+		if covers(nsec, name) && dns.IsSubDomain(name, nsec.NextDomain) {
+			return true
+		}
+	}
+	for _, nsec3 := range nsec3s {
+		if nsec3.Match(name) && absent(nsec3.TypeBitMap) {
+			return true
+		}
+		// unsigned delegations may be skipped by opt-out NSEC3 records (RFC 5155 section 6)
+		if qtype == dns.TypeDS && nsec3.Flags&1 == 1 && nsec3.Cover(name) {
+			return true
+		}
+	}
+	return false
+}
+
+// delegated reports whether the proof of the absent DS records is for a delegation of the zone
+func delegated(m *dns.Msg, zone string) bool {
+	delegation := func(types []uint16) bool {
+		return slices.Contains(types, dns.TypeNS) && !slices.Contains(types, dns.TypeSOA)
+	}
+	for _, rr := range m.Ns {
+		switch rr := rr.(type) {
+		case *dns.NSEC:
+			if strings.EqualFold(rr.Hdr.Name, zone) && delegation(rr.TypeBitMap) {
+				return true
+			}
+		case *dns.NSEC3:
+			if rr.Match(zone) && delegation(rr.TypeBitMap) || rr.Flags&1 == 1 && rr.Cover(zone) {
+				return true
+			}
+		}
+	}
+	return false
+}
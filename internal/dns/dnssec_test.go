@@ -0,0 +1,161 @@
+package dns
+
+import (
+	"crypto"
+	"errors"
+	"fmt"
+	"net"
+	"sleuth/internal/db"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+type testZone struct {
+	key  *dns.DNSKEY
+	priv crypto.Signer
+}
+
+func newTestZone(t *testing.T, name string) *testZone {
+	key := &dns.DNSKEY{
+		Hdr:       dns.RR_Header{Name: name, Rrtype: dns.TypeDNSKEY, Class: dns.ClassINET, Ttl: 300},
+		Flags:     257,
+		Protocol:  3,
+		Algorithm: dns.ECDSAP256SHA256,
+	}
+	priv, err := key.Generate(256)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &testZone{key: key, priv: priv.(crypto.Signer)}
+}
+
+// sign returns the set followed by its signature
+func (z *testZone) sign(t *testing.T, set ...dns.RR) []dns.RR {
+	sig := &dns.RRSIG{
+		Hdr:         dns.RR_Header{Name: set[0].Header().Name, Rrtype: dns.TypeRRSIG, Class: dns.ClassINET, Ttl: 300},
+		TypeCovered: set[0].Header().Rrtype,
+		Algorithm:   z.key.Algorithm,
+		Labels:      uint8(dns.CountLabel(set[0].Header().Name)),
+		OrigTtl:     300,
+		Expiration:  uint32(time.Now().Add(time.Hour).Unix()),
+		Inception:   uint32(time.Now().Add(-time.Hour).Unix()),
+		KeyTag:      z.key.KeyTag(),
+		SignerName:  z.key.Hdr.Name,
+	}
+	if err := sig.Sign(z.priv, set); err != nil {
+		t.Fatal(err)
+	}
+	return append(set, sig)
+}
+
+func testRR(t *testing.T, s string) dns.RR {
+	rr, err := dns.NewRR(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return rr
+}
+
+// newTestValidator returns a validator trusting a test root with the signed zone example. and the
+// insecure delegation insecure.
+func newTestValidator(t *testing.T) (*validator, lookupFunc, *testZone) {
+	root := newTestZone(t, ".")
+	example := newTestZone(t, "example.")
+	v := newValidator()
+	v.anchors = []*dns.DS{root.key.ToDS(dns.SHA256)}
+
+	answers := map[string]*dns.Msg{
+		"./DNSKEY":        {Answer: root.sign(t, root.key)},
+		"example./DS":     {Answer: root.sign(t, example.key.ToDS(dns.SHA256))},
+		"example./DNSKEY": {Answer: example.sign(t, example.key)},
+		"insecure./DS": {Ns: append(
+			root.sign(t, testRR(t, ". 300 IN SOA a.root. hostmaster.root. 1 3600 600 86400 300")),
+			root.sign(t, testRR(t, "insecure. 300 IN NSEC z. NS RRSIG NSEC"))...)},
+		"www.insecure./SOA": {Ns: []dns.RR{testRR(t, "insecure. 300 IN SOA ns.insecure. hostmaster.insecure. 1 3600 600 86400 300")}},
+		"www.example./SOA":  {Ns: example.sign(t, testRR(t, "example. 300 IN SOA ns.example. hostmaster.example. 1 3600 600 86400 300"))},
+	}
+	lookup := func(name string, qtype uint16) (*dns.Msg, error) {
+		if m, ok := answers[name+"/"+dns.TypeToString[qtype]]; ok {
+			return m, nil
+		}
+		return nil, fmt.Errorf("no answer for %s %s", name, dns.TypeToString[qtype])
+	}
+	return v, lookup, example
+}
+
+func TestValidateSecure(t *testing.T) {
+	v, lookup, example := newTestValidator(t)
+	m := &dns.Msg{Answer: example.sign(t, testRR(t, "www.example. 300 IN A 192.0.2.1"))}
+	status, err := v.validate("www.example.", dns.TypeA, m, lookup, 0)
+	checkTestBool(t, true, err == nil)
+	checkTestString(t, db.DNSSECSecure, status)
+
+	// a spoofed address does not match the signature
+	m.Answer[0].(*dns.A).A = net.ParseIP("198.51.100.1")
+	status, err = v.validate("www.example.", dns.TypeA, m, lookup, 0)
+	checkTestBool(t, true, errors.Is(err, errBogus))
+	checkTestString(t, db.DNSSECBogus, status)
+
+	// unsigned answers of a signed zone are bogus
+	m = &dns.Msg{Answer: []dns.RR{testRR(t, "www.example. 300 IN A 198.51.100.1")}}
+	_, err = v.validate("www.example.", dns.TypeA, m, lookup, 0)
+	checkTestBool(t, true, errors.Is(err, errBogus))
+}
+
+func TestValidateInsecure(t *testing.T) {
+	v, lookup, _ := newTestValidator(t)
+	m := &dns.Msg{Answer: []dns.RR{testRR(t, "www.insecure. 300 IN A 192.0.2.1")}}
+	status, err := v.validate("www.insecure.", dns.TypeA, m, lookup, 0)
+	checkTestBool(t, true, err == nil)
+	checkTestString(t, db.DNSSECInsecure, status)
+}
+
+func TestValidateNXDomain(t *testing.T) {
+	v, lookup, example := newTestValidator(t)
+	m := &dns.Msg{
+		MsgHdr: dns.MsgHdr{Rcode: dns.RcodeNameError},
+		Ns: append(
+			example.sign(t, testRR(t, "example. 300 IN SOA ns.example. hostmaster.example. 1 3600 600 86400 300")),
+			example.sign(t, testRR(t, "example. 300 IN NSEC www.example. SOA NS RRSIG NSEC DNSKEY"))...),
+	}
+	status, err := v.validate("none.example.", dns.TypeA, m, lookup, 0)
+	checkTestBool(t, true, err == nil)
+	checkTestString(t, db.DNSSECSecure, status)
+
+	// the NSEC record does not cover names after www.example.
+	_, err = v.validate("zzz.example.", dns.TypeA, m, lookup, 0)
+	checkTestBool(t, true, errors.Is(err, errBogus))
+}
+
+func TestValidateWildcard(t *testing.T) {
+	v, lookup, example := newTestValidator(t)
+	answer := example.sign(t, testRR(t, "*.example. 300 IN A 192.0.2.1"))
+	for _, rr := range answer {
+		rr.Header().Name = "a.example."
+	}
+	m := &dns.Msg{Answer: answer}
+
+	// the expansion requires the proof that a.example. does not exist
+	_, err := v.validate("a.example.", dns.TypeA, m, lookup, 0)
+	checkTestBool(t, true, errors.Is(err, errBogus))
+
+	m.Ns = example.sign(t, testRR(t, "example. 300 IN NSEC www.example. SOA NS RRSIG NSEC DNSKEY"))
+	status, err := v.validate("a.example.", dns.TypeA, m, lookup, 0)
+	checkTestBool(t, true, err == nil)
+	checkTestString(t, db.DNSSECSecure, status)
+}
+
+func TestValidateNXDomainWildcard(t *testing.T) {
+	v, lookup, example := newTestValidator(t)
+	m := &dns.Msg{
+		MsgHdr: dns.MsgHdr{Rcode: dns.RcodeNameError},
+		Ns: append(
+			example.sign(t, testRR(t, "example. 300 IN SOA ns.example. hostmaster.example. 1 3600 600 86400 300")),
+			example.sign(t, testRR(t, "*.example. 300 IN NSEC www.example. A RRSIG NSEC"))...),
+	}
+	// the wildcard of the closest encloser exists
+	_, err := v.validate("none.example.", dns.TypeA, m, lookup, 0)
+	checkTestBool(t, true, errors.Is(err, errBogus))
+}
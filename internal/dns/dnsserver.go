@@ -1,7 +1,6 @@
 package dns
 
 import (
-	"context"
 	"errors"
 	"fmt"
 	"log"
@@ -9,8 +8,10 @@ import (
 	"sleuth/internal/constants"
 	"sleuth/internal/db"
 	"sleuth/internal/firewall"
+	"sleuth/internal/metrics"
 	"sleuth/internal/network"
 	"sleuth/internal/security"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
@@ -20,20 +21,43 @@ import (
 )
 
 type DnsServer struct {
-	db       *db.Db
-	fw       firewall.FirewallManager
-	network  *network.Network
-	security *security.Security
-	settings *db.Settings
+	db        *db.Db
+	fw        firewall.FirewallManager
+	network   *network.Network
+	security  *security.Security
+	settings  *db.Settings
+	querylog  *queryLogger
+	upstreams *upstreamPool
+	transport *upstreamTransport
+	answers   *answerCache
+	validator *validator
+	limiter   *rateLimiter
+	// forwarders, safesearch and bypassEndpoints are shared by the copies of the server
+	forwarders      *reloadCache[db.DNSForwarder]
+	safesearch      *reloadCache[db.SafeSearchMapping]
+	bypassEndpoints *reloadCache[db.BypassEndpoint]
 }
 
-func (s *DnsServer) parseQuery(source net.Addr, interfaceAddress string, m *dns.Msg) {
+// parseQuery answers the questions of the message and reports whether all answers are DNSSEC secure
+func (s *DnsServer) parseQuery(source net.Addr, interfaceAddress string, m *dns.Msg) bool {
+	secure := len(m.Question) > 0
 	for _, q := range m.Question {
 		name := strings.ToLower(q.Name)
-		res, errCode := s.processDnsQuery(name, q.Qtype, strings.Split(source.String(), ":")[0], interfaceAddress)
-		m.Answer = append(m.Answer, res...)
+		res, errCode, dnssec := s.answerQuery(name, q.Qtype, hostIP(source.String()), interfaceAddress)
+		secure = secure && dnssec == db.DNSSECSecure
 		m.Rcode = errCode
+		if len(res) == 1 && res[0].Header().Rrtype == dns.TypeSOA && q.Qtype != dns.TypeSOA {
+			// negative blocked answers carry their SOA (RFC 2308)
+			m.Ns = append(m.Ns, res...)
+			continue
+		}
+		m.Answer = append(m.Answer, res...)
+		// negative answers of the local domain carry its SOA (RFC 2308)
+		if zone := s.localZone(); len(res) == 0 && zone != "" && dns.IsSubDomain(zone, name) {
+			m.Ns = append(m.Ns, localSOA(zone))
+		}
 	}
+	return secure
 }
 
 func (s *DnsServer) queryCache(clientIP string, name string, qtype uint16) (*constants.DNSSession, error) {
@@ -47,9 +71,15 @@ func (s *DnsServer) queryCache(clientIP string, name string, qtype uint16) (*con
 	return cache, nil
 }
 
-func (s *DnsServer) processResponse(name string, qtype uint16, upstream *[]dns.RR, cache *constants.DNSSession, ses security.SessionInfo, if_ip string, isLocal bool) []dns.RR {
+func (s *DnsServer) processResponse(name string, qtype uint16, upstream *[]dns.RR, cache *constants.DNSSession, ses security.SessionInfo, if_ip string, isLocal bool, dnssec string, safesearch string) ([]dns.RR, *constants.DNSSession) {
 	ttl := uint32(32768)
 	cached := cache != nil
+	if upstream != nil && safesearch != "" {
+		// the records of the safe-search target are served for the name, the synthesized CNAME is not signed
+		answer := safeSearchAnswer(name, safesearch, *upstream)
+		upstream = &answer
+		dnssec = ""
+	}
 	if upstream != nil && cached {
 		a := make(map[string]constants.DNS_IP_Record)
 		aaaa := make(map[string]constants.DNS_IP_Record)
@@ -81,13 +111,10 @@ func (s *DnsServer) processResponse(name string, qtype uint16, upstream *[]dns.R
 			_, matched = a[cache.DNSResponse.A.IP]
 		}
 		if !matched {
-			if cache.DNSResponse.A == nil {
-				cache.DNSResponse.A = nil
-			} else {
-				for _, _a := range a {
-					cache.DNSResponse.A = &_a
-					break
-				}
+			cache.DNSResponse.A = nil
+			for _, _a := range a {
+				cache.DNSResponse.A = &_a
+				break
 			}
 		}
 		matched = false
@@ -95,16 +122,18 @@ func (s *DnsServer) processResponse(name string, qtype uint16, upstream *[]dns.R
 			_, matched = aaaa[cache.DNSResponse.AAAA.IP]
 		}
 		if !matched {
-			if cache.DNSResponse.AAAA == nil {
-				cache.DNSResponse.AAAA = nil
-			} else {
-				for _, _aaaa := range aaaa {
-					cache.DNSResponse.A = &_aaaa
-					break
-				}
+			cache.DNSResponse.AAAA = nil
+			for _, _aaaa := range aaaa {
+				cache.DNSResponse.AAAA = &_aaaa
+				break
 			}
 		}
 		cache.ReasonCode = ses.RejectReason
+		cache.Rcode = dns.RcodeSuccess
+		cache.TTL = ttl
+		cache.Hits = 0
+		cache.DNSSEC = dnssec
+		cache.SafeSearch = safesearch
 		cache.DNSExpiry = time.Now().Add(time.Duration(ttl) * time.Second)
 		cache.SessionExpiry = time.Now().Add(time.Duration(330) * time.Second)
 
@@ -120,6 +149,8 @@ func (s *DnsServer) processResponse(name string, qtype uint16, upstream *[]dns.R
 			SessionExpiry: time.Now().Add(time.Duration(330) * time.Second),
 			ReasonCode:    ses.RejectReason,
 			IsLocal:       isLocal,
+			DNSSEC:        dnssec,
+			SafeSearch:    safesearch,
 			DNSResponse: constants.DNSResponse{
 				Raw: make([]string, 0),
 			},
@@ -149,11 +180,32 @@ func (s *DnsServer) processResponse(name string, qtype uint16, upstream *[]dns.R
 				cache.DNSResponse.Raw = append(cache.DNSResponse.Raw, r.String())
 			}
 		}
+		cache.TTL = ttl
 		cache.DNSExpiry = time.Now().Add(time.Duration(ttl) * time.Second)
 	}
 
-	cache.ReasonCode = security.VerifyDomainAccess(ses, cache)
-	if /*ses.RejectReason == 0 && cache.ReasonCode == 0 &&*/ upstream != nil {
+	cache.MacAddress = ses.MacAddress
+	if cache.DNSResponse.AAAA != nil && cache.InterfaceIPv6 == "" {
+		ipv6, err := network.GetInterfaceIPv6(if_ip)
+		if err != nil {
+			log.Println(err)
+		}
+		cache.InterfaceIPv6 = ipv6
+	}
+
+	cache.ReasonCode = s.verifyAccess(ses, cache)
+	// blocked lookups only take a forwarding address when they are redirected to the portal
+	redirect := true
+	if cache.ReasonCode != constants.AccessAllowed {
+		mode, _ := s.blockResponse(ses, cache.ReasonCode)
+		redirect = mode == db.BlockModePortal
+	}
+	// expired sessions released their forwarding addresses, they allocate them again when they answer
+	expired := upstream == nil && time.Now().After(cache.SessionExpiry)
+	if expired {
+		cache.SessionExpiry = time.Now().Add(time.Duration(330) * time.Second)
+	}
+	if /*ses.RejectReason == 0 && cache.ReasonCode == 0 &&*/ (upstream != nil || expired) && redirect {
 		s.fw.Allocate(*cache, if_ip)
 	}
 
@@ -189,169 +241,131 @@ func (s *DnsServer) processResponse(name string, qtype uint16, upstream *[]dns.R
 			A: net.ParseIP(ip).To4(),
 		})
 	}
-	return resp
-}
-
-func (s *DnsServer) queryLocal(name string, qtype uint16, source string, if_ip string) ([]dns.RR, error) {
-	localdomain := s.settings.LocalDomain
-	if s.db == nil {
-		return nil, errors.New("Db access required to query local")
-	}
-	if s.network == nil {
-		return nil, errors.New("Db access required to query local")
-	}
-	if s.settings == nil {
-		return nil, errors.New("Settings access required to query local")
-	}
-	if localdomain == "" {
-		return nil, errors.New("Local domain not specified")
-	}
-	if localdomain[0] != '.' {
-		localdomain = "." + localdomain
-	}
-	if localdomain[len(localdomain)-1] != '.' {
-		localdomain += "."
-	}
-
-	hostname := ""
-	if len(name) > len(localdomain) && name[len(name)-len(localdomain):] == localdomain {
-		hostname = name[0 : len(name)-len(localdomain)]
-	} else if len(strings.Split(name, ".")) == 2 {
-		hostname = strings.Split(name, ".")[0]
-	}
-
-	if hostname != "" {
-		arr := make([]dns.RR, 0)
-
-		if hostname == "session" {
-			rr, err := dns.NewRR(fmt.Sprintf("%s %d IN %s %s", name, 1, getQueryTypeText(qtype), if_ip))
-			arr = append(arr, rr)
-			if err != nil {
-				log.Println(err)
-				return []dns.RR{}, err
-			}
-		} else {
-			for _, device := range s.db.GetDevices() {
-				if device.DNSName == hostname {
-					dev := s.network.FindByMac(device.MACAddress)
-					if dev != nil && dev.Ip != nil {
-						rr, err := dns.NewRR(fmt.Sprintf("%s %d IN %s %s", name, 1, getQueryTypeText(qtype), dev.Ip.String()))
-						arr = append(arr, rr)
-						if err != nil {
-							log.Println(err)
-							return []dns.RR{}, err
-						}
-					}
-				}
-			}
+	if cache.DNSResponse.AAAA != nil {
+		ip := cache.InterfaceIPv6
+		if ses.DynamicRouting && !cache.IsLocal && cache.DNSResponse.AAAA.AllocatedIP != "" {
+			ip = cache.DNSResponse.AAAA.AllocatedIP
 		}
-
-		if len(arr) > 0 {
-			//s.security.VerifySessionAccess(source)
-			return arr, nil
+		// without an IPv6 address to route through, the client falls back to IPv4
+		if ip != "" {
+			resp = append(resp, &dns.AAAA{
+				Hdr: dns.RR_Header{
+					Name:   cache.DNSResponse.AAAA.Name,
+					Class:  dns.StringToClass[cache.DNSResponse.AAAA.Class],
+					Ttl:    1,
+					Rrtype: dns.TypeAAAA,
+				},
+				AAAA: net.ParseIP(ip),
+			})
 		}
-
 	}
-	return nil, errors.New("Not within local domain")
-
+	return resp, cache
 }
 
-func (s *DnsServer) queryUpstream(name string, qtype uint16, source string, if_ip string, config *db.DNSConfiguration) ([]dns.RR, error) {
-	m1 := new(dns.Msg)
-	m1.Id = dns.Id()
-	m1.RecursionDesired = true
-	m1.Question = make([]dns.Question, 1)
-	m1.Question[0] = dns.Question{
-		Name:   name,
-		Qtype:  qtype,
-		Qclass: dns.ClassINET,
-	}
-
-	c := new(dns.Client)
-	fallbackAddress := s.settings.FallbackDNS
+func (s *DnsServer) processDnsQuery(name string, qtype uint16, source string, if_ip string) ([]dns.RR, int) {
+	res, rcode, _ := s.answerQuery(name, qtype, source, if_ip)
+	return res, rcode
+}
 
-	if fallbackAddress == "" {
-		fallbackAddress = "1.1.1.1"
-	} else {
-		if net.ParseIP(fallbackAddress) == nil {
-			fallbackAddress = "1.1.1.1"
+// answerQuery resolves the query of the client and returns the records, the rcode and the DNSSEC status
+func (s *DnsServer) answerQuery(name string, qtype uint16, source string, if_ip string) ([]dns.RR, int, string) {
+	start := time.Now()
+	ses, _ := s.security.GetSessionInfo(source)
+	entry := db.QueryLogEntry{
+		Time:       start,
+		ClientIP:   source,
+		MacAddress: ses.MacAddress,
+		Username:   ses.Username,
+		Name:       name,
+		QType:      qtype,
+		Source:     db.QuerySourceNone,
+		Rcode:      dns.RcodeNameError,
+		ReasonCode: ses.RejectReason,
+	}
+	defer func() {
+		entry.Latency = time.Since(start)
+		s.querylog.Log(entry)
+		metrics.DNSQueries.WithLabelValues(dns.RcodeToString[entry.Rcode], entry.Source, getQueryTypeText(qtype)).Inc()
+		metrics.DNSQueryDuration.WithLabelValues(entry.Source).Observe(entry.Latency.Seconds())
+		if entry.ReasonCode != constants.AccessAllowed {
+			metrics.DNSBlocked.WithLabelValues(strconv.Itoa(int(entry.ReasonCode))).Inc()
 		}
-	}
+	}()
 
-	if len(strings.Split(fallbackAddress, ":")) < 2 {
-		fallbackAddress = fmt.Sprintf("%s:53", fallbackAddress)
+	if ses.Reevaluate {
+		s.ReevaluateAccess(source)
 	}
-	address := fallbackAddress
-	if config != nil && config.Address != "" {
-		address = config.Address
-		switch config.Type {
-		case 0:
-			if len(strings.Split(address, ":")) < 2 {
-				address = fmt.Sprintf("%s:53", address)
-			}
-		case 1:
-			c.Net = "tcp"
-			if len(strings.Split(address, ":")) < 2 {
-				address = fmt.Sprintf("%s:53", address)
-			}
-			c = &dns.Client{
-				Net: "tcp",
-				Dialer: &net.Dialer{
-					Resolver: &net.Resolver{
-						PreferGo: true,
-						Dial: func(ctx context.Context, network, address string) (net.Conn, error) {
-							d := net.Dialer{}
-							return d.DialContext(ctx, network, fallbackAddress)
-						},
-					},
-				},
-			}
-		case 2:
-			if len(strings.Split(address, ":")) < 2 {
-				address = fmt.Sprintf("%s:853", address)
-			}
-			c = &dns.Client{
-				Net: "tcp-tls",
-				Dialer: &net.Dialer{
-					Resolver: &net.Resolver{
-						PreferGo: true,
-						Dial: func(ctx context.Context, network, address string) (net.Conn, error) {
-							d := net.Dialer{}
-							return d.DialContext(ctx, network, fallbackAddress)
-						},
-					},
-				},
-			}
+	if s.bypassDomain(name) {
+		// clients fall back to the portal when their DoH, DoT or VPN endpoint does not resolve
+		logQueryResult(source, name, qtype, "is a DNS bypass endpoint")
+		entry.Source = db.QuerySourceLocal
+		entry.ReasonCode = constants.AccessBlockedBypass
+		return []dns.RR{}, dns.RcodeNameError, ""
+	}
+	// resolved records the outcome of a resolved query in the query log entry, blocked lookups are answered
+	// in the block mode of the access profile or role
+	resolved := func(resp []dns.RR, session *constants.DNSSession) ([]dns.RR, int, string) {
+		entry.Rcode = dns.RcodeSuccess
+		entry.ReasonCode = session.ReasonCode
+		entry.Category = session.Category
+		entry.BlockedBy = session.BlockedBy
+		entry.DNSSEC = session.DNSSEC
+		if session.ReasonCode != constants.AccessAllowed {
+			mode, ttl := s.blockResponse(ses, session.ReasonCode)
+			entry.BlockMode = db.BlockModes[mode]
+			resp, entry.Rcode = blockedAnswer(name, qtype, resp, mode, ttl)
+			return resp, entry.Rcode, ""
 		}
+		return resp, dns.RcodeSuccess, session.DNSSEC
+	}
+
+	// cached answers the query from the session, negative answers have no records
+	cached := func(cache *constants.DNSSession, source string) ([]dns.RR, int, string) {
+		entry.Source = source
+		cache.Hits++
+		if cache.Rcode != dns.RcodeSuccess {
+			s.db.UpdateDNSSession(cache)
+			entry.Rcode = cache.Rcode
+			entry.DNSSEC = cache.DNSSEC
+			return []dns.RR{}, cache.Rcode, cache.DNSSEC
+		}
+		return resolved(s.processResponse(name, qtype, nil, cache, ses, if_ip, cache.IsLocal, cache.DNSSEC, cache.SafeSearch))
 	}
 
-	in, _, err := c.Exchange(m1, address)
-	if in != nil {
-		return in.Answer, err
-	}
-	return nil, err
-}
-
-func (s *DnsServer) processDnsQuery(name string, qtype uint16, source string, if_ip string) ([]dns.RR, int) {
-	arr := make([]dns.RR, 0)
+	// lookups of search engines and video sites are rewritten to their safe-search targets for the access profile
+	safesearch := s.safeSearchTarget(name, ses.AccessProfile)
 
-	ses, _ := s.security.GetSessionInfo(source)
-	if ses.Reevaluate {
-		s.ReevaluateAccess(source)
-	}
 	cache, err := s.queryCache(source, name, qtype)
 	if err == nil && cache != nil {
-		if time.Until(cache.DNSExpiry) > 0 {
+		// sessions resolved before the access profile changed safe search are resolved again
+		if time.Until(cache.DNSExpiry) > 0 && cache.SafeSearch == safesearch {
+			metrics.DNSCacheLookups.WithLabelValues("hit").Inc()
 			logQueryResult(source, name, qtype, "resolved from cache")
-			return s.processResponse(name, qtype, nil, cache, ses, if_ip, cache.IsLocal), dns.RcodeSuccess
+			if s.shouldPrefetch(cache) {
+				go s.prefetch(*cache, ses, if_ip)
+			}
+			return cached(cache, db.QuerySourceCache)
 		}
 	}
 
-	arr, err = s.queryLocal(name, qtype, source, if_ip)
-	if err == nil {
+	metrics.DNSCacheLookups.WithLabelValues("miss").Inc()
+
+	arr, err := s.queryLocal(name, qtype, source, if_ip, ses.Role)
+	switch {
+	case err == nil:
 		logQueryResult(source, name, qtype, "resolved as local address")
 		//return arr, dns.RcodeSuccess
-		return s.processResponse(name, qtype, &arr, cache, ses, if_ip, true), dns.RcodeSuccess
+		entry.Source = db.QuerySourceLocal
+		return resolved(s.processResponse(name, qtype, &arr, cache, ses, if_ip, true, "", ""))
+	case errors.Is(err, errLocalNoData):
+		logQueryResult(source, name, qtype, "has no local record of this type")
+		entry.Source = db.QuerySourceLocal
+		entry.Rcode = dns.RcodeSuccess
+		return []dns.RR{}, dns.RcodeSuccess, ""
+	case errors.Is(err, errLocalNXDomain):
+		logQueryResult(source, name, qtype, "does not exist locally")
+		entry.Source = db.QuerySourceLocal
+		return []dns.RR{}, dns.RcodeNameError, ""
 	}
 
 	/*arr, err = queryBlacklist(name, qtype)
@@ -360,34 +374,87 @@ func (s *DnsServer) processDnsQuery(name string, qtype uint16, source string, if
 		return arr, dns.RcodeNameError
 	}*/
 
-	arr, err = s.queryUpstream(name, qtype, source, if_ip, ses.DNS)
-	if err == nil {
-		logQueryResult(source, name, qtype, "resolved via upstream")
-		return s.processResponse(name, qtype, &arr, cache, ses, if_ip, false), dns.RcodeSuccess
+	config := ses.DNS
+	lookup := name
+	via := "upstream"
+	if safesearch != "" {
+		lookup = safesearch
+		via = "upstream as " + safesearch
+	}
+	entry.Source = db.QuerySourceUpstream
+	forwarder := s.matchForwarder(lookup, ses.Role)
+	if forwarder != nil {
+		// split-horizon domains are resolved by their forwarder only
+		config = forwarderConfiguration(forwarder)
+		via = "forwarder for " + forwarder.Domain
+		entry.Source = db.QuerySourceForwarder
+	}
+
+	arr, dnssec, err := s.queryUpstream(lookup, qtype, source, if_ip, config)
+	entry.DNSSEC = dnssec
+	var negative *negativeAnswer
+	switch {
+	case err == nil:
+		// internal names of conditional forwarders may resolve within the network
+		stripped := false
+		if forwarder == nil {
+			arr, stripped = s.stripRebinding(lookup, arr)
+		}
+		logQueryResult(source, name, qtype, "resolved via "+via)
+		resp, rcode, status := resolved(s.processResponse(name, qtype, &arr, cache, ses, if_ip, false, dnssec, safesearch))
+		if stripped && entry.ReasonCode == constants.AccessAllowed {
+			entry.ReasonCode = constants.AccessBlockedRebinding
+		}
+		return resp, rcode, status
+	case errors.As(err, &negative):
+		logQueryResult(source, name, qtype, "resolved via "+via+": "+negative.Error())
+		s.cacheNegative(name, qtype, cache, ses, if_ip, negative, safesearch)
+		entry.Rcode = negative.Rcode
+		return []dns.RR{}, negative.Rcode, dnssec
+	case errors.Is(err, errBogus):
+		// bogus answers are never served, not even from the stale cache
+		logQueryResult(source, name, qtype, "failed DNSSEC validation via "+via)
+		entry.Rcode = dns.RcodeServerFailure
+		return []dns.RR{}, dns.RcodeServerFailure, dnssec
+	case s.serveStale(cache):
+		logQueryResult(source, name, qtype, "resolved from stale cache")
+		return cached(cache, db.QuerySourceStale)
 	}
 
 	logQueryResult(source, name, qtype, "did not resolve")
-	return []dns.RR{}, dns.RcodeNameError
+	entry.Source = db.QuerySourceNone
+	return []dns.RR{}, dns.RcodeNameError, ""
 }
 
 func (s *DnsServer) handleDnsRequest(w dns.ResponseWriter, r *dns.Msg) {
-	m := new(dns.Msg)
-	m.SetReply(r)
-	m.Compress = false
-
-	switch r.Opcode {
-	case dns.OpcodeQuery:
-		if w.RemoteAddr() != nil {
-			remoteIP := strings.Split(w.RemoteAddr().String(), ":")[0]
-			var localIP string
-			if val, ok := lastDstIP.Load(remoteIP); ok {
-				localIP = val.(string)
-			} else {
-				localIP = w.RemoteAddr().String()
-			}
-			s.parseQuery(w.RemoteAddr(), localIP, m)
+	var localIP string
+	if w.RemoteAddr() != nil {
+		remoteIP := hostIP(w.RemoteAddr().String())
+		if val, ok := lastDstIP.Load(remoteIP); ok {
+			localIP = val.(string)
+		} else {
+			localIP = w.RemoteAddr().String()
+		}
+	}
+	m := s.reply(r, w.RemoteAddr(), localIP)
+	if m == nil {
+		w.Close()
+		return
+	}
+	if s.settings != nil && w.RemoteAddr() != nil && len(r.Question) > 0 {
+		// identical responses beyond the limit are dropped or truncated so that they cannot be amplified
+		allowed, slip := s.limiter.allowResponse(hostIP(w.RemoteAddr().String()), strings.ToLower(r.Question[0].Name), r.Question[0].Qtype, m.Rcode, s.settings.Snapshot().RateLimit)
+		if !allowed && !slip {
+			w.Close()
+			return
+		}
+		if !allowed {
+			m.Answer, m.Ns, m.Extra = nil, nil, nil
+			m.Truncated = true
 		}
 	}
+	// answers exceeding the buffer of the client are truncated with TC=1, the client retries over TCP
+	m.Truncate(udpSize(r))
 
 	err := w.WriteMsg(m)
 	if err != nil {
@@ -398,17 +465,28 @@ func (s *DnsServer) handleDnsRequest(w dns.ResponseWriter, r *dns.Msg) {
 
 func InitDnsServer(fw firewall.FirewallManager, db *db.Db, security *security.Security, network *network.Network, settings *db.Settings) *DnsServer {
 	s := &DnsServer{
-		fw:       fw,
-		db:       db,
-		security: security,
-		settings: settings,
-		network:  network,
-	}
+		fw:              fw,
+		db:              db,
+		security:        security,
+		settings:        settings,
+		network:         network,
+		upstreams:       newUpstreamPool(),
+		answers:         newAnswerCache(),
+		validator:       newValidator(),
+		limiter:         newRateLimiter(),
+		forwarders:      newForwarderCache(),
+		safesearch:      newSafeSearchCache(),
+		bypassEndpoints: newBypassCache(),
+	}
+	s.transport = newUpstreamTransport(s.fallbackAddress)
 	GetConfig().ReadConfig()
 	GetConfig().Print()
 
 	initLogging()
-	GetUpstreamCache().Init()
+	if db != nil {
+		s.querylog = newQueryLogger(db, settings)
+		go s.probeUpstreams()
+	}
 	updateLocalRecords()
 	//updateBlacklistRecords()
 	updateWhitelistRecords()
@@ -428,6 +506,16 @@ func (s DnsServer) Start() {
 		panic(err)
 	}
 
+	tcpListener, err := net.Listen("tcp4", ":53")
+	if err != nil {
+		log.Printf("Failed to start TCP listener: %s\n", err)
+	} else {
+		go func() {
+			defer tcpListener.Close()
+			log.Printf("TCP listener exited: %v\n", s.serveStream(tcpListener))
+		}()
+	}
+
 	pc, err := newPktinfoConn(udpConn) // net.ListenPacket("udp", ":53")
 
 	if err != nil {
@@ -450,9 +538,13 @@ func (s *DnsServer) ReevaluateAccess(clientIP string) {
 		allrules := s.db.GetDNSSessionsForClient(clientIP)
 		for i := range allrules {
 			//if allrules[i].ReasonCode == 0 {
-			newReason := security.VerifyDomainAccess(ses, &allrules[i])
+			newReason := s.verifyAccess(ses, &allrules[i])
 			if newReason != allrules[i].ReasonCode {
-				if s.fw.IsActive() && allrules[i].DNSResponse.A != nil {
+				if s.fw.IsActive() && allrules[i].DNSResponse.AAAA != nil && allrules[i].DNSResponse.AAAA.AllocatedIP != "" {
+					rule := allrules[i]
+					s.fw.UpdateIPv6(&rule, newReason)
+				}
+				if s.fw.IsActive() && allrules[i].DNSResponse.A != nil && allrules[i].DNSResponse.A.AllocatedIP != "" {
 					s.fw.UpdateIPv4(&allrules[i], newReason)
 				}
 				allrules[i].ReasonCode = newReason
@@ -524,10 +616,7 @@ func (p *pktinfoConn) ReadFrom(b []byte) (int, net.Addr, error) {
 	}
 
 	if cm != nil && cm.Dst != nil {
-		host, _, err := net.SplitHostPort(raddr.String())
-		if err == nil {
-			lastDstIP.Store(host, cm.Dst.String()) // thread-safe
-		}
+		lastDstIP.Store(hostIP(raddr.String()), cm.Dst.String()) // thread-safe
 	}
 
 	return n, raddr, nil
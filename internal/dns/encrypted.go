@@ -0,0 +1,121 @@
+package dns
+
+import (
+	"crypto/tls"
+	"encoding/base64"
+	"io"
+	"log"
+	"mime"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+const (
+	// DoTPort is the port of the DNS over TLS listener (RFC 7858)
+	DoTPort = 853
+	// dohContentType is the media type of DNS over HTTPS requests and responses (RFC 8484)
+	dohContentType = "application/dns-message"
+	dohMaxSize     = dns.MaxMsgSize
+)
+
+// hostIP returns the IP address of a host:port address
+func hostIP(addr string) string {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return addr
+	}
+	if ip := net.ParseIP(host); ip != nil && ip.To4() != nil {
+		return ip.To4().String()
+	}
+	return host
+}
+
+// StartTLS serves DNS over TLS on port 853 with certificates of the TLS configuration
+func (s *DnsServer) StartTLS(config *tls.Config) {
+	log.Printf("Starting DNS over TLS on port %d\n", DoTPort)
+	ln, err := tls.Listen("tcp", ":"+strconv.Itoa(DoTPort), config)
+	if err != nil {
+		log.Printf("Failed to start DNS over TLS: %s\n", err)
+		return
+	}
+	defer ln.Close()
+	log.Printf("DNS over TLS exited: %v\n", s.serveStream(ln))
+}
+
+// ServeDoH answers DNS over HTTPS requests (RFC 8484) with the query in the dns parameter of a GET request
+// or in the body of a POST request
+func (s *DnsServer) ServeDoH(w http.ResponseWriter, r *http.Request) {
+	var data []byte
+	var err error
+	switch r.Method {
+	case http.MethodGet:
+		param := r.URL.Query().Get("dns")
+		if param == "" {
+			http.Error(w, "missing dns parameter", http.StatusBadRequest)
+			return
+		}
+		data, err = base64.RawURLEncoding.DecodeString(strings.TrimRight(param, "="))
+	case http.MethodPost:
+		if mt, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type")); mt != dohContentType {
+			http.Error(w, "unsupported content type", http.StatusUnsupportedMediaType)
+			return
+		}
+		data, err = io.ReadAll(io.LimitReader(r.Body, dohMaxSize+1))
+		if err == nil && len(data) > dohMaxSize {
+			http.Error(w, "message too large", http.StatusRequestEntityTooLarge)
+			return
+		}
+	default:
+		w.Header().Set("Allow", "GET, POST")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if err != nil {
+		http.Error(w, "invalid dns message", http.StatusBadRequest)
+		return
+	}
+	req := new(dns.Msg)
+	if err := req.Unpack(data); err != nil {
+		http.Error(w, "invalid dns message", http.StatusBadRequest)
+		return
+	}
+
+	// the client is identified by the address of the connection, forwarding headers are not trusted
+	ip := net.ParseIP(hostIP(r.RemoteAddr))
+	if ip == nil {
+		http.Error(w, "invalid remote address", http.StatusBadRequest)
+		return
+	}
+	source := &net.TCPAddr{IP: ip}
+	interfaceAddress := ""
+	if local, ok := r.Context().Value(http.LocalAddrContextKey).(net.Addr); ok {
+		interfaceAddress = hostIP(local.String())
+	}
+
+	m := s.reply(req, source, interfaceAddress)
+	if m == nil {
+		http.Error(w, "too many queries", http.StatusTooManyRequests)
+		return
+	}
+	out, err := m.Pack()
+	if err != nil {
+		log.Print(err)
+		http.Error(w, "could not pack response", http.StatusInternalServerError)
+		return
+	}
+	// the response may be cached for the lowest TTL of its records
+	if len(m.Answer) > 0 {
+		ttl := m.Answer[0].Header().Ttl
+		for _, rr := range m.Answer[1:] {
+			ttl = min(ttl, rr.Header().Ttl)
+		}
+		w.Header().Set("Cache-Control", "max-age="+strconv.FormatUint(uint64(ttl), 10))
+	}
+	w.Header().Set("Content-Type", dohContentType)
+	w.Header().Set("Content-Length", strconv.Itoa(len(out)))
+	w.Write(out)
+}
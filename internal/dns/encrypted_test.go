@@ -0,0 +1,91 @@
+package dns
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func dohQuery(t *testing.T, name string) []byte {
+	q := new(dns.Msg)
+	q.SetQuestion(name, dns.TypeA)
+	q.Id = 0
+	data, err := q.Pack()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+func dohAnswer(t *testing.T, res *http.Response) *dns.Msg {
+	checkTestInt(t, http.StatusOK, res.StatusCode)
+	checkTestString(t, dohContentType, res.Header.Get("Content-Type"))
+	body, _ := io.ReadAll(res.Body)
+	m := new(dns.Msg)
+	if err := m.Unpack(body); err != nil {
+		t.Fatal(err)
+	}
+	return m
+}
+
+// dohRequest sets the client and the interface address of the portal on the request
+func dohRequest(req *http.Request) *http.Request {
+	req.RemoteAddr = "127.0.0.1:50000"
+	return req.WithContext(context.WithValue(req.Context(), http.LocalAddrContextKey, &net.TCPAddr{IP: net.IPv4(192, 168, 1, 1), Port: 443}))
+}
+
+func TestServeDoHGet(t *testing.T) {
+	d := newTestServer(t)
+	req := httptest.NewRequest(http.MethodGet, "/dns-query?dns="+base64.RawURLEncoding.EncodeToString(dohQuery(t, "session.local.")), nil)
+	rec := httptest.NewRecorder()
+	d.ServeDoH(rec, dohRequest(req))
+	m := dohAnswer(t, rec.Result())
+	checkTestInt(t, dns.RcodeSuccess, m.Rcode)
+	checkTestInt(t, 1, len(m.Answer))
+	checkTestString(t, "192.168.1.1", m.Answer[0].(*dns.A).A.String())
+}
+
+func TestServeDoHPost(t *testing.T) {
+	d := newTestServer(t)
+	req := httptest.NewRequest(http.MethodPost, "/dns-query", bytes.NewReader(dohQuery(t, "session.local.")))
+	req.Header.Set("Content-Type", dohContentType)
+	rec := httptest.NewRecorder()
+	d.ServeDoH(rec, dohRequest(req))
+	m := dohAnswer(t, rec.Result())
+	checkTestInt(t, dns.RcodeSuccess, m.Rcode)
+	checkTestInt(t, 1, len(m.Answer))
+	checkTestString(t, "192.168.1.1", m.Answer[0].(*dns.A).A.String())
+
+	req = httptest.NewRequest(http.MethodPost, "/dns-query", bytes.NewReader(dohQuery(t, "unknown.local.")))
+	req.Header.Set("Content-Type", dohContentType)
+	rec = httptest.NewRecorder()
+	d.ServeDoH(rec, dohRequest(req))
+	checkTestInt(t, dns.RcodeNameError, dohAnswer(t, rec.Result()).Rcode)
+}
+
+func TestServeDoHInvalid(t *testing.T) {
+	d := newTestServer(t)
+	req := httptest.NewRequest(http.MethodPost, "/dns-query", bytes.NewReader(dohQuery(t, "service1.local.")))
+	req.Header.Set("Content-Type", "text/plain")
+	rec := httptest.NewRecorder()
+	d.ServeDoH(rec, req)
+	checkTestInt(t, http.StatusUnsupportedMediaType, rec.Code)
+
+	req = httptest.NewRequest(http.MethodGet, "/dns-query?dns=AAAA", nil)
+	rec = httptest.NewRecorder()
+	d.ServeDoH(rec, req)
+	checkTestInt(t, http.StatusBadRequest, rec.Code)
+}
+
+func TestHostIP(t *testing.T) {
+	checkTestString(t, "192.168.1.10", hostIP("192.168.1.10:853"))
+	checkTestString(t, "192.168.1.10", hostIP("[::ffff:192.168.1.10]:853"))
+	checkTestString(t, "2001:db8::10", hostIP("[2001:db8::10]:443"))
+}
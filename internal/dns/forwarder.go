@@ -0,0 +1,62 @@
+package dns
+
+import (
+	"sleuth/internal/db"
+	"slices"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+func newForwarderCache() *reloadCache[db.DNSForwarder] {
+	return &reloadCache[db.DNSForwarder]{}
+}
+
+// dnsForwarders returns the conditional forwarders in memory
+func (s *DnsServer) dnsForwarders() []db.DNSForwarder {
+	return s.forwarders.get(s.db.GetDNSForwarders)
+}
+
+// ReloadForwarders drops the conditional forwarders in memory after they were edited
+func (s *DnsServer) ReloadForwarders() {
+	s.forwarders.reload()
+}
+
+// matchForwarder returns the conditional forwarder in memory that resolves the name for clients of the role
+func (s *DnsServer) matchForwarder(name string, role string) *db.DNSForwarder {
+	if s.db == nil {
+		return nil
+	}
+	return matchForwarder(name, role, s.dnsForwarders())
+}
+
+// matchForwarder returns the enabled forwarder of the role with the longest domain containing the name,
+// forwarders scoped to the role are preferred over global forwarders of the same domain
+func matchForwarder(name string, role string, forwarders []db.DNSForwarder) *db.DNSForwarder {
+	var match *db.DNSForwarder
+	labels := 0
+	for i := range forwarders {
+		f := &forwarders[i]
+		if !f.Enabled || len(f.Upstreams) == 0 || (len(f.Roles) > 0 && !slices.Contains(f.Roles, role)) {
+			continue
+		}
+		domain := dns.Fqdn(strings.ToLower(f.Domain))
+		if !dns.IsSubDomain(domain, name) {
+			continue
+		}
+		count := dns.CountLabel(domain)
+		if match == nil || count > labels || count == labels && len(match.Roles) == 0 && len(f.Roles) > 0 {
+			match = f
+			labels = count
+		}
+	}
+	return match
+}
+
+// forwarderConfiguration returns the DNS configuration that resolves via the upstreams of the forwarder
+func forwarderConfiguration(f *db.DNSForwarder) *db.DNSConfiguration {
+	return &db.DNSConfiguration{
+		Name:      "forwarder " + f.Domain,
+		Upstreams: f.Upstreams,
+	}
+}
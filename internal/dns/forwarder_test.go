@@ -0,0 +1,57 @@
+package dns
+
+import (
+	"errors"
+	"sleuth/internal/db"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func TestMatchForwarder(t *testing.T) {
+	upstreams := []db.DNSUpstream{{Address: "192.168.10.1"}}
+	forwarders := []db.DNSForwarder{
+		{ForwarderId: "corp", Domain: "corp.example.com", Upstreams: upstreams, Enabled: true},
+		{ForwarderId: "lab", Domain: "lab.corp.example.com.", Upstreams: upstreams, Enabled: true},
+		{ForwarderId: "staff", Domain: "hr.corp.example.com", Upstreams: upstreams, Roles: []string{"staff"}, Enabled: true},
+		{ForwarderId: "off", Domain: "old.corp.example.com", Upstreams: upstreams, Enabled: false},
+		{ForwarderId: "reverse", Domain: "168.192.in-addr.arpa", Upstreams: upstreams, Enabled: true},
+	}
+	id := func(f *db.DNSForwarder) string {
+		if f == nil {
+			return ""
+		}
+		return f.ForwarderId
+	}
+	checkTestString(t, "corp", id(matchForwarder("www.corp.example.com.", "guest", forwarders)))
+	checkTestString(t, "lab", id(matchForwarder("host.lab.corp.example.com.", "guest", forwarders)))
+	checkTestString(t, "corp", id(matchForwarder("payroll.hr.corp.example.com.", "guest", forwarders)))
+	checkTestString(t, "staff", id(matchForwarder("payroll.hr.corp.example.com.", "staff", forwarders)))
+	checkTestString(t, "corp", id(matchForwarder("old.corp.example.com.", "guest", forwarders)))
+	checkTestString(t, "", id(matchForwarder("notcorp.example.com.", "guest", forwarders)))
+	checkTestString(t, "reverse", id(matchForwarder("20.1.168.192.in-addr.arpa.", "guest", forwarders)))
+
+	// forwarders of the role win over global forwarders of the same domain in either order
+	scoped := []db.DNSForwarder{
+		{ForwarderId: "staff", Domain: "corp.example.com", Upstreams: upstreams, Roles: []string{"staff"}, Enabled: true},
+		{ForwarderId: "global", Domain: "corp.example.com", Upstreams: upstreams, Enabled: true},
+	}
+	checkTestString(t, "staff", id(matchForwarder("www.corp.example.com.", "staff", scoped)))
+	checkTestString(t, "global", id(matchForwarder("www.corp.example.com.", "guest", scoped)))
+	scoped[0], scoped[1] = scoped[1], scoped[0]
+	checkTestString(t, "staff", id(matchForwarder("www.corp.example.com.", "staff", scoped)))
+}
+
+func TestQueryReverseForwarder(t *testing.T) {
+	d := newTestServer(t)
+	_, err := d.queryLocal("20.1.168.192.in-addr.arpa.", dns.TypePTR, "127.0.0.1", "127.0.0.1", "test")
+	checkTestBool(t, true, errors.Is(err, errLocalNXDomain))
+
+	// private reverse zones with a conditional forwarder are resolved by the forwarder
+	d.db.CreateDNSForwarder(&db.DNSForwarder{Domain: "168.192.in-addr.arpa", Upstreams: []db.DNSUpstream{{Address: "192.168.10.1"}}, Enabled: true})
+	d.ReloadForwarders()
+	_, err = d.queryLocal("20.1.168.192.in-addr.arpa.", dns.TypePTR, "127.0.0.1", "127.0.0.1", "test")
+	checkTestBool(t, true, errors.Is(err, errNotLocal))
+	_, err = d.queryLocal("20.0.0.10.in-addr.arpa.", dns.TypePTR, "127.0.0.1", "127.0.0.1", "test")
+	checkTestBool(t, true, errors.Is(err, errLocalNXDomain))
+}
@@ -0,0 +1,263 @@
+package dns
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"sleuth/internal/db"
+	"sleuth/internal/network"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+const (
+	// localTTL is the TTL of device addresses, they are re-evaluated for every session
+	localTTL = 1
+	// localRecordTTL is the TTL of static records without one and of the SOA and NS records
+	localRecordTTL = 300
+)
+
+// LocalRecordTypes are the types of the static records of the local domain
+var LocalRecordTypes = []string{"CNAME", "MX", "SRV", "TXT"}
+
+var (
+	errNotLocal      = errors.New("Not within local domain")
+	errLocalNXDomain = errors.New("Name does not exist in local domain")
+	errLocalNoData   = errors.New("No record of the requested type in local domain")
+)
+
+// localZone returns the fully qualified local domain, or an empty string when none is configured
+func (s *DnsServer) localZone() string {
+	if s.settings == nil {
+		return ""
+	}
+	domain := strings.Trim(strings.ToLower(s.settings.Snapshot().LocalDomain), ".")
+	if domain == "" {
+		return ""
+	}
+	return dns.Fqdn(domain)
+}
+
+// localSOA returns the start of authority of the local domain, the minimum TTL is used by clients to
+// cache negative answers
+func localSOA(zone string) *dns.SOA {
+	return &dns.SOA{
+		Hdr:     dns.RR_Header{Name: zone, Rrtype: dns.TypeSOA, Class: dns.ClassINET, Ttl: localRecordTTL},
+		Ns:      "ns." + zone,
+		Mbox:    "hostmaster." + zone,
+		Serial:  uint32(time.Now().Unix()),
+		Refresh: 3600,
+		Retry:   600,
+		Expire:  86400,
+		Minttl:  localRecordTTL,
+	}
+}
+
+// LocalRecordRR parses a static record of the local domain, relative names in the value are within the zone
+func LocalRecordRR(record db.DNSRecord, zone string) (dns.RR, error) {
+	if !slices.Contains(LocalRecordTypes, strings.ToUpper(record.Type)) {
+		return nil, fmt.Errorf("unsupported record type %q", record.Type)
+	}
+	if record.Name == "" || strings.ContainsAny(record.Name, " \t") {
+		return nil, fmt.Errorf("invalid name %q", record.Name)
+	}
+	ttl := record.TTL
+	if ttl == 0 {
+		ttl = localRecordTTL
+	}
+	zp := dns.NewZoneParser(strings.NewReader(fmt.Sprintf("%s %d IN %s %s", record.Name, ttl, strings.ToUpper(record.Type), record.Value)), zone, "")
+	rr, ok := zp.Next()
+	if err := zp.Err(); err != nil {
+		return nil, err
+	}
+	if !ok {
+		return nil, fmt.Errorf("invalid %s record %q", record.Type, record.Value)
+	}
+	return rr, nil
+}
+
+// addressRecord returns the A or AAAA record of the address
+func addressRecord(name string, ip net.IP) dns.RR {
+	if ip4 := ip.To4(); ip4 != nil {
+		return &dns.A{Hdr: dns.RR_Header{Name: name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: localTTL}, A: ip4}
+	}
+	return &dns.AAAA{Hdr: dns.RR_Header{Name: name, Rrtype: dns.TypeAAAA, Class: dns.ClassINET, Ttl: localTTL}, AAAA: ip}
+}
+
+// localRecords returns all records of a host of the local domain, @ is the domain itself
+func (s *DnsServer) localRecords(name string, hostname string, zone string, if_ip string) []dns.RR {
+	rrs := make([]dns.RR, 0)
+	switch hostname {
+	case "@":
+		rrs = append(rrs, localSOA(zone), &dns.NS{
+			Hdr: dns.RR_Header{Name: name, Rrtype: dns.TypeNS, Class: dns.ClassINET, Ttl: localRecordTTL},
+			Ns:  "ns." + zone,
+		})
+	case "session", "ns":
+		if ip := net.ParseIP(if_ip); ip != nil {
+			rrs = append(rrs, addressRecord(name, ip))
+		}
+		if ipv6, err := network.GetInterfaceIPv6(if_ip); err == nil && net.ParseIP(ipv6) != nil {
+			rrs = append(rrs, addressRecord(name, net.ParseIP(ipv6)))
+		}
+	}
+
+	for _, device := range s.db.GetDevices() {
+		if device.DNSName != "" && strings.EqualFold(device.DNSName, hostname) {
+			for _, node := range s.network.FindAllByMac(device.MACAddress) {
+				if node.Ip != nil {
+					rrs = append(rrs, addressRecord(name, node.Ip))
+				}
+			}
+		}
+	}
+
+	for _, record := range s.db.GetDNSRecords() {
+		if strings.EqualFold(record.Name, hostname) {
+			rr, err := LocalRecordRR(record, zone)
+			if err != nil {
+				log.Println(err)
+				continue
+			}
+			rr.Header().Name = name
+			rrs = append(rrs, rr)
+		}
+	}
+	return rrs
+}
+
+// queryLocal answers names of the local domain and reverse lookups of device addresses, unknown names of the
+// local domain and of private reverse zones are not forwarded upstream
+func (s *DnsServer) queryLocal(name string, qtype uint16, source string, if_ip string, role string) ([]dns.RR, error) {
+	if s.db == nil {
+		return nil, errors.New("Db access required to query local")
+	}
+	if s.network == nil {
+		return nil, errors.New("Network access required to query local")
+	}
+	zone := s.localZone()
+	if zone == "" {
+		return nil, errors.New("Local domain not specified")
+	}
+
+	if strings.HasSuffix(name, ".in-addr.arpa.") || strings.HasSuffix(name, ".ip6.arpa.") {
+		return s.queryReverse(name, qtype, zone, role)
+	}
+
+	// single label names are resolved within the local domain but are forwarded when unknown
+	single := false
+	hostname := ""
+	switch {
+	case name == zone:
+		hostname = "@"
+	case dns.IsSubDomain(zone, name):
+		hostname = strings.TrimSuffix(name, "."+zone)
+	case dns.CountLabel(name) == 1:
+		hostname = strings.TrimSuffix(name, ".")
+		single = true
+	default:
+		return nil, errNotLocal
+	}
+
+	rrs := s.localRecords(name, hostname, zone, if_ip)
+	if len(rrs) == 0 {
+		if single {
+			return nil, errNotLocal
+		}
+		return nil, errLocalNXDomain
+	}
+
+	answer := make([]dns.RR, 0)
+	for _, rr := range rrs {
+		if rr.Header().Rrtype == qtype || qtype == dns.TypeANY {
+			answer = append(answer, rr)
+		}
+	}
+	if len(answer) == 0 {
+		// an alias answers every type, its target is followed within the local domain
+		for _, rr := range rrs {
+			if cname, ok := rr.(*dns.CNAME); ok {
+				answer = append(answer, cname)
+				if target := cname.Target; dns.IsSubDomain(zone, target) && target != zone && target != name {
+					for _, trr := range s.localRecords(target, strings.TrimSuffix(target, "."+zone), zone, if_ip) {
+						if trr.Header().Rrtype == qtype {
+							answer = append(answer, trr)
+						}
+					}
+				}
+			}
+		}
+	}
+	if len(answer) == 0 {
+		return nil, errLocalNoData
+	}
+	return answer, nil
+}
+
+// reverseAddress returns the address of an in-addr.arpa or ip6.arpa name
+func reverseAddress(name string) net.IP {
+	labels := dns.SplitDomainName(name)
+	if len(labels) == 6 && strings.HasSuffix(name, ".in-addr.arpa.") {
+		octets := slices.Clone(labels[:4])
+		slices.Reverse(octets)
+		return net.ParseIP(strings.Join(octets, ".")).To4()
+	}
+	if len(labels) == 34 && strings.HasSuffix(name, ".ip6.arpa.") {
+		nibbles := slices.Clone(labels[:32])
+		slices.Reverse(nibbles)
+		ip := make(net.IP, net.IPv6len)
+		for i, nibble := range nibbles {
+			v, err := strconv.ParseUint(nibble, 16, 4)
+			if err != nil {
+				return nil
+			}
+			ip[i/2] |= byte(v) << (4 * (1 - i%2))
+		}
+		return ip
+	}
+	return nil
+}
+
+// queryReverse answers PTR queries for the addresses of devices with a DNS or host name, unknown private addresses
+// are resolved by the conditional forwarder of their reverse zone if the role has one
+func (s *DnsServer) queryReverse(name string, qtype uint16, zone string, role string) ([]dns.RR, error) {
+	ip := reverseAddress(name)
+	if ip == nil {
+		return nil, errNotLocal
+	}
+	answer := make([]dns.RR, 0)
+	for _, device := range s.db.GetDevices() {
+		// devices without a DNS name are known by the host name they announced
+		host := device.DNSName
+		if host == "" {
+			host = strings.ReplaceAll(device.HostName, " ", "-")
+		}
+		ptr := strings.ToLower(host) + "." + zone
+		if _, ok := dns.IsDomainName(ptr); host == "" || !ok {
+			continue
+		}
+		for _, node := range s.network.FindAllByMac(device.MACAddress) {
+			if node.Ip.Equal(ip) {
+				answer = append(answer, &dns.PTR{
+					Hdr: dns.RR_Header{Name: name, Rrtype: dns.TypePTR, Class: dns.ClassINET, Ttl: localRecordTTL},
+					Ptr: ptr,
+				})
+			}
+		}
+	}
+	switch {
+	case len(answer) > 0 && qtype == dns.TypePTR:
+		return answer, nil
+	case len(answer) > 0:
+		return nil, errLocalNoData
+	case (ip.IsPrivate() || ip.IsLinkLocalUnicast()) && s.matchForwarder(name, role) == nil:
+		// reverse lookups of private addresses do not leave the network (RFC 6303)
+		return nil, errLocalNXDomain
+	}
+	return nil, errNotLocal
+}
@@ -0,0 +1,76 @@
+package dns
+
+import (
+	"errors"
+	"net"
+	"sleuth/internal/db"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func TestReverseAddress(t *testing.T) {
+	checkTestString(t, "192.168.1.20", reverseAddress("20.1.168.192.in-addr.arpa.").String())
+	name, _ := dns.ReverseAddr("fd00::1:2")
+	checkTestString(t, "fd00::1:2", reverseAddress(name).String())
+	checkTestBool(t, true, reverseAddress("1.168.192.in-addr.arpa.") == nil)
+}
+
+func TestLocalRecordRR(t *testing.T) {
+	rr, err := LocalRecordRR(db.DNSRecord{Name: "_ipp._tcp", Type: "SRV", Value: "0 5 631 printer"}, "home.")
+	checkTestBool(t, true, err == nil)
+	checkTestString(t, "printer.home.", rr.(*dns.SRV).Target)
+	checkTestString(t, "_ipp._tcp.home.", rr.Header().Name)
+
+	_, err = LocalRecordRR(db.DNSRecord{Name: "www", Type: "A", Value: "10.0.0.1"}, "home.")
+	checkTestBool(t, false, err == nil)
+	_, err = LocalRecordRR(db.DNSRecord{Name: "mail", Type: "MX", Value: "mailhost"}, "home.")
+	checkTestBool(t, false, err == nil)
+}
+
+func TestQueryLocal(t *testing.T) {
+	d := newTestServer(t)
+	d.db.CreateDNSRecord(&db.DNSRecord{Name: "www", Type: "CNAME", Value: "web"})
+	d.db.CreateDNSRecord(&db.DNSRecord{Name: "web", Type: "TXT", Value: "hello"})
+
+	_, err := d.queryLocal("unknown.local.", dns.TypeA, "127.0.0.1", "", "test")
+	checkTestBool(t, true, errors.Is(err, errLocalNXDomain))
+	_, err = d.queryLocal("web.local.", dns.TypeMX, "127.0.0.1", "", "test")
+	checkTestBool(t, true, errors.Is(err, errLocalNoData))
+	// unknown single label names are forwarded
+	_, err = d.queryLocal("unknown.", dns.TypeA, "127.0.0.1", "", "test")
+	checkTestBool(t, true, errors.Is(err, errNotLocal))
+
+	// the alias is followed within the local domain
+	res, err := d.queryLocal("www.local.", dns.TypeTXT, "127.0.0.1", "", "test")
+	checkTestBool(t, true, err == nil)
+	checkTestInt(t, 2, len(res))
+	checkTestString(t, "web.local.", res[0].(*dns.CNAME).Target)
+	checkTestString(t, "web.local.", res[1].Header().Name)
+	checkTestString(t, "hello", res[1].(*dns.TXT).Txt[0])
+}
+
+func TestLocalNegativeAuthority(t *testing.T) {
+	d := newTestServer(t)
+	d.db.CreateDNSRecord(&db.DNSRecord{Name: "web", Type: "TXT", Value: "hello"})
+
+	// negative answers carry the SOA of the local domain in the authority section
+	for _, test := range []struct {
+		name  string
+		rcode int
+	}{
+		{"unknown.local.", dns.RcodeNameError},
+		{"web.local.", dns.RcodeSuccess},
+	} {
+		q := new(dns.Msg)
+		q.SetQuestion(test.name, dns.TypeMX)
+		m := d.reply(q, &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)}, "127.0.0.1")
+		checkTestInt(t, test.rcode, m.Rcode)
+		checkTestInt(t, 0, len(m.Answer))
+		checkTestInt(t, 1, len(m.Ns))
+		soa, ok := m.Ns[0].(*dns.SOA)
+		checkTestBool(t, true, ok)
+		checkTestString(t, "local.", soa.Hdr.Name)
+		checkTestInt(t, localRecordTTL, int(soa.Minttl))
+	}
+}
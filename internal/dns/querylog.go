@@ -0,0 +1,65 @@
+package dns
+
+import (
+	"log"
+	"sleuth/internal/db"
+	"time"
+)
+
+const (
+	queryLogBuffer   = 4096
+	queryLogBatch    = 256
+	queryLogInterval = time.Second
+)
+
+// queryLogger writes the query log in batches so that resolving a query does not wait for the database
+type queryLogger struct {
+	db       *db.Db
+	settings *db.Settings
+	entries  chan db.QueryLogEntry
+}
+
+func newQueryLogger(d *db.Db, settings *db.Settings) *queryLogger {
+	l := &queryLogger{
+		db:       d,
+		settings: settings,
+		entries:  make(chan db.QueryLogEntry, queryLogBuffer),
+	}
+	go l.run()
+	return l
+}
+
+// Log queues the entry, entries are dropped while the queue is full
+func (l *queryLogger) Log(entry db.QueryLogEntry) {
+	if l == nil || !l.settings.Snapshot().QueryLog.Enabled {
+		return
+	}
+	select {
+	case l.entries <- entry:
+	default:
+	}
+}
+
+func (l *queryLogger) run() {
+	ticker := time.NewTicker(queryLogInterval)
+	defer ticker.Stop()
+	batch := make([]db.QueryLogEntry, 0, queryLogBatch)
+	for {
+		select {
+		case entry := <-l.entries:
+			batch = append(batch, entry)
+			if len(batch) < queryLogBatch {
+				continue
+			}
+		case <-ticker.C:
+			if len(batch) == 0 {
+				continue
+			}
+		}
+		retention := time.Duration(l.settings.Snapshot().QueryLog.RetentionDays) * 24 * time.Hour
+		if err := l.db.AppendQueryLog(batch, retention); err != nil {
+			log.Printf("Could not write query log: %s\n", err)
+		}
+		batch = batch[:0]
+	}
+}
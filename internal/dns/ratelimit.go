@@ -0,0 +1,264 @@
+package dns
+
+import (
+	"fmt"
+	"net"
+	"sleuth/internal/db"
+	"sleuth/internal/metrics"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	// limiterIdle removes the state of clients, subnets and responses not seen for this long
+	limiterIdle = 10 * time.Minute
+	// a client dropping QuarantineDrops queries within quarantineWindow is quarantined
+	quarantineWindow = time.Minute
+)
+
+// tokenBucket allows bursts of its size and refills at its rate per second
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+func (b *tokenBucket) take(rate float64, burst float64, now time.Time) bool {
+	if b.last.IsZero() {
+		b.tokens = burst
+	} else {
+		b.tokens = min(burst, b.tokens+now.Sub(b.last).Seconds()*rate)
+	}
+	b.last = now
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// ThrottledClient is a client whose queries were dropped or that is quarantined
+type ThrottledClient struct {
+	IP               string
+	Queries          uint64
+	Dropped          uint64
+	QuarantinedUntil time.Time
+	LastSeen         time.Time
+}
+
+type clientLimit struct {
+	ThrottledClient
+	bucket      tokenBucket
+	window      time.Time
+	windowDrops int
+}
+
+type responseLimit struct {
+	bucket  tokenBucket
+	limited uint64
+}
+
+// rateLimiter limits the queries per client and per subnet with token buckets and the identical UDP
+// responses per subnet or private client (RRL), clients exceeding the limits repeatedly are quarantined
+type rateLimiter struct {
+	mu        sync.Mutex
+	clients   map[string]*clientLimit
+	subnets   map[string]*tokenBucket
+	responses map[string]*responseLimit
+	purged    time.Time
+}
+
+func newRateLimiter() *rateLimiter {
+	return &rateLimiter{
+		clients:   make(map[string]*clientLimit),
+		subnets:   make(map[string]*tokenBucket),
+		responses: make(map[string]*responseLimit),
+		purged:    time.Now(),
+	}
+}
+
+// subnet returns the /24 of an IPv4 address or the /64 of an IPv6 address
+func subnet(ip string) string {
+	addr := net.ParseIP(ip)
+	if addr == nil {
+		return ip
+	}
+	if ip4 := addr.To4(); ip4 != nil {
+		return ip4.Mask(net.CIDRMask(24, 32)).String() + "/24"
+	}
+	return addr.Mask(net.CIDRMask(64, 128)).String() + "/64"
+}
+
+// responseSource returns the address of clients on private networks, which share their subnet with the
+// other local hosts, and the subnet of other clients
+func responseSource(ip string) string {
+	if addr := net.ParseIP(ip); addr != nil && (addr.IsPrivate() || addr.IsLoopback()) {
+		return addr.String()
+	}
+	return subnet(ip)
+}
+
+// purge removes the state not seen for limiterIdle, quarantined clients are kept
+func (l *rateLimiter) purge(now time.Time) {
+	if now.Sub(l.purged) < time.Minute {
+		return
+	}
+	l.purged = now
+	for ip, c := range l.clients {
+		if now.Sub(c.LastSeen) > limiterIdle && now.After(c.QuarantinedUntil) {
+			delete(l.clients, ip)
+		}
+	}
+	for key, b := range l.subnets {
+		if now.Sub(b.last) > limiterIdle {
+			delete(l.subnets, key)
+		}
+	}
+	for key, r := range l.responses {
+		if now.Sub(r.bucket.last) > limiterIdle {
+			delete(l.responses, key)
+		}
+	}
+}
+
+// allow reports whether the query of the client is answered and whether its quarantine started or ended
+func (l *rateLimiter) allow(ip string, cfg db.RateLimitSettings) (bool, bool) {
+	if !cfg.Enabled || cfg.ClientQPS <= 0 {
+		return true, false
+	}
+	now := time.Now()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.purge(now)
+
+	c, ok := l.clients[ip]
+	if !ok {
+		c = &clientLimit{ThrottledClient: ThrottledClient{IP: ip}}
+		l.clients[ip] = c
+	}
+	c.Queries++
+	c.LastSeen = now
+	changed := false
+	if !c.QuarantinedUntil.IsZero() && now.After(c.QuarantinedUntil) {
+		c.QuarantinedUntil = time.Time{}
+		changed = true
+	}
+
+	allowed := c.bucket.take(float64(cfg.ClientQPS), float64(max(cfg.ClientBurst, cfg.ClientQPS)), now)
+	limit := "client"
+	if allowed && cfg.SubnetQPS > 0 {
+		b, ok := l.subnets[subnet(ip)]
+		if !ok {
+			b = &tokenBucket{}
+			l.subnets[subnet(ip)] = b
+		}
+		allowed = b.take(float64(cfg.SubnetQPS), float64(cfg.SubnetQPS), now)
+		limit = "subnet"
+	}
+	if allowed {
+		return true, changed
+	}
+
+	metrics.DNSRateLimited.WithLabelValues(limit).Inc()
+	c.Dropped++
+	if now.Sub(c.window) > quarantineWindow {
+		c.window = now
+		c.windowDrops = 0
+	}
+	c.windowDrops++
+	if cfg.QuarantineDrops > 0 && c.windowDrops >= cfg.QuarantineDrops && c.QuarantinedUntil.IsZero() {
+		c.QuarantinedUntil = now.Add(time.Duration(max(cfg.QuarantineMinutes, 1)) * time.Minute)
+		metrics.DNSRateLimited.WithLabelValues("quarantine").Inc()
+		changed = true
+	}
+	return false, changed
+}
+
+// allowResponse reports whether an identical response is sent to the client again, every
+// second limited response is truncated so that legitimate clients retry over TCP (slip)
+func (l *rateLimiter) allowResponse(ip string, name string, qtype uint16, rcode int, cfg db.RateLimitSettings) (bool, bool) {
+	if !cfg.Enabled || cfg.ResponseQPS <= 0 {
+		return true, false
+	}
+	key := fmt.Sprintf("%s|%s|%d|%d", responseSource(ip), name, qtype, rcode)
+	now := time.Now()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.purge(now)
+
+	r, ok := l.responses[key]
+	if !ok {
+		r = &responseLimit{}
+		l.responses[key] = r
+	}
+	if r.bucket.take(float64(cfg.ResponseQPS), float64(cfg.ResponseQPS), now) {
+		return true, false
+	}
+	r.limited++
+	metrics.DNSRateLimited.WithLabelValues("response").Inc()
+	return false, r.limited%2 == 0
+}
+
+func (l *rateLimiter) quarantined(ip string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	c, ok := l.clients[ip]
+	return ok && time.Now().Before(c.QuarantinedUntil)
+}
+
+// throttled returns the clients with dropped queries or a quarantine, the most dropped first
+func (l *rateLimiter) throttled() []ThrottledClient {
+	l.mu.Lock()
+	clients := make([]ThrottledClient, 0)
+	for _, c := range l.clients {
+		if c.Dropped > 0 || time.Now().Before(c.QuarantinedUntil) {
+			clients = append(clients, c.ThrottledClient)
+		}
+	}
+	l.mu.Unlock()
+
+	sort.Slice(clients, func(i, j int) bool {
+		if clients[i].Dropped == clients[j].Dropped {
+			return clients[i].IP < clients[j].IP
+		}
+		return clients[i].Dropped > clients[j].Dropped
+	})
+	return clients
+}
+
+// release lifts the quarantine of the client and refills its bucket
+func (l *rateLimiter) release(ip string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	c, ok := l.clients[ip]
+	if ok {
+		delete(l.clients, ip)
+	}
+	return ok && !c.QuarantinedUntil.IsZero()
+}
+
+// admit applies the rate limits to the query of the client, the access of the client is reevaluated
+// when its quarantine starts or ends
+func (s *DnsServer) admit(source net.Addr) bool {
+	if s.settings == nil || source == nil {
+		return true
+	}
+	ip := hostIP(source.String())
+	allowed, changed := s.limiter.allow(ip, s.settings.Snapshot().RateLimit)
+	if changed && s.security != nil {
+		go s.ReevaluateAccess(ip)
+	}
+	return allowed
+}
+
+// ThrottledClients returns the clients whose queries were dropped by the rate limits or that are quarantined
+func (s *DnsServer) ThrottledClients() []ThrottledClient {
+	return s.limiter.throttled()
+}
+
+// ReleaseClient lifts the quarantine and resets the rate limits of the client
+func (s *DnsServer) ReleaseClient(ip string) {
+	if s.limiter.release(ip) && s.security != nil {
+		s.ReevaluateAccess(ip)
+	}
+}
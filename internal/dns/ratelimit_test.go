@@ -0,0 +1,47 @@
+package dns
+
+import (
+	"sleuth/internal/db"
+	"testing"
+)
+
+func TestRateLimiterQuarantine(t *testing.T) {
+	l := newRateLimiter()
+	cfg := db.RateLimitSettings{Enabled: true, ClientQPS: 1, ClientBurst: 2, QuarantineDrops: 3, QuarantineMinutes: 1}
+	for range 2 {
+		allowed, _ := l.allow("10.0.0.5", cfg)
+		checkTestBool(t, true, allowed)
+	}
+	allowed, changed := l.allow("10.0.0.5", cfg)
+	checkTestBool(t, false, allowed)
+	checkTestBool(t, false, changed)
+	l.allow("10.0.0.5", cfg)
+	_, changed = l.allow("10.0.0.5", cfg)
+	checkTestBool(t, true, changed)
+	checkTestBool(t, true, l.quarantined("10.0.0.5"))
+	checkTestBool(t, false, l.quarantined("10.0.0.6"))
+	checkTestInt(t, 1, len(l.throttled()))
+
+	checkTestBool(t, true, l.release("10.0.0.5"))
+	checkTestBool(t, false, l.quarantined("10.0.0.5"))
+}
+
+func TestResponseRateLimit(t *testing.T) {
+	l := newRateLimiter()
+	cfg := db.RateLimitSettings{Enabled: true, ResponseQPS: 1}
+	allowed, _ := l.allowResponse("198.51.100.5", "example.com.", 1, 0, cfg)
+	checkTestBool(t, true, allowed)
+	allowed, slip := l.allowResponse("198.51.100.6", "example.com.", 1, 0, cfg)
+	checkTestBool(t, false, allowed)
+	checkTestBool(t, false, slip)
+	_, slip = l.allowResponse("198.51.100.7", "example.com.", 1, 0, cfg)
+	checkTestBool(t, true, slip)
+
+	// clients of private networks are limited by their address
+	allowed, _ = l.allowResponse("10.0.0.5", "example.com.", 1, 0, cfg)
+	checkTestBool(t, true, allowed)
+	allowed, _ = l.allowResponse("10.0.0.6", "example.com.", 1, 0, cfg)
+	checkTestBool(t, true, allowed)
+	allowed, _ = l.allowResponse("10.0.0.6", "example.com.", 1, 0, cfg)
+	checkTestBool(t, false, allowed)
+}
@@ -0,0 +1,100 @@
+package dns
+
+import (
+	"net"
+	"sleuth/internal/constants"
+	"sleuth/internal/db"
+	"sleuth/internal/security"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// rebindingAddress reports whether the address is within the network of the portal, answers pointing
+// there would forward the client into the LAN
+func rebindingAddress(ip net.IP) bool {
+	if ip.IsPrivate() || ip.IsLoopback() || ip.IsLinkLocalUnicast() || ip.IsUnspecified() {
+		return true
+	}
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return false
+	}
+	for _, addr := range addrs {
+		if ipnet, ok := addr.(*net.IPNet); ok && ipnet.IP.Equal(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// rebindingMode returns the protection mode for the upstream answers of the name, allowed domains
+// and their subdomains are not protected
+func (s *DnsServer) rebindingMode(name string) uint {
+	if s.settings == nil {
+		return uint(db.RebindingOff)
+	}
+	settings := s.settings.Snapshot().Rebinding
+	if settings.Mode == db.RebindingOff {
+		return uint(db.RebindingOff)
+	}
+	name = strings.TrimSuffix(strings.ToLower(name), ".")
+	for _, domain := range settings.AllowedDomains {
+		if name == domain || strings.HasSuffix(name, "."+domain) {
+			return uint(db.RebindingOff)
+		}
+	}
+	return uint(settings.Mode)
+}
+
+// stripRebinding removes the addresses within the network from the upstream answer
+func (s *DnsServer) stripRebinding(name string, arr []dns.RR) ([]dns.RR, bool) {
+	if s.rebindingMode(name) != db.RebindingStrip {
+		return arr, false
+	}
+	stripped := false
+	answer := make([]dns.RR, 0, len(arr))
+	for _, rr := range arr {
+		switch rr := rr.(type) {
+		case *dns.A:
+			if rebindingAddress(rr.A) {
+				stripped = true
+				continue
+			}
+		case *dns.AAAA:
+			if rebindingAddress(rr.AAAA) {
+				stripped = true
+				continue
+			}
+		}
+		answer = append(answer, rr)
+	}
+	return answer, stripped
+}
+
+// verifyAccess verifies the access to the domain of the session and the targets of its CNAME chain,
+// quarantined clients are blocked and upstream answers pointing into the network are blocked unless
+// resolved by a conditional forwarder
+func (s *DnsServer) verifyAccess(ses security.SessionInfo, cache *constants.DNSSession) uint16 {
+	cache.BlockedBy = ""
+	reason := security.VerifyDomainAccess(ses, cache)
+	if reason == constants.AccessAllowed {
+		reason = verifyChain(ses, cache)
+	}
+	if s.limiter.quarantined(ses.ClientIP) {
+		return constants.AccessBlockedQuarantined
+	}
+	if reason != constants.AccessAllowed || cache.IsLocal || s.rebindingMode(cache.Hostname) != db.RebindingBlock {
+		return reason
+	}
+	if s.matchForwarder(cache.Hostname, ses.Role) != nil {
+		return reason
+	}
+	if a := cache.DNSResponse.A; a != nil && rebindingAddress(net.ParseIP(a.IP)) {
+		return constants.AccessBlockedRebinding
+	}
+	if aaaa := cache.DNSResponse.AAAA; aaaa != nil && rebindingAddress(net.ParseIP(aaaa.IP)) {
+		return constants.AccessBlockedRebinding
+	}
+	return reason
+}
@@ -0,0 +1,27 @@
+package dns
+
+import (
+	"sleuth/internal/db"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func TestStripRebinding(t *testing.T) {
+	s := &DnsServer{settings: &db.Settings{Rebinding: db.RebindingSettings{
+		Mode:           db.RebindingStrip,
+		AllowedDomains: []string{"corp.example"},
+	}}}
+	arr := []dns.RR{
+		testRR(t, "evil.example. 60 IN A 192.168.1.1"),
+		testRR(t, "evil.example. 60 IN A 203.0.113.5"),
+		testRR(t, "evil.example. 60 IN AAAA ::1"),
+	}
+	answer, stripped := s.stripRebinding("evil.example.", arr)
+	checkTestBool(t, true, stripped)
+	checkTestInt(t, 1, len(answer))
+
+	// allowed domains and their subdomains may resolve within the network
+	_, stripped = s.stripRebinding("intranet.corp.example.", arr)
+	checkTestBool(t, false, stripped)
+}
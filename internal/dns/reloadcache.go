@@ -0,0 +1,43 @@
+package dns
+
+import "sync"
+
+// reloadCache keeps records of the database in memory for the queries, the admin handlers call reload after
+// an edit so that they are loaded again on the next query. A nil cache loads the records on every call.
+type reloadCache[T any] struct {
+	mu     sync.RWMutex
+	loaded bool
+	items  []T
+}
+
+// get returns the records in memory, loading them when needed
+func (c *reloadCache[T]) get(load func() []T) []T {
+	if c == nil {
+		return load()
+	}
+	c.mu.RLock()
+	if c.loaded {
+		defer c.mu.RUnlock()
+		return c.items
+	}
+	c.mu.RUnlock()
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !c.loaded {
+		c.items = load()
+		c.loaded = true
+	}
+	return c.items
+}
+
+// reload drops the records in memory
+func (c *reloadCache[T]) reload() {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.loaded = false
+	c.items = nil
+}
@@ -0,0 +1,97 @@
+package dns
+
+import (
+	"path"
+	"sleuth/internal/db"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+func newSafeSearchCache() *reloadCache[db.SafeSearchMapping] {
+	return &reloadCache[db.SafeSearchMapping]{}
+}
+
+// safeSearchMappings returns the safe-search mappings in memory
+func (s *DnsServer) safeSearchMappings() []db.SafeSearchMapping {
+	return s.safesearch.get(s.db.GetSafeSearchMappings)
+}
+
+// ReloadSafeSearchMappings drops the safe-search mappings in memory after they were edited
+func (s *DnsServer) ReloadSafeSearchMappings() {
+	s.safesearch.reload()
+}
+
+// safeSearchTarget returns the safe-search target of the name when the access profile enforces safe search,
+// empty otherwise
+func (s *DnsServer) safeSearchTarget(name string, profile *db.AccessProfile) string {
+	if s.db == nil || profile == nil || !profile.SafeSearch {
+		return ""
+	}
+	return matchSafeSearch(name, s.safeSearchMappings())
+}
+
+// matchLabels reports whether the name matches the domain pattern label by label, wildcards do not match
+// across labels
+func matchLabels(pattern string, name string) bool {
+	patterns := strings.Split(pattern, ".")
+	labels := strings.Split(name, ".")
+	if len(patterns) != len(labels) {
+		return false
+	}
+	for i := range patterns {
+		if ok, _ := path.Match(patterns[i], labels[i]); !ok {
+			return false
+		}
+	}
+	return true
+}
+
+// matchSafeSearch returns the fully qualified target of the enabled mapping with the longest domain matching
+// the name, exact domains are preferred over wildcards of the same length
+func matchSafeSearch(name string, mappings []db.SafeSearchMapping) string {
+	name = strings.TrimSuffix(strings.ToLower(name), ".")
+	target := ""
+	length := -1
+	for _, m := range mappings {
+		domain := strings.Trim(strings.ToLower(m.Domain), ".")
+		if !m.Enabled || domain == "" || m.Target == "" {
+			continue
+		}
+		if !matchLabels(domain, name) {
+			continue
+		}
+		l := len(domain) * 2
+		if !strings.Contains(domain, "*") {
+			l++
+		}
+		if l > length {
+			target = dns.Fqdn(strings.ToLower(m.Target))
+			length = l
+		}
+	}
+	// the target itself is resolved as is
+	if dns.Fqdn(name) == target {
+		return ""
+	}
+	return target
+}
+
+// safeSearchAnswer answers the name with a CNAME to the safe-search target followed by the records of the target
+func safeSearchAnswer(name string, target string, arr []dns.RR) []dns.RR {
+	ttl := uint32(300)
+	for _, rr := range arr {
+		ttl = min(ttl, rr.Header().Ttl)
+	}
+	answer := make([]dns.RR, 0, len(arr)+1)
+	answer = append(answer, &dns.CNAME{
+		Hdr: dns.RR_Header{
+			Name:   dns.Fqdn(name),
+			Rrtype: dns.TypeCNAME,
+			Class:  dns.ClassINET,
+			Ttl:    ttl,
+		},
+		Target: target,
+	})
+	return append(answer, arr...)
+}
@@ -0,0 +1,50 @@
+package dns
+
+import (
+	"sleuth/internal/db"
+	"sleuth/internal/security"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func TestMatchSafeSearch(t *testing.T) {
+	mappings := []db.SafeSearchMapping{
+		{Domain: "www.google.*", Target: "forcesafesearch.google.com", Enabled: true},
+		{Domain: "www.youtube.com", Target: "restrictmoderate.youtube.com", Enabled: true},
+		{Domain: "www.youtube.*", Target: "restrict.youtube.com", Enabled: true},
+		{Domain: "www.bing.com", Target: "strict.bing.com", Enabled: false},
+	}
+	checkTestString(t, "forcesafesearch.google.com.", matchSafeSearch("WWW.Google.de.", mappings))
+	// wildcards match a single label
+	checkTestString(t, "", matchSafeSearch("www.google.co.za.", mappings))
+	checkTestString(t, "", matchSafeSearch("www.youtube.evil.example.", mappings))
+	// exact domains are preferred over wildcards
+	checkTestString(t, "restrictmoderate.youtube.com.", matchSafeSearch("www.youtube.com.", mappings))
+	checkTestString(t, "", matchSafeSearch("www.bing.com.", mappings))
+	checkTestString(t, "", matchSafeSearch("mail.google.com.", mappings))
+
+	answer := safeSearchAnswer("www.google.com.", "forcesafesearch.google.com.", []dns.RR{
+		testRR(t, "forcesafesearch.google.com. 60 IN A 216.239.38.120"),
+	})
+	checkTestInt(t, 2, len(answer))
+	checkTestString(t, "www.google.com.\t60\tIN\tCNAME\tforcesafesearch.google.com.", answer[0].String())
+}
+
+func TestSafeSearchTarget(t *testing.T) {
+	s := newTestServer(t)
+	profile := &db.AccessProfile{SafeSearch: true}
+	s.db.CreateSafeSearchMapping(&db.SafeSearchMapping{Domain: "www.bing.com", Target: "strict.bing.com", Enabled: true})
+	checkTestString(t, "strict.bing.com.", s.safeSearchTarget("www.bing.com.", profile))
+
+	// the mappings in memory are replaced after an edit
+	s.db.CreateSafeSearchMapping(&db.SafeSearchMapping{Domain: "bing.com", Target: "strict.bing.com", Enabled: true})
+	checkTestString(t, "", s.safeSearchTarget("bing.com.", profile))
+	s.ReloadSafeSearchMappings()
+	checkTestString(t, "strict.bing.com.", s.safeSearchTarget("bing.com.", profile))
+
+	// negative answers keep the target they were resolved for
+	ses := security.SessionInfo{ClientIP: "10.0.0.5"}
+	s.cacheNegative("www.bing.com.", dns.TypeA, nil, ses, "", &negativeAnswer{Rcode: dns.RcodeNameError, TTL: 60}, "strict.bing.com.")
+	checkTestString(t, "strict.bing.com.", s.db.GetDNSSession("10.0.0.5", "www.bing.com.", dns.TypeA).SafeSearch)
+}
@@ -0,0 +1,132 @@
+package dns
+
+import (
+	"fmt"
+	"sleuth/internal/constants"
+	"sleuth/internal/security"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+const (
+	// maxNegativeTTL caps the caching of NXDOMAIN and NODATA answers (RFC 2308)
+	maxNegativeTTL = 3600
+	// a session answering prefetchHits queries is refreshed in the last tenth of its TTL
+	prefetchHits   = 5
+	prefetchMinTTL = 10
+)
+
+// prefetching holds the sessions that are being refreshed
+var prefetching sync.Map
+
+// negativeAnswer is returned by queryUpstream for NXDOMAIN and NODATA answers, answers without a SOA have
+// no TTL and are not cached
+type negativeAnswer struct {
+	Rcode  int
+	TTL    uint32
+	DNSSEC string
+}
+
+func (n *negativeAnswer) Error() string {
+	if n.Rcode == dns.RcodeNameError {
+		return "name does not exist"
+	}
+	return fmt.Sprintf("no record of the requested type (%s)", dns.RcodeToString[n.Rcode])
+}
+
+// negativeTTL returns the lower of the TTL and the minimum of the SOA in the authority section
+func negativeTTL(m *dns.Msg) uint32 {
+	for _, rr := range m.Ns {
+		if soa, ok := rr.(*dns.SOA); ok {
+			return min(soa.Hdr.Ttl, soa.Minttl, maxNegativeTTL)
+		}
+	}
+	return 0
+}
+
+// cacheNegative stores the negative answer in the session of the client with the safe-search target it was
+// resolved for
+func (s *DnsServer) cacheNegative(name string, qtype uint16, cache *constants.DNSSession, ses security.SessionInfo, if_ip string, negative *negativeAnswer, safesearch string) {
+	if s.db == nil || negative.TTL == 0 {
+		return
+	}
+	cached := cache != nil
+	if !cached {
+		cache = &constants.DNSSession{
+			Since:       time.Now(),
+			ClientIP:    ses.ClientIP,
+			InterfaceIP: if_ip,
+			Hostname:    name,
+			QType:       qtype,
+			LastEvent:   time.Now(),
+			ReasonCode:  ses.RejectReason,
+		}
+	}
+	cache.DNSResponse = constants.DNSResponse{
+		Raw: make([]string, 0),
+	}
+	cache.Rcode = negative.Rcode
+	cache.TTL = negative.TTL
+	cache.DNSSEC = negative.DNSSEC
+	cache.SafeSearch = safesearch
+	cache.Hits = 0
+	cache.DNSExpiry = time.Now().Add(time.Duration(negative.TTL) * time.Second)
+	cache.SessionExpiry = time.Now().Add(time.Duration(330) * time.Second)
+
+	if cached {
+		s.db.UpdateDNSSession(cache)
+	} else {
+		s.db.CreateDNSSession(cache)
+	}
+}
+
+// serveStale reports whether the expired session may answer while the upstreams fail (RFC 8767)
+func (s *DnsServer) serveStale(cache *constants.DNSSession) bool {
+	if cache == nil || cache.IsLocal || s.settings == nil {
+		return false
+	}
+	settings := s.settings.Snapshot().Cache
+	return settings.ServeStale && time.Since(cache.DNSExpiry) < time.Duration(settings.StaleHours)*time.Hour
+}
+
+// shouldPrefetch reports whether the session is queried frequently and is about to expire
+func (s *DnsServer) shouldPrefetch(cache *constants.DNSSession) bool {
+	if cache.IsLocal || s.settings == nil || !s.settings.Snapshot().Cache.Prefetch {
+		return false
+	}
+	if cache.TTL < prefetchMinTTL || cache.Hits < prefetchHits {
+		return false
+	}
+	return time.Until(cache.DNSExpiry) < time.Duration(cache.TTL)*time.Second/10
+}
+
+// prefetch refreshes the session from the upstream of the client in the background
+func (s *DnsServer) prefetch(cache constants.DNSSession, ses security.SessionInfo, if_ip string) {
+	key := fmt.Sprintf("%s:%d:%s", cache.ClientIP, cache.QType, cache.Hostname)
+	if _, running := prefetching.LoadOrStore(key, true); running {
+		return
+	}
+	defer prefetching.Delete(key)
+
+	config := ses.DNS
+	lookup := cache.Hostname
+	if cache.SafeSearch != "" {
+		lookup = cache.SafeSearch
+	}
+	forwarder := s.matchForwarder(lookup, ses.Role)
+	if forwarder != nil {
+		config = forwarderConfiguration(forwarder)
+	}
+	arr, dnssec, err := s.resolveUpstream(lookup, cache.QType, config, true)
+	if err == nil && forwarder == nil {
+		arr, _ = s.stripRebinding(lookup, arr)
+	}
+	if negative, ok := err.(*negativeAnswer); ok {
+		s.cacheNegative(cache.Hostname, cache.QType, &cache, ses, if_ip, negative, cache.SafeSearch)
+	} else if err == nil {
+		s.processResponse(cache.Hostname, cache.QType, &arr, &cache, ses, if_ip, false, dnssec, cache.SafeSearch)
+		logQueryResult(cache.ClientIP, cache.Hostname, cache.QType, "prefetched via upstream")
+	}
+}
@@ -0,0 +1,150 @@
+package dns
+
+import (
+	"net"
+	"sleuth/internal/constants"
+	"sleuth/internal/db"
+	"sleuth/internal/security"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+func TestNegativeTTL(t *testing.T) {
+	m := new(dns.Msg)
+	m.SetQuestion("nonexistentrecord.virtualzone.de.", dns.TypeA)
+	checkTestInt(t, 0, int(negativeTTL(m)))
+
+	m.Ns = append(m.Ns, &dns.SOA{Hdr: dns.RR_Header{Name: "virtualzone.de.", Rrtype: dns.TypeSOA, Ttl: 600}, Minttl: 300})
+	checkTestInt(t, 300, int(negativeTTL(m)))
+	m.Ns[0].(*dns.SOA).Minttl = 86400
+	checkTestInt(t, 600, int(negativeTTL(m)))
+	m.Ns[0].Header().Ttl = 86400
+	checkTestInt(t, maxNegativeTTL, int(negativeTTL(m)))
+}
+
+// testUpstream serves the queries of the handler on a local UDP port and returns its address
+func testUpstream(t *testing.T, handler dns.HandlerFunc) string {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	started := make(chan struct{})
+	server := &dns.Server{PacketConn: pc, Handler: handler, NotifyStartedFunc: func() { close(started) }}
+	go server.ActivateAndServe()
+	<-started
+	t.Cleanup(func() { server.Shutdown() })
+	return pc.LocalAddr().String()
+}
+
+// useUpstream resolves the queries of the test role with the upstream
+func useUpstream(t *testing.T, s *DnsServer, address string) {
+	role := s.db.GetRole("test")
+	role.DNSOverride = true
+	role.DNSMode = db.ModeUDP
+	role.DNSAddress = address
+	if err := s.db.UpdateRole(role); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestServeStale(t *testing.T) {
+	s := newTestServer(t)
+	useUpstream(t, s, testUpstream(t, func(w dns.ResponseWriter, r *dns.Msg) {
+		m := new(dns.Msg)
+		w.WriteMsg(m.SetRcode(r, dns.RcodeServerFailure))
+	}))
+	session := func(expired time.Duration) {
+		s.db.DeleteDNSSession(&constants.DNSSession{ClientIP: "10.0.0.5", Hostname: "stale.example.", QType: dns.TypeA})
+		s.db.CreateDNSSession(&constants.DNSSession{
+			ClientIP:      "10.0.0.5",
+			Hostname:      "stale.example.",
+			QType:         dns.TypeA,
+			TTL:           300,
+			DNSExpiry:     time.Now().Add(-expired),
+			SessionExpiry: time.Now().Add(-expired),
+			DNSResponse: constants.DNSResponse{
+				A: &constants.DNS_IP_Record{Name: "stale.example.", TTL: 300, Class: "IN", IP: "93.184.216.34"},
+			},
+		})
+	}
+
+	session(time.Minute)
+	_, rcode, _ := s.answerQuery("stale.example.", dns.TypeA, "10.0.0.5", "10.0.0.1")
+	checkTestInt(t, dns.RcodeNameError, rcode)
+
+	// expired answers are served for the stale hours while the upstreams fail
+	s.settings.Cache = db.CacheSettings{ServeStale: true, StaleHours: 1}
+	res, rcode, _ := s.answerQuery("stale.example.", dns.TypeA, "10.0.0.5", "10.0.0.1")
+	checkTestInt(t, dns.RcodeSuccess, rcode)
+	checkTestInt(t, 1, len(res))
+	checkTestBool(t, true, time.Until(s.db.GetDNSSession("10.0.0.5", "stale.example.", dns.TypeA).SessionExpiry) > 0)
+
+	session(2 * time.Hour)
+	_, rcode, _ = s.answerQuery("stale.example.", dns.TypeA, "10.0.0.5", "10.0.0.1")
+	checkTestInt(t, dns.RcodeNameError, rcode)
+}
+
+func TestCacheNegative(t *testing.T) {
+	s := newTestServer(t)
+	ses := security.SessionInfo{ClientIP: "10.0.0.5"}
+
+	// negative answers without a SOA have no TTL and are not cached
+	s.cacheNegative("none.example.", dns.TypeA, nil, ses, "", &negativeAnswer{Rcode: dns.RcodeNameError}, "")
+	checkTestBool(t, true, s.db.GetDNSSession("10.0.0.5", "none.example.", dns.TypeA) == nil)
+
+	s.cacheNegative("none.example.", dns.TypeA, nil, ses, "", &negativeAnswer{Rcode: dns.RcodeNameError, TTL: 60}, "")
+	cache := s.db.GetDNSSession("10.0.0.5", "none.example.", dns.TypeA)
+	checkTestInt(t, dns.RcodeNameError, cache.Rcode)
+	checkTestBool(t, true, time.Until(cache.DNSExpiry) > 50*time.Second && time.Until(cache.DNSExpiry) <= time.Minute)
+
+	// the negative answer replaces the records of the session and is answered from the cache
+	cache.DNSResponse.A = &constants.DNS_IP_Record{IP: "93.184.216.34"}
+	s.db.UpdateDNSSession(cache)
+	s.cacheNegative("none.example.", dns.TypeA, cache, ses, "", &negativeAnswer{Rcode: dns.RcodeSuccess, TTL: 30}, "")
+	cache = s.db.GetDNSSession("10.0.0.5", "none.example.", dns.TypeA)
+	checkTestBool(t, true, cache.DNSResponse.A == nil)
+	res, rcode, _ := s.answerQuery("none.example.", dns.TypeA, "10.0.0.5", "10.0.0.1")
+	checkTestInt(t, dns.RcodeSuccess, rcode)
+	checkTestInt(t, 0, len(res))
+	checkTestInt(t, 1, int(s.db.GetDNSSession("10.0.0.5", "none.example.", dns.TypeA).Hits))
+}
+
+func TestPrefetch(t *testing.T) {
+	s := newTestServer(t)
+	upstream := testUpstream(t, func(w dns.ResponseWriter, r *dns.Msg) {
+		m := new(dns.Msg)
+		m.SetReply(r)
+		m.Answer = append(m.Answer, testRR(t, r.Question[0].Name+" 300 IN A 10.1.2.3"))
+		w.WriteMsg(m)
+	})
+	cache := &constants.DNSSession{
+		ClientIP:      "10.0.0.5",
+		Hostname:      "busy.example.",
+		QType:         dns.TypeA,
+		TTL:           300,
+		Hits:          prefetchHits,
+		DNSExpiry:     time.Now().Add(10 * time.Second),
+		SessionExpiry: time.Now().Add(time.Minute),
+		DNSResponse: constants.DNSResponse{
+			A: &constants.DNS_IP_Record{Name: "busy.example.", TTL: 300, Class: "IN", IP: "93.184.216.34"},
+		},
+	}
+	checkTestBool(t, false, s.shouldPrefetch(cache))
+	s.settings.Cache.Prefetch = true
+	checkTestBool(t, true, s.shouldPrefetch(cache))
+
+	// sessions queried rarely, with a short TTL or outside the last tenth of their TTL are not prefetched
+	checkTestBool(t, false, s.shouldPrefetch(&constants.DNSSession{TTL: 300, Hits: prefetchHits - 1, DNSExpiry: cache.DNSExpiry}))
+	checkTestBool(t, false, s.shouldPrefetch(&constants.DNSSession{TTL: prefetchMinTTL - 1, Hits: prefetchHits, DNSExpiry: time.Now()}))
+	checkTestBool(t, false, s.shouldPrefetch(&constants.DNSSession{TTL: 300, Hits: prefetchHits, DNSExpiry: time.Now().Add(time.Minute)}))
+
+	s.db.CreateDNSSession(cache)
+	ses := security.SessionInfo{ClientIP: "10.0.0.5", DNS: &db.DNSConfiguration{Type: db.ModeUDP, Address: upstream}}
+	s.prefetch(*cache, ses, "10.0.0.1")
+	refreshed := s.db.GetDNSSession("10.0.0.5", "busy.example.", dns.TypeA)
+	checkTestString(t, "10.1.2.3", refreshed.DNSResponse.A.IP)
+	checkTestInt(t, 0, int(refreshed.Hits))
+	checkTestBool(t, true, time.Until(refreshed.DNSExpiry) > time.Minute)
+}
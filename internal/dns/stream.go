@@ -0,0 +1,136 @@
+package dns
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+const (
+	// ednsUDPSize is the UDP payload size advertised to EDNS0 clients, it avoids IP fragmentation
+	ednsUDPSize = 1232
+	// tcpIdleTimeout closes TCP and TLS connections without queries (RFC 7766)
+	tcpIdleTimeout = 10 * time.Second
+	// tcpMaxInflight limits the pipelined queries of a connection that are resolved concurrently
+	tcpMaxInflight = 16
+)
+
+// reply resolves the questions of the request, the response carries an OPT record when the request does,
+// queries beyond the rate limits of the client have no response
+func (s *DnsServer) reply(r *dns.Msg, source net.Addr, interfaceAddress string) *dns.Msg {
+	if !s.admit(source) {
+		return nil
+	}
+	m := new(dns.Msg)
+	m.SetReply(r)
+	m.Compress = false
+
+	do := false
+	if opt := r.IsEdns0(); opt != nil {
+		do = opt.Do()
+		m.SetEdns0(ednsUDPSize, do)
+		if opt.Version() != 0 {
+			m.Rcode = dns.RcodeBadVers
+			return m
+		}
+	}
+
+	switch r.Opcode {
+	case dns.OpcodeQuery:
+		if source != nil {
+			// validated answers are flagged for clients that asked for DNSSEC (RFC 6840 section 5.8)
+			secure := s.parseQuery(source, interfaceAddress, m)
+			m.AuthenticatedData = secure && (do || r.AuthenticatedData)
+		}
+	}
+	return m
+}
+
+// udpSize returns the largest UDP response the client accepts
+func udpSize(r *dns.Msg) int {
+	if opt := r.IsEdns0(); opt != nil {
+		return int(min(max(opt.UDPSize(), dns.MinMsgSize), ednsUDPSize))
+	}
+	return dns.MinMsgSize
+}
+
+// serveStream answers queries on the connections of a TCP or TLS listener
+func (s *DnsServer) serveStream(ln net.Listener) error {
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			var ne net.Error
+			if errors.As(err, &ne) && ne.Timeout() {
+				continue
+			}
+			return err
+		}
+		go s.serveConn(conn)
+	}
+}
+
+// serveConn reads length prefixed queries until the client closes the connection or stays idle, pipelined
+// queries are resolved concurrently and answered in the order they complete
+func (s *DnsServer) serveConn(conn net.Conn) {
+	defer conn.Close()
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	inflight := make(chan struct{}, tcpMaxInflight)
+	source := conn.RemoteAddr()
+	interfaceAddress := hostIP(conn.LocalAddr().String())
+	reader := bufio.NewReader(conn)
+
+	for {
+		conn.SetReadDeadline(time.Now().Add(tcpIdleTimeout))
+		var length uint16
+		if err := binary.Read(reader, binary.BigEndian, &length); err != nil {
+			break
+		}
+		data := make([]byte, length)
+		if _, err := io.ReadFull(reader, data); err != nil {
+			break
+		}
+		req := new(dns.Msg)
+		if err := req.Unpack(data); err != nil {
+			break
+		}
+
+		inflight <- struct{}{}
+		wg.Add(1)
+		go func() {
+			defer func() {
+				<-inflight
+				wg.Done()
+			}()
+			m := s.reply(req, source, interfaceAddress)
+			if m == nil {
+				return
+			}
+			m.Truncate(dns.MaxMsgSize)
+			out, err := m.Pack()
+			if err != nil {
+				log.Print(err)
+				return
+			}
+			frame := make([]byte, 2+len(out))
+			binary.BigEndian.PutUint16(frame, uint16(len(out)))
+			copy(frame[2:], out)
+
+			mu.Lock()
+			defer mu.Unlock()
+			conn.SetWriteDeadline(time.Now().Add(tcpIdleTimeout))
+			if _, err := conn.Write(frame); err != nil {
+				log.Print(err)
+			}
+		}()
+	}
+	// answer the queries that are still being resolved before closing
+	wg.Wait()
+}
@@ -0,0 +1,73 @@
+package dns
+
+import (
+	"encoding/binary"
+	"io"
+	"net"
+	"sleuth/internal/db"
+	"sleuth/internal/firewall"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+func TestUdpSize(t *testing.T) {
+	q := new(dns.Msg)
+	q.SetQuestion("service1.local.", dns.TypeA)
+	checkTestInt(t, dns.MinMsgSize, udpSize(q))
+	q.SetEdns0(4096, false)
+	checkTestInt(t, ednsUDPSize, udpSize(q))
+	q.IsEdns0().SetUDPSize(100)
+	checkTestInt(t, dns.MinMsgSize, udpSize(q))
+}
+
+func TestReplyEdnsVersion(t *testing.T) {
+	d := InitDnsServer(firewall.LoadFirewallManager(), nil, nil, nil, &db.Settings{FallbackDNS: "1.1.1.1"})
+	q := new(dns.Msg)
+	q.SetQuestion("service1.local.", dns.TypeA)
+	q.SetEdns0(4096, false)
+	q.IsEdns0().SetVersion(1)
+	m := d.reply(q, &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)}, "127.0.0.1")
+	checkTestInt(t, dns.RcodeBadVers, m.Rcode)
+	checkTestBool(t, true, m.IsEdns0() != nil)
+}
+
+func TestServeConnPipelining(t *testing.T) {
+	d := newTestServer(t)
+	// the pipe has no interface address, the record answers without one
+	d.db.CreateDNSRecord(&db.DNSRecord{Name: "service1", Type: "TXT", Value: "pipelined"})
+	client, server := net.Pipe()
+	defer client.Close()
+	go d.serveConn(server)
+
+	// send both queries before reading an answer
+	for i := range 2 {
+		q := new(dns.Msg)
+		q.SetQuestion("service1.local.", dns.TypeTXT)
+		q.Id = uint16(i + 1)
+		data, _ := q.Pack()
+		frame := binary.BigEndian.AppendUint16(nil, uint16(len(data)))
+		go client.Write(append(frame, data...))
+	}
+
+	ids := make(map[uint16]bool)
+	client.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for range 2 {
+		var length uint16
+		if err := binary.Read(client, binary.BigEndian, &length); err != nil {
+			t.Fatal(err)
+		}
+		data := make([]byte, length)
+		if _, err := io.ReadFull(client, data); err != nil {
+			t.Fatal(err)
+		}
+		m := new(dns.Msg)
+		if err := m.Unpack(data); err != nil {
+			t.Fatal(err)
+		}
+		checkTestInt(t, 1, len(m.Answer))
+		ids[m.Id] = true
+	}
+	checkTestBool(t, true, ids[1] && ids[2])
+}
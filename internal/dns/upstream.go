@@ -7,18 +7,6 @@ import (
 )
 
 func queryUpstream(name string, qtype uint16) ([]dns.RR, error) {
-	// Check cache first
-	/*res, err := GetUpstreamCache().Get(name, qtype)
-	if err == nil {
-		// Record found in cache
-		log.Printf("query for %s %s resolved via upstream via upstream cache\n", getQueryTypeText(qtype), name)
-		if len(res) == 0 {
-			return nil, errors.New("record not found via upstream DNS server")
-		}
-		return res, nil
-	}*/
-
-	// If not cached, perform actual upstream query
 	m1 := new(dns.Msg)
 	m1.Id = dns.Id()
 	m1.RecursionDesired = true
@@ -40,7 +28,6 @@ func queryUpstream(name string, qtype uint16) ([]dns.RR, error) {
 				return in.Ns, nil
 			}
 
-			GetUpstreamCache().Set(name, qtype, in.Answer)
 			return in.Answer, nil
 		}
 	}
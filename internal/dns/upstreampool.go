@@ -0,0 +1,355 @@
+package dns
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"sleuth/internal/db"
+	"sleuth/internal/metrics"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+const (
+	upstreamTimeout = 2 * time.Second
+	// an upstream failing circuitFailures times in a row is skipped for circuitCooldown
+	circuitFailures = 3
+	circuitCooldown = 30 * time.Second
+	probeInterval   = 30 * time.Second
+)
+
+// UpstreamStat holds the health and the statistics of an upstream
+type UpstreamStat struct {
+	db.DNSUpstream
+	Healthy bool
+	Queries uint64
+	Errors  uint64
+	// Latency is the moving average of the response time
+	Latency     time.Duration
+	LastError   string
+	LastChecked time.Time
+}
+
+type upstreamState struct {
+	stat      UpstreamStat
+	failures  int
+	openUntil time.Time
+}
+
+// upstreamPool tracks the upstreams of all DNS configurations
+type upstreamPool struct {
+	mu     sync.Mutex
+	states map[string]*upstreamState
+	// next round-robin position by configuration
+	next map[string]int
+}
+
+func newUpstreamPool() *upstreamPool {
+	return &upstreamPool{
+		states: make(map[string]*upstreamState),
+		next:   make(map[string]int),
+	}
+}
+
+// UpstreamKey identifies the upstream in the statistics
+func UpstreamKey(u db.DNSUpstream) string {
+	return fmt.Sprintf("%d/%s", u.Type, u.Address)
+}
+
+func (p *upstreamPool) state(u db.DNSUpstream) *upstreamState {
+	key := UpstreamKey(u)
+	st, ok := p.states[key]
+	if !ok {
+		st = &upstreamState{stat: UpstreamStat{DNSUpstream: u, Healthy: true}}
+		p.states[key] = st
+	}
+	return st
+}
+
+// order returns the upstreams in the order they are tried, upstreams with an open circuit come last
+func (p *upstreamPool) order(config string, strategy uint, upstreams []db.DNSUpstream) []db.DNSUpstream {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	ordered := slices.Clone(upstreams)
+	switch strategy {
+	case db.StrategyRoundRobin:
+		n := p.next[config] % len(ordered)
+		p.next[config] = n + 1
+		ordered = append(ordered[n:], ordered[:n]...)
+	case db.StrategyFastest:
+		// upstreams without a measurement are tried first so that they get one
+		slices.SortStableFunc(ordered, func(a, b db.DNSUpstream) int {
+			return int(p.state(a).stat.Latency - p.state(b).stat.Latency)
+		})
+	}
+
+	now := time.Now()
+	available := make([]db.DNSUpstream, 0, len(ordered))
+	open := make([]db.DNSUpstream, 0)
+	for _, u := range ordered {
+		if p.state(u).openUntil.After(now) {
+			open = append(open, u)
+		} else {
+			available = append(available, u)
+		}
+	}
+	return append(available, open...)
+}
+
+// record updates the statistics and the circuit of the upstream with the result of a query, health
+// probes are not counted as queries
+func (p *upstreamPool) record(u db.DNSUpstream, rtt time.Duration, err error, probe bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	st := p.state(u)
+	if !probe {
+		st.stat.Queries++
+	}
+	st.stat.LastChecked = time.Now()
+	if err != nil {
+		if !probe {
+			st.stat.Errors++
+		}
+		st.stat.LastError = err.Error()
+		st.failures++
+		if st.failures >= circuitFailures {
+			st.stat.Healthy = false
+			st.openUntil = time.Now().Add(circuitCooldown)
+		}
+		return
+	}
+	st.failures = 0
+	st.openUntil = time.Time{}
+	st.stat.Healthy = true
+	if st.stat.Latency == 0 {
+		st.stat.Latency = rtt
+	} else {
+		st.stat.Latency = (st.stat.Latency*4 + rtt) / 5
+	}
+}
+
+// Stats returns the statistics of the upstreams by UpstreamKey
+func (p *upstreamPool) Stats() map[string]UpstreamStat {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	stats := make(map[string]UpstreamStat, len(p.states))
+	for key, st := range p.states {
+		stats[key] = st.stat
+	}
+	return stats
+}
+
+// fallbackAddress returns the address of the fallback DNS server, it also resolves the host names of
+// TCP and TLS upstreams
+func (s *DnsServer) fallbackAddress() string {
+	address := s.settings.Snapshot().FallbackDNS
+	if address == "" || net.ParseIP(address) == nil {
+		address = "1.1.1.1"
+	}
+	return upstreamAddress(address, "53")
+}
+
+// upstreamAddress adds the default port to the address when it has none
+func upstreamAddress(address string, port string) string {
+	if _, _, err := net.SplitHostPort(address); err == nil {
+		return address
+	}
+	return net.JoinHostPort(strings.Trim(address, "[]"), port)
+}
+
+// exchange sends the query to the upstream, the device name is prepended to the host name of TCP, TLS and
+// QUIC upstreams and added to the URL path of HTTPS upstreams
+func (s *DnsServer) exchange(m *dns.Msg, u db.DNSUpstream, deviceName string) (*dns.Msg, time.Duration, error) {
+	if u.Type == db.ModeHTTPS {
+		address, err := dohURL(u.Address, deviceName)
+		if err != nil {
+			return nil, 0, err
+		}
+		start := time.Now()
+		r, err := s.transport.exchangeHTTPS(m, address)
+		return r, time.Since(start), err
+	}
+
+	address := u.Address
+	if deviceName != "" && u.Type > 0 && net.ParseIP(strings.Trim(address, "[]")) == nil {
+		address = deviceName + "-" + address
+	}
+	c := &dns.Client{Timeout: upstreamTimeout}
+	switch u.Type {
+	case db.ModeTCP:
+		address = upstreamAddress(address, "53")
+		c.Net = "tcp"
+		c.Dialer = &net.Dialer{Resolver: s.transport.resolver}
+	case db.ModeTLS:
+		address = upstreamAddress(address, "853")
+		c.Net = "tcp-tls"
+		c.Dialer = &net.Dialer{Resolver: s.transport.resolver}
+	case db.ModeQUIC:
+		start := time.Now()
+		r, err := s.transport.exchangeQUIC(m, upstreamAddress(address, "853"))
+		return r, time.Since(start), err
+	default:
+		address = upstreamAddress(address, "53")
+	}
+	return c.Exchange(m, address)
+}
+
+func (s *DnsServer) queryUpstream(name string, qtype uint16, source string, if_ip string, config *db.DNSConfiguration) ([]dns.RR, string, error) {
+	return s.resolveUpstream(name, qtype, config, false)
+}
+
+// resolveUpstream answers from the shared answer cache unless the answer is refreshed, the answers of the
+// upstreams are cached with their TTL clamped to the cache settings, answers of configurations validating
+// DNSSEC return their status
+func (s *DnsServer) resolveUpstream(name string, qtype uint16, config *db.DNSConfiguration, refresh bool) ([]dns.RR, string, error) {
+	configuration := "fallback"
+	upstreams := []db.DNSUpstream{{Type: db.ModeUDP, Address: s.fallbackAddress()}}
+	var strategy uint
+	deviceName := ""
+	validate := false
+	if config != nil && len(config.GetUpstreams()) > 0 {
+		upstreams = config.GetUpstreams()
+		strategy = uint(config.Strategy)
+		deviceName = config.DeviceName
+		validate = config.DNSSEC
+		configuration = config.Address
+		if config.Name != "" {
+			configuration = config.Name
+		}
+	}
+
+	keys := make([]string, len(upstreams))
+	for i, u := range upstreams {
+		keys[i] = UpstreamKey(u)
+	}
+	// answers of device specific upstreams depend on the device name
+	upstream := strings.Join(keys, ",")
+	if deviceName != "" {
+		upstream += "@" + deviceName
+	}
+	if validate {
+		upstream += "+dnssec"
+	}
+	key := answerKey(upstream, name, qtype)
+	if !refresh {
+		if answer, negative, dnssec, ok := s.answers.get(key); ok {
+			metrics.DNSAnswerCacheLookups.WithLabelValues("hit").Inc()
+			if negative != nil {
+				return nil, dnssec, negative
+			}
+			return answer, dnssec, nil
+		}
+		metrics.DNSAnswerCacheLookups.WithLabelValues("miss").Inc()
+	}
+
+	m1 := new(dns.Msg)
+	m1.Id = dns.Id()
+	m1.RecursionDesired = true
+	m1.Question = make([]dns.Question, 1)
+	m1.Question[0] = dns.Question{
+		Name:   name,
+		Qtype:  qtype,
+		Qclass: dns.ClassINET,
+	}
+	if validate {
+		// the signatures are requested and bogus answers are returned to be validated locally
+		m1.SetEdns0(dnssecUDPSize, true)
+		m1.CheckingDisabled = true
+	}
+
+	var err error
+	for _, u := range s.upstreams.order(configuration, strategy, upstreams) {
+		var in *dns.Msg
+		var rtt time.Duration
+		in, rtt, err = s.exchange(m1, u, deviceName)
+		if err == nil && validate && in.Truncated && u.Type == db.ModeUDP {
+			in, _, err = s.exchange(m1, db.DNSUpstream{Type: db.ModeTCP, Address: u.Address}, deviceName)
+		}
+		if err == nil && (in.Rcode == dns.RcodeServerFailure || in.Rcode == dns.RcodeRefused) {
+			err = fmt.Errorf("%s answered %s", u.Address, dns.RcodeToString[in.Rcode])
+		}
+		s.upstreams.record(u, rtt, err, false)
+		result := "success"
+		if err != nil {
+			result = "error"
+		}
+		metrics.DNSUpstreamDuration.WithLabelValues(configuration, result).Observe(rtt.Seconds())
+		if err != nil {
+			continue
+		}
+
+		dnssec := ""
+		if validate {
+			dnssec, err = s.validator.validate(name, qtype, in, s.lookupSigned(u, deviceName), 0)
+			metrics.DNSSECValidations.WithLabelValues(dnssec).Inc()
+			if err != nil {
+				log.Printf("%s %s from %s: %v", name, getQueryTypeText(qtype), u.Address, err)
+				return nil, dnssec, err
+			}
+			in.Answer = slices.DeleteFunc(in.Answer, func(rr dns.RR) bool {
+				return rr.Header().Rrtype == dns.TypeRRSIG && qtype != dns.TypeRRSIG
+			})
+		}
+
+		if in.Rcode == dns.RcodeNameError || len(in.Answer) == 0 {
+			negative := &negativeAnswer{Rcode: in.Rcode, TTL: negativeTTL(in), DNSSEC: dnssec}
+			if negative.TTL > 0 {
+				negative.TTL = s.clampTTL(negative.TTL)
+			}
+			s.answers.put(key, upstream, name, qtype, nil, negative, dnssec, negative.TTL, s.answerCacheBytes())
+			return nil, dnssec, negative
+		}
+		ttl := uint32(0)
+		for i, rr := range in.Answer {
+			rr.Header().Ttl = s.clampTTL(rr.Header().Ttl)
+			if i == 0 || rr.Header().Ttl < ttl {
+				ttl = rr.Header().Ttl
+			}
+		}
+		s.answers.put(key, upstream, name, qtype, in.Answer, nil, dnssec, ttl, s.answerCacheBytes())
+		return in.Answer, dnssec, nil
+	}
+	return nil, "", err
+}
+
+// UpstreamStats returns the statistics of the upstreams by UpstreamKey
+func (s *DnsServer) UpstreamStats() map[string]UpstreamStat {
+	return s.upstreams.Stats()
+}
+
+// probeUpstreams periodically queries the root name servers from every upstream of the DNS configurations,
+// a successful probe closes the circuit of an upstream
+func (s *DnsServer) probeUpstreams() {
+	ticker := time.NewTicker(probeInterval)
+	defer ticker.Stop()
+	for range ticker.C {
+		upstreams := make(map[string]db.DNSUpstream)
+		for _, c := range s.db.GetDNSConfigurations() {
+			for _, u := range c.GetUpstreams() {
+				upstreams[UpstreamKey(u)] = u
+			}
+		}
+		var wg sync.WaitGroup
+		for _, u := range upstreams {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				m := new(dns.Msg)
+				m.SetQuestion(".", dns.TypeNS)
+				in, rtt, err := s.exchange(m, u, "")
+				if err == nil && in.Rcode != dns.RcodeSuccess {
+					err = fmt.Errorf("%s answered %s", u.Address, dns.RcodeToString[in.Rcode])
+				}
+				s.upstreams.record(u, rtt, err, true)
+			}()
+		}
+		wg.Wait()
+	}
+}
@@ -0,0 +1,76 @@
+package dns
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sleuth/internal/db"
+	"testing"
+	"time"
+)
+
+func TestUpstreamPoolRoundRobin(t *testing.T) {
+	p := newUpstreamPool()
+	upstreams := []db.DNSUpstream{{Address: "10.0.0.1"}, {Address: "10.0.0.2"}}
+	checkTestString(t, "10.0.0.1", p.order("test", uint(db.StrategyRoundRobin), upstreams)[0].Address)
+	checkTestString(t, "10.0.0.2", p.order("test", uint(db.StrategyRoundRobin), upstreams)[0].Address)
+	checkTestString(t, "10.0.0.1", p.order("test", uint(db.StrategyRoundRobin), upstreams)[0].Address)
+}
+
+func TestUpstreamPoolFastest(t *testing.T) {
+	p := newUpstreamPool()
+	upstreams := []db.DNSUpstream{{Address: "10.0.0.1"}, {Address: "10.0.0.2"}}
+	p.record(upstreams[0], 50*time.Millisecond, nil, false)
+	p.record(upstreams[1], 10*time.Millisecond, nil, false)
+	checkTestString(t, "10.0.0.2", p.order("test", uint(db.StrategyFastest), upstreams)[0].Address)
+}
+
+func TestUpstreamPoolCircuit(t *testing.T) {
+	p := newUpstreamPool()
+	upstreams := []db.DNSUpstream{{Address: "10.0.0.1"}, {Address: "10.0.0.2"}}
+	for range circuitFailures {
+		checkTestString(t, "10.0.0.1", p.order("test", uint(db.StrategyFailover), upstreams)[0].Address)
+		p.record(upstreams[0], 0, errors.New("timeout"), false)
+	}
+	checkTestString(t, "10.0.0.2", p.order("test", uint(db.StrategyFailover), upstreams)[0].Address)
+	stat := p.Stats()[UpstreamKey(upstreams[0])]
+	checkTestBool(t, false, stat.Healthy)
+	checkTestInt(t, circuitFailures, int(stat.Errors))
+
+	// a successful probe closes the circuit without counting a query
+	p.record(upstreams[0], time.Millisecond, nil, true)
+	checkTestString(t, "10.0.0.1", p.order("test", uint(db.StrategyFailover), upstreams)[0].Address)
+	checkTestInt(t, circuitFailures, int(p.Stats()[UpstreamKey(upstreams[0])].Queries))
+}
+
+func TestDohURL(t *testing.T) {
+	address, _ := dohURL("dns.nextdns.io/abc123", "Living--Room")
+	checkTestString(t, "https://dns.nextdns.io/abc123/Living--Room", address)
+	address, _ = dohURL("family.cloudflare-dns.com", "")
+	checkTestString(t, "https://family.cloudflare-dns.com/dns-query", address)
+}
+
+func TestQuicConnDial(t *testing.T) {
+	// the upstream never answers the handshake
+	silent, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer silent.Close()
+
+	tr := newUpstreamTransport(func() string { return "127.0.0.1:1" })
+	ctx, cancel := context.WithTimeout(context.Background(), 500*time.Millisecond)
+	defer cancel()
+	done := make(chan error)
+	go func() {
+		_, err := tr.quicConn(ctx, silent.LocalAddr().String())
+		done <- err
+	}()
+
+	// the other upstreams are not blocked while dialing
+	time.Sleep(100 * time.Millisecond)
+	checkTestBool(t, true, tr.mu.TryLock())
+	tr.mu.Unlock()
+	checkTestBool(t, false, <-done == nil)
+	checkTestInt(t, 0, len(tr.conns))
+}
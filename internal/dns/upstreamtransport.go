@@ -0,0 +1,231 @@
+package dns
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/quic-go/quic-go"
+)
+
+const (
+	// dohPath is the path of DNS over HTTPS upstreams that have none
+	dohPath = "/dns-query"
+	// doqALPN is the application protocol of DNS over QUIC (RFC 9250)
+	doqALPN = "doq"
+	// upstreamIdleTimeout closes idle HTTP/2 and QUIC connections to the upstreams
+	upstreamIdleTimeout = 60 * time.Second
+)
+
+// upstreamTransport holds the connections to the DNS over HTTPS and DNS over QUIC upstreams so that
+// they are reused across queries, host names are resolved through the fallback DNS
+type upstreamTransport struct {
+	resolver *net.Resolver
+	doh      *http.Client
+
+	mu    sync.Mutex
+	conns map[string]*quic.Conn
+}
+
+func newUpstreamTransport(fallbackAddress func() string) *upstreamTransport {
+	t := &upstreamTransport{
+		resolver: &net.Resolver{
+			PreferGo: true,
+			Dial: func(ctx context.Context, network, address string) (net.Conn, error) {
+				d := net.Dialer{}
+				return d.DialContext(ctx, network, fallbackAddress())
+			},
+		},
+		conns: make(map[string]*quic.Conn),
+	}
+	dialer := &net.Dialer{Resolver: t.resolver}
+	t.doh = &http.Client{
+		Timeout: upstreamTimeout,
+		Transport: &http.Transport{
+			DialContext: dialer.DialContext,
+			// a custom dialer disables HTTP/2 unless it is requested
+			ForceAttemptHTTP2:   true,
+			TLSHandshakeTimeout: upstreamTimeout,
+			MaxIdleConnsPerHost: 4,
+			IdleConnTimeout:     upstreamIdleTimeout,
+		},
+	}
+	return t
+}
+
+// dohURL returns the URL of a DNS over HTTPS upstream, the device name is added as the last path segment
+func dohURL(address string, deviceName string) (string, error) {
+	u, err := url.Parse("https://" + strings.TrimPrefix(address, "https://"))
+	if err != nil {
+		return "", err
+	}
+	if u.Path == "" || u.Path == "/" {
+		u.Path = dohPath
+	}
+	if deviceName != "" {
+		u.Path = strings.TrimSuffix(u.Path, "/") + "/" + deviceName
+	}
+	return u.String(), nil
+}
+
+// exchangeHTTPS sends the query to a DNS over HTTPS upstream (RFC 8484), the message id is zero so
+// that HTTP caches can be used
+func (t *upstreamTransport) exchangeHTTPS(m *dns.Msg, address string) (*dns.Msg, error) {
+	q := m.Copy()
+	q.Id = 0
+	data, err := q.Pack()
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequest(http.MethodPost, address, bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", dohContentType)
+	req.Header.Set("Accept", dohContentType)
+
+	res, err := t.doh.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s answered HTTP %d", address, res.StatusCode)
+	}
+	body, err := io.ReadAll(io.LimitReader(res.Body, dohMaxSize))
+	if err != nil {
+		return nil, err
+	}
+	r := new(dns.Msg)
+	if err := r.Unpack(body); err != nil {
+		return nil, err
+	}
+	r.Id = m.Id
+	return r, nil
+}
+
+// quicConn returns the open connection to a DNS over QUIC upstream or dials a new one, the lock is not held
+// while dialing so that a slow upstream does not delay the queries to the others
+func (t *upstreamTransport) quicConn(ctx context.Context, address string) (*quic.Conn, error) {
+	if conn := t.openQUIC(address); conn != nil {
+		return conn, nil
+	}
+
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, err
+	}
+	ip := host
+	if net.ParseIP(host) == nil {
+		ips, err := t.resolver.LookupHost(ctx, host)
+		if err != nil {
+			return nil, err
+		}
+		ip = ips[0]
+	}
+	conn, err := quic.DialAddr(ctx, net.JoinHostPort(ip, port), &tls.Config{
+		ServerName: host,
+		NextProtos: []string{doqALPN},
+	}, &quic.Config{
+		MaxIdleTimeout:  upstreamIdleTimeout,
+		KeepAlivePeriod: upstreamIdleTimeout / 2,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	// a concurrent query may have dialed the upstream in the meantime
+	if other, ok := t.conns[address]; ok && other.Context().Err() == nil {
+		conn.CloseWithError(0, "")
+		return other, nil
+	}
+	t.conns[address] = conn
+	return conn, nil
+}
+
+// openQUIC returns the cached connection to the upstream unless it was closed
+func (t *upstreamTransport) openQUIC(address string) *quic.Conn {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	conn, ok := t.conns[address]
+	if !ok {
+		return nil
+	}
+	if conn.Context().Err() != nil {
+		delete(t.conns, address)
+		return nil
+	}
+	return conn
+}
+
+// dropQUIC closes the failed connection and removes it from the cache unless it was replaced already
+func (t *upstreamTransport) dropQUIC(address string, conn *quic.Conn) {
+	t.mu.Lock()
+	if t.conns[address] == conn {
+		delete(t.conns, address)
+	}
+	t.mu.Unlock()
+	conn.CloseWithError(0, "")
+}
+
+// exchangeQUIC sends the query on a new stream of the connection to a DNS over QUIC upstream (RFC 9250)
+func (t *upstreamTransport) exchangeQUIC(m *dns.Msg, address string) (*dns.Msg, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), upstreamTimeout)
+	defer cancel()
+
+	q := m.Copy()
+	q.Id = 0
+	data, err := q.Pack()
+	if err != nil {
+		return nil, err
+	}
+	conn, err := t.quicConn(ctx, address)
+	if err != nil {
+		return nil, err
+	}
+	stream, err := conn.OpenStreamSync(ctx)
+	if err != nil {
+		t.dropQUIC(address, conn)
+		return nil, err
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		stream.SetDeadline(deadline)
+	}
+	frame := binary.BigEndian.AppendUint16(nil, uint16(len(data)))
+	if _, err := stream.Write(append(frame, data...)); err != nil {
+		if conn.Context().Err() != nil {
+			// the handshake or the connection failed after it was cached
+			t.dropQUIC(address, conn)
+		}
+		return nil, err
+	}
+	// the client closes its direction of the stream after the query
+	stream.Close()
+
+	var length uint16
+	if err := binary.Read(stream, binary.BigEndian, &length); err != nil {
+		return nil, err
+	}
+	body := make([]byte, length)
+	if _, err := io.ReadFull(stream, body); err != nil {
+		return nil, err
+	}
+	r := new(dns.Msg)
+	if err := r.Unpack(body); err != nil {
+		return nil, err
+	}
+	r.Id = m.Id
+	return r, nil
+}
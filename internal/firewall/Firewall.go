@@ -1,9 +1,18 @@
 package firewall
 
 import (
+	"net"
 	"sleuth/internal/constants"
 )
 
+// BypassRules keep the clients from resolving past the portal
+type BypassRules struct {
+	// Blocked are the addresses of public DoH/DoT resolvers and VPN services, forwarded traffic to them is dropped
+	Blocked []net.IP
+	// Redirect are the DNS ports whose traffic from the clients is redirected to the portal
+	Redirect []int
+}
+
 // FirewallManager is a minimal interface for managing firewall rules.
 type Firewall interface {
 	Name() string
@@ -19,6 +28,8 @@ type Firewall interface {
 	AddAllowPort(protocol string, port int) error
 	// RemoveAllowPort removes an allow rule created by AddAllowPort.
 	RemoveAllowPort(protocol string, port int) error
+	// SetBypassRules replaces the rules installed by a previous call, empty rules remove them.
+	SetBypassRules(rules BypassRules) error
 	// Flush removes all rules created by this manager (best-effort).
 	Flush() error
 }
@@ -4,11 +4,13 @@ import (
 	"encoding/binary"
 	"errors"
 	"fmt"
-	"math/bits"
+	"math"
 	"net"
 	"sleuth/internal/constants"
 	"sleuth/internal/db"
 	"sleuth/internal/log"
+	"slices"
+	"sync"
 	"time"
 
 	"github.com/miekg/dns"
@@ -22,14 +24,16 @@ type Stat struct {
 
 // FirewallManager is a minimal interface for managing firewall rules.
 type FirewallManager struct {
-	fws     []Firewall
-	fw      Firewall
-	db      *db.Db
-	ip_seed uint16
+	fws      []Firewall
+	fw       Firewall
+	db       *db.Db
+	settings *db.Settings
+	ip_seed  uint16
 }
 
-func (m *FirewallManager) Init(db *db.Db) {
+func (m *FirewallManager) Init(db *db.Db, settings *db.Settings) {
 	m.db = db
+	m.settings = settings
 	m.ip_seed = 1
 
 	ticker := time.NewTicker(time.Second * 60)
@@ -62,16 +66,7 @@ func (m *FirewallManager) SetActiveFirewall(firewall string) {
 	sessions := m.db.GetDNSSessions()
 	rules := make([]constants.FwdRule, 0)
 	for _, s := range sessions {
-		rule := constants.FwdRule{
-			ClientIP:    s.ClientIP,
-			InterfaceIP: s.InterfaceIP,
-			ReasonCode:  s.ReasonCode,
-		}
-		if s.DNSResponse.A != nil {
-			rule.TargetIP = s.DNSResponse.A.IP
-			rule.AllocatedIP = s.DNSResponse.A.AllocatedIP
-		}
-		rules = append(rules, rule)
+		rules = append(rules, forwardRules(&s)...)
 	}
 
 	if m.fw != nil {
@@ -86,41 +81,63 @@ func (m *FirewallManager) SetActiveFirewall(firewall string) {
 	found := false
 	for _, fw := range m.fws {
 		if firewall == fw.Name() {
-			m.fw = fw
+			m.fw = meteredFirewall{fw}
 			found = true
 			break
 		}
 	}
 
 	if found == false && len(m.fws) > 0 {
-		m.fw = m.fws[0]
+		m.fw = meteredFirewall{m.fws[0]}
 	}
 
 	if m.fw != nil {
 		rules := make([]constants.FwdRule, 0)
 		for _, s := range sessions {
 			if time.Now().After(s.SessionExpiry) {
-				if s.DNSResponse.A != nil {
-					m.db.DeleteReverseDNS(s.ClientIP, s.QType, uint16(OffsetFromIP4(s.DNSResponse.A.AllocatedIP)))
+				released := m.release(&s)
+				if time.Now().After(m.staleUntil(&s)) {
+					m.db.DeleteDNSSession(&s)
+				} else if released {
+					m.db.UpdateDNSSession(&s)
 				}
-				m.db.DeleteDNSSession(&s)
 			} else {
-				rule := constants.FwdRule{
-					ClientIP:    s.ClientIP,
-					InterfaceIP: s.InterfaceIP,
-					ReasonCode:  s.ReasonCode,
-				}
-				if s.DNSResponse.A != nil {
-					rule.TargetIP = s.DNSResponse.A.IP
-					rule.AllocatedIP = s.DNSResponse.A.AllocatedIP
-				}
-				rules = append(rules, rule)
+				rules = append(rules, forwardRules(&s)...)
 			}
 		}
 		m.fw.Init(rules)
+		if err := m.ApplyBypassRules(); err != nil {
+			log.Errorf("bypass rules not installed: %v", err)
+		}
 	}
 }
 
+// ApplyBypassRules installs the bypass prevention of the settings, the forwarded traffic to the addresses of
+// the enabled bypass endpoints is dropped and DNS of the clients is redirected to the portal
+func (m *FirewallManager) ApplyBypassRules() error {
+	if m.fw == nil || m.db == nil || m.settings == nil {
+		return nil
+	}
+	rules := BypassRules{}
+	bypass := m.settings.Snapshot().Bypass
+	if bypass.Enabled {
+		for _, e := range m.db.GetBypassEndpoints() {
+			if !e.Enabled {
+				continue
+			}
+			for _, address := range e.Addresses {
+				if ip := net.ParseIP(address); ip != nil {
+					rules.Blocked = append(rules.Blocked, ip)
+				}
+			}
+		}
+	}
+	if bypass.RedirectDNS {
+		rules.Redirect = []int{53, 853}
+	}
+	return m.fw.SetBypassRules(rules)
+}
+
 func ip4ToInt(ipStr string) (uint32, error) {
 	ip := net.ParseIP(ipStr)
 	if ip == nil {
@@ -141,72 +158,380 @@ func intToIP4(n uint32) string {
 	return ip.String()
 }
 
-func IP4fromOffset(offset uint16) string {
-	ip, _ := ip4ToInt("10.0.0.1")
-	return intToIP4(ip + uint32(offset))
+// IP4fromOffset builds an address within the IPv4 pool, offset 0 is the first host address of the network
+func IP4fromOffset(pool string, offset uint32) (string, error) {
+	if err := ValidateIPv4Pool(pool); err != nil {
+		return "", err
+	}
+	_, ipnet, _ := net.ParseCIDR(pool)
+	if offset >= poolSize(ipnet) {
+		return "", fmt.Errorf("offset %d is outside the IPv4 pool %s", offset, pool)
+	}
+	start, _ := ip4ToInt(ipnet.IP.String())
+	return intToIP4(start + 1 + offset), nil
 }
 
-func OffsetFromIP4(IP string) uint32 {
+func OffsetFromIP4(pool string, IP string) uint32 {
+	_, ipnet, err := net.ParseCIDR(pool)
+	ip := net.ParseIP(IP)
+	if err != nil || ip == nil || ip.To4() == nil || !ipnet.Contains(ip) {
+		return max_value
+	}
 	ipint, _ := ip4ToInt(IP)
-	ipstart, _ := ip4ToInt("10.0.0.1")
-	if ipint > ipstart {
-		return ipint - ipstart
+	ipstart, _ := ip4ToInt(ipnet.IP.String())
+	if ipint > ipstart && ipint-ipstart-1 < poolSize(ipnet) {
+		return ipint - ipstart - 1
 	}
 	return max_value
 }
 
-const max_value = 65535 //256*256
-func firstAvailable(nums []constants.ReverseDNS) (uint16, bool) {
-	var seen [(max_value + 1) / 64]uint64
+// ValidateIPv4Pool checks that the pool is an IPv4 network with at least two host addresses
+func ValidateIPv4Pool(pool string) error {
+	ip, ipnet, err := net.ParseCIDR(pool)
+	if err != nil {
+		return fmt.Errorf("invalid IPv4 pool %s: %v", pool, err)
+	}
+	if ones, bits := ipnet.Mask.Size(); ip.To4() == nil || bits != 32 || ones > 30 {
+		return fmt.Errorf("IPv4 pool %s must be an IPv4 network of /30 or larger", pool)
+	}
+	return nil
+}
 
-	// Mark numbers as seen
-	for _, n := range nums {
-		seen[n.DestIPOffset>>6] |= 1 << (n.DestIPOffset & 63)
+// ValidateForwardingPools checks the IPv4 and IPv6 pools and that neither overlaps the network of a local
+// interface, the forwarded addresses would otherwise shadow hosts of the network
+func ValidateForwardingPools(ipv4 string, ipv6 string) error {
+	if err := ValidateIPv4Pool(ipv4); err != nil {
+		return err
 	}
+	if err := ValidateIPv6Pool(ipv6); err != nil {
+		return err
+	}
+	for _, pool := range []string{ipv4, ipv6} {
+		if name, network := overlappingInterface(pool); name != "" {
+			return fmt.Errorf("forwarding pool %s overlaps network %s of interface %s", pool, network, name)
+		}
+	}
+	return nil
+}
 
-	for wordIdx, word := range seen {
-		inv := ^word
+var (
+	defaultPoolOnce sync.Once
+	defaultPool     string
+	defaultPoolErr  error
+)
 
-		if inv != 0 {
-			bit := bits.TrailingZeros64(inv)
-			result := wordIdx*64 + bit
+// DefaultIPv4Pool returns the first of the candidate pools that does not overlap a local interface, the
+// interfaces are only inspected once
+func DefaultIPv4Pool() (string, error) {
+	defaultPoolOnce.Do(func() {
+		candidates := []string{"10.0.0.0/16", "172.31.0.0/16", "100.127.0.0/16", "10.254.0.0/16"}
+		for _, pool := range candidates {
+			if name, _ := overlappingInterface(pool); name == "" {
+				defaultPool = pool
+				return
+			}
+		}
+		defaultPoolErr = fmt.Errorf("every default IPv4 forwarding pool overlaps a local network, configure one")
+	})
+	return defaultPool, defaultPoolErr
+}
 
-			if result <= max_value {
-				return uint16(result), true
+// overlappingInterface returns the name and network of the first local interface that overlaps the pool
+func overlappingInterface(pool string) (string, string) {
+	_, ipnet, err := net.ParseCIDR(pool)
+	if err != nil {
+		return "", ""
+	}
+	interfaces, err := net.Interfaces()
+	if err != nil {
+		return "", ""
+	}
+	for _, iface := range interfaces {
+		addrs, err := iface.Addrs()
+		if err != nil {
+			continue
+		}
+		for _, addr := range addrs {
+			if network, ok := addr.(*net.IPNet); ok && (network.Contains(ipnet.IP) || ipnet.Contains(network.IP)) {
+				return iface.Name, network.String()
 			}
 		}
 	}
+	return "", ""
+}
+
+// poolSize returns the number of offsets of a pool: the host addresses of an IPv4 network or the addresses
+// per client of an IPv6 network, limited to max_value
+func poolSize(ipnet *net.IPNet) uint32 {
+	ones, bits := ipnet.Mask.Size()
+	host := bits - ones
+	if bits == 128 {
+		host = ipv6OffsetBits(ones)
+	}
+	if host >= 32 {
+		return max_value
+	}
+	size := uint32(1) << host
+	if bits == 32 {
+		size -= 2
+	}
+	return size
+}
+
+// forwardRules returns the A and AAAA forwarding rules of a DNS session
+func forwardRules(s *constants.DNSSession) []constants.FwdRule {
+	rules := make([]constants.FwdRule, 0)
+	if s.DNSResponse.A != nil {
+		rules = append(rules, constants.FwdRule{
+			ClientIP:    s.ClientIP,
+			InterfaceIP: s.InterfaceIP,
+			HostName:    s.Hostname,
+			ReasonCode:  s.ReasonCode,
+			TargetIP:    s.DNSResponse.A.IP,
+			AllocatedIP: s.DNSResponse.A.AllocatedIP,
+		})
+	}
+	if s.DNSResponse.AAAA != nil {
+		rules = append(rules, constants.FwdRule{
+			ClientIP:    s.ClientIP,
+			InterfaceIP: s.InterfaceIPv6,
+			HostName:    s.Hostname,
+			ReasonCode:  s.ReasonCode,
+			TargetIP:    s.DNSResponse.AAAA.IP,
+			AllocatedIP: s.DNSResponse.AAAA.AllocatedIP,
+			MacAddress:  s.MacAddress,
+		})
+	}
+	return rules
+}
+
+// IP6fromOffset builds an address within the IPv6 pool: the pool prefix,
+// followed by the client IPv4 address and the offset in the last 48 bits,
+// so that every allocated address is unique to its client. Offsets beyond
+// 16 bits continue in the bits between the prefix and the client address.
+func IP6fromOffset(pool string, clientIP string, offset uint32) (string, error) {
+	if err := ValidateIPv6Pool(pool); err != nil {
+		return "", err
+	}
+	_, ipnet, _ := net.ParseCIDR(pool)
+	client := net.ParseIP(clientIP).To4()
+	if client == nil {
+		return "", fmt.Errorf("client %s is not an IPv4 address", clientIP)
+	}
+	if offset >= poolSize(ipnet) {
+		return "", fmt.Errorf("offset %d is outside the IPv6 pool %s", offset, pool)
+	}
+	ip := make(net.IP, net.IPv6len)
+	copy(ip, ipnet.IP)
+	binary.BigEndian.PutUint16(ip[8:10], binary.BigEndian.Uint16(ip[8:10])|uint16(offset>>16))
+	copy(ip[10:14], client)
+	binary.BigEndian.PutUint16(ip[14:], uint16(offset))
+	return ip.String(), nil
+}
+
+// ipv6OffsetBits returns the number of bits of the offset in a pool of the prefix length: the last 16 bits
+// and up to 16 bits between the prefix and the client address
+func ipv6OffsetBits(ones int) int {
+	return 16 + min(16, 80-ones)
+}
+
+// ValidateIPv6Pool checks that the pool is an IPv6 network large enough to hold the client address and offset
+func ValidateIPv6Pool(pool string) error {
+	ip, ipnet, err := net.ParseCIDR(pool)
+	if err != nil {
+		return fmt.Errorf("invalid IPv6 pool %s: %v", pool, err)
+	}
+	if ones, bits := ipnet.Mask.Size(); ip.To4() != nil || bits != 128 || ones > 80 {
+		return fmt.Errorf("IPv6 pool %s must be an IPv6 network of /80 or larger", pool)
+	}
+	return nil
+}
+
+func OffsetFromIP6(pool string, IP string) uint32 {
+	_, ipnet, err := net.ParseCIDR(pool)
+	ip := net.ParseIP(IP)
+	if err != nil || ip == nil || ip.To4() != nil || !ipnet.Contains(ip) {
+		return max_value
+	}
+	ones, _ := ipnet.Mask.Size()
+	high := uint32(binary.BigEndian.Uint16(ip.To16()[8:10])) & (1<<(ipv6OffsetBits(ones)-16) - 1)
+	return high<<16 | uint32(binary.BigEndian.Uint16(ip.To16()[14:]))
+}
+
+func (m *FirewallManager) ipv6Pool() string {
+	if m.settings != nil {
+		return m.settings.Snapshot().ForwardingPoolIPv6
+	}
+	return ""
+}
+
+func (m *FirewallManager) offsetFromIP6(IP string) uint32 {
+	return OffsetFromIP6(m.ipv6Pool(), IP)
+}
+
+func (m *FirewallManager) ipv4Pool() string {
+	if m.settings != nil {
+		if pool := m.settings.Snapshot().ForwardingPoolIPv4; pool != "" {
+			return pool
+		}
+	}
+	pool, _ := DefaultIPv4Pool()
+	return pool
+}
+
+// FlushForwardingPools removes every allocated forwarding address with its session and forwarding rules,
+// the addresses of a previous pool cannot be matched to their offsets once the pools changed
+func (m *FirewallManager) FlushForwardingPools() {
+	if m.db == nil {
+		return
+	}
+	for _, s := range m.db.GetDNSSessions() {
+		rules := forwardRules(&s)
+		allocated := false
+		for _, r := range rules {
+			allocated = allocated || r.AllocatedIP != ""
+		}
+		if !allocated {
+			continue
+		}
+		if m.fw != nil {
+			for _, r := range rules {
+				m.fw.RemoveForwardRule(&r)
+			}
+		}
+		m.db.DeleteDNSSession(&s)
+	}
+	if err := m.db.DeleteAllReverseDNS(); err != nil {
+		log.Errorf("forwarding addresses not flushed: %v", err)
+	}
+}
+
+func (m *FirewallManager) offsetFromIP4(IP string) uint32 {
+	return OffsetFromIP4(m.ipv4Pool(), IP)
+}
+
+// poolCapacity returns the number of offsets of the pool, 0 when the pool is invalid
+func poolCapacity(pool string) uint32 {
+	_, ipnet, err := net.ParseCIDR(pool)
+	if err != nil {
+		return 0
+	}
+	return poolSize(ipnet)
+}
+
+// max_value marks an address outside the pool, it also limits the offsets of a pool
+const max_value = math.MaxUint32
+
+// firstAvailable returns the lowest offset below size that is not in use
+func firstAvailable(nums []constants.ReverseDNS, size uint32) (uint32, bool) {
+	used := make([]uint32, 0, len(nums))
+	for _, n := range nums {
+		if n.DestIPOffset < size {
+			used = append(used, n.DestIPOffset)
+		}
+	}
+	slices.Sort(used)
+
+	result := uint32(0)
+	for _, n := range used {
+		if n > result {
+			break
+		}
+		if n == result {
+			result++
+		}
+	}
+	if result < size {
+		return result, true
+	}
 
 	// All numbers used
 	return 0, false
 }
 
+// recycleOffset releases the least recently used allocation of the client when the pool is exhausted,
+// allocations without a DNS session are stale and go first. The session of the allocation is removed
+// with its forwarding rules, allocations of the hostname being allocated are kept.
+func (m *FirewallManager) recycleOffset(clientIP string, qtype uint16, hostname string, rules []constants.ReverseDNS) (uint32, bool) {
+	sessions := make(map[string]constants.DNSSession)
+	for _, s := range m.db.GetDNSSessionsForClient(clientIP) {
+		if qtype == dns.TypeAAAA && s.DNSResponse.AAAA != nil && s.DNSResponse.AAAA.AllocatedIP != "" {
+			sessions[s.DNSResponse.AAAA.AllocatedIP] = s
+		} else if qtype != dns.TypeAAAA && s.DNSResponse.A != nil && s.DNSResponse.A.AllocatedIP != "" {
+			sessions[s.DNSResponse.A.AllocatedIP] = s
+		}
+	}
+
+	var victim *constants.ReverseDNS
+	var lastUsed time.Time
+	for i := range rules {
+		if rules[i].Hostname == hostname {
+			continue
+		}
+		used := time.Time{}
+		if s, ok := sessions[rules[i].DestIP]; ok {
+			used = s.SessionExpiry
+		}
+		if victim == nil || used.Before(lastUsed) {
+			victim = &rules[i]
+			lastUsed = used
+		}
+	}
+	if victim == nil {
+		return 0, false
+	}
+
+	if s, ok := sessions[victim.DestIP]; ok {
+		if m.fw != nil {
+			for _, r := range forwardRules(&s) {
+				m.fw.RemoveForwardRule(&r)
+			}
+		}
+		m.db.DeleteDNSSession(&s)
+	}
+	m.db.DeleteReverseDNS(clientIP, qtype, victim.DestIPOffset)
+	log.Infof("forwarding pool of %s exhausted, recycled %s of %s", clientIP, victim.DestIP, victim.Hostname)
+	return victim.DestIPOffset, true
+}
+
 func (m *FirewallManager) Allocate(session constants.DNSSession, if_ip string) error {
 	var err error
 
 	if session.DNSResponse.A != nil {
 		// check if IP is already allocated
 		if session.DNSResponse.A.AllocatedIP != "" {
-			t := OffsetFromIP4(session.DNSResponse.A.AllocatedIP)
-			if t < uint32(max_value) {
-				rdns := m.db.GetReverseDNS(session.ClientIP, dns.TypeA, uint16(t))
+			t := m.offsetFromIP4(session.DNSResponse.A.AllocatedIP)
+			if t < max_value {
+				rdns := m.db.GetReverseDNS(session.ClientIP, dns.TypeA, t)
 				if rdns != nil {
 					if rdns.Hostname == session.Hostname {
 						return nil
 					}
-					m.db.DeleteReverseDNS(session.ClientIP, dns.TypeA, uint16(t))
+					m.db.DeleteReverseDNS(session.ClientIP, dns.TypeA, t)
 				}
 			}
 		}
 
+		if m.ipv4Pool() == "" {
+			_, err := DefaultIPv4Pool()
+			log.Errorf("%s A not allocated: %v", session.DNSResponse.A.Name, err)
+			return err
+		}
 		rules := m.db.GetReverseDNSByClientType(session.ClientIP, session.QType)
-		destIPOffset, found := firstAvailable(rules)
+		destIPOffset, found := firstAvailable(rules, poolCapacity(m.ipv4Pool()))
+		if !found {
+			destIPOffset, found = m.recycleOffset(session.ClientIP, session.QType, session.Hostname, rules)
+		}
 
 		if !found {
 			return errors.New("no available IP offset")
 		} else {
-			destIP := IP4fromOffset(destIPOffset)
-			err := m.db.CreateReverseDNS(session.ClientIP, session.QType, &constants.ReverseDNS{
+			destIP, err := IP4fromOffset(m.ipv4Pool(), destIPOffset)
+			if err != nil {
+				log.Errorf("%s A not allocated: %v", session.DNSResponse.A.Name, err)
+				return err
+			}
+			err = m.db.CreateReverseDNS(session.ClientIP, session.QType, &constants.ReverseDNS{
 				Hostname:     session.Hostname,
 				IP:           session.DNSResponse.A.IP,
 				DestIP:       destIP,
@@ -231,7 +556,59 @@ func (m *FirewallManager) Allocate(session constants.DNSSession, if_ip string) e
 	}
 
 	if session.DNSResponse.AAAA != nil {
-		log.Errorf("%s AAAA not yet supported", session.DNSResponse.AAAA.Name)
+		// check if IP is already allocated
+		if session.DNSResponse.AAAA.AllocatedIP != "" {
+			t := m.offsetFromIP6(session.DNSResponse.AAAA.AllocatedIP)
+			if t < max_value {
+				rdns := m.db.GetReverseDNS(session.ClientIP, dns.TypeAAAA, t)
+				if rdns != nil {
+					if rdns.Hostname == session.Hostname {
+						return nil
+					}
+					m.db.DeleteReverseDNS(session.ClientIP, dns.TypeAAAA, t)
+				}
+			}
+		}
+
+		if session.MacAddress == "" {
+			// the forward could not be restricted to the client, the portal address is answered instead
+			session.DNSResponse.AAAA.AllocatedIP = ""
+			err := fmt.Errorf("MAC address of client %s not known", session.ClientIP)
+			log.Errorf("%s AAAA not allocated: %v", session.DNSResponse.AAAA.Name, err)
+			return err
+		}
+		rules := m.db.GetReverseDNSByClientType(session.ClientIP, dns.TypeAAAA)
+		destIPOffset, found := firstAvailable(rules, poolCapacity(m.ipv6Pool()))
+		if !found {
+			destIPOffset, found = m.recycleOffset(session.ClientIP, dns.TypeAAAA, session.Hostname, rules)
+		}
+
+		if !found {
+			return errors.New("no available IPv6 offset")
+		}
+		destIP, err := IP6fromOffset(m.ipv6Pool(), session.ClientIP, destIPOffset)
+		if err != nil {
+			log.Errorf("%s AAAA not allocated: %v", session.DNSResponse.AAAA.Name, err)
+			return err
+		}
+		err = m.db.CreateReverseDNS(session.ClientIP, dns.TypeAAAA, &constants.ReverseDNS{
+			Hostname:     session.Hostname,
+			IP:           session.DNSResponse.AAAA.IP,
+			DestIP:       destIP,
+			DestIPOffset: destIPOffset,
+		})
+		if err == nil && m.fw != nil {
+			m.fw.AddForwardRule(&constants.FwdRule{
+				ClientIP:    session.ClientIP,
+				InterfaceIP: session.InterfaceIPv6,
+				HostName:    session.Hostname,
+				AllocatedIP: destIP,
+				TargetIP:    session.DNSResponse.AAAA.IP,
+				ReasonCode:  session.ReasonCode,
+				MacAddress:  session.MacAddress,
+			})
+		}
+		session.DNSResponse.AAAA.AllocatedIP = destIP
 	}
 
 	return err
@@ -256,6 +633,26 @@ func (m *FirewallManager) UpdateIPv4(s *constants.DNSSession, newReasonCode uint
 	return m.fw.AddForwardRule(r)
 }
 
+func (m *FirewallManager) UpdateIPv6(s *constants.DNSSession, newReasonCode uint16) error {
+	r := &constants.FwdRule{
+		ClientIP:    s.ClientIP,
+		InterfaceIP: s.InterfaceIPv6,
+		ReasonCode:  s.ReasonCode,
+		TargetIP:    s.DNSResponse.AAAA.IP,
+		AllocatedIP: s.DNSResponse.AAAA.AllocatedIP,
+		MacAddress:  s.MacAddress,
+	}
+
+	err := m.fw.RemoveForwardRule(r)
+	if err != nil {
+		return err
+	}
+	s.ReasonCode = newReasonCode
+	m.db.UpdateDNSSession(s)
+	r.ReasonCode = newReasonCode
+	return m.fw.AddForwardRule(r)
+}
+
 /*func (m *FirewallManager) IPCacheLookup(clientIP string, name string, qtype uint16) *constants.FwdRule {
 	r := m.db.GetFwdRuleByHostname(clientIP, name, qtype)
 	if r != nil {
@@ -281,19 +678,25 @@ func (m *FirewallManager) ReviewFwdRules() {
 				destination := stats[i].Destination.IP.String()
 				if stats[i].Bytes > 0 {
 					for _, rule := range rules {
+						matched := false
 						if rule.DNSResponse.A != nil {
 							from := rule.ClientIP
 							to := rule.DNSResponse.A.AllocatedIP
 							//to := IP4fromOffset(rule.DestIPOffset)
-							if source == from && destination == to {
-								if stats[i].Bytes > rule.BytesUsed {
-									rule.BytesUsed = stats[i].Bytes
-									rule.LastEvent = time.Now()
-									rule.SessionExpiry = time.Now().Add(time.Second * 630)
-									m.db.UpdateDNSSession(&rule)
-									//m.db.ExtendFwdRule(&rule, time.Now().Add(time.Second*630))
-									break
-								}
+							matched = source == from && destination == to
+						}
+						if rule.DNSResponse.AAAA != nil {
+							// IPv6 allocations are unique per client, the source is not matched
+							matched = matched || destination == rule.DNSResponse.AAAA.AllocatedIP
+						}
+						if matched {
+							if stats[i].Bytes > rule.BytesUsed {
+								rule.BytesUsed = stats[i].Bytes
+								rule.LastEvent = time.Now()
+								rule.SessionExpiry = time.Now().Add(time.Second * 630)
+								m.db.UpdateDNSSession(&rule)
+								//m.db.ExtendFwdRule(&rule, time.Now().Add(time.Second*630))
+								break
 							}
 						}
 					}
@@ -306,42 +709,74 @@ func (m *FirewallManager) ReviewFwdRules() {
 		if now.After(rules[i].SessionExpiry) {
 			var err error
 			if m.fw != nil {
-				if rules[i].DNSResponse.A != nil {
-					err = m.fw.RemoveForwardRule(&constants.FwdRule{
-						ClientIP:    rules[i].ClientIP,
-						InterfaceIP: rules[i].InterfaceIP,
-						ReasonCode:  rules[i].ReasonCode,
-						TargetIP:    rules[i].DNSResponse.A.IP,
-						AllocatedIP: rules[i].DNSResponse.A.AllocatedIP,
-					})
+				for _, r := range forwardRules(&rules[i]) {
+					if r.AllocatedIP == "" {
+						continue
+					}
+					if e := m.fw.RemoveForwardRule(&r); e != nil {
+						err = e
+					}
 				}
 			}
-			if err == nil {
+			if err != nil {
+				continue
+			}
+			released := m.release(&rules[i])
+			if now.After(m.staleUntil(&rules[i])) {
 				m.db.DeleteDNSSession(&rules[i])
+			} else if released {
+				m.db.UpdateDNSSession(&rules[i])
 			}
 		}
 	}
 
 }
 
+// staleUntil returns the time until which the expired session is kept to answer while the upstreams
+// fail (RFC 8767)
+func (m *FirewallManager) staleUntil(s *constants.DNSSession) time.Time {
+	if m.settings == nil || s.IsLocal {
+		return s.SessionExpiry
+	}
+	cache := m.settings.Snapshot().Cache
+	if stale := s.DNSExpiry.Add(time.Duration(cache.StaleHours) * time.Hour); cache.ServeStale && stale.After(s.SessionExpiry) {
+		return stale
+	}
+	return s.SessionExpiry
+}
+
+// release frees the forwarding addresses of the expired session, a stale session allocates them again
+// when it answers
+func (m *FirewallManager) release(s *constants.DNSSession) bool {
+	released := false
+	if s.DNSResponse.A != nil && s.DNSResponse.A.AllocatedIP != "" {
+		m.db.DeleteReverseDNS(s.ClientIP, dns.TypeA, m.offsetFromIP4(s.DNSResponse.A.AllocatedIP))
+		s.DNSResponse.A.AllocatedIP = ""
+		released = true
+	}
+	if s.DNSResponse.AAAA != nil && s.DNSResponse.AAAA.AllocatedIP != "" {
+		m.db.DeleteReverseDNS(s.ClientIP, dns.TypeAAAA, m.offsetFromIP6(s.DNSResponse.AAAA.AllocatedIP))
+		s.DNSResponse.AAAA.AllocatedIP = ""
+		released = true
+	}
+	return released
+}
+
 func (m *FirewallManager) FlushSource(clientIP string) {
 	rules := m.db.GetDNSSessionsForClient(clientIP)
 	for i := range rules {
 		if m.fw != nil {
-			if rules[i].DNSResponse.A != nil {
-				m.fw.RemoveForwardRule(&constants.FwdRule{
-					ClientIP:    rules[i].ClientIP,
-					InterfaceIP: rules[i].InterfaceIP,
-					ReasonCode:  rules[i].ReasonCode,
-					TargetIP:    rules[i].DNSResponse.A.IP,
-					AllocatedIP: rules[i].DNSResponse.A.AllocatedIP,
-				})
+			for _, r := range forwardRules(&rules[i]) {
+				m.fw.RemoveForwardRule(&r)
 			}
 		}
 		m.db.DeleteDNSSession(&rules[i])
 	}
-	for _, ip := range m.db.GetReverseDNSByClientType(clientIP, 1) {
-		m.db.DeleteReverseDNS(clientIP, 1, ip.DestIPOffset)
+	for _, ip := range m.db.GetReverseDNSByClientType(clientIP, dns.TypeA) {
+		m.db.DeleteReverseDNS(clientIP, dns.TypeA, ip.DestIPOffset)
+	}
+	for _, ip := range m.db.GetReverseDNSByClientType(clientIP, dns.TypeAAAA) {
+		m.db.DeleteReverseDNS(clientIP, dns.TypeAAAA, ip.DestIPOffset)
 	}
 }
 
@@ -0,0 +1,213 @@
+package firewall
+
+import (
+	"sleuth/internal/constants"
+	"sleuth/internal/db"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+func TestIP4Offsets(t *testing.T) {
+	tests := []struct {
+		pool   string
+		offset uint32
+		ip     string
+	}{
+		{"10.0.0.0/16", 0, "10.0.0.1"},
+		{"10.0.0.0/16", 255, "10.0.1.0"},
+		{"10.0.0.0/16", 65533, "10.0.255.254"},
+		{"172.31.4.0/30", 0, "172.31.4.1"},
+		{"172.31.4.0/30", 1, "172.31.4.2"},
+		{"100.64.0.0/10", 4194301, "100.127.255.254"},
+	}
+	for _, test := range tests {
+		ip, err := IP4fromOffset(test.pool, test.offset)
+		if err != nil || ip != test.ip {
+			t.Errorf("IP4fromOffset(%s, %d) = %s, %v, want %s", test.pool, test.offset, ip, err, test.ip)
+		}
+		if offset := OffsetFromIP4(test.pool, test.ip); offset != test.offset {
+			t.Errorf("OffsetFromIP4(%s, %s) = %d, want %d", test.pool, test.ip, offset, test.offset)
+		}
+	}
+
+	// the network and broadcast addresses and addresses of other networks are outside the pool
+	for _, ip := range []string{"10.0.0.0", "10.0.255.255", "10.1.0.1", "fd00::1", "invalid"} {
+		if offset := OffsetFromIP4("10.0.0.0/16", ip); offset != max_value {
+			t.Errorf("OffsetFromIP4(10.0.0.0/16, %s) = %d, want outside the pool", ip, offset)
+		}
+	}
+	for _, test := range []struct {
+		pool   string
+		offset uint32
+	}{{"10.0.0.0/16", 65534}, {"172.31.4.0/30", 2}, {"10.0.0.0/31", 0}, {"fd00::/64", 0}} {
+		if ip, err := IP4fromOffset(test.pool, test.offset); err == nil {
+			t.Errorf("IP4fromOffset(%s, %d) = %s, want an error", test.pool, test.offset, ip)
+		}
+	}
+}
+
+func TestIP6Offsets(t *testing.T) {
+	tests := []struct {
+		pool   string
+		offset uint32
+		ip     string
+	}{
+		{"fd00:1:2:3::/64", 7, "fd00:1:2:3:0:c0a8:105:7"},
+		{"fd00:1:2:3::/64", 65535, "fd00:1:2:3:0:c0a8:105:ffff"},
+		{"fd00:1:2:3::/64", 70000, "fd00:1:2:3:1:c0a8:105:1170"},
+		{"fd00:1:2:3:4::/80", 7, "fd00:1:2:3:4:c0a8:105:7"},
+	}
+	for _, test := range tests {
+		ip, err := IP6fromOffset(test.pool, "192.168.1.5", test.offset)
+		if err != nil || ip != test.ip {
+			t.Errorf("IP6fromOffset(%s, %d) = %s, %v, want %s", test.pool, test.offset, ip, err, test.ip)
+		}
+		if offset := OffsetFromIP6(test.pool, test.ip); offset != test.offset {
+			t.Errorf("OffsetFromIP6(%s, %s) = %d, want %d", test.pool, test.ip, offset, test.offset)
+		}
+	}
+	if ip, err := IP6fromOffset("fd00:1:2:3:4::/80", "192.168.1.5", 65536); err == nil {
+		t.Errorf("IP6fromOffset beyond a /80 pool = %s, want an error", ip)
+	}
+}
+
+func TestPoolSize(t *testing.T) {
+	tests := []struct {
+		pool string
+		size uint32
+	}{
+		{"172.31.4.0/30", 2},
+		{"10.0.0.0/24", 254},
+		{"10.0.0.0/16", 65534},
+		{"10.0.0.0/8", 16777214},
+		{"0.0.0.0/0", max_value},
+		{"fd00::/80", 65536},
+		{"fd00::/72", 1 << 24},
+		{"fd00::/64", max_value},
+		{"fd00::/48", max_value},
+		{"invalid", 0},
+	}
+	for _, test := range tests {
+		if size := poolCapacity(test.pool); size != test.size {
+			t.Errorf("poolCapacity(%s) = %d, want %d", test.pool, size, test.size)
+		}
+	}
+}
+
+func TestFirstAvailable(t *testing.T) {
+	used := func(offsets ...uint32) []constants.ReverseDNS {
+		rules := make([]constants.ReverseDNS, len(offsets))
+		for i, offset := range offsets {
+			rules[i].DestIPOffset = offset
+		}
+		return rules
+	}
+	tests := []struct {
+		rules  []constants.ReverseDNS
+		size   uint32
+		offset uint32
+		found  bool
+	}{
+		{used(), 2, 0, true},
+		{used(1, 0, 3), 10, 2, true},
+		{used(0, 0, 1), 10, 2, true},
+		{used(0, 1), 2, 0, false},
+		{used(0, 1, 5), 2, 0, false},
+		{used(65533), 65534, 0, true},
+		{used(), 0, 0, false},
+	}
+	for i, test := range tests {
+		offset, found := firstAvailable(test.rules, test.size)
+		if offset != test.offset || found != test.found {
+			t.Errorf("firstAvailable #%d = %d, %t, want %d, %t", i, offset, found, test.offset, test.found)
+		}
+	}
+}
+
+func TestRecycleOffset(t *testing.T) {
+	database := db.InitDB(t.TempDir())
+	defer database.Close()
+	m := &FirewallManager{db: database, settings: &db.Settings{ForwardingPoolIPv4: "172.31.4.0/30"}}
+	client := "192.168.1.10"
+
+	allocate := func(hostname string, offset uint32, expiry time.Duration) {
+		ip, _ := IP4fromOffset(m.ipv4Pool(), offset)
+		database.CreateReverseDNS(client, dns.TypeA, &constants.ReverseDNS{Hostname: hostname, DestIP: ip, DestIPOffset: offset})
+		if expiry > 0 {
+			database.CreateDNSSession(&constants.DNSSession{
+				ClientIP:      client,
+				Hostname:      hostname,
+				QType:         dns.TypeA,
+				SessionExpiry: time.Now().Add(expiry),
+				DNSResponse:   constants.DNSResponse{A: &constants.DNS_IP_Record{AllocatedIP: ip}},
+			})
+		}
+	}
+	allocate("stale.example.com.", 0, 0)
+	allocate("recent.example.com.", 1, 10*time.Minute)
+
+	// allocations without a session are recycled first
+	offset, found := m.recycleOffset(client, dns.TypeA, "new.example.com.", database.GetReverseDNSByClientType(client, dns.TypeA))
+	if !found || offset != 0 {
+		t.Fatalf("recycleOffset = %d, %t, want the stale offset 0", offset, found)
+	}
+	allocate("old.example.com.", 0, time.Minute)
+
+	// then the allocation with the oldest session, which is removed with it
+	offset, found = m.recycleOffset(client, dns.TypeA, "new.example.com.", database.GetReverseDNSByClientType(client, dns.TypeA))
+	if !found || offset != 0 {
+		t.Fatalf("recycleOffset = %d, %t, want the least recently used offset 0", offset, found)
+	}
+	if database.GetDNSSession(client, "old.example.com.", dns.TypeA) != nil {
+		t.Errorf("the session of the recycled offset was not removed")
+	}
+
+	// the allocation of the hostname being allocated is kept
+	if offset, found = m.recycleOffset(client, dns.TypeA, "recent.example.com.", database.GetReverseDNSByClientType(client, dns.TypeA)); found {
+		t.Errorf("recycleOffset = %d, want the allocation of the hostname to be kept", offset)
+	}
+}
+
+func TestStaleSessions(t *testing.T) {
+	database := db.InitDB(t.TempDir())
+	defer database.Close()
+	settings := &db.Settings{ForwardingPoolIPv4: "172.31.4.0/30"}
+	m := &FirewallManager{db: database, settings: settings}
+	client := "192.168.1.10"
+
+	session := func(hostname string, offset uint32, expired time.Duration) {
+		ip, _ := IP4fromOffset(m.ipv4Pool(), offset)
+		database.CreateReverseDNS(client, dns.TypeA, &constants.ReverseDNS{Hostname: hostname, DestIP: ip, DestIPOffset: offset})
+		database.CreateDNSSession(&constants.DNSSession{
+			ClientIP:      client,
+			Hostname:      hostname,
+			QType:         dns.TypeA,
+			DNSExpiry:     time.Now().Add(-expired),
+			SessionExpiry: time.Now().Add(-expired),
+			DNSResponse:   constants.DNSResponse{A: &constants.DNS_IP_Record{AllocatedIP: ip}},
+		})
+	}
+	session("expired.example.com.", 0, time.Minute)
+	m.ReviewFwdRules()
+	if database.GetDNSSession(client, "expired.example.com.", dns.TypeA) != nil {
+		t.Errorf("the expired session was kept without serving stale answers")
+	}
+
+	// expired sessions are kept for the stale hours, their forwarding addresses are released
+	settings.Cache = db.CacheSettings{ServeStale: true, StaleHours: 1}
+	session("stale.example.com.", 0, time.Minute)
+	session("old.example.com.", 1, 2*time.Hour)
+	m.ReviewFwdRules()
+	s := database.GetDNSSession(client, "stale.example.com.", dns.TypeA)
+	if s == nil {
+		t.Fatalf("the stale session was removed")
+	}
+	if s.DNSResponse.A.AllocatedIP != "" || len(database.GetReverseDNSByClientType(client, dns.TypeA)) != 0 {
+		t.Errorf("the forwarding address %s of the stale session was not released", s.DNSResponse.A.AllocatedIP)
+	}
+	if database.GetDNSSession(client, "old.example.com.", dns.TypeA) != nil {
+		t.Errorf("the session beyond the stale hours was kept")
+	}
+}
@@ -57,3 +57,8 @@ func (n *natManager) Flush() error {
 func (n *natManager) RemoveAllowPort(protocol string, port int) error {
 	return errors.New("Not implemented")
 }
+
+// SetBypassRules implements FirewallManager.
+func (n *natManager) SetBypassRules(rules BypassRules) error {
+	return errors.New("Not implemented")
+}
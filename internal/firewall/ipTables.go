@@ -5,6 +5,7 @@ package firewall
 
 import (
 	"fmt"
+	"net"
 	"os"
 	"sleuth/internal/constants"
 	"sleuth/internal/log"
@@ -14,7 +15,8 @@ import (
 )
 
 type ipTables struct {
-	ipt *iptables.IPTables
+	ipt  *iptables.IPTables
+	ip6t *iptables.IPTables
 }
 
 func NewIptablesManager() (Firewall, error) {
@@ -22,7 +24,22 @@ func NewIptablesManager() (Firewall, error) {
 	if err != nil {
 		return nil, err
 	}
-	return &ipTables{ipt: ipt}, nil
+	// IPv6 is optional, forwarding of AAAA records is disabled without ip6tables
+	ip6t, err := iptables.NewWithProtocol(iptables.ProtocolIPv6)
+	if err != nil {
+		log.Errorf("ip6tables not available: %v", err)
+		ip6t = nil
+	}
+	return &ipTables{ipt: ipt, ip6t: ip6t}, nil
+}
+
+// table returns the ip(6)tables handle for the address family of the rule
+func (m *ipTables) table(fwdrule *constants.FwdRule) *iptables.IPTables {
+	ip := net.ParseIP(fwdrule.AllocatedIP)
+	if ip != nil && ip.To4() == nil {
+		return m.ip6t
+	}
+	return m.ipt
 }
 
 func (m *ipTables) Name() string {
@@ -32,48 +49,56 @@ func (m *ipTables) Name() string {
 func (m *ipTables) Init(fwdrules []constants.FwdRule) error {
 	os.WriteFile("/proc/sys/net/ipv4/ip_forward", []byte("1"), 0644)
 
+	initTable(m.ipt)
+	if m.ip6t != nil {
+		os.WriteFile("/proc/sys/net/ipv6/conf/all/forwarding", []byte("1"), 0644)
+		initTable(m.ip6t)
+	}
+
+	for _, r := range fwdrules {
+		if r.AllocatedIP != "" {
+			m.AddForwardRule(&r)
+		}
+	}
+
+	return nil
+}
+
+func initTable(ipt *iptables.IPTables) {
 	// Flush the NAT table
-	err := m.ipt.ClearChain("nat", "PREROUTING")
+	err := ipt.ClearChain("nat", "PREROUTING")
 	if err != nil {
 		fmt.Printf("Error flushing PREROUTING chain: %v\n", err)
 	}
 
-	err = m.ipt.ClearChain("nat", "POSTROUTING")
+	err = ipt.ClearChain("nat", "POSTROUTING")
 	if err != nil {
 		fmt.Printf("Error flushing POSTROUTING chain: %v\n", err)
 	}
 
-	err = m.ipt.ClearChain("nat", "INPUT")
+	err = ipt.ClearChain("nat", "INPUT")
 	if err != nil {
 		fmt.Printf("Error flushing INPUT chain: %v\n", err)
 	}
 
-	err = m.ipt.ClearChain("nat", "OUTPUT")
+	err = ipt.ClearChain("nat", "OUTPUT")
 	if err != nil {
 		fmt.Printf("Error flushing OUTPUT chain: %v\n", err)
 	}
 
 	// Set the default FORWARD policy to ACCEPT
-	err = m.ipt.ChangePolicy("filter", "FORWARD", "ACCEPT")
+	err = ipt.ChangePolicy("filter", "FORWARD", "ACCEPT")
 	if err != nil {
 		fmt.Println(fmt.Errorf("Error setting FORWARD policy: %v", err))
 	} else {
 		fmt.Println("Set default FORWARD policy to ACCEPT")
 	}
-	err = m.ipt.Append("nat", "POSTROUTING", "-j", "MASQUERADE")
+	err = ipt.Append("nat", "POSTROUTING", "-j", "MASQUERADE")
 	if err != nil {
 		fmt.Println(fmt.Errorf("Error appending POSTROUTING MASQUERADE rule: %v", err))
 	} else {
 		fmt.Println("Appended POSTROUTING MASQUERADE rule")
 	}
-
-	for _, r := range fwdrules {
-		if r.AllocatedIP != "" {
-			m.AddForwardRule(&r)
-		}
-	}
-
-	return nil
 }
 
 func (m *ipTables) Close(fwdrules []constants.FwdRule) error {
@@ -91,6 +116,15 @@ func getDestIP(fwdrule *constants.FwdRule) (string, string) {
 	return fwdrule.TargetIP, chain
 }
 
+// dnatMatch returns the rule specification of the DNAT to the destination, IPv6 forwards match the MAC
+// address of the client as its IPv6 source address is not known
+func dnatMatch(fwdrule *constants.FwdRule, ipv6 bool, destIP string) []string {
+	if ipv6 {
+		return []string{"-m", "mac", "--mac-source", fwdrule.MacAddress, "-d", fwdrule.AllocatedIP, "-j", "DNAT", "--to-destination", destIP}
+	}
+	return []string{"-s", fwdrule.ClientIP, "-d", fwdrule.AllocatedIP, "-j", "DNAT", "--to-destination", destIP}
+}
+
 func (m *ipTables) AddForwardRule(fwdrule *constants.FwdRule) error {
 	/*err := m.ipt.Append("nat", "PREROUTING", "-s", fwdrule.ClientIP, "-d", IP4fromOffset(fwdrule.DestIPOffset), "-j", "DNAT", "--to-destination", fwdrule.OrigIP)
 	if err != nil {
@@ -98,11 +132,27 @@ func (m *ipTables) AddForwardRule(fwdrule *constants.FwdRule) error {
 	}*/
 
 	destIP, chain := getDestIP(fwdrule)
+	ipt := m.table(fwdrule)
 
 	if fwdrule.ClientIP == fwdrule.AllocatedIP {
 		log.Errorf("unexpected IP allocation %s", fwdrule.ClientIP)
+	} else if ipt == nil {
+		return fmt.Errorf("ip6tables not available for %s", fwdrule.AllocatedIP)
+	} else if destIP == "" {
+		return fmt.Errorf("no destination for %s", fwdrule.AllocatedIP)
+	} else if ipt == m.ip6t {
+		if fwdrule.MacAddress == "" {
+			return fmt.Errorf("no MAC address of client %s for %s", fwdrule.ClientIP, fwdrule.AllocatedIP)
+		}
+		err := ipt.Append("nat", chain, dnatMatch(fwdrule, true, destIP)...)
+		if err != nil {
+			fmt.Printf("Error appending %s, DNAT rule %s -> %s -> %s, %v\n", chain, fwdrule.HostName, fwdrule.AllocatedIP, destIP, err)
+			return err
+		} else {
+			fmt.Printf("Created %s Rule %s, %s: %s -> %s\n", chain, fwdrule.ClientIP, fwdrule.HostName, fwdrule.AllocatedIP, destIP)
+		}
 	} else {
-		err := m.ipt.Append("nat", chain, "-s", fwdrule.ClientIP, "-d", fwdrule.AllocatedIP, "-j", "DNAT", "--to-destination", destIP)
+		err := ipt.Append("nat", chain, dnatMatch(fwdrule, false, destIP)...)
 		if err != nil {
 			fmt.Printf("Error appending %s, DNAT rule %s -> %s -> %s, %v\n", chain, fwdrule.HostName, fwdrule.AllocatedIP, destIP, err)
 			return err
@@ -110,8 +160,8 @@ func (m *ipTables) AddForwardRule(fwdrule *constants.FwdRule) error {
 			fmt.Printf("Created %s Rule %s, %s: %s -> %s\n", chain, fwdrule.ClientIP, fwdrule.HostName, fwdrule.AllocatedIP, destIP)
 		}
 		if chain == "PREROUTING" {
-			m.ipt.AppendUnique("filter", "FORWARD", "-s", fwdrule.ClientIP, "-j", "ACCEPT")
-			m.ipt.AppendUnique("filter", "FORWARD", "-d", fwdrule.ClientIP, "-j", "ACCEPT")
+			ipt.AppendUnique("filter", "FORWARD", "-s", fwdrule.ClientIP, "-j", "ACCEPT")
+			ipt.AppendUnique("filter", "FORWARD", "-d", fwdrule.ClientIP, "-j", "ACCEPT")
 		}
 	}
 
@@ -125,7 +175,11 @@ func (m *ipTables) RemoveForwardRule(fwdrule *constants.FwdRule) error {
 		return err
 	}*/
 	destIP, chain := getDestIP(fwdrule)
-	err := m.ipt.Delete("nat", chain, "-s", fwdrule.ClientIP, "-d", fwdrule.AllocatedIP, "-j", "DNAT", "--to-destination", destIP)
+	ipt := m.table(fwdrule)
+	if ipt == nil {
+		return fmt.Errorf("ip6tables not available for %s", fwdrule.AllocatedIP)
+	}
+	err := ipt.Delete("nat", chain, dnatMatch(fwdrule, ipt == m.ip6t, destIP)...)
 	if err != nil {
 		fmt.Printf("Error deleting %s rule %s -> %s -> %v\n", fwdrule.HostName, fwdrule.AllocatedIP, destIP, err)
 		return err
@@ -149,6 +203,10 @@ func (m *ipTables) RemoveForwardRule(fwdrule *constants.FwdRule) error {
 
 func (m *ipTables) GetStats() ([]Stat, error) {
 	stats, _ := m.ipt.StructuredStats("nat", "OUTPUT")
+	if m.ip6t != nil {
+		stats6, _ := m.ip6t.StructuredStats("nat", "OUTPUT")
+		stats = append(stats, stats6...)
+	}
 	output := make([]Stat, 0)
 	for _, stat := range stats {
 		output = append(output, Stat{
@@ -168,6 +226,46 @@ func (m *ipTables) RemoveAllowPort(protocol string, port int) error {
 	return m.ipt.Delete("filter", "INPUT", "-p", protocol, "--dport", strconv.Itoa(port), "-j", "ACCEPT")
 }
 
+// SetBypassRules drops the forwarded traffic to the blocked addresses in the SLEUTH-BYPASS chain of the filter
+// table and redirects the DNS ports in the SLEUTH-REDIRECT chain of the nat table
+func (m *ipTables) SetBypassRules(rules BypassRules) error {
+	for _, ipt := range []*iptables.IPTables{m.ipt, m.ip6t} {
+		if ipt == nil {
+			continue
+		}
+		// ClearChain creates the chain when missing, Init flushes PREROUTING and with it the jump
+		if err := ipt.ClearChain("filter", "SLEUTH-BYPASS"); err != nil {
+			return err
+		}
+		if err := ipt.ClearChain("nat", "SLEUTH-REDIRECT"); err != nil {
+			return err
+		}
+		if err := ipt.InsertUnique("filter", "FORWARD", 1, "-j", "SLEUTH-BYPASS"); err != nil {
+			return err
+		}
+		if err := ipt.InsertUnique("nat", "PREROUTING", 1, "-j", "SLEUTH-REDIRECT"); err != nil {
+			return err
+		}
+		for _, ip := range rules.Blocked {
+			if (ip.To4() != nil) != (ipt == m.ipt) {
+				continue
+			}
+			if err := ipt.Append("filter", "SLEUTH-BYPASS", "-d", ip.String(), "-j", "DROP"); err != nil {
+				return err
+			}
+		}
+		for _, port := range rules.Redirect {
+			for _, protocol := range []string{"udp", "tcp"} {
+				if err := ipt.Append("nat", "SLEUTH-REDIRECT", "-p", protocol, "--dport", strconv.Itoa(port), "-j", "REDIRECT"); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	fmt.Printf("Installed bypass rules, %d blocked addresses, %d redirected ports\n", len(rules.Blocked), len(rules.Redirect))
+	return nil
+}
+
 func (m *ipTables) Flush() error {
 	// best-effort: delete rules we added is safer; here we do nothing.
 	return nil
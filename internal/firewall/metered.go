@@ -0,0 +1,47 @@
+package firewall
+
+import (
+	"sleuth/internal/constants"
+	"sleuth/internal/metrics"
+)
+
+// meteredFirewall counts the failed operations of a firewall backend
+type meteredFirewall struct {
+	Firewall
+}
+
+func (f meteredFirewall) count(operation string, err error) error {
+	if err != nil {
+		metrics.FirewallErrors.WithLabelValues(f.Name(), operation).Inc()
+	}
+	return err
+}
+
+func (f meteredFirewall) Init(fwdrules []constants.FwdRule) error {
+	return f.count("init", f.Firewall.Init(fwdrules))
+}
+
+func (f meteredFirewall) Close(fwdrules []constants.FwdRule) error {
+	return f.count("close", f.Firewall.Close(fwdrules))
+}
+
+func (f meteredFirewall) AddForwardRule(fwdrule *constants.FwdRule) error {
+	return f.count("add", f.Firewall.AddForwardRule(fwdrule))
+}
+
+func (f meteredFirewall) RemoveForwardRule(fwdrule *constants.FwdRule) error {
+	return f.count("remove", f.Firewall.RemoveForwardRule(fwdrule))
+}
+
+func (f meteredFirewall) GetStats() ([]Stat, error) {
+	stats, err := f.Firewall.GetStats()
+	return stats, f.count("stats", err)
+}
+
+func (f meteredFirewall) Flush() error {
+	return f.count("flush", f.Firewall.Flush())
+}
+
+func (f meteredFirewall) SetBypassRules(rules BypassRules) error {
+	return f.count("bypass", f.Firewall.SetBypassRules(rules))
+}
@@ -4,20 +4,75 @@
 package firewall
 
 import (
+	"bytes"
 	"encoding/binary"
-	"errors"
 	"fmt"
+	"net"
+	"os"
 	"sleuth/internal/constants"
+	"sleuth/internal/log"
+	"strings"
+	"sync"
 
 	"github.com/google/nftables"
+	"github.com/google/nftables/binaryutil"
 	"github.com/google/nftables/expr"
+	"github.com/google/nftables/userdata"
 	"golang.org/x/sys/unix"
 )
 
+// nftables layout, all rules live in the inet table "sleuth":
+//
+//	count_prerouting, count_output  filter hooks before DNAT, jump to the counters chain
+//	counters                        one rule per forward rule updating its named counter
+//	prerouting, output              DNAT through the fwd4 (client . allocated) and fwd6 (client MAC .
+//	                                allocated) maps,
+//	                                prerouting jumps to the redirect chain first
+//	redirect                        redirects the DNS ports of SetBypassRules to the portal
+//	postrouting                     masquerades DNATed connections
+//	input                           ports allowed by AddAllowPort
+//	bypass                          drops forwarded traffic to the bypass4 and bypass6 sets
+const (
+	nfTableName     = "sleuth"
+	nfMap4          = "fwd4"
+	nfMap6          = "fwd6"
+	nfBypass4       = "bypass4"
+	nfBypass6       = "bypass6"
+	nfCounters      = "counters"
+	nfInput         = "input"
+	nfRedirect      = "redirect"
+	nfBypass        = "bypass"
+	nfCounterPrefix = "fwd-"
+	nfAllowPrefix   = "allow-"
+)
+
+// ctStatusDNAT is IPS_DST_NAT of the conntrack status
+const ctStatusDNAT = 0x20
+
 type nfTables struct {
+	mu    sync.Mutex
 	conn  *nftables.Conn
 	table *nftables.Table
-	chain *nftables.Chain
+	// chains by name
+	chains map[string]*nftables.Chain
+	fwd4   *nftables.Set
+	fwd6   *nftables.Set
+	// blocked addresses of SetBypassRules
+	bypass4 *nftables.Set
+	bypass6 *nftables.Set
+	// forwards by key, see nfKey
+	forwards map[string]*nfForward
+}
+
+// nfForward is an installed forward rule
+type nfForward struct {
+	client net.IP
+	// mac identifies the client of IPv6 forwards
+	mac       net.HardwareAddr
+	allocated net.IP
+	target    net.IP
+	// handle of the rule in the counters chain
+	handle uint64
 }
 
 func (m *nfTables) Name() string {
@@ -25,26 +80,59 @@ func (m *nfTables) Name() string {
 }
 
 func NewNftablesManager() (Firewall, error) {
-	c := &nftables.Conn{}
-	// use a dedicated table for the app
-	tbl := c.AddTable(&nftables.Table{
-		Family: nftables.TableFamilyIPv4,
-		Name:   "sleuth_fw",
-	})
-	// input chain hooked to input with policy accept (we'll add accept rules)
-	policy := nftables.ChainPolicyAccept
-	ch := c.AddChain(&nftables.Chain{
-		Table:    tbl,
-		Name:     "input",
-		Type:     nftables.ChainTypeFilter,
-		Hooknum:  nftables.ChainHookInput,
-		Priority: nftables.ChainPriorityFilter,
-		Policy:   &policy,
-	})
-	if err := c.Flush(); err != nil {
+	c, err := nftables.New()
+	if err != nil {
+		return nil, err
+	}
+	// fails without CAP_NET_ADMIN or nf_tables support in the kernel
+	if _, err := c.ListTablesOfFamily(nftables.TableFamilyINet); err != nil {
 		return nil, err
 	}
-	return &nfTables{conn: c, table: tbl, chain: ch}, nil
+	return newNfTables(c), nil
+}
+
+// newNfTables returns the manager with the table, maps and chains of the layout
+func newNfTables(c *nftables.Conn) *nfTables {
+	m := &nfTables{
+		conn:     c,
+		table:    &nftables.Table{Family: nftables.TableFamilyINet, Name: nfTableName},
+		forwards: make(map[string]*nfForward),
+	}
+	m.fwd4 = &nftables.Set{
+		Table:         m.table,
+		Name:          nfMap4,
+		IsMap:         true,
+		Concatenation: true,
+		KeyType:       nftables.MustConcatSetType(nftables.TypeIPAddr, nftables.TypeIPAddr),
+		DataType:      nftables.TypeIPAddr,
+	}
+	m.fwd6 = &nftables.Set{
+		Table:         m.table,
+		Name:          nfMap6,
+		IsMap:         true,
+		Concatenation: true,
+		KeyType:       nftables.MustConcatSetType(nftables.TypeEtherAddr, nftables.TypeIP6Addr),
+		DataType:      nftables.TypeIP6Addr,
+	}
+	m.bypass4 = &nftables.Set{Table: m.table, Name: nfBypass4, KeyType: nftables.TypeIPAddr}
+	m.bypass6 = &nftables.Set{Table: m.table, Name: nfBypass6, KeyType: nftables.TypeIP6Addr}
+	policy := nftables.ChainPolicyAccept
+	m.chains = map[string]*nftables.Chain{
+		"count_prerouting": {Type: nftables.ChainTypeFilter, Hooknum: nftables.ChainHookPrerouting, Priority: nftables.ChainPriorityMangle, Policy: &policy},
+		"count_output":     {Type: nftables.ChainTypeFilter, Hooknum: nftables.ChainHookOutput, Priority: nftables.ChainPriorityMangle, Policy: &policy},
+		nfCounters:         {},
+		"prerouting":       {Type: nftables.ChainTypeNAT, Hooknum: nftables.ChainHookPrerouting, Priority: nftables.ChainPriorityNATDest, Policy: &policy},
+		"output":           {Type: nftables.ChainTypeNAT, Hooknum: nftables.ChainHookOutput, Priority: nftables.ChainPriorityNATDest, Policy: &policy},
+		"postrouting":      {Type: nftables.ChainTypeNAT, Hooknum: nftables.ChainHookPostrouting, Priority: nftables.ChainPriorityNATSource, Policy: &policy},
+		nfInput:            {Type: nftables.ChainTypeFilter, Hooknum: nftables.ChainHookInput, Priority: nftables.ChainPriorityFilter, Policy: &policy},
+		nfRedirect:         {},
+		nfBypass:           {Type: nftables.ChainTypeFilter, Hooknum: nftables.ChainHookForward, Priority: nftables.ChainPriorityFilter, Policy: &policy},
+	}
+	for name, ch := range m.chains {
+		ch.Table = m.table
+		ch.Name = name
+	}
+	return m
 }
 
 func protoNum(proto string) (uint8, error) {
@@ -58,38 +146,112 @@ func protoNum(proto string) (uint8, error) {
 	}
 }
 
-func (m *nfTables) Init(fwdrules []constants.FwdRule) error {
-	return nil
+// nfKey identifies the forward rule, allocated IPv6 addresses are unique per client
+func nfKey(client net.IP, allocated net.IP) string {
+	if allocated.To4() == nil {
+		return allocated.String()
+	}
+	return client.String() + "-" + allocated.String()
 }
 
-func (m *nfTables) Close(fwdrules []constants.FwdRule) error {
-	return nil
+func comment(s string) []byte {
+	return userdata.AppendString(nil, userdata.TypeComment, s)
 }
 
-func (m *nfTables) AddForwardRule(fwdrule *constants.FwdRule) error {
-	return errors.New("Not implemented")
+func matchFamily(family byte) []expr.Any {
+	return []expr.Any{
+		&expr.Meta{Key: expr.MetaKeyNFPROTO, Register: 1},
+		&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: []byte{family}},
+	}
 }
 
-func (m *nfTables) RemoveForwardRule(fwdrule *constants.FwdRule) error {
-	return errors.New("Not implemented")
+// matchAddress compares the source (offset 12/8) or destination (offset 16/24) address
+func matchAddress(ip net.IP, source bool) []expr.Any {
+	offset, data := uint32(16), []byte(ip.To4())
+	if source {
+		offset = 12
+	}
+	if data == nil {
+		offset, data = 24, []byte(ip.To16())
+		if source {
+			offset = 8
+		}
+	}
+	return []expr.Any{
+		&expr.Payload{DestRegister: 1, Base: expr.PayloadBaseNetworkHeader, Offset: offset, Len: uint32(len(data))},
+		&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: data},
+	}
 }
 
-func (m *nfTables) GetStats() ([]Stat, error) {
-	return nil, nil
+// matchMAC compares the source address of the link layer header
+func matchMAC(mac net.HardwareAddr) []expr.Any {
+	return []expr.Any{
+		&expr.Payload{DestRegister: 1, Base: expr.PayloadBaseLLHeader, Offset: 6, Len: 6},
+		&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: []byte(mac)},
+	}
 }
 
-func (m *nfTables) AddAllowPort(protocol string, port int) error {
-	pnum, err := protoNum(protocol)
-	if err != nil {
-		return err
+// forward parses the addresses of the forward rule
+func forward(fwdrule *constants.FwdRule) (*nfForward, error) {
+	destIP, _ := getDestIP(fwdrule)
+	f := &nfForward{
+		client:    net.ParseIP(fwdrule.ClientIP),
+		allocated: net.ParseIP(fwdrule.AllocatedIP),
+		target:    net.ParseIP(destIP),
+	}
+	switch {
+	case f.allocated == nil:
+		return nil, fmt.Errorf("invalid allocated address %q", fwdrule.AllocatedIP)
+	case f.target == nil:
+		return nil, fmt.Errorf("no destination for %s", fwdrule.AllocatedIP)
+	case (f.allocated.To4() == nil) != (f.target.To4() == nil):
+		return nil, fmt.Errorf("address family of %s and %s differ", fwdrule.AllocatedIP, destIP)
+	case f.allocated.To4() != nil && (f.client == nil || f.client.To4() == nil):
+		return nil, fmt.Errorf("invalid client address %q", fwdrule.ClientIP)
 	}
-	// payload expr to match L4 proto and dport, then accept
+	if f.allocated.To4() == nil {
+		mac, err := net.ParseMAC(fwdrule.MacAddress)
+		if err != nil || len(mac) != 6 {
+			return nil, fmt.Errorf("invalid MAC address %q of client %s", fwdrule.MacAddress, fwdrule.ClientIP)
+		}
+		f.mac = mac
+	}
+	return f, nil
+}
+
+// element returns the map and the map element of the forward rule
+func (m *nfTables) element(f *nfForward) (*nftables.Set, nftables.SetElement) {
+	if f.allocated.To4() == nil {
+		// the 6 bytes of the MAC address are padded to the register size
+		key := append(append(append([]byte{}, f.mac...), 0, 0), f.allocated.To16()...)
+		return m.fwd6, nftables.SetElement{Key: key, Val: f.target.To16()}
+	}
+	return m.fwd4, nftables.SetElement{Key: append(append([]byte{}, f.client.To4()...), f.allocated.To4()...), Val: f.target.To4()}
+}
+
+// counterRule returns the rule of the counters chain that updates the named counter of the forward rule
+func (m *nfTables) counterRule(key string, f *nfForward) *nftables.Rule {
+	exprs := append(matchFamily(unix.NFPROTO_IPV6), matchMAC(f.mac)...)
+	if f.allocated.To4() != nil {
+		exprs = append(matchFamily(unix.NFPROTO_IPV4), matchAddress(f.client, true)...)
+	}
+	exprs = append(exprs, matchAddress(f.allocated, false)...)
+	exprs = append(exprs, &expr.Objref{Type: int(nftables.ObjTypeCounter), Name: nfCounterPrefix + key})
+	return &nftables.Rule{
+		Table:    m.table,
+		Chain:    m.chains[nfCounters],
+		Exprs:    exprs,
+		UserData: comment(key),
+	}
+}
+
+// matchPort compares the layer 4 protocol and the destination port
+func matchPort(protocol uint8, port int) []expr.Any {
 	dport := make([]byte, 2)
 	binary.BigEndian.PutUint16(dport, uint16(port))
-
-	exprs := []expr.Any{
+	return []expr.Any{
 		&expr.Meta{Key: expr.MetaKeyL4PROTO, Register: 1},
-		&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: []byte{byte(pnum)}},
+		&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: []byte{protocol}},
 		&expr.Payload{
 			DestRegister: 1,
 			Base:         expr.PayloadBaseTransportHeader,
@@ -97,26 +259,477 @@ func (m *nfTables) AddAllowPort(protocol string, port int) error {
 			Len:          2,
 		},
 		&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: dport},
-		&expr.Verdict{Kind: expr.VerdictAccept},
 	}
+}
 
+// bypassRules returns the rules of the bypass chain that drop traffic to the addresses in the bypass sets
+func (m *nfTables) bypassRules() []*nftables.Rule {
+	ipv4 := append(matchFamily(unix.NFPROTO_IPV4),
+		&expr.Payload{DestRegister: 1, Base: expr.PayloadBaseNetworkHeader, Offset: 16, Len: 4},
+		&expr.Lookup{SourceRegister: 1, SetName: m.bypass4.Name, SetID: m.bypass4.ID},
+		&expr.Verdict{Kind: expr.VerdictDrop},
+	)
+	ipv6 := append(matchFamily(unix.NFPROTO_IPV6),
+		&expr.Payload{DestRegister: 1, Base: expr.PayloadBaseNetworkHeader, Offset: 24, Len: 16},
+		&expr.Lookup{SourceRegister: 1, SetName: m.bypass6.Name, SetID: m.bypass6.ID},
+		&expr.Verdict{Kind: expr.VerdictDrop},
+	)
+	return []*nftables.Rule{
+		{Table: m.table, Chain: m.chains[nfBypass], Exprs: ipv4},
+		{Table: m.table, Chain: m.chains[nfBypass], Exprs: ipv6},
+	}
+}
+
+// dnatRules returns the DNAT rules of the nat chains, the destination is looked up in the maps
+func (m *nfTables) dnatRules(chain *nftables.Chain) []*nftables.Rule {
+	ipv4 := append(matchFamily(unix.NFPROTO_IPV4),
+		// ip saddr . ip daddr
+		&expr.Payload{DestRegister: unix.NFT_REG32_00, Base: expr.PayloadBaseNetworkHeader, Offset: 12, Len: 4},
+		&expr.Payload{DestRegister: unix.NFT_REG32_01, Base: expr.PayloadBaseNetworkHeader, Offset: 16, Len: 4},
+		&expr.Lookup{SourceRegister: unix.NFT_REG32_00, DestRegister: 1, IsDestRegSet: true, SetName: m.fwd4.Name, SetID: m.fwd4.ID},
+		&expr.NAT{Type: expr.NATTypeDestNAT, Family: unix.NFPROTO_IPV4, RegAddrMin: 1},
+	)
+	ipv6 := append(matchFamily(unix.NFPROTO_IPV6),
+		// ether saddr . ip6 daddr, locally generated packets have no link layer header and do not match
+		&expr.Payload{DestRegister: unix.NFT_REG32_00, Base: expr.PayloadBaseLLHeader, Offset: 6, Len: 6},
+		&expr.Payload{DestRegister: unix.NFT_REG32_02, Base: expr.PayloadBaseNetworkHeader, Offset: 24, Len: 16},
+		&expr.Lookup{SourceRegister: unix.NFT_REG32_00, DestRegister: 1, IsDestRegSet: true, SetName: m.fwd6.Name, SetID: m.fwd6.ID},
+		&expr.NAT{Type: expr.NATTypeDestNAT, Family: unix.NFPROTO_IPV6, RegAddrMin: 1},
+	)
+	return []*nftables.Rule{
+		{Table: m.table, Chain: chain, Exprs: ipv4},
+		{Table: m.table, Chain: chain, Exprs: ipv6},
+	}
+}
+
+// setup creates the table, chains and maps when missing and replaces the rules of the base chains,
+// forward rules, allowed ports and bypass rules are kept
+func (m *nfTables) setup() error {
+	m.conn.AddTable(m.table)
+	for _, name := range []string{nfCounters, nfRedirect, "count_prerouting", "count_output", "prerouting", "output", "postrouting", nfInput, nfBypass} {
+		m.conn.AddChain(m.chains[name])
+	}
+	for _, set := range []*nftables.Set{m.fwd4, m.fwd6, m.bypass4, m.bypass6} {
+		if err := m.conn.AddSet(set, nil); err != nil {
+			return err
+		}
+	}
+	for _, name := range []string{"count_prerouting", "count_output", "prerouting", "output", "postrouting", nfBypass} {
+		m.conn.FlushChain(m.chains[name])
+	}
+	for _, r := range m.bypassRules() {
+		m.conn.AddRule(r)
+	}
+	m.conn.AddRule(&nftables.Rule{
+		Table: m.table,
+		Chain: m.chains["prerouting"],
+		Exprs: []expr.Any{&expr.Verdict{Kind: expr.VerdictJump, Chain: nfRedirect}},
+	})
+	for _, name := range []string{"count_prerouting", "count_output"} {
+		m.conn.AddRule(&nftables.Rule{
+			Table: m.table,
+			Chain: m.chains[name],
+			Exprs: []expr.Any{&expr.Verdict{Kind: expr.VerdictJump, Chain: nfCounters}},
+		})
+	}
+	for _, name := range []string{"prerouting", "output"} {
+		for _, r := range m.dnatRules(m.chains[name]) {
+			m.conn.AddRule(r)
+		}
+	}
 	m.conn.AddRule(&nftables.Rule{
 		Table: m.table,
-		Chain: m.chain,
-		Exprs: exprs,
+		Chain: m.chains["postrouting"],
+		Exprs: []expr.Any{
+			&expr.Ct{Register: 1, Key: expr.CtKeySTATUS},
+			&expr.Bitwise{SourceRegister: 1, DestRegister: 1, Len: 4,
+				Mask: binaryutil.NativeEndian.PutUint32(ctStatusDNAT), Xor: binaryutil.NativeEndian.PutUint32(0)},
+			&expr.Cmp{Op: expr.CmpOpNeq, Register: 1, Data: binaryutil.NativeEndian.PutUint32(0)},
+			&expr.Masq{},
+		},
+	})
+	return m.conn.Flush()
+}
+
+// handles returns the rules of the chain by the key stored in their comment
+func (m *nfTables) handles(chain string) (map[string]*nftables.Rule, error) {
+	rules, err := m.conn.GetRules(m.table, m.chains[chain])
+	if err != nil {
+		return nil, err
+	}
+	handles := make(map[string]*nftables.Rule)
+	for _, r := range rules {
+		if key, ok := userdata.GetString(r.UserData, userdata.TypeComment); ok {
+			handles[key] = r
+		}
+	}
+	return handles, nil
+}
+
+// Init creates the table and reconciles the installed forward rules with fwdrules, stale map elements,
+// counters and rules are removed and missing ones are added
+func (m *nfTables) Init(fwdrules []constants.FwdRule) error {
+	os.WriteFile("/proc/sys/net/ipv4/ip_forward", []byte("1"), 0644)
+	os.WriteFile("/proc/sys/net/ipv6/conf/all/forwarding", []byte("1"), 0644)
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if err := m.setup(); err != nil {
+		return fmt.Errorf("nftables setup: %w", err)
+	}
+
+	desired := make(map[string]*nfForward)
+	for i := range fwdrules {
+		if fwdrules[i].AllocatedIP == "" || fwdrules[i].ClientIP == fwdrules[i].AllocatedIP {
+			continue
+		}
+		f, err := forward(&fwdrules[i])
+		if err != nil {
+			log.Errorf("nftables: skipping forward rule %s: %v", fwdrules[i].HostName, err)
+			continue
+		}
+		desired[nfKey(f.client, f.allocated)] = f
+	}
+
+	// remove map elements that are not desired or point to another target
+	for _, set := range []*nftables.Set{m.fwd4, m.fwd6} {
+		elements, err := m.conn.GetSetElements(set)
+		if err != nil {
+			return err
+		}
+		stale := make([]nftables.SetElement, 0)
+		for _, e := range elements {
+			var key string
+			var mac net.HardwareAddr
+			if set == m.fwd4 && len(e.Key) == 8 {
+				key = nfKey(net.IP(e.Key[:4]), net.IP(e.Key[4:]))
+			} else if len(e.Key) == 24 {
+				mac, key = net.HardwareAddr(e.Key[:6]), nfKey(nil, net.IP(e.Key[8:]))
+			}
+			if f, ok := desired[key]; !ok || !f.target.Equal(net.IP(e.Val)) || !bytes.Equal(f.mac, mac) {
+				stale = append(stale, nftables.SetElement{Key: e.Key})
+			}
+		}
+		if len(stale) > 0 {
+			if err := m.conn.SetDeleteElements(set, stale); err != nil {
+				return err
+			}
+		}
+	}
+
+	// remove the counting rules and counters of forward rules that are not desired
+	rules, err := m.handles(nfCounters)
+	if err != nil {
+		return err
+	}
+	for key, r := range rules {
+		if _, ok := desired[key]; !ok {
+			if err := m.conn.DelRule(r); err != nil {
+				return err
+			}
+			delete(rules, key)
+		}
+	}
+	counters := make(map[string]bool)
+	objs, err := m.conn.GetObjects(m.table)
+	if err != nil {
+		return err
+	}
+	for _, o := range objs {
+		c, ok := o.(*nftables.CounterObj)
+		if !ok || !strings.HasPrefix(c.Name, nfCounterPrefix) {
+			continue
+		}
+		key := strings.TrimPrefix(c.Name, nfCounterPrefix)
+		if _, ok := desired[key]; !ok {
+			m.conn.DeleteObject(c)
+		} else {
+			counters[key] = true
+		}
+	}
+	if err := m.conn.Flush(); err != nil {
+		return err
+	}
+
+	m.forwards = make(map[string]*nfForward)
+	for key, f := range desired {
+		set, element := m.element(f)
+		if err := m.conn.SetAddElements(set, []nftables.SetElement{element}); err != nil {
+			return err
+		}
+		if !counters[key] {
+			m.conn.AddObj(&nftables.CounterObj{Table: m.table, Name: nfCounterPrefix + key})
+		}
+		if r, ok := rules[key]; ok {
+			f.handle = r.Handle
+		} else {
+			m.conn.AddRule(m.counterRule(key, f))
+		}
+		m.forwards[key] = f
+	}
+	if err := m.conn.Flush(); err != nil {
+		return err
+	}
+	if err := m.refreshHandles(); err != nil {
+		return err
+	}
+	log.Infof("nftables: %d forward rules installed", len(m.forwards))
+	return nil
+}
+
+// refreshHandles records the handles assigned by the kernel to new counting rules
+func (m *nfTables) refreshHandles() error {
+	rules, err := m.handles(nfCounters)
+	if err != nil {
+		return err
+	}
+	for key, f := range m.forwards {
+		if r, ok := rules[key]; ok {
+			f.handle = r.Handle
+		}
+	}
+	return nil
+}
+
+// Close removes the table so that another backend can take over
+func (m *nfTables) Close(fwdrules []constants.FwdRule) error {
+	return m.Flush()
+}
+
+func (m *nfTables) AddForwardRule(fwdrule *constants.FwdRule) error {
+	if fwdrule.ClientIP == fwdrule.AllocatedIP {
+		log.Errorf("unexpected IP allocation %s", fwdrule.ClientIP)
+		return nil
+	}
+	f, err := forward(fwdrule)
+	if err != nil {
+		return err
+	}
+	key := nfKey(f.client, f.allocated)
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	set, element := m.element(f)
+	existing, ok := m.forwards[key]
+	samemac := ok && bytes.Equal(existing.mac, f.mac)
+	if samemac && existing.target.Equal(f.target) {
+		return nil
+	}
+	if ok {
+		// the target changed, e.g. the access was blocked, the counter is kept and so is its rule unless
+		// the MAC address of the client changed
+		_, previous := m.element(existing)
+		if err := m.conn.SetDeleteElements(set, []nftables.SetElement{{Key: previous.Key}}); err != nil {
+			return err
+		}
+		if samemac {
+			f.handle = existing.handle
+		} else if existing.handle != 0 {
+			if err := m.conn.DelRule(&nftables.Rule{Table: m.table, Chain: m.chains[nfCounters], Handle: existing.handle}); err != nil {
+				return err
+			}
+		}
+	}
+	if err := m.conn.SetAddElements(set, []nftables.SetElement{element}); err != nil {
+		return err
+	}
+	if !ok {
+		m.conn.AddObj(&nftables.CounterObj{Table: m.table, Name: nfCounterPrefix + key})
+	}
+	if !samemac {
+		m.conn.AddRule(m.counterRule(key, f))
+	}
+	if err := m.conn.Flush(); err != nil {
+		log.Errorf("nftables: error adding forward rule %s, %s: %s -> %s, %v", fwdrule.ClientIP, fwdrule.HostName, fwdrule.AllocatedIP, f.target, err)
+		return err
+	}
+	m.forwards[key] = f
+	if f.handle == 0 {
+		if err := m.refreshHandles(); err != nil {
+			return err
+		}
+	}
+	log.Infof("nftables: created forward rule %s, %s: %s -> %s", fwdrule.ClientIP, fwdrule.HostName, fwdrule.AllocatedIP, f.target)
+	return nil
+}
+
+func (m *nfTables) RemoveForwardRule(fwdrule *constants.FwdRule) error {
+	client, allocated := net.ParseIP(fwdrule.ClientIP), net.ParseIP(fwdrule.AllocatedIP)
+	if allocated == nil {
+		return fmt.Errorf("invalid allocated address %q", fwdrule.AllocatedIP)
+	}
+	key := nfKey(client, allocated)
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	f, ok := m.forwards[key]
+	if !ok {
+		return fmt.Errorf("no forward rule for %s", key)
+	}
+	set, element := m.element(f)
+	if err := m.conn.SetDeleteElements(set, []nftables.SetElement{{Key: element.Key}}); err != nil {
+		return err
+	}
+	if f.handle != 0 {
+		if err := m.conn.DelRule(&nftables.Rule{Table: m.table, Chain: m.chains[nfCounters], Handle: f.handle}); err != nil {
+			return err
+		}
+	}
+	if err := m.conn.Flush(); err != nil {
+		log.Errorf("nftables: error deleting forward rule %s, %s: %s -> %s, %v", fwdrule.ClientIP, fwdrule.HostName, fwdrule.AllocatedIP, f.target, err)
+		return err
+	}
+	// the counter can only be deleted once no rule references it
+	m.conn.DeleteObject(&nftables.CounterObj{Table: m.table, Name: nfCounterPrefix + key})
+	if err := m.conn.Flush(); err != nil {
+		log.Errorf("nftables: error deleting counter %s: %v", key, err)
+	}
+	delete(m.forwards, key)
+	log.Infof("nftables: deleted forward rule %s, %s: %s -> %s", fwdrule.ClientIP, fwdrule.HostName, fwdrule.AllocatedIP, f.target)
+	return nil
+}
+
+func (m *nfTables) GetStats() ([]Stat, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	objs, err := m.conn.GetObjects(m.table)
+	if err != nil {
+		return nil, err
+	}
+	output := make([]Stat, 0, len(objs))
+	for _, o := range objs {
+		c, ok := o.(*nftables.CounterObj)
+		if !ok {
+			continue
+		}
+		f, ok := m.forwards[strings.TrimPrefix(c.Name, nfCounterPrefix)]
+		if !ok {
+			continue
+		}
+		stat := Stat{Destination: hostNet(f.allocated), Bytes: c.Bytes}
+		if f.client != nil {
+			stat.Source = hostNet(f.client)
+		}
+		output = append(output, stat)
+	}
+	return output, nil
+}
+
+func hostNet(ip net.IP) net.IPNet {
+	if ip4 := ip.To4(); ip4 != nil {
+		return net.IPNet{IP: ip4, Mask: net.CIDRMask(32, 32)}
+	}
+	return net.IPNet{IP: ip, Mask: net.CIDRMask(128, 128)}
+}
+
+func (m *nfTables) AddAllowPort(protocol string, port int) error {
+	pnum, err := protoNum(protocol)
+	if err != nil {
+		return err
+	}
+	exprs := append(matchPort(pnum, port), &expr.Verdict{Kind: expr.VerdictAccept})
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	key := fmt.Sprintf("%s%s-%d", nfAllowPrefix, protocol, port)
+	m.conn.AddTable(m.table)
+	m.conn.AddChain(m.chains[nfInput])
+	if err := m.conn.Flush(); err != nil {
+		return err
+	}
+	rules, err := m.handles(nfInput)
+	if err != nil {
+		return err
+	}
+	if _, ok := rules[key]; ok {
+		return nil
+	}
+	m.conn.AddRule(&nftables.Rule{
+		Table:    m.table,
+		Chain:    m.chains[nfInput],
+		Exprs:    exprs,
+		UserData: comment(key),
 	})
 	return m.conn.Flush()
 }
 
 func (m *nfTables) RemoveAllowPort(protocol string, port int) error {
-	// For brevity: simplest approach is to flush table and let caller re-add needed rules.
-	// Implementing precise rule deletion requires scanning m.conn.GetRules and matching exprs.
-	return fmt.Errorf("RemoveAllowPort not implemented for nftables backend")
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	key := fmt.Sprintf("%s%s-%d", nfAllowPrefix, protocol, port)
+	rules, err := m.handles(nfInput)
+	if err != nil {
+		return err
+	}
+	r, ok := rules[key]
+	if !ok {
+		return fmt.Errorf("no allow rule for %s/%d", protocol, port)
+	}
+	if err := m.conn.DelRule(r); err != nil {
+		return err
+	}
+	return m.conn.Flush()
+}
+
+// SetBypassRules replaces the addresses of the bypass sets and the rules of the redirect chain, the redirect
+// keeps the destination port
+func (m *nfTables) SetBypassRules(rules BypassRules) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	elements := map[*nftables.Set][]nftables.SetElement{m.bypass4: {}, m.bypass6: {}}
+	seen := make(map[string]bool)
+	for _, ip := range rules.Blocked {
+		if seen[ip.String()] {
+			continue
+		}
+		seen[ip.String()] = true
+		if ip4 := ip.To4(); ip4 != nil {
+			elements[m.bypass4] = append(elements[m.bypass4], nftables.SetElement{Key: ip4})
+		} else {
+			elements[m.bypass6] = append(elements[m.bypass6], nftables.SetElement{Key: ip.To16()})
+		}
+	}
+	for set, e := range elements {
+		m.conn.FlushSet(set)
+		if len(e) == 0 {
+			continue
+		}
+		if err := m.conn.SetAddElements(set, e); err != nil {
+			return err
+		}
+	}
+
+	m.conn.FlushChain(m.chains[nfRedirect])
+	for _, port := range rules.Redirect {
+		for _, pnum := range []uint8{unix.IPPROTO_UDP, unix.IPPROTO_TCP} {
+			m.conn.AddRule(&nftables.Rule{
+				Table: m.table,
+				Chain: m.chains[nfRedirect],
+				Exprs: append(matchPort(pnum, port), &expr.Redir{}),
+			})
+		}
+	}
+	if err := m.conn.Flush(); err != nil {
+		return err
+	}
+	log.Infof("nftables: %d blocked bypass addresses, %d redirected ports", len(seen), len(rules.Redirect))
+	return nil
 }
 
 func (m *nfTables) Flush() error {
-	// remove table (best-effort)
-	if m.conn == nil || m.table == nil {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.forwards = make(map[string]*nfForward)
+	if _, err := m.conn.ListTableOfFamily(nfTableName, nftables.TableFamilyINet); err != nil {
+		// nothing to remove
 		return nil
 	}
 	m.conn.DelTable(m.table)
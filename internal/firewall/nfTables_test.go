@@ -0,0 +1,42 @@
+//go:build linux
+// +build linux
+
+package firewall
+
+import (
+	"bytes"
+	"net"
+	"sleuth/internal/constants"
+	"testing"
+)
+
+func TestNftablesElement(t *testing.T) {
+	m := newNfTables(nil)
+
+	f, err := forward(&constants.FwdRule{ClientIP: "192.168.1.10", AllocatedIP: "10.0.0.1", TargetIP: "93.184.216.34"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	set, element := m.element(f)
+	if set != m.fwd4 || !bytes.Equal(element.Key, []byte{192, 168, 1, 10, 10, 0, 0, 1}) {
+		t.Errorf("IPv4 element key = %v, want the client and allocated address", element.Key)
+	}
+
+	// IPv6 forwards match the MAC address of the client
+	rule := &constants.FwdRule{ClientIP: "192.168.1.10", AllocatedIP: "fd00::c0a8:10a:0:1", TargetIP: "2606:2800::1"}
+	if _, err := forward(rule); err == nil {
+		t.Error("forward without a MAC address of the client succeeded")
+	}
+	rule.MacAddress = "02:00:00:00:00:01"
+	if f, err = forward(rule); err != nil {
+		t.Fatal(err)
+	}
+	set, element = m.element(f)
+	want := append([]byte{2, 0, 0, 0, 0, 1, 0, 0}, net.ParseIP("fd00::c0a8:10a:0:1").To16()...)
+	if set != m.fwd6 || !bytes.Equal(element.Key, want) {
+		t.Errorf("IPv6 element key = %v, want %v", element.Key, want)
+	}
+	if len(element.Key) != int(m.fwd6.KeyType.Bytes) {
+		t.Errorf("IPv6 element key has %d bytes, the map key %d", len(element.Key), m.fwd6.KeyType.Bytes)
+	}
+}
@@ -0,0 +1,108 @@
+package metrics
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+const namespace = "sleuth"
+
+var (
+	DNSQueries = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "dns",
+		Name:      "queries_total",
+		Help:      "DNS queries by response code, result source and query type.",
+	}, []string{"rcode", "source", "qtype"})
+
+	DNSQueryDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Subsystem: "dns",
+		Name:      "query_duration_seconds",
+		Help:      "Time to answer DNS queries by result source.",
+		Buckets:   []float64{.0005, .001, .0025, .005, .01, .025, .05, .1, .25, .5, 1, 2.5},
+	}, []string{"source"})
+
+	DNSUpstreamDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Subsystem: "dns",
+		Name:      "upstream_duration_seconds",
+		Help:      "Upstream DNS exchange latency by DNS configuration and result.",
+		Buckets:   []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5},
+	}, []string{"configuration", "result"})
+
+	DNSCacheLookups = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "dns",
+		Name:      "cache_lookups_total",
+		Help:      "DNS session cache lookups by result (hit or miss).",
+	}, []string{"result"})
+
+	DNSRateLimited = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "dns",
+		Name:      "rate_limited_total",
+		Help:      "Queries dropped by the rate limits by limit (client, subnet or response) and started quarantines.",
+	}, []string{"limit"})
+
+	DNSSECValidations = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "dns",
+		Name:      "dnssec_validations_total",
+		Help:      "DNSSEC validations of upstream answers by result (secure, insecure or bogus).",
+	}, []string{"result"})
+
+	DNSAnswerCacheLookups = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "dns",
+		Name:      "answer_cache_lookups_total",
+		Help:      "Shared upstream answer cache lookups by result (hit or miss).",
+	}, []string{"result"})
+
+	DNSBlocked = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "dns",
+		Name:      "blocked_total",
+		Help:      "DNS queries answered for blocked access by reason code.",
+	}, []string{"reason"})
+
+	FirewallErrors = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "firewall",
+		Name:      "errors_total",
+		Help:      "Failed firewall backend operations by backend and operation.",
+	}, []string{"backend", "operation"})
+
+	WAFBlocks = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "waf",
+		Name:      "blocked_total",
+		Help:      "Requests blocked by the web application firewall by proxied site.",
+	}, []string{"site"})
+)
+
+// gaugeFunc is a gauge with a single label whose values are computed when the metrics are collected
+type gaugeFunc struct {
+	desc   *prometheus.Desc
+	values func() map[string]float64
+}
+
+// NewGaugeFunc registers a gauge with one label, values returns the value of every label value
+func NewGaugeFunc(subsystem string, name string, help string, label string, values func() map[string]float64) prometheus.Collector {
+	g := &gaugeFunc{
+		desc:   prometheus.NewDesc(prometheus.BuildFQName(namespace, subsystem, name), help, []string{label}, nil),
+		values: values,
+	}
+	prometheus.MustRegister(g)
+	return g
+}
+
+func (g *gaugeFunc) Describe(ch chan<- *prometheus.Desc) {
+	ch <- g.desc
+}
+
+func (g *gaugeFunc) Collect(ch chan<- prometheus.Metric) {
+	for label, value := range g.values() {
+		ch <- prometheus.MustNewConstMetric(g.desc, prometheus.GaugeValue, value, label)
+	}
+}
@@ -346,6 +346,17 @@ func (n *Network) FindByMac(mac string) *node {
 	return nil
 }
 
+// FindAllByMac returns the nodes of all addresses seen for the MAC address
+func (n *Network) FindAllByMac(mac string) []*node {
+	nodes := make([]*node, 0)
+	for _, node := range n.Nodes {
+		if node.Mac.String() == mac {
+			nodes = append(nodes, node)
+		}
+	}
+	return nodes
+}
+
 func GetInterfaceIP(remoteAddr string) (string, error) {
 
 	// Get a list of all network interfaces
@@ -379,3 +390,40 @@ func GetInterfaceIP(remoteAddr string) (string, error) {
 
 	return "", fmt.Errorf("no matching IP found for remoteAddr: %s", remoteAddr)
 }
+
+// GetInterfaceIPv6 returns a global IPv6 address of the interface holding the given IPv4 address
+func GetInterfaceIPv6(ipv4 string) (string, error) {
+	interfaces, err := net.Interfaces()
+	if err != nil {
+		return "", fmt.Errorf("error getting interfaces: %v", err)
+	}
+
+	for _, iface := range interfaces {
+		addrs, err := iface.Addrs()
+		if err != nil {
+			continue
+		}
+
+		found := false
+		var ipv6 net.IP
+		for _, addr := range addrs {
+			ipNet, ok := addr.(*net.IPNet)
+			if !ok {
+				continue
+			}
+			if ipNet.IP.String() == ipv4 {
+				found = true
+			} else if ipNet.IP.To4() == nil && ipNet.IP.IsGlobalUnicast() && ipv6 == nil {
+				ipv6 = ipNet.IP
+			}
+		}
+		if found {
+			if ipv6 == nil {
+				return "", fmt.Errorf("no IPv6 address on interface %s", iface.Name)
+			}
+			return ipv6.String(), nil
+		}
+	}
+
+	return "", fmt.Errorf("no interface found for %s", ipv4)
+}
@@ -1,30 +1,41 @@
 package rules
 
 import (
-	"bufio"
-	"bytes"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
 	"log"
 	"net/http"
-	"regexp"
 	"sleuth/internal/db"
 	"slices"
 	"strconv"
 	"strings"
+	"sync"
+	"time"
 )
 
 type DNSRulesEngine struct {
 	db       *db.Db
 	settings *db.Settings
+	// categories is shared by the copies of the engine
+	categories *categoryCache
+}
+
+// categoryCache keeps the categories and their hierarchy in memory until a category is written
+type categoryCache struct {
+	mu         sync.Mutex
+	loaded     bool
+	version    uint64
+	categories []db.DNSCategory
+	hierarchy  []category
 }
 
 func Init(db *db.Db, settings *db.Settings) *DNSRulesEngine {
 	return &DNSRulesEngine{
-		db:       db,
-		settings: settings,
+		db:         db,
+		settings:   settings,
+		categories: &categoryCache{},
 	}
 }
 
@@ -1313,25 +1324,11 @@ func (re *DNSRulesEngine) InitDefaults() {
 	}
 }
 
-func isValidHostSourceRecord(split []string) bool {
-	if len(split) == 0 {
-		return false
-	}
-	if len(split) > 2 {
-		return false
-	}
-	if len(split) == 2 {
-		if split[0] != "0.0.0.0" {
-			return false
-		}
-		if split[0] == "0.0.0.0" && split[1] == "0.0.0.0" {
-			return false
-		}
-	}
-	return true
+func (re DNSRulesEngine) UpdateRuleSet(rs db.DNSRuleSet) error {
+	return re.updateRuleSet(rs, false)
 }
 
-func (re DNSRulesEngine) UpdateRuleSet(rs db.DNSRuleSet) error {
+func (re DNSRulesEngine) updateRuleSet(rs db.DNSRuleSet, scheduled bool) error {
 	if !rs.Enabled {
 		return fmt.Errorf("Ruleset %s not enabled", rs.RuleSetName)
 	}
@@ -1339,30 +1336,52 @@ func (re DNSRulesEngine) UpdateRuleSet(rs db.DNSRuleSet) error {
 		return fmt.Errorf("Ruleset %s source not specified", rs.RuleSetName)
 	}
 
-	data, err := getUrlData(rs.Source)
-	if err != nil {
-		return fmt.Errorf("Unable to fetch ruleset %s: %w", rs.RuleSetName, err)
+	// fetch without holding the lock, a slow source must not hold up other updates and reindexing
+	data, fetchErr := getUrlData(rs.Source)
+
+	updateLock.Lock()
+	defer updateLock.Unlock()
+
+	// the rule set may have been changed or removed while it was fetched
+	current := re.db.GetDNSRuleSet(rs.RuleSetId)
+	if current == nil {
+		return fmt.Errorf("Ruleset %s no longer exists", rs.RuleSetName)
 	}
+	if !current.Enabled {
+		return fmt.Errorf("Ruleset %s not enabled", rs.RuleSetName)
+	}
+	if current.Source != rs.Source {
+		return fmt.Errorf("Ruleset %s source changed during the update", rs.RuleSetName)
+	}
+	rs = *current
 
-	var list = make([]string, 0)
-	reader := bytes.NewReader(data)
-	fileScanner := bufio.NewScanner(reader)
-	fileScanner.Split(bufio.ScanLines)
-	regex := regexp.MustCompile(`\s+`)
-	for fileScanner.Scan() {
-		line := strings.TrimSpace(fileScanner.Text())
-		if line != "" && line[0] != '#' {
-			split := regex.Split(line, -1)
-			if isValidHostSourceRecord(split) {
-				if len(split) == 2 {
-					list = append(list, strings.ToLower(split[1])+".")
-				} else if len(split) == 1 {
-					list = append(list, strings.ToLower(split[0])+".")
-				}
-			}
-		}
+	if fetchErr != nil {
+		err := fmt.Errorf("Unable to fetch ruleset %s: %w", rs.RuleSetName, fetchErr)
+		re.addHistory(&rs, db.DNSRuleSetUpdate{Time: time.Now(), Error: err.Error(), Schedule: scheduled})
+		return err
 	}
-	return re.db.UpdateDNSRules(&rs, &list)
+
+	list, report := parseRules(data, rs.Format)
+	rs.Report = report
+
+	var previous []string
+	if rules := re.db.GetDNSRules(rs.RuleSetId); rules != nil {
+		previous = *rules
+	}
+	err := re.db.UpdateDNSRules(&rs, &list)
+	if err != nil {
+		re.addHistory(&rs, db.DNSRuleSetUpdate{Time: time.Now(), Error: err.Error(), Schedule: scheduled})
+		return err
+	}
+	added, removed := re.reIndexRuleSet(rs, previous, list)
+	return re.addHistory(&rs, db.DNSRuleSetUpdate{
+		Time:     time.Now(),
+		Success:  true,
+		Count:    rs.Count,
+		Added:    added,
+		Removed:  removed,
+		Schedule: scheduled,
+	})
 }
 
 type Signal struct {
@@ -1414,6 +1433,9 @@ func getUrlData(url string) ([]byte, error) {
 }
 
 func (re DNSRulesEngine) ReIndex() error {
+	updateLock.Lock()
+	defer updateLock.Unlock()
+
 	rs := re.db.GetDNSRuleSets()
 	re.db.ClearDnsHostRules()
 	for i := range rs {
@@ -1421,45 +1443,129 @@ func (re DNSRulesEngine) ReIndex() error {
 		rules := re.db.GetDNSRules(rs[i].RuleSetId)
 		if rules != nil {
 			for _, rule := range *rules {
-				name := rule
-				wildcard := false
-				if name[:2] == "*." {
-					wildcard = true
-					name = rule[2:]
-				}
+				re.indexRule(rule, rs[i].CategoryId)
+			}
+		}
+	}
+	return nil
+}
 
-				update := false
-				hr := re.db.GetDnsHostRule(name)
-				if hr == nil {
-					hr = &db.DNSHostRule{
-						Name:               name,
-						WildcardCategories: make([]string, 0),
-						ExactCategories:    make([]string, 0),
-						DomScanCategories:  make([]string, 0),
-					}
-				}
-				if wildcard {
-					if !slices.Contains(hr.WildcardCategories, rs[i].CategoryId) {
-						update = true
-						hr.WildcardCategories = append(hr.WildcardCategories, rs[i].CategoryId)
-					}
-				} else {
-					if !slices.Contains(hr.ExactCategories, rs[i].CategoryId) {
-						update = true
-						hr.ExactCategories = append(hr.ExactCategories, rs[i].CategoryId)
+// splitRule returns the host name of a rule and whether it applies to subdomains or is an exception
+func splitRule(rule string) (string, bool, bool) {
+	exception := strings.HasPrefix(rule, exceptionPrefix)
+	rule = strings.TrimPrefix(rule, exceptionPrefix)
+	if len(rule) > 2 && rule[:2] == "*." {
+		return rule[2:], true, exception
+	}
+	return rule, false, exception
+}
+
+// indexCategories returns the category list of the host rule the rule is indexed in
+func indexCategories(hr *db.DNSHostRule, wildcard bool, exception bool) *[]string {
+	switch {
+	case wildcard && exception:
+		return &hr.WildcardExceptions
+	case exception:
+		return &hr.ExactExceptions
+	case wildcard:
+		return &hr.WildcardCategories
+	}
+	return &hr.ExactCategories
+}
+
+// indexRule adds the category of a rule to the host rule index
+func (re DNSRulesEngine) indexRule(rule string, categoryId string) {
+	name, wildcard, exception := splitRule(rule)
+
+	update := false
+	hr := re.db.GetDnsHostRule(name)
+	if hr == nil {
+		hr = &db.DNSHostRule{
+			Name:               name,
+			WildcardCategories: make([]string, 0),
+			ExactCategories:    make([]string, 0),
+			DomScanCategories:  make([]string, 0),
+		}
+	}
+	categories := indexCategories(hr, wildcard, exception)
+	if !slices.Contains(*categories, categoryId) {
+		update = true
+		*categories = append(*categories, categoryId)
+	}
+	if update {
+		re.db.SetDnsHostRule(hr)
+	}
+}
+
+// unindexRule removes the category of a rule from the host rule index
+func (re DNSRulesEngine) unindexRule(rule string, categoryId string) {
+	name, wildcard, exception := splitRule(rule)
+
+	hr := re.db.GetDnsHostRule(name)
+	if hr == nil {
+		return
+	}
+	categories := indexCategories(hr, wildcard, exception)
+	*categories = slices.DeleteFunc(*categories, func(c string) bool { return c == categoryId })
+	if len(hr.WildcardCategories) == 0 && len(hr.ExactCategories) == 0 && len(hr.DomScanCategories) == 0 &&
+		len(hr.WildcardExceptions) == 0 && len(hr.ExactExceptions) == 0 {
+		re.db.DeleteDnsHostRule(name)
+	} else {
+		re.db.SetDnsHostRule(hr)
+	}
+}
+
+// reIndexRuleSet updates the host rule index with the changes between the previous and the updated rules of a rule set
+func (re DNSRulesEngine) reIndexRuleSet(rs db.DNSRuleSet, previous []string, updated []string) (uint, uint) {
+	var added, removed uint
+	before := make(map[string]bool, len(previous))
+	for _, rule := range previous {
+		before[rule] = true
+	}
+	after := make(map[string]bool, len(updated))
+	for _, rule := range updated {
+		after[rule] = true
+		if !before[rule] {
+			re.indexRule(rule, rs.CategoryId)
+			added++
+		}
+	}
+
+	// rules still listed by another rule set of the same category remain indexed
+	var others map[string]bool
+	for _, rule := range previous {
+		if after[rule] {
+			continue
+		}
+		if others == nil {
+			others = make(map[string]bool)
+			for _, o := range re.db.GetDNSRuleSets() {
+				if o.RuleSetId != rs.RuleSetId && o.CategoryId == rs.CategoryId {
+					if rules := re.db.GetDNSRules(o.RuleSetId); rules != nil {
+						for _, r := range *rules {
+							others[r] = true
+						}
 					}
 				}
-				if update {
-					re.db.SetDnsHostRule(hr)
-				}
 			}
 		}
+		if !others[rule] {
+			re.unindexRule(rule, rs.CategoryId)
+		}
+		removed++
 	}
-	return nil
+	return added, removed
 }
 
-func (re DNSRulesEngine) Test(name string) []string {
+// Match returns the categories of name found in the host rule index
+func (re DNSRulesEngine) Match(name string) []string {
+	matches, _ := re.match(name)
+	return matches
+}
+
+func (re DNSRulesEngine) match(name string) ([]string, bool) {
 	matches := make([]string, 0)
+	exceptions := make([]string, 0)
 	parts := strings.Split(name, ".")
 	domscan := false
 	for i := range parts {
@@ -1473,6 +1579,7 @@ func (re DNSRulesEngine) Test(name string) []string {
 							matches = append(matches, cat)
 						}
 					}
+					exceptions = append(exceptions, hr.ExactExceptions...)
 					for _, cat := range hr.DomScanCategories {
 						domscan = true
 						if !slices.Contains(matches, cat) {
@@ -1485,12 +1592,21 @@ func (re DNSRulesEngine) Test(name string) []string {
 						matches = append(matches, cat)
 					}
 				}
+				exceptions = append(exceptions, hr.WildcardExceptions...)
 			}
 		}
 	}
+	// exception rules allow the host for the category of their rule set
+	matches = slices.DeleteFunc(matches, func(c string) bool { return slices.Contains(exceptions, c) })
+	return matches, domscan
+}
+
+func (re DNSRulesEngine) Test(name string) []string {
+	matches, domscan := re.match(name)
 
 	if domscan == false {
-		if re.settings.APIs.DomScan.Enabled && re.settings.APIs.DomScan.Services.WebSiteCategorization && re.settings.APIs.DomScan.Key != "" {
+		api := re.settings.Snapshot().APIs.DomScan
+		if api.Enabled && api.Services.WebSiteCategorization && api.Key != "" {
 			req, err := http.NewRequest(
 				"GET",
 				fmt.Sprintf("https://domscan.net/v1/categorize?domain=%s", name),
@@ -1501,7 +1617,7 @@ func (re DNSRulesEngine) Test(name string) []string {
 				return matches
 			}
 
-			req.Header.Set("X-API-Key", re.settings.APIs.DomScan.Key)
+			req.Header.Set("X-API-Key", api.Key)
 
 			client := &http.Client{}
 
@@ -1586,24 +1702,71 @@ func (re DNSRulesEngine) getCategoryHierarchy(cat category, cats []db.DNSCategor
 	return result
 }
 
-func (re DNSRulesEngine) GetCategoryHierarchy(cat *category) []category {
-	categories := re.db.GetDNSCategories()
-	if cat == nil {
-		tlc := make([]category, 0)
-		for _, cat := range categories {
-			if cat.ParentCategoryId == nil {
-				c := category{
-					CategoryName: cat.CategoryName,
-					CategoryId:   cat.CategoryId,
-					Enabled:      cat.Enabled,
-					Level:        0,
-				}
-				c.SubCategories = re.getCategoryHierarchy(c, categories)
-				tlc = append(tlc, c)
+func (re DNSRulesEngine) buildCategoryHierarchy(categories []db.DNSCategory) []category {
+	tlc := make([]category, 0)
+	for _, cat := range categories {
+		if cat.ParentCategoryId == nil {
+			c := category{
+				CategoryName: cat.CategoryName,
+				CategoryId:   cat.CategoryId,
+				Enabled:      cat.Enabled,
+				Level:        0,
 			}
+			c.SubCategories = re.getCategoryHierarchy(c, categories)
+			tlc = append(tlc, c)
 		}
+	}
+	return tlc
+}
 
-		return tlc
+// loadCategories returns the categories and their hierarchy, they are loaded from the database again
+// after a category was written
+func (re DNSRulesEngine) loadCategories() ([]db.DNSCategory, []category) {
+	if re.categories == nil {
+		categories := re.db.GetDNSCategories()
+		return categories, re.buildCategoryHierarchy(categories)
+	}
+	re.categories.mu.Lock()
+	defer re.categories.mu.Unlock()
+	version := re.db.DNSCategoriesVersion()
+	if !re.categories.loaded || re.categories.version != version {
+		re.categories.categories = re.db.GetDNSCategories()
+		re.categories.hierarchy = re.buildCategoryHierarchy(re.categories.categories)
+		re.categories.version = version
+		re.categories.loaded = true
+	}
+	return re.categories.categories, re.categories.hierarchy
+}
+
+func (re DNSRulesEngine) GetCategoryHierarchy(cat *category) []category {
+	categories, hierarchy := re.loadCategories()
+	if cat == nil {
+		return hierarchy
 	}
 	return re.getCategoryHierarchy(*cat, categories)
 }
+
+// ExpandCategories returns the given category IDs together with all of their subcategories,
+// mapped to the configured ID they were inherited from
+func (re DNSRulesEngine) ExpandCategories(ids []string) map[string]string {
+	result := make(map[string]string)
+	if len(ids) == 0 {
+		return result
+	}
+	var expand func(id string, cats []category)
+	expand = func(id string, cats []category) {
+		for _, c := range cats {
+			if _, found := result[c.CategoryId]; !found {
+				result[c.CategoryId] = id
+			}
+			expand(id, c.SubCategories)
+		}
+	}
+	for _, id := range ids {
+		result[id] = id
+	}
+	for _, id := range ids {
+		expand(id, re.GetCategoryHierarchy(&category{CategoryId: id}))
+	}
+	return result
+}
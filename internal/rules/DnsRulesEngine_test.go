@@ -0,0 +1,33 @@
+package rules
+
+import (
+	"sleuth/internal/db"
+	"testing"
+)
+
+func TestExpandCategories(t *testing.T) {
+	database := db.InitDB(t.TempDir())
+	t.Cleanup(database.Close)
+	re := Init(database, &db.Settings{})
+	database.CreateDNSCategory(&db.DNSCategory{CategoryId: "social", CategoryName: "Social", Enabled: true})
+	database.CreateDNSCategory(&db.DNSCategory{CategoryId: "chat", CategoryName: "Chat", ParentCategoryId: stringPtr("social"), Enabled: true})
+
+	expanded := re.ExpandCategories([]string{"social"})
+	if len(expanded) != 2 || expanded["chat"] != "social" {
+		t.Errorf("ExpandCategories() = %v", expanded)
+	}
+
+	// the hierarchy in memory is rebuilt after a category was written
+	database.CreateDNSCategory(&db.DNSCategory{CategoryId: "video", CategoryName: "Video", ParentCategoryId: stringPtr("chat"), Enabled: true})
+	expanded = re.ExpandCategories([]string{"social"})
+	if len(expanded) != 3 || expanded["video"] != "social" {
+		t.Errorf("ExpandCategories() = %v after create", expanded)
+	}
+	database.DeleteDNSCategory("video")
+	if expanded = re.ExpandCategories([]string{"social"}); len(expanded) != 2 {
+		t.Errorf("ExpandCategories() = %v after delete", expanded)
+	}
+	if tlc := re.GetCategoryHierarchy(nil); len(tlc) != 1 || len(tlc[0].SubCategories) != 1 {
+		t.Errorf("GetCategoryHierarchy() = %v", tlc)
+	}
+}
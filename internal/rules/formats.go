@@ -0,0 +1,348 @@
+package rules
+
+import (
+	"bufio"
+	"bytes"
+	"net"
+	"regexp"
+	"sleuth/internal/db"
+	"strings"
+)
+
+const (
+	FormatAuto    = ""
+	FormatHosts   = "hosts"
+	FormatAdblock = "adblock"
+	FormatDnsmasq = "dnsmasq"
+	FormatDomains = "domains"
+	FormatRPZ     = "rpz"
+)
+
+// rules prefixed with exceptionPrefix are allow entries
+const exceptionPrefix = "@@"
+
+var (
+	whitespace  = regexp.MustCompile(`\s+`)
+	domainRegex = regexp.MustCompile(`^(\*\.)?([a-z0-9_]([a-z0-9_-]{0,61}[a-z0-9_])?\.)+$`)
+)
+
+// blockedTargets are the addresses that hosts and dnsmasq lists use to block a name
+var blockedTargets = []string{"0.0.0.0", "127.0.0.1", "::", "::1", "#", ""}
+
+// lineResult is the outcome of parsing a single line of a rule set
+type lineResult int
+
+const (
+	lineIgnored lineResult = iota // comments, headers and blank lines
+	lineAccepted
+	lineRejected
+)
+
+type lineParser func(line string, origin *string) ([]string, lineResult)
+
+// parseRules converts the data of a rule set into rules ("name.", "*.name." or "@@name." exceptions)
+func parseRules(data []byte, format string) ([]string, db.DNSRuleSetReport) {
+	if format == FormatAuto {
+		format = detectFormat(data)
+	}
+	report := db.DNSRuleSetReport{Format: format}
+
+	var parse lineParser
+	switch format {
+	case FormatAdblock:
+		parse = parseAdblockLine
+	case FormatDnsmasq:
+		parse = parseDnsmasqLine
+	case FormatDomains:
+		parse = parseDomainLine
+	case FormatRPZ:
+		parse = parseRPZLine
+	default:
+		parse = parseHostsLine
+	}
+
+	list := make([]string, 0)
+	seen := make(map[string]bool)
+	origin := ""
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	scanner.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		rules, result := parse(strings.TrimSpace(scanner.Text()), &origin)
+		switch result {
+		case lineRejected:
+			report.Rejected++
+		case lineAccepted:
+			for _, rule := range rules {
+				if seen[rule] {
+					report.Duplicate++
+					continue
+				}
+				seen[rule] = true
+				if strings.HasPrefix(rule, exceptionPrefix) {
+					report.Exceptions++
+				}
+				report.Accepted++
+				list = append(list, rule)
+			}
+		}
+	}
+	return list, report
+}
+
+// detectFormat guesses the format of a rule set from its first significant lines
+func detectFormat(data []byte) string {
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	scanner.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+	for lines := 0; scanner.Scan() && lines < 100; {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || line[0] == '#' {
+			continue
+		}
+		lines++
+		switch {
+		case strings.HasPrefix(line, "[Adblock"), strings.HasPrefix(line, "||"), strings.HasPrefix(line, "@@"), line[0] == '!':
+			return FormatAdblock
+		case strings.HasPrefix(line, "address=/"), strings.HasPrefix(line, "server=/"), strings.HasPrefix(line, "local=/"):
+			return FormatDnsmasq
+		case line[0] == '$', line[0] == ';', strings.Contains(line, " SOA "), strings.Contains(strings.ToUpper(line), " CNAME "):
+			return FormatRPZ
+		}
+		fields := whitespace.Split(line, -1)
+		if len(fields) > 1 && isBlockedTarget(fields[0]) {
+			return FormatHosts
+		}
+		if len(fields) == 1 {
+			return FormatDomains
+		}
+	}
+	return FormatHosts
+}
+
+func isBlockedTarget(target string) bool {
+	for _, t := range blockedTargets {
+		if target == t {
+			return true
+		}
+	}
+	return false
+}
+
+// normaliseDomain returns the fully qualified lower case name, empty if it is not a valid domain
+func normaliseDomain(name string) string {
+	name = strings.ToLower(strings.TrimSpace(name))
+	if name == "" || name == "." {
+		return ""
+	}
+	if !strings.HasSuffix(name, ".") {
+		name += "."
+	}
+	if !domainRegex.MatchString(name) || net.ParseIP(strings.TrimSuffix(name, ".")) != nil {
+		return ""
+	}
+	switch strings.TrimPrefix(name, "*.") {
+	case "localhost.", "localhost.localdomain.", "local.", "broadcasthost.", "ip6-localhost.", "ip6-loopback.":
+		return ""
+	}
+	return name
+}
+
+// parseHostsLine parses "0.0.0.0 name [name...]" lines
+func parseHostsLine(line string, _ *string) ([]string, lineResult) {
+	if i := strings.IndexByte(line, '#'); i >= 0 {
+		line = strings.TrimSpace(line[:i])
+	}
+	if line == "" {
+		return nil, lineIgnored
+	}
+	split := whitespace.Split(line, -1)
+	names := split
+	if len(split) > 1 {
+		if !isBlockedTarget(split[0]) {
+			return nil, lineRejected
+		}
+		names = split[1:]
+	}
+	rules := make([]string, 0, len(names))
+	for _, n := range names {
+		if name := normaliseDomain(n); name != "" {
+			rules = append(rules, name)
+		}
+	}
+	if len(rules) == 0 {
+		return nil, lineRejected
+	}
+	return rules, lineAccepted
+}
+
+// parseDomainLine parses lists with a single domain per line
+func parseDomainLine(line string, _ *string) ([]string, lineResult) {
+	if i := strings.IndexByte(line, '#'); i >= 0 {
+		line = strings.TrimSpace(line[:i])
+	}
+	if line == "" {
+		return nil, lineIgnored
+	}
+	if name := normaliseDomain(line); name != "" {
+		return []string{name}, lineAccepted
+	}
+	return nil, lineRejected
+}
+
+// parseAdblockLine parses the DNS subset of the Adblock Plus syntax: "||name^" blocks the domain and
+// its subdomains, "@@||name^" excepts them and "|name^" or a plain domain only matches the name itself
+func parseAdblockLine(line string, _ *string) ([]string, lineResult) {
+	if line == "" || line[0] == '!' || line[0] == '#' || line[0] == '[' {
+		return nil, lineIgnored
+	}
+	exception := strings.HasPrefix(line, "@@")
+	rule := strings.TrimPrefix(line, "@@")
+
+	if i := strings.IndexByte(rule, '$'); i >= 0 {
+		// only options that do not restrict the rule to a page context apply to DNS
+		for _, option := range strings.Split(rule[i+1:], ",") {
+			if option != "important" && option != "all" && option != "document" {
+				return nil, lineRejected
+			}
+		}
+		rule = rule[:i]
+	}
+	if strings.Contains(rule, "##") || strings.Contains(rule, "#@#") {
+		return nil, lineRejected
+	}
+
+	wildcard := false
+	switch {
+	case strings.HasPrefix(rule, "||"):
+		wildcard = true
+		rule = rule[2:]
+	case strings.HasPrefix(rule, "|"):
+		rule = rule[1:]
+	}
+	rule = strings.TrimSuffix(strings.TrimSuffix(rule, "|"), "^")
+
+	name := normaliseDomain(rule)
+	if name == "" || strings.HasPrefix(name, "*.") {
+		return nil, lineRejected
+	}
+	if wildcard {
+		name = "*." + name
+	}
+	if exception {
+		name = exceptionPrefix + name
+	}
+	return []string{name}, lineAccepted
+}
+
+// parseDnsmasqLine parses "address=/name/0.0.0.0" and "local=/name/" lines, both block the domain and its subdomains
+func parseDnsmasqLine(line string, _ *string) ([]string, lineResult) {
+	if line == "" || line[0] == '#' {
+		return nil, lineIgnored
+	}
+	key, value, found := strings.Cut(line, "=")
+	if !found || (key != "address" && key != "local" && key != "server") {
+		return nil, lineRejected
+	}
+	parts := strings.Split(value, "/")
+	if len(parts) < 3 || parts[0] != "" {
+		return nil, lineRejected
+	}
+	target := parts[len(parts)-1]
+	if key == "server" {
+		// server=/name/ without an upstream excepts the domain from blocking
+		if target != "" && target != "#" {
+			return nil, lineRejected
+		}
+	} else if !isBlockedTarget(target) {
+		return nil, lineRejected
+	}
+	rules := make([]string, 0)
+	for _, n := range parts[1 : len(parts)-1] {
+		name := normaliseDomain(n)
+		if name == "" || strings.HasPrefix(name, "*.") {
+			return nil, lineRejected
+		}
+		if key == "server" {
+			name = exceptionPrefix + "*." + name
+		} else {
+			name = "*." + name
+		}
+		rules = append(rules, name)
+	}
+	if len(rules) == 0 {
+		return nil, lineRejected
+	}
+	return rules, lineAccepted
+}
+
+// parseRPZLine parses the QNAME triggers of a Response Policy Zone, "rpz-passthru." actions are exceptions
+func parseRPZLine(line string, origin *string) ([]string, lineResult) {
+	if i := strings.IndexByte(line, ';'); i >= 0 {
+		line = strings.TrimSpace(line[:i])
+	}
+	if line == "" {
+		return nil, lineIgnored
+	}
+	fields := whitespace.Split(line, -1)
+	if fields[0] == "$ORIGIN" {
+		if len(fields) > 1 {
+			*origin = strings.ToLower(strings.TrimSuffix(fields[1], ".")) + "."
+		}
+		return nil, lineIgnored
+	}
+	if fields[0][0] == '$' || line[0] == ')' || strings.HasPrefix(line, "@") {
+		return nil, lineIgnored
+	}
+
+	// owner [ttl] [class] type rdata
+	typeIdx := -1
+	for i := 1; i < len(fields); i++ {
+		switch strings.ToUpper(fields[i]) {
+		case "SOA", "NS":
+			return nil, lineIgnored
+		case "CNAME", "A", "AAAA":
+			typeIdx = i
+		}
+		if typeIdx > -1 {
+			break
+		}
+	}
+	if typeIdx < 0 || typeIdx == len(fields)-1 {
+		return nil, lineRejected
+	}
+	rrtype := strings.ToUpper(fields[typeIdx])
+	rdata := strings.ToLower(fields[typeIdx+1])
+
+	owner := strings.ToLower(fields[0])
+	if strings.HasSuffix(owner, ".") {
+		if *origin != "" && strings.HasSuffix(owner, "."+*origin) {
+			owner = strings.TrimSuffix(owner, *origin)
+		} else {
+			return nil, lineRejected
+		}
+	}
+	name := normaliseDomain(owner)
+	if name == "" {
+		return nil, lineRejected
+	}
+	if strings.HasSuffix(name, ".rpz-ip.") || strings.HasSuffix(name, ".rpz-nsdname.") ||
+		strings.HasSuffix(name, ".rpz-nsip.") || strings.HasSuffix(name, ".rpz-client-ip.") {
+		// only QNAME triggers apply to the host index
+		return nil, lineRejected
+	}
+
+	switch rrtype {
+	case "CNAME":
+		switch rdata {
+		case ".", "*.", "rpz-drop.":
+			return []string{name}, lineAccepted
+		case "rpz-passthru.":
+			return []string{exceptionPrefix + name}, lineAccepted
+		}
+		return nil, lineRejected
+	default:
+		if isBlockedTarget(rdata) {
+			return []string{name}, lineAccepted
+		}
+	}
+	return nil, lineRejected
+}
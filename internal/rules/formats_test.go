@@ -0,0 +1,52 @@
+package rules
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestParseRules(t *testing.T) {
+	tests := []struct {
+		format   string
+		data     string
+		detected string
+		rules    []string
+		rejected uint
+	}{
+		{FormatAuto, "# hosts\n0.0.0.0 ads.example.com\n127.0.0.1 a.example.com b.example.com\n0.0.0.0 0.0.0.0\n192.168.1.1 router\n0.0.0.0 localhost\n",
+			FormatHosts, []string{"ads.example.com.", "a.example.com.", "b.example.com."}, 3},
+		{FormatAuto, "[Adblock Plus 2.0]\n! comment\n||ads.example.com^\n@@||good.example.com^\n|exact.example.com^\n||tracker.example.com^$important\n||x.example.com^$third-party\nexample.com##.banner\n",
+			FormatAdblock, []string{"*.ads.example.com.", "@@*.good.example.com.", "exact.example.com.", "*.tracker.example.com."}, 2},
+		{FormatAuto, "address=/ads.example.com/0.0.0.0\naddress=/a.example.com/b.example.com/\nserver=/good.example.com/\naddress=/x.example.com/10.0.0.1\n",
+			FormatDnsmasq, []string{"*.ads.example.com.", "*.a.example.com.", "*.b.example.com.", "@@*.good.example.com."}, 1},
+		{FormatAuto, "ads.example.com\n*.tracker.example.com\nnot a domain\n",
+			FormatDomains, []string{"ads.example.com.", "*.tracker.example.com."}, 1},
+		{FormatAuto, "$TTL 300\n$ORIGIN rpz.local.\n@ IN SOA localhost. root.localhost. 1 3600 600 86400 300\n@ IN NS localhost.\nads.example.com CNAME .\n*.ads.example.com 300 IN CNAME .\ngood.example.com CNAME rpz-passthru.\nzero.example.com.rpz.local. A 0.0.0.0\n32.1.0.0.10.rpz-ip CNAME .\nwalled.example.com CNAME garden.example.net.\n",
+			FormatRPZ, []string{"ads.example.com.", "*.ads.example.com.", "@@good.example.com.", "zero.example.com."}, 2},
+		{FormatHosts, "0.0.0.0 ads.example.com\n0.0.0.0 ads.example.com\n",
+			FormatHosts, []string{"ads.example.com."}, 0},
+	}
+
+	for _, test := range tests {
+		rules, report := parseRules([]byte(test.data), test.format)
+		if report.Format != test.detected {
+			t.Errorf("format %q, expected %q", report.Format, test.detected)
+		}
+		if !slices.Equal(rules, test.rules) {
+			t.Errorf("%s rules %v, expected %v", test.detected, rules, test.rules)
+		}
+		if report.Accepted != uint(len(test.rules)) {
+			t.Errorf("%s accepted %d, expected %d", test.detected, report.Accepted, len(test.rules))
+		}
+		if report.Rejected != test.rejected {
+			t.Errorf("%s rejected %d, expected %d", test.detected, report.Rejected, test.rejected)
+		}
+	}
+}
+
+func TestParseRulesDuplicates(t *testing.T) {
+	_, report := parseRules([]byte("0.0.0.0 a.example.com\n0.0.0.0 a.example.com\n0.0.0.0 A.example.com\n"), FormatHosts)
+	if report.Accepted != 1 || report.Duplicate != 2 {
+		t.Errorf("accepted %d duplicate %d, expected 1 and 2", report.Accepted, report.Duplicate)
+	}
+}
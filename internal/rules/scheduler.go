@@ -0,0 +1,80 @@
+package rules
+
+import (
+	"fmt"
+	"log"
+	"sleuth/internal/db"
+	"sync"
+	"time"
+
+	"github.com/robfig/cron/v3"
+)
+
+// maximum number of updates kept in the rule set history
+const maxRuleSetHistory = 10
+
+// serialises rule set updates and reindexing between the scheduler, manual refreshes and the API
+var updateLock sync.Mutex
+
+// ParseSchedule parses a rule set update schedule, either cron syntax ("0 23 * * *", "@daily")
+// or an interval ("6h", "@every 6h")
+func ParseSchedule(spec string) (cron.Schedule, error) {
+	if d, err := time.ParseDuration(spec); err == nil {
+		if d < time.Minute {
+			return nil, fmt.Errorf("interval %s is less than a minute", spec)
+		}
+		return cron.Every(d), nil
+	}
+	return cron.ParseStandard(spec)
+}
+
+// NextUpdate returns the next scheduled update of the rule set, zero if it is not scheduled
+func (re DNSRulesEngine) NextUpdate(rs db.DNSRuleSet) time.Time {
+	if !rs.Enabled || !rs.External || rs.Source == "" || rs.Schedule == "" {
+		return time.Time{}
+	}
+	schedule, err := ParseSchedule(rs.Schedule)
+	if err != nil {
+		return time.Time{}
+	}
+	last := rs.LastUpdated
+	if len(rs.History) > 0 && rs.History[len(rs.History)-1].Time.After(last) {
+		last = rs.History[len(rs.History)-1].Time
+	}
+	if last.IsZero() {
+		// never updated, update on the next run of the scheduler
+		return time.Now()
+	}
+	return schedule.Next(last)
+}
+
+// StartScheduler refreshes the enabled external rule sets when their schedule is due
+func (re DNSRulesEngine) StartScheduler() {
+	ticker := time.NewTicker(time.Minute)
+	go func() {
+		for {
+			re.runSchedule(time.Now())
+			<-ticker.C
+		}
+	}()
+}
+
+func (re DNSRulesEngine) runSchedule(now time.Time) {
+	for _, rs := range re.db.GetDNSRuleSets() {
+		next := re.NextUpdate(rs)
+		if !next.IsZero() && !next.After(now) {
+			if err := re.updateRuleSet(rs, true); err != nil {
+				log.Printf("Scheduled update of ruleset %s failed: %v", rs.RuleSetName, err)
+			}
+		}
+	}
+}
+
+// addHistory records the outcome of an update on the rule set
+func (re DNSRulesEngine) addHistory(rs *db.DNSRuleSet, update db.DNSRuleSetUpdate) error {
+	rs.History = append(rs.History, update)
+	if len(rs.History) > maxRuleSetHistory {
+		rs.History = rs.History[len(rs.History)-maxRuleSetHistory:]
+	}
+	return re.db.UpdateDNSRuleSet(rs)
+}
@@ -6,6 +6,7 @@ import (
 	"sleuth/internal/db"
 	"sleuth/internal/log"
 	"sleuth/internal/network"
+	"sleuth/internal/rules"
 	"slices"
 	"strings"
 	"time"
@@ -15,10 +16,11 @@ type Security struct {
 	settings *db.Settings
 	db       *db.Db
 	network  *network.Network
+	rules    *rules.DNSRulesEngine
 }
 
 func InitSession(db *db.Db, network *network.Network, settings *db.Settings) *Security {
-	return &Security{db: db, network: network, settings: settings}
+	return &Security{db: db, network: network, settings: settings, rules: rules.Init(db, settings)}
 }
 
 func (s *Security) GetSession(IP string) (string, error) {
@@ -84,7 +86,7 @@ func (s *Security) SetAccessProfile(clientIP string, accessprofile string) error
 		user = s.db.GetUser(ses.Username)
 		role = user.Role
 	} else {
-		role = s.settings.DefaultRole
+		role = s.settings.Snapshot().DefaultRole
 	}
 	if role == "" {
 		return fmt.Errorf("Could not identify role to set access profile for client IP %s", clientIP)
@@ -110,7 +112,7 @@ func (s *Security) VerifySessionAccess(clientIP string) (bool, uint16) {
 	var macaddress string
 	//var username = ""
 	var accessprofile = ""
-	var role = s.settings.DefaultRole
+	var role = s.settings.Snapshot().DefaultRole
 	reasoncode := constants.AccessBlockedNotAuthenticated
 
 	if session := s.db.GetSession(clientIP); session != nil {
@@ -156,7 +158,7 @@ func (s *Security) VerifySessionAccess(clientIP string) (bool, uint16) {
 		accessprofile = ""
 	}
 
-	if s.settings.Mode == db.ModeBlock {
+	if s.settings.Snapshot().Mode == db.ModeBlock {
 		reasoncode = constants.AccessBlockedUnauthorised
 	}
 	//s.SetSession(clientIP, username, macaddress, reasoncode, accessprofile)
@@ -166,6 +168,7 @@ func (s *Security) VerifySessionAccess(clientIP string) (bool, uint16) {
 
 type SessionInfo struct {
 	ClientIP       string
+	MacAddress     string
 	Username       string
 	Role           string
 	DynamicRouting bool
@@ -173,46 +176,53 @@ type SessionInfo struct {
 	DNS            *db.DNSConfiguration
 	RejectReason   uint16
 	Reevaluate     bool
+
+	rules *rules.DNSRulesEngine
 }
 
 func (s *Security) GetSessionInfo(clientIP string) (SessionInfo, error) {
 	var user *db.UserProfile
 	var macaddress string
 	var role *db.Role
+	settings := s.settings.Snapshot()
 	ses := s.db.GetSession(clientIP)
 
 	sessionInfo := SessionInfo{
 		ClientIP:     clientIP,
 		RejectReason: constants.AccessBlockedUnauthorised,
+		rules:        s.rules,
 	}
 
 	if ses != nil {
 		sessionInfo.RejectReason = ses.ReasonCode
+		sessionInfo.MacAddress = ses.MacAddress
 		if /*ses.MacAddress != "" &&*/ ses.Username != "" {
 			user = s.db.GetUser(ses.Username)
 		} else {
-			role = s.db.GetRole(s.settings.DefaultRole)
+			role = s.db.GetRole(settings.DefaultRole)
 		}
 		if ses.ReasonCode > 0 {
 			return sessionInfo, nil
 		}
 	} else {
-		if user, macaddress = s.ResolveUserByMacAddress(clientIP); user != nil && user.Enabled && user.Role != "" {
+		user, macaddress = s.ResolveUserByMacAddress(clientIP)
+		sessionInfo.MacAddress = macaddress
+		if user != nil && user.Enabled && user.Role != "" {
 			ses = s.SetSession(clientIP, user.UserName, macaddress, 0, user.AccessProfile)
 			sessionInfo.Reevaluate = true
 		}
 	}
 
 	if ses == nil {
-		switch s.settings.Mode {
+		switch settings.Mode {
 		case db.ModeAllow:
-			role = s.db.GetRole(s.settings.DefaultRole)
+			role = s.db.GetRole(settings.DefaultRole)
 			if role != nil {
 				//sessionInfo.Role = s.settings.DefaultRole
 				//sessionInfo.DynamicRouting = role.DynamicRouting
 				sessionInfo.RejectReason = constants.AccessAllowed
 			} else {
-				return sessionInfo, fmt.Errorf("Could not locate default role (%s)", s.settings.DefaultRole)
+				return sessionInfo, fmt.Errorf("Could not locate default role (%s)", settings.DefaultRole)
 			}
 		case db.ModeCaptive:
 			sessionInfo.RejectReason = constants.AccessBlockedNotAuthenticated
@@ -263,18 +273,23 @@ func (s *Security) GetSessionInfo(clientIP string) (SessionInfo, error) {
 
 	if sessionInfo.DNS == nil {
 		sessionInfo.DNS = &db.DNSConfiguration{
-			Address: s.settings.FallbackDNS,
+			Address: settings.FallbackDNS,
 			Type:    0,
 		}
 	}
-	if sessionInfo.DNS.Type > 0 {
+	// the first upstream may be plain DNS while the others carry the device name
+	named := slices.ContainsFunc(sessionInfo.DNS.GetUpstreams(), func(u db.DNSUpstream) bool {
+		return u.Type != db.ModeUDP
+	})
+	if named {
 		if role.DNSPrependDeviceName {
 			if ses != nil && ses.MacAddress != "" {
 				if d := s.db.GetDevice(ses.MacAddress); d != nil {
+					// the resolver prepends the name to the host name of the upstreams
 					if d.DeviceName != "" {
-						sessionInfo.DNS.Address = strings.ReplaceAll(d.DeviceName, " ", "--") + "-" + sessionInfo.DNS.Address
+						sessionInfo.DNS.DeviceName = strings.ReplaceAll(d.DeviceName, " ", "--")
 					} else if d.HostName != "" {
-						sessionInfo.DNS.Address = strings.ReplaceAll(d.HostName, " ", "--") + "-" + sessionInfo.DNS.Address
+						sessionInfo.DNS.DeviceName = strings.ReplaceAll(d.HostName, " ", "--")
 					}
 				}
 			}
@@ -376,7 +391,7 @@ func (s *Security) ResolveUserByMacAddress(clientIP string) (*db.UserProfile, st
 					DeviceName: name,
 					HostName:   deviceName,
 					DNSName:    deviceName,
-					Enabled:    s.settings.Mode != db.ModeBlock,
+					Enabled:    s.settings.Snapshot().Mode != db.ModeBlock,
 				})
 			}
 		} else if device.UserName != "" {
@@ -400,6 +415,7 @@ func (s *Security) IsAllowedPortalAccess(Username string) bool {
 }
 
 func VerifyDomainAccess(ses SessionInfo, dns *constants.DNSSession) uint16 {
+	dns.Category = ""
 	if !dns.IsLocal {
 		if ses.RejectReason != constants.AccessBlockedNotAuthenticated && ses.RejectReason != constants.AccessBlockedUnauthorised {
 			if ses.AccessProfile == nil {
@@ -432,9 +448,38 @@ func VerifyDomainAccess(ses SessionInfo, dns *constants.DNSSession) uint16 {
 						}
 					}
 				}
+				if category := verifyCategoryAccess(ses, dns.Hostname); category != "" {
+					dns.Category = category
+					return constants.AccessBlockedCategory
+				}
 				return constants.AccessAllowed
 			}
 		}
 	}
 	return ses.RejectReason
 }
+
+// verifyCategoryAccess returns the indexed category of the host blocked by the access profile,
+// categories inherit the allowed or blocked state of their parent and allowed categories take precedence
+func verifyCategoryAccess(ses SessionInfo, hostname string) string {
+	if ses.rules == nil || len(ses.AccessProfile.BlockedCategories) == 0 {
+		return ""
+	}
+	matches := ses.rules.Match(strings.ToLower(hostname))
+	if len(matches) == 0 {
+		return ""
+	}
+	allowed := ses.rules.ExpandCategories(ses.AccessProfile.AllowedCategories)
+	for _, m := range matches {
+		if _, found := allowed[m]; found {
+			return ""
+		}
+	}
+	blocked := ses.rules.ExpandCategories(ses.AccessProfile.BlockedCategories)
+	for _, m := range matches {
+		if _, found := blocked[m]; found {
+			return m
+		}
+	}
+	return ""
+}
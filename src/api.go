@@ -0,0 +1,735 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"mime"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"sleuth/internal/db"
+	"sleuth/internal/dns"
+	"sleuth/internal/firewall"
+	"sleuth/internal/rules"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	apiPrefix       = "/api/v1"
+	apiDefaultLimit = 50
+	apiMaxLimit     = 500
+)
+
+// list parameters that are not field filters
+var apiReservedParams = []string{"offset", "limit", "q", "sort"}
+
+type api struct {
+	portal *Portal
+	router *gin.RouterGroup
+	spec   *openAPI
+}
+
+// apiResource describes a collection of admin objects exposed under /api/v1/<name>, operations
+// without a function are not routed
+type apiResource[T any] struct {
+	name    string
+	title   string
+	id      func(*T) string
+	list    func() []T
+	get     func(id string) *T
+	create  func(*T) error
+	update  func(*T) error
+	delete  func(id string) error
+	output  func(*T) any
+	changed func()
+}
+
+// apiUser hides the password hash and history of a user
+type apiUser struct {
+	db.UserProfile
+	Password        *string   `json:",omitempty"`
+	PasswordHistory *[]string `json:",omitempty"`
+}
+
+// apiSettings hides the secrets of the settings, secrets sent back empty keep their stored value
+func apiSettings(s db.Settings) db.Settings {
+	s.APIs.DomScan.Key = ""
+	return s
+}
+
+type TokenResponse struct {
+	Token   string
+	Expires time.Time
+}
+
+type apiListResponse struct {
+	Items  []any
+	Total  int
+	Offset int
+	Limit  int
+}
+
+type QueryLogResponse struct {
+	Items  []db.QueryLogEntry
+	Offset int
+	Limit  int
+	More   bool
+}
+
+// apiError is returned by the resource functions to select the response status
+type apiError struct {
+	status int
+	err    error
+}
+
+func (e *apiError) Error() string {
+	return e.err.Error()
+}
+
+func apiErrorf(status int, format string, a ...any) error {
+	return &apiError{status: status, err: fmt.Errorf(format, a...)}
+}
+
+func apiAbort(c *gin.Context, status int, err error) {
+	var ae *apiError
+	if errors.As(err, &ae) {
+		status = ae.status
+	}
+	c.AbortWithStatusJSON(status, gin.H{"error": err.Error()})
+}
+
+func apiInit(p *Portal) *api {
+	a := &api{
+		portal: p,
+		router: p.server.router.Group(apiPrefix),
+		spec:   newOpenAPI("Sleuth API", AppVersion),
+	}
+
+	a.router.GET("/openapi.json", func(c *gin.Context) {
+		c.JSON(http.StatusOK, a.spec)
+	})
+	a.router.POST("/auth/token", apiRequireJSON, a.token)
+	a.spec.addToken("/auth/token")
+
+	a.router.Use(a.authenticate, apiRequireJSON)
+
+	registerApiResource(a, apiResource[db.UserProfile]{
+		name:  "users",
+		title: "User",
+		id:    func(u *db.UserProfile) string { return u.UserName },
+		list:  p.db.GetUsers,
+		get:   p.db.GetUser,
+		create: func(u *db.UserProfile) error {
+			u.PasswordHistory = nil
+			u.PasswordChanged = time.Time{}
+			return p.db.CreateUser(u)
+		},
+		update: a.updateUser,
+		delete: p.db.DeleteUser,
+		output: func(u *db.UserProfile) any { return apiUser{UserProfile: *u} },
+	})
+	registerApiResource(a, apiResource[db.Role]{
+		name:   "roles",
+		title:  "Role",
+		id:     func(r *db.Role) string { return r.RoleName },
+		list:   p.db.GetRoles,
+		get:    p.db.GetRole,
+		create: p.db.CreateRole,
+		update: p.db.UpdateRole,
+		delete: p.db.DeleteRole,
+	})
+	registerApiResource(a, apiResource[db.DeviceProfile]{
+		name:   "devices",
+		title:  "Device",
+		id:     func(d *db.DeviceProfile) string { return d.MACAddress },
+		list:   p.db.GetDevices,
+		get:    p.db.GetDevice,
+		create: p.db.CreateDevice,
+		update: p.db.UpdateDevice,
+		delete: p.db.DeleteDevice,
+	})
+	registerApiResource(a, apiResource[db.AccessProfile]{
+		name:   "accessprofiles",
+		title:  "AccessProfile",
+		id:     func(ap *db.AccessProfile) string { return ap.Name },
+		list:   p.db.GetAccessProfiles,
+		get:    p.db.GetAccessProfile,
+		create: p.db.CreateAccessProfile,
+		update: p.db.UpdateAccessProfile,
+		delete: p.db.DeleteAccessProfile,
+		changed: func() {
+			sessions := p.db.GetSessions()
+			for i := range sessions {
+				p.dns.ReevaluateAccess(sessions[i].IP)
+			}
+		},
+	})
+	registerApiResource(a, apiResource[db.DNSConfiguration]{
+		name:   "dnsconfigurations",
+		title:  "DNSConfiguration",
+		id:     func(dc *db.DNSConfiguration) string { return dc.ProfileId },
+		list:   p.db.GetDNSConfigurations,
+		get:    p.db.GetDNSConfiguration,
+		create: p.db.CreateDNSConfiguration,
+		update: p.db.UpdateDNSConfiguration,
+		delete: p.db.DeleteDNSConfiguration,
+	})
+	registerApiResource(a, apiResource[db.DNSForwarder]{
+		name:    "dnsforwarders",
+		title:   "DNSForwarder",
+		id:      func(f *db.DNSForwarder) string { return f.ForwarderId },
+		list:    p.db.GetDNSForwarders,
+		get:     p.db.GetDNSForwarder,
+		create:  p.db.CreateDNSForwarder,
+		update:  p.db.UpdateDNSForwarder,
+		delete:  p.db.DeleteDNSForwarder,
+		changed: p.dns.ReloadForwarders,
+	})
+	registerApiResource(a, apiResource[db.BypassEndpoint]{
+		name:  "bypassendpoints",
+		title: "BypassEndpoint",
+		id:    func(e *db.BypassEndpoint) string { return e.EndpointId },
+		list:  p.db.GetBypassEndpoints,
+		get:   p.db.GetBypassEndpoint,
+		create: func(e *db.BypassEndpoint) error {
+			if err := checkBypassEndpoint(e); err != nil {
+				return apiErrorf(http.StatusBadRequest, "Create endpoint: %s", err)
+			}
+			return p.db.CreateBypassEndpoint(e)
+		},
+		update: func(e *db.BypassEndpoint) error {
+			if err := checkBypassEndpoint(e); err != nil {
+				return apiErrorf(http.StatusBadRequest, "Update endpoint: %s", err)
+			}
+			return p.db.UpdateBypassEndpoint(e)
+		},
+		delete: p.db.DeleteBypassEndpoint,
+		changed: func() {
+			p.dns.ReloadBypassEndpoints()
+			p.fw.ApplyBypassRules()
+		},
+	})
+	registerApiResource(a, apiResource[db.SafeSearchMapping]{
+		name:  "safesearchmappings",
+		title: "SafeSearchMapping",
+		id:    func(m *db.SafeSearchMapping) string { return m.MappingId },
+		list:  p.db.GetSafeSearchMappings,
+		get:   p.db.GetSafeSearchMapping,
+		create: func(m *db.SafeSearchMapping) error {
+			if err := checkSafeSearchMapping(m); err != nil {
+				return apiErrorf(http.StatusBadRequest, "Create mapping: %s", err)
+			}
+			return p.db.CreateSafeSearchMapping(m)
+		},
+		update: func(m *db.SafeSearchMapping) error {
+			if err := checkSafeSearchMapping(m); err != nil {
+				return apiErrorf(http.StatusBadRequest, "Update mapping: %s", err)
+			}
+			return p.db.UpdateSafeSearchMapping(m)
+		},
+		delete:  p.db.DeleteSafeSearchMapping,
+		changed: p.dns.ReloadSafeSearchMappings,
+	})
+	registerApiResource(a, apiResource[db.DNSRecord]{
+		name:  "dnsrecords",
+		title: "DNSRecord",
+		id:    func(r *db.DNSRecord) string { return r.RecordId },
+		list:  p.db.GetDNSRecords,
+		get:   p.db.GetDNSRecord,
+		create: func(r *db.DNSRecord) error {
+			if _, err := dns.LocalRecordRR(*r, localZone(p.config.settings)); err != nil {
+				return apiErrorf(http.StatusBadRequest, "Create record: %s", err)
+			}
+			return p.db.CreateDNSRecord(r)
+		},
+		update: func(r *db.DNSRecord) error {
+			if _, err := dns.LocalRecordRR(*r, localZone(p.config.settings)); err != nil {
+				return apiErrorf(http.StatusBadRequest, "Update record: %s", err)
+			}
+			return p.db.UpdateDNSRecord(r)
+		},
+		delete: p.db.DeleteDNSRecord,
+	})
+	registerApiResource(a, apiResource[db.DNSCategory]{
+		name:   "categories",
+		title:  "DNSCategory",
+		id:     func(cat *db.DNSCategory) string { return cat.CategoryId },
+		list:   p.db.GetDNSCategories,
+		get:    p.db.GetDNSCategory,
+		create: p.db.CreateDNSCategory,
+		update: p.db.UpdateDNSCategory,
+		delete: p.db.DeleteDNSCategory,
+	})
+	registerApiResource(a, apiResource[db.DNSRuleSet]{
+		name:  "rulesets",
+		title: "DNSRuleSet",
+		id:    func(rs *db.DNSRuleSet) string { return rs.RuleSetId },
+		list:  p.db.GetDNSRuleSets,
+		get:   p.db.GetDNSRuleSet,
+		create: func(rs *db.DNSRuleSet) error {
+			if err := validateSchedule(rs.Schedule); err != nil {
+				return err
+			}
+			if err := p.db.CreateDNSRuleSet(rs); err != nil {
+				return err
+			}
+			a.fetchRuleSet(*rs)
+			return nil
+		},
+		update: func(rs *db.DNSRuleSet) error {
+			if err := validateSchedule(rs.Schedule); err != nil {
+				return err
+			}
+			if err := p.db.UpdateDNSRuleSet(rs); err != nil {
+				return err
+			}
+			a.fetchRuleSet(*rs)
+			return nil
+		},
+		delete:  p.db.DeleteDNSRuleSet,
+		changed: func() { go p.rules.ReIndex() },
+	})
+	registerApiResource(a, apiResource[db.HttpProxy]{
+		name:    "httpproxies",
+		title:   "HttpProxy",
+		id:      func(hp *db.HttpProxy) string { return hp.DomainName },
+		list:    p.db.GetHTTPProxyConfigurations,
+		get:     p.db.GetHTTPProxyConfiguration,
+		create:  p.db.CreateHTTPProxyConfiguration,
+		update:  p.db.UpdateHTTPProxyConfiguration,
+		delete:  p.db.DeleteHTTPProxyConfiguration,
+		changed: func() { p.httpproxy.ApplyConfiguration() },
+	})
+	registerApiResource(a, apiResource[db.WAFConfiguration]{
+		name:    "wafconfigurations",
+		title:   "WAFConfiguration",
+		id:      func(wc *db.WAFConfiguration) string { return wc.Name },
+		list:    p.db.GetWAFConfigurations,
+		get:     p.db.GetWAFConfiguration,
+		create:  p.db.CreateWAFConfiguration,
+		update:  p.db.UpdateWAFConfiguration,
+		delete:  p.db.DeleteWAFConfiguration,
+		changed: func() { p.httpproxy.ApplyConfiguration() },
+	})
+	registerApiResource(a, apiResource[db.Session]{
+		name:  "sessions",
+		title: "Session",
+		id:    func(s *db.Session) string { return s.IP },
+		list:  p.db.GetSessions,
+		get:   p.db.GetSession,
+		delete: func(ip string) error {
+			err := p.db.DeleteSession(ip)
+			if err == nil {
+				p.fw.FlushSource(ip)
+			}
+			return err
+		},
+	})
+
+	a.router.GET("/querylog", func(c *gin.Context) {
+		filter, err := parseQueryLogFilter(c)
+		if err != nil {
+			apiAbort(c, http.StatusBadRequest, err)
+			return
+		}
+		entries, more, err := p.db.SearchQueryLog(filter)
+		if err != nil {
+			apiAbort(c, http.StatusInternalServerError, err)
+			return
+		}
+		c.JSON(http.StatusOK, QueryLogResponse{Items: entries, Offset: filter.Offset, Limit: filter.Limit, More: more})
+	})
+	a.spec.addQueryLog("/querylog")
+
+	a.router.GET("/settings", func(c *gin.Context) {
+		c.JSON(http.StatusOK, apiSettings(p.config.settings.Snapshot()))
+	})
+	a.router.PUT("/settings", a.updateSettings)
+	a.spec.addSingleton("/settings", "Settings", db.Settings{})
+
+	return a
+}
+
+// token exchanges the credentials of an administrator for a bearer token
+func (a *api) token(c *gin.Context) {
+	var cred Credentials
+	if err := c.ShouldBindJSON(&cred); err != nil {
+		apiAbort(c, http.StatusBadRequest, err)
+		return
+	}
+	u := a.portal.db.GetUser(cred.User)
+	if !a.portal.db.VerifyPassword(u, cred.Password) {
+		apiAbort(c, http.StatusUnauthorized, fmt.Errorf("access denied"))
+		return
+	}
+	if !u.Enabled || !a.portal.security.IsAllowedPortalAccess(u.UserName) {
+		apiAbort(c, http.StatusForbidden, fmt.Errorf("access denied"))
+		return
+	}
+	if u.PasswordReset.After(time.Now()) || a.portal.db.IsPasswordExpired(u) {
+		apiAbort(c, http.StatusForbidden, fmt.Errorf("password reset required"))
+		return
+	}
+	token, exp, err := a.portal.server.CreateSessionToken(u.UserName)
+	if err != nil {
+		apiAbort(c, http.StatusInternalServerError, err)
+		return
+	}
+	c.JSON(http.StatusOK, TokenResponse{Token: token, Expires: exp})
+}
+
+// authenticate accepts a bearer token or the admin portal session cookie of an administrator
+func (a *api) authenticate(c *gin.Context) {
+	var tokenStr string
+	if auth := c.Request.Header.Get("Authorization"); strings.HasPrefix(auth, "Bearer ") {
+		tokenStr = strings.TrimPrefix(auth, "Bearer ")
+	} else if cookie, err := c.Cookie("sleuth_session"); err == nil {
+		tokenStr = cookie
+	}
+	if tokenStr == "" {
+		c.Header("WWW-Authenticate", `Bearer realm="sleuth"`)
+		apiAbort(c, http.StatusUnauthorized, fmt.Errorf("authentication required"))
+		return
+	}
+	username, err := a.portal.server.ValidateSessionToken(tokenStr)
+	if err != nil || username == "" {
+		c.Header("WWW-Authenticate", `Bearer realm="sleuth", error="invalid_token"`)
+		apiAbort(c, http.StatusUnauthorized, fmt.Errorf("invalid token"))
+		return
+	}
+	if !a.portal.security.IsAllowedPortalAccess(username) {
+		apiAbort(c, http.StatusForbidden, fmt.Errorf("access denied"))
+		return
+	}
+	c.Set("username", username)
+	c.Next()
+}
+
+// apiRequireJSON rejects request bodies that are not JSON, browsers do not send JSON cross-site without a
+// CORS preflight so that other sites cannot make changes with the session cookie of the admin portal
+func apiRequireJSON(c *gin.Context) {
+	switch c.Request.Method {
+	case http.MethodPost, http.MethodPut, http.MethodPatch:
+		mediaType, _, err := mime.ParseMediaType(c.GetHeader("Content-Type"))
+		if err != nil || mediaType != "application/json" {
+			apiAbort(c, http.StatusUnsupportedMediaType, fmt.Errorf("Content-Type application/json required"))
+			return
+		}
+	}
+	c.Next()
+}
+
+// updateUser keeps the password hash and history of the user, a new password is set through the password policy
+func (a *api) updateUser(u *db.UserProfile) error {
+	current := a.portal.db.GetUser(u.UserName)
+	if current == nil {
+		return apiErrorf(http.StatusNotFound, "user %s does not exist", u.UserName)
+	}
+	password := u.Password
+	u.Password = current.Password
+	u.PasswordHistory = current.PasswordHistory
+	u.PasswordChanged = current.PasswordChanged
+	if password != "" && password != current.Password {
+		if err := a.portal.db.SetPassword(u.UserName, password); err != nil {
+			return apiErrorf(http.StatusBadRequest, "%s", err)
+		}
+		updated := a.portal.db.GetUser(u.UserName)
+		u.Password = updated.Password
+		u.PasswordHistory = updated.PasswordHistory
+		u.PasswordChanged = updated.PasswordChanged
+		u.PasswordReset = updated.PasswordReset
+	}
+	return a.portal.db.UpdateUser(u)
+}
+
+func (a *api) updateSettings(c *gin.Context) {
+	p := a.portal
+	current := p.config.settings.Snapshot()
+	settings := current
+	if err := json.NewDecoder(c.Request.Body).Decode(&settings); err != nil {
+		apiAbort(c, http.StatusBadRequest, err)
+		return
+	}
+	if settings.APIs.DomScan.Key == "" {
+		settings.APIs.DomScan.Key = current.APIs.DomScan.Key
+	}
+	if err := firewall.ValidateForwardingPools(settings.ForwardingPoolIPv4, settings.ForwardingPoolIPv6); err != nil {
+		apiAbort(c, http.StatusBadRequest, err)
+		return
+	}
+	found := false
+	for _, fw := range p.fw.AvailableFirewalls() {
+		found = found || fw == settings.Firewall
+	}
+	if !found {
+		apiAbort(c, http.StatusBadRequest, fmt.Errorf("firewall %s is not available", settings.Firewall))
+		return
+	}
+	if err := p.db.SaveSettings(settings); err != nil {
+		apiAbort(c, http.StatusInternalServerError, err)
+		return
+	}
+	setfw := settings.Firewall != current.Firewall
+	setpools := settings.ForwardingPoolIPv4 != current.ForwardingPoolIPv4 || settings.ForwardingPoolIPv6 != current.ForwardingPoolIPv6
+	setbypass := settings.Bypass != current.Bypass
+	p.config.settings.Update(func(s *db.Settings) { *s = settings })
+	if setfw {
+		p.fw.SetActiveFirewall(settings.Firewall)
+	} else if setbypass {
+		if err := p.fw.ApplyBypassRules(); err != nil {
+			apiAbort(c, http.StatusInternalServerError, err)
+			return
+		}
+	}
+	if setpools {
+		p.fw.FlushForwardingPools()
+	}
+	c.JSON(http.StatusOK, apiSettings(settings))
+}
+
+// fetchRuleSet downloads the rules of an enabled rule set with a source in the background, failures are
+// recorded in the update history of the rule set
+func (a *api) fetchRuleSet(rs db.DNSRuleSet) {
+	if rs.Enabled && rs.Source != "" {
+		go a.portal.rules.UpdateRuleSet(rs)
+	}
+}
+
+func validateSchedule(schedule string) error {
+	if schedule == "" {
+		return nil
+	}
+	if _, err := rules.ParseSchedule(schedule); err != nil {
+		return apiErrorf(http.StatusBadRequest, "Update schedule: %s", err)
+	}
+	return nil
+}
+
+func registerApiResource[T any](a *api, r apiResource[T]) {
+	output := r.output
+	if output == nil {
+		output = func(v *T) any { return v }
+	}
+	changed := func() {
+		if r.changed != nil {
+			r.changed()
+		}
+	}
+	collection := "/" + r.name
+	item := collection + "/:id"
+
+	a.router.GET(collection, func(c *gin.Context) {
+		result, err := apiList(c, r.list(), output)
+		if err != nil {
+			apiAbort(c, http.StatusBadRequest, err)
+			return
+		}
+		c.JSON(http.StatusOK, result)
+	})
+
+	a.router.GET(item, func(c *gin.Context) {
+		v := r.get(c.Param("id"))
+		if v == nil {
+			apiAbort(c, http.StatusNotFound, fmt.Errorf("%s %s does not exist", r.title, c.Param("id")))
+			return
+		}
+		c.JSON(http.StatusOK, output(v))
+	})
+
+	if r.create != nil {
+		a.router.POST(collection, func(c *gin.Context) {
+			var v T
+			if err := json.NewDecoder(c.Request.Body).Decode(&v); err != nil {
+				apiAbort(c, http.StatusBadRequest, err)
+				return
+			}
+			if id := r.id(&v); id != "" && r.get(id) != nil {
+				apiAbort(c, http.StatusConflict, fmt.Errorf("%s %s already exists", r.title, id))
+				return
+			}
+			if err := r.create(&v); err != nil {
+				apiAbort(c, http.StatusBadRequest, err)
+				return
+			}
+			changed()
+			c.Header("Location", apiPrefix+collection+"/"+r.id(&v))
+			c.JSON(http.StatusCreated, output(&v))
+		})
+	}
+
+	if r.update != nil {
+		// fields missing from the request body keep their current value
+		a.router.PUT(item, func(c *gin.Context) {
+			v := r.get(c.Param("id"))
+			if v == nil {
+				apiAbort(c, http.StatusNotFound, fmt.Errorf("%s %s does not exist", r.title, c.Param("id")))
+				return
+			}
+			if err := json.NewDecoder(c.Request.Body).Decode(v); err != nil {
+				apiAbort(c, http.StatusBadRequest, err)
+				return
+			}
+			if r.id(v) != c.Param("id") {
+				apiAbort(c, http.StatusBadRequest, fmt.Errorf("%s identifier can not be changed", r.title))
+				return
+			}
+			if err := r.update(v); err != nil {
+				apiAbort(c, http.StatusBadRequest, err)
+				return
+			}
+			changed()
+			c.JSON(http.StatusOK, output(v))
+		})
+	}
+
+	if r.delete != nil {
+		a.router.DELETE(item, func(c *gin.Context) {
+			if r.get(c.Param("id")) == nil {
+				apiAbort(c, http.StatusNotFound, fmt.Errorf("%s %s does not exist", r.title, c.Param("id")))
+				return
+			}
+			if err := r.delete(c.Param("id")); err != nil {
+				apiAbort(c, http.StatusConflict, err)
+				return
+			}
+			changed()
+			c.Status(http.StatusNoContent)
+		})
+	}
+
+	var zero T
+	a.spec.addResource(collection, r.title, zero, r.create != nil, r.update != nil, r.delete != nil)
+}
+
+// apiList filters, sorts and pages the items. Query parameters other than offset, limit, q and sort
+// select the items with a matching field, q searches all fields and sort=Field or sort=-Field orders them
+func apiList[T any](c *gin.Context, items []T, output func(*T) any) (*apiListResponse, error) {
+	offset, limit := 0, apiDefaultLimit
+	var err error
+	if v := c.Query("offset"); v != "" {
+		if offset, err = strconv.Atoi(v); err != nil || offset < 0 {
+			return nil, fmt.Errorf("invalid offset %q", v)
+		}
+	}
+	if v := c.Query("limit"); v != "" {
+		if limit, err = strconv.Atoi(v); err != nil || limit < 1 || limit > apiMaxLimit {
+			return nil, fmt.Errorf("limit must be between 1 and %d", apiMaxLimit)
+		}
+	}
+
+	type row struct {
+		value  any
+		fields map[string]any
+	}
+	rows := make([]row, 0, len(items))
+	q := strings.ToLower(c.Query("q"))
+	for i := range items {
+		value := output(&items[i])
+		data, err := json.Marshal(value)
+		if err != nil {
+			return nil, err
+		}
+		fields := make(map[string]any)
+		if err := json.Unmarshal(data, &fields); err != nil {
+			return nil, err
+		}
+		if q != "" && !strings.Contains(strings.ToLower(string(data)), q) {
+			continue
+		}
+		match := true
+		for param, values := range c.Request.URL.Query() {
+			if isReservedParam(param) {
+				continue
+			}
+			if !matchField(lookupField(fields, param), values[0]) {
+				match = false
+				break
+			}
+		}
+		if match {
+			rows = append(rows, row{value: value, fields: fields})
+		}
+	}
+
+	if field := c.Query("sort"); field != "" {
+		desc := strings.HasPrefix(field, "-")
+		field = strings.TrimPrefix(field, "-")
+		sort.SliceStable(rows, func(i, j int) bool {
+			x, y := lookupField(rows[i].fields, field), lookupField(rows[j].fields, field)
+			if desc {
+				return lessField(y, x)
+			}
+			return lessField(x, y)
+		})
+	}
+
+	result := &apiListResponse{Items: []any{}, Total: len(rows), Offset: offset, Limit: limit}
+	for i := offset; i < len(rows) && i < offset+limit; i++ {
+		result.Items = append(result.Items, rows[i].value)
+	}
+	return result, nil
+}
+
+func isReservedParam(param string) bool {
+	for _, p := range apiReservedParams {
+		if p == param {
+			return true
+		}
+	}
+	return false
+}
+
+// lookupField returns the top level field of an object, field names are not case sensitive
+func lookupField(fields map[string]any, name string) any {
+	if v, ok := fields[name]; ok {
+		return v
+	}
+	for k, v := range fields {
+		if strings.EqualFold(k, name) {
+			return v
+		}
+	}
+	return nil
+}
+
+func matchField(value any, filter string) bool {
+	switch v := value.(type) {
+	case nil:
+		return false
+	case []any:
+		for _, e := range v {
+			if matchField(e, filter) {
+				return true
+			}
+		}
+		return false
+	case string:
+		return strings.EqualFold(v, filter)
+	}
+	return fmt.Sprint(value) == filter
+}
+
+func lessField(x any, y any) bool {
+	switch a := x.(type) {
+	case float64:
+		if b, ok := y.(float64); ok {
+			return a < b
+		}
+	case bool:
+		if b, ok := y.(bool); ok {
+			return !a && b
+		}
+	case string:
+		if b, ok := y.(string); ok {
+			return strings.ToLower(a) < strings.ToLower(b)
+		}
+	case nil:
+		return y != nil
+	}
+	return fmt.Sprint(x) < fmt.Sprint(y)
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"sleuth/internal/db"
+	"sleuth/internal/firewall"
+	"sleuth/internal/network"
+	"sleuth/internal/rules"
+	"sleuth/internal/security"
+
+	"github.com/gin-gonic/gin"
+)
+
+// newTestPortal returns a portal with the API routes and an administrator admin with the password secret
+func newTestPortal(t *testing.T) *Portal {
+	gin.SetMode(gin.TestMode)
+	database := db.InitDB(t.TempDir())
+	t.Cleanup(database.Close)
+	settings := &db.Settings{}
+	p := &Portal{db: database, config: GlobalConfiguration{settings: settings}}
+	p.server = WebServer{router: gin.New(), ttl: time.Hour, signingKey: []byte("test")}
+	p.security = security.InitSession(database, &network.Network{}, settings)
+	p.rules = *rules.Init(database, settings)
+	if err := database.CreateRole(&db.Role{RoleName: "admin", Admin: true}); err != nil {
+		t.Fatal(err)
+	}
+	if err := database.CreateUser(&db.UserProfile{UserName: "admin", Password: "secret", Role: "admin", Enabled: true}); err != nil {
+		t.Fatal(err)
+	}
+	p.wc.API = *apiInit(p)
+	return p
+}
+
+func apiRequest(p *Portal, method string, path string, contentType string, body string, token string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, apiPrefix+path, strings.NewReader(body))
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	w := httptest.NewRecorder()
+	p.server.router.ServeHTTP(w, req)
+	return w
+}
+
+func apiToken(t *testing.T, p *Portal) string {
+	w := apiRequest(p, http.MethodPost, "/auth/token", "application/json", `{"User":"admin","Password":"secret"}`, "")
+	if w.Code != http.StatusOK {
+		t.Fatalf("POST /auth/token returned %d: %s", w.Code, w.Body)
+	}
+	var res TokenResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &res); err != nil {
+		t.Fatal(err)
+	}
+	return res.Token
+}
+
+func TestApiAuthentication(t *testing.T) {
+	p := newTestPortal(t)
+	if w := apiRequest(p, http.MethodGet, "/roles", "", "", ""); w.Code != http.StatusUnauthorized {
+		t.Errorf("GET /roles without a token returned %d", w.Code)
+	}
+	if w := apiRequest(p, http.MethodPost, "/auth/token", "application/json", `{"User":"admin","Password":"wrong"}`, ""); w.Code != http.StatusUnauthorized {
+		t.Errorf("POST /auth/token with a wrong password returned %d", w.Code)
+	}
+	if w := apiRequest(p, http.MethodGet, "/roles", "", "", apiToken(t, p)); w.Code != http.StatusOK {
+		t.Errorf("GET /roles returned %d: %s", w.Code, w.Body)
+	}
+}
+
+func TestApiRequireJSON(t *testing.T) {
+	p := newTestPortal(t)
+	token := apiToken(t, p)
+	tests := []struct {
+		contentType string
+		status      int
+	}{
+		{"", http.StatusUnsupportedMediaType},
+		{"text/plain", http.StatusUnsupportedMediaType},
+		{"application/x-www-form-urlencoded", http.StatusUnsupportedMediaType},
+		{"application/json; charset=utf-8", http.StatusCreated},
+	}
+	for _, test := range tests {
+		w := apiRequest(p, http.MethodPost, "/roles", test.contentType, `{"RoleName":"guest"}`, token)
+		if w.Code != test.status {
+			t.Errorf("POST /roles with Content-Type %q returned %d: %s", test.contentType, w.Code, w.Body)
+		}
+	}
+	if p.db.GetRole("guest") == nil {
+		t.Error("POST /roles did not create the role")
+	}
+	if w := apiRequest(p, http.MethodPost, "/auth/token", "text/plain", `{"User":"admin","Password":"secret"}`, ""); w.Code != http.StatusUnsupportedMediaType {
+		t.Errorf("POST /auth/token with Content-Type text/plain returned %d", w.Code)
+	}
+	if w := apiRequest(p, http.MethodDelete, "/roles/guest", "", "", token); w.Code >= http.StatusBadRequest {
+		t.Errorf("DELETE /roles/guest returned %d: %s", w.Code, w.Body)
+	}
+}
+
+func TestApiSettingsSecrets(t *testing.T) {
+	p := newTestPortal(t)
+	token := apiToken(t, p)
+	p.config.settings.Firewall = "none"
+	p.config.settings.ForwardingPoolIPv4, _ = firewall.DefaultIPv4Pool()
+	p.config.settings.ForwardingPoolIPv6 = "fd00:5eed::/64"
+	p.config.settings.APIs.DomScan.Key = "key"
+
+	w := apiRequest(p, http.MethodGet, "/settings", "", "", token)
+	if w.Code != http.StatusOK {
+		t.Fatalf("GET /settings returned %d: %s", w.Code, w.Body)
+	}
+	if strings.Contains(w.Body.String(), `"key"`) {
+		t.Errorf("GET /settings returned the API key: %s", w.Body)
+	}
+	w = apiRequest(p, http.MethodPut, "/settings", "application/json", w.Body.String(), token)
+	if w.Code != http.StatusOK {
+		t.Fatalf("PUT /settings returned %d: %s", w.Code, w.Body)
+	}
+	if key := p.config.settings.APIs.DomScan.Key; key != "key" {
+		t.Errorf("PUT /settings with an empty API key stored %q", key)
+	}
+	w = apiRequest(p, http.MethodPut, "/settings", "application/json", `{"APIs":{"DomScan":{"Key":"other"}}}`, token)
+	if w.Code != http.StatusOK {
+		t.Fatalf("PUT /settings returned %d: %s", w.Code, w.Body)
+	}
+	if key := p.config.settings.APIs.DomScan.Key; key != "other" {
+		t.Errorf("PUT /settings stored the API key %q", key)
+	}
+	if strings.Contains(w.Body.String(), `"other"`) {
+		t.Errorf("PUT /settings returned the API key: %s", w.Body)
+	}
+}
+
+// waitFor polls the condition until it holds or a few seconds have passed
+func waitFor(t *testing.T, what string, condition func() bool) {
+	t.Helper()
+	for deadline := time.Now().Add(5 * time.Second); !condition(); time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+	}
+}
+
+func TestApiRuleSetsIndex(t *testing.T) {
+	p := newTestPortal(t)
+	token := apiToken(t, p)
+	source := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ads.example.com\n"))
+	}))
+	defer source.Close()
+
+	if err := p.db.CreateDNSCategory(&db.DNSCategory{CategoryId: "ads", CategoryName: "Ads"}); err != nil {
+		t.Fatal(err)
+	}
+	body := `{"RuleSetId":"ads","CategoryId":"ads","Format":"` + rules.FormatDomains + `","Source":"` + source.URL + `","Enabled":true}`
+	if w := apiRequest(p, http.MethodPost, "/rulesets", "application/json", body, token); w.Code != http.StatusCreated {
+		t.Fatalf("POST /rulesets returned %d: %s", w.Code, w.Body)
+	}
+	waitFor(t, "the rules of the created rule set", func() bool {
+		hr := p.db.GetDnsHostRule("ads.example.com.")
+		return hr != nil && len(hr.ExactCategories) == 1 && hr.ExactCategories[0] == "ads"
+	})
+	if w := apiRequest(p, http.MethodDelete, "/rulesets/ads", "", "", token); w.Code != http.StatusNoContent {
+		t.Fatalf("DELETE /rulesets/ads returned %d: %s", w.Code, w.Body)
+	}
+	waitFor(t, "the rules of the deleted rule set to be removed", func() bool {
+		return p.db.GetDnsHostRule("ads.example.com.") == nil
+	})
+}
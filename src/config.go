@@ -50,6 +50,14 @@ var conf = config.Map{
 		Default: "debug",
 		Usage:   fmt.Sprintf("defines the minimum level of logs to show - one of ['%s']", strings.Join(log.ValidLevelStrings, "', '")),
 	},
+	"metrics-token": &config.String{
+		Default: "",
+		Usage:   "bearer token that scrapes the prometheus metrics without an admin session",
+	},
+	"path-doh": &config.String{
+		Default: "/dns-query",
+		Usage:   "url path to the DNS over HTTPS endpoint",
+	},
 	"path-liveness": &config.String{
 		Default: "/healthz",
 		Usage:   "url path to the liveness probe endpoint",
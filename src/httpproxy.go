@@ -18,6 +18,7 @@ import (
 	"regexp"
 	"sleuth/internal/db"
 	"sleuth/internal/log"
+	"sleuth/internal/metrics"
 	"strconv"
 	"strings"
 	"time"
@@ -173,6 +174,16 @@ func (p *HttpProxy) CertificateHandler(hello *tls.ClientHelloInfo) (*tls.Certifi
 
 			DNSNames: []string{host},
 		}
+		// clients connecting by address, e.g. DNS over TLS, send no server name
+		if host == "" && hello.Conn != nil {
+			if h, _, err := net.SplitHostPort(hello.Conn.LocalAddr().String()); err == nil {
+				if ip := net.ParseIP(h); ip != nil {
+					template.Subject.CommonName = h
+					template.DNSNames = nil
+					template.IPAddresses = []net.IP{ip}
+				}
+			}
+		}
 
 		// ---- Create cert ----
 		derBytes, err := x509.CreateCertificate(
@@ -262,6 +273,7 @@ func (p *HttpProxy) WAFHandler(next http.Handler) http.Handler {
 				}
 
 				if it := tx.ProcessRequestHeaders(); it != nil {
+					metrics.WAFBlocks.WithLabelValues(site.DomainName).Inc()
 					http.Error(w, "Request blocked by WAF", http.StatusForbidden)
 					return
 				}
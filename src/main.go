@@ -7,11 +7,14 @@ import (
 	"crypto/tls"
 	"crypto/x509"
 	"crypto/x509/pkix"
+	"encoding/base64"
 	"log"
 	"math/big"
+	"net"
 	"net/http"
 	"sleuth/internal/constants"
 	"sleuth/internal/db"
+	"sleuth/internal/firewall"
 	logger "sleuth/internal/log"
 	"strings"
 	"time"
@@ -25,12 +28,16 @@ func main() {
 	// start HTTP and DNS servers concurrently and keep main alive
 
 	go func() {
+		// DNS over HTTPS is only served over TLS, queries over plain HTTP could be read on the path
+		mux := http.NewServeMux()
+		mux.HandleFunc(conf.GetString("path-doh"), p.dns.ServeDoH)
+		mux.Handle("/", p.certManager.HTTPHandler(p.httpproxy.WAFHandler(p.server.router)))
 		httpsServer := &http.Server{
 			Addr: ":443",
 			TLSConfig: &tls.Config{
 				GetCertificate: p.httpproxy.CertificateHandler,
 			},
-			Handler:  p.certManager.HTTPHandler(p.httpproxy.WAFHandler(p.server.router)),
+			Handler:  mux,
 			ErrorLog: log.New(&filteredLogger{logger: log.Default()}, "", log.LstdFlags),
 		}
 		logger.Print("Starting HTTPS server running on port 443")
@@ -53,6 +60,9 @@ func main() {
 	}()
 
 	go p.dns.Start()
+	go p.dns.StartTLS(&tls.Config{
+		GetCertificate: p.httpproxy.CertificateHandler,
+	})
 	select {}
 }
 
@@ -181,6 +191,47 @@ func initDefaults(p *Portal) {
 		p.db.CreateAccessProfile(&db.AccessProfile{Name: "Default"})
 	}
 
+	if len(p.db.GetBypassEndpoints()) == 0 {
+		endpoints := []db.BypassEndpoint{
+			{Name: "Firefox DoH canary", Domains: []string{"use-application-dns.net"}},
+			{Name: "iCloud Private Relay", Domains: []string{"mask.icloud.com", "mask-h2.icloud.com"}},
+			{Name: "Google Public DNS", Domains: []string{"dns.google", "dns.google.com", "8888.google"},
+				Addresses: []string{"8.8.8.8", "8.8.4.4", "2001:4860:4860::8888", "2001:4860:4860::8844"}},
+			{Name: "Cloudflare DNS", Domains: []string{"cloudflare-dns.com", "one.one.one.one", "1dot1dot1dot1.cloudflare-dns.com"},
+				Addresses: []string{"1.1.1.1", "1.0.0.1", "1.1.1.2", "1.0.0.2", "1.1.1.3", "1.0.0.3", "2606:4700:4700::1111", "2606:4700:4700::1001"}},
+			{Name: "Quad9", Domains: []string{"dns.quad9.net", "dns9.quad9.net", "dns10.quad9.net", "dns11.quad9.net"},
+				Addresses: []string{"9.9.9.9", "149.112.112.112", "9.9.9.10", "149.112.112.10", "9.9.9.11", "149.112.112.11", "2620:fe::fe", "2620:fe::9"}},
+			{Name: "OpenDNS", Domains: []string{"doh.opendns.com", "doh.familyshield.opendns.com", "dns.umbrella.com"},
+				Addresses: []string{"208.67.222.222", "208.67.220.220", "208.67.222.123", "208.67.220.123"}},
+			{Name: "AdGuard DNS", Domains: []string{"dns.adguard-dns.com", "family.adguard-dns.com", "unfiltered.adguard-dns.com", "dns.adguard.com"},
+				Addresses: []string{"94.140.14.14", "94.140.15.15", "94.140.14.15", "94.140.15.16", "94.140.14.140", "94.140.14.141"}},
+			{Name: "NextDNS", Domains: []string{"dns.nextdns.io"}},
+			{Name: "CleanBrowsing", Domains: []string{"doh.cleanbrowsing.org"},
+				Addresses: []string{"185.228.168.9", "185.228.169.9", "185.228.168.10", "185.228.169.11", "185.228.168.168", "185.228.169.168"}},
+			{Name: "DNS4EU", Domains: []string{"protective.joindns4.eu", "child.joindns4.eu", "noads.joindns4.eu", "child-noads.joindns4.eu", "unfiltered.joindns4.eu"},
+				Addresses: []string{"86.54.11.1", "86.54.11.11", "86.54.11.12", "86.54.11.13", "86.54.11.100"}},
+			{Name: "VPN services", Domains: []string{"nordvpn.com", "expressvpn.com", "protonvpn.com", "surfshark.com", "windscribe.com", "privateinternetaccess.com", "mullvad.net"}},
+		}
+		for i := range endpoints {
+			endpoints[i].Enabled = true
+			p.db.CreateBypassEndpoint(&endpoints[i])
+		}
+	}
+
+	if len(p.db.GetSafeSearchMappings()) == 0 {
+		mappings := map[string][]string{
+			"forcesafesearch.google.com": {"google.com", "www.google.*", "www.google.co.*", "www.google.com.*", "google.co.*", "google.com.*"},
+			"restrict.youtube.com":       {"youtube.com", "www.youtube.com", "m.youtube.com", "youtubei.googleapis.com", "youtube.googleapis.com", "www.youtube-nocookie.com"},
+			"strict.bing.com":            {"bing.com", "www.bing.com"},
+			"safe.duckduckgo.com":        {"duckduckgo.com", "www.duckduckgo.com", "start.duckduckgo.com"},
+		}
+		for target, domains := range mappings {
+			for _, domain := range domains {
+				p.db.CreateSafeSearchMapping(&db.SafeSearchMapping{Domain: domain, Target: target, Enabled: true})
+			}
+		}
+	}
+
 	if len(p.db.GetRoles()) == 0 {
 
 		dnsconfigurations := p.db.GetDNSConfigurations()
@@ -220,14 +271,23 @@ func initDefaults(p *Portal) {
 	}
 
 	if len(p.db.GetUsers()) == 0 {
+		// the admin gets a one-time password, a pending reset could be claimed by anyone on the network
+		b := make([]byte, 12)
+		if _, err := rand.Read(b); err != nil {
+			panic(err)
+		}
+		password := base64.RawURLEncoding.EncodeToString(b)
 		up := &db.UserProfile{
-			UserName:      "admin",
-			Password:      "admin",
-			Role:          "admin",
-			Enabled:       true,
-			PasswordReset: time.Now().Add(time.Hour * 72),
+			UserName: "admin",
+			Role:     "admin",
+			Enabled:  true,
+			Password: password,
+		}
+		if err := p.db.CreateUser(up); err != nil {
+			logger.Error(err)
+		} else {
+			logger.Printf("Created user admin with the one-time password %s, change it after the first login", password)
 		}
-		p.db.CreateUser(up)
 	}
 
 	if p.config.settings.FallbackDNS == "" {
@@ -240,6 +300,59 @@ func initDefaults(p *Portal) {
 		p.db.SaveSettings(*p.config.settings)
 	}
 
+	if p.config.settings.PasswordPolicy.MinLength == 0 {
+		p.config.settings.PasswordPolicy.MinLength = 8
+		p.config.settings.PasswordPolicy.History = 3
+		p.db.SaveSettings(*p.config.settings)
+	}
+
+	if p.config.settings.QueryLog.RetentionDays == 0 {
+		p.config.settings.QueryLog.Enabled = true
+		p.config.settings.QueryLog.RetentionDays = 7
+		p.db.SaveSettings(*p.config.settings)
+	}
+
+	if p.config.settings.Cache.StaleHours == 0 {
+		p.config.settings.Cache.StaleHours = 24
+		p.config.settings.Cache.Prefetch = true
+		p.db.SaveSettings(*p.config.settings)
+	}
+
+	if p.config.settings.Cache.SizeMB == 0 {
+		p.config.settings.Cache.SizeMB = 16
+		p.db.SaveSettings(*p.config.settings)
+	}
+
+	if p.config.settings.RateLimit.ClientQPS == 0 {
+		p.config.settings.RateLimit = db.RateLimitSettings{
+			Enabled:           true,
+			ClientQPS:         50,
+			ClientBurst:       200,
+			SubnetQPS:         500,
+			ResponseQPS:       20,
+			QuarantineDrops:   1000,
+			QuarantineMinutes: 10,
+		}
+		p.db.SaveSettings(*p.config.settings)
+	}
+
+	if p.config.settings.ForwardingPoolIPv4 == "" {
+		if pool, err := firewall.DefaultIPv4Pool(); err == nil {
+			p.config.settings.ForwardingPoolIPv4 = pool
+			p.db.SaveSettings(*p.config.settings)
+		} else {
+			logger.Error(err)
+		}
+	}
+
+	if p.config.settings.ForwardingPoolIPv6 == "" {
+		// RFC 4193 unique local address with a random global ID
+		prefix := make([]byte, 16)
+		prefix[0] = 0xfd
+		rand.Read(prefix[1:6])
+		p.config.settings.ForwardingPoolIPv6 = (&net.IPNet{IP: prefix, Mask: net.CIDRMask(64, 128)}).String()
+		p.db.SaveSettings(*p.config.settings)
+	}
 }
 
 type filteredLogger struct {
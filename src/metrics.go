@@ -0,0 +1,58 @@
+package main
+
+import (
+	"crypto/subtle"
+	"sleuth/internal/metrics"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// metricsInit serves the prometheus metrics and registers the gauges computed from the database
+func metricsInit(p *Portal) {
+	metrics.NewGaugeFunc("", "sessions", "Active sessions by role.", "role", func() map[string]float64 {
+		roles := make(map[string]float64)
+		for _, ses := range p.db.GetSessions() {
+			role := p.config.settings.Snapshot().DefaultRole
+			if ses.Username != "" {
+				if u := p.db.GetUser(ses.Username); u != nil {
+					role = u.Role
+				}
+			}
+			roles[role]++
+		}
+		return roles
+	})
+
+	metrics.NewGaugeFunc("firewall", "allocated_addresses", "Allocated forwarding addresses by client.", "client", func() map[string]float64 {
+		clients := make(map[string]float64)
+		for client, count := range p.db.CountReverseDNS() {
+			clients[client] = float64(count)
+		}
+		return clients
+	})
+
+	metrics.NewGaugeFunc("dns", "answer_cache", "Usage of the shared upstream answer cache.", "measure", func() map[string]float64 {
+		stats := p.dns.AnswerCacheStats()
+		return map[string]float64{
+			"entries":   float64(stats.Entries),
+			"bytes":     float64(stats.Bytes),
+			"hit_ratio": stats.HitRatio(),
+		}
+	})
+
+	p.server.router.GET(conf.GetString("path-metrics"), p.metricsAuth, gin.WrapH(promhttp.Handler()))
+}
+
+// metricsAuth accepts the metrics token of the configuration or else authenticates like the api, the series
+// are labelled with client addresses and roles
+func (p *Portal) metricsAuth(c *gin.Context) {
+	token := conf.GetString("metrics-token")
+	auth := strings.TrimPrefix(c.Request.Header.Get("Authorization"), "Bearer ")
+	if token != "" && subtle.ConstantTimeCompare([]byte(auth), []byte(token)) == 1 {
+		c.Next()
+		return
+	}
+	p.wc.API.authenticate(c)
+}
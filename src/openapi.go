@@ -0,0 +1,278 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"time"
+)
+
+// openAPI is the OpenAPI 3 document of the REST API, built from the registered resources so that it
+// always matches the routes served by the binary
+type openAPI struct {
+	OpenAPI    string                    `json:"openapi"`
+	Info       map[string]string         `json:"info"`
+	Servers    []map[string]string       `json:"servers"`
+	Security   []map[string][]string     `json:"security"`
+	Paths      map[string]map[string]any `json:"paths"`
+	Components map[string]map[string]any `json:"components"`
+}
+
+var timeType = reflect.TypeOf(time.Time{})
+
+func newOpenAPI(title string, version string) *openAPI {
+	return &openAPI{
+		OpenAPI:  "3.0.3",
+		Info:     map[string]string{"title": title, "version": version},
+		Servers:  []map[string]string{{"url": apiPrefix}},
+		Security: []map[string][]string{{"bearer": {}}},
+		Paths:    make(map[string]map[string]any),
+		Components: map[string]map[string]any{
+			"securitySchemes": {
+				"bearer": map[string]string{"type": "http", "scheme": "bearer", "bearerFormat": "JWT"},
+			},
+			"schemas": {
+				"Error": map[string]any{
+					"type":       "object",
+					"properties": map[string]any{"error": map[string]string{"type": "string"}},
+				},
+			},
+		},
+	}
+}
+
+func schemaRef(name string) map[string]string {
+	return map[string]string{"$ref": "#/components/schemas/" + name}
+}
+
+func jsonContent(schema any) map[string]any {
+	return map[string]any{"application/json": map[string]any{"schema": schema}}
+}
+
+func response(description string, schema any) map[string]any {
+	r := map[string]any{"description": description}
+	if schema != nil {
+		r["content"] = jsonContent(schema)
+	}
+	return r
+}
+
+func errorResponse(description string) map[string]any {
+	return response(description, schemaRef("Error"))
+}
+
+func (o *openAPI) addToken(path string) {
+	o.Paths[path] = map[string]any{
+		"post": map[string]any{
+			"summary":     "Create a bearer token for an administrator",
+			"tags":        []string{"auth"},
+			"security":    []map[string][]string{},
+			"requestBody": map[string]any{"required": true, "content": jsonContent(o.schema(reflect.TypeOf(Credentials{})))},
+			"responses": map[string]any{
+				"200": response("Token", o.schema(reflect.TypeOf(TokenResponse{}))),
+				"400": errorResponse("Invalid request"),
+				"401": errorResponse("Invalid credentials"),
+				"403": errorResponse("Not an administrator or password reset required"),
+			},
+		},
+	}
+}
+
+func (o *openAPI) addResource(collection string, title string, sample any, create bool, update bool, delete bool) {
+	tags := []string{strings.TrimPrefix(collection, "/")}
+	ref := o.schema(reflect.TypeOf(sample))
+	idParam := []map[string]any{{"name": "id", "in": "path", "required": true, "schema": map[string]string{"type": "string"}}}
+
+	list := map[string]any{
+		"get": map[string]any{
+			"summary": "List " + title + " objects",
+			"tags":    tags,
+			"parameters": []map[string]any{
+				{"name": "offset", "in": "query", "schema": map[string]any{"type": "integer", "minimum": 0, "default": 0}},
+				{"name": "limit", "in": "query", "schema": map[string]any{"type": "integer", "minimum": 1, "maximum": apiMaxLimit, "default": apiDefaultLimit}},
+				{"name": "q", "in": "query", "description": "Case insensitive search in all fields", "schema": map[string]string{"type": "string"}},
+				{"name": "sort", "in": "query", "description": "Field to sort by, prefix with - to sort descending", "schema": map[string]string{"type": "string"}},
+				{"name": "filter", "in": "query", "description": "Any other parameter selects the objects with a matching field, e.g. ?Enabled=true",
+					"style": "form", "explode": true, "schema": map[string]any{"type": "object", "additionalProperties": map[string]string{"type": "string"}}},
+			},
+			"responses": map[string]any{
+				"200": response("Page of "+title+" objects", map[string]any{
+					"type": "object",
+					"properties": map[string]any{
+						"Items":  map[string]any{"type": "array", "items": ref},
+						"Total":  map[string]string{"type": "integer"},
+						"Offset": map[string]string{"type": "integer"},
+						"Limit":  map[string]string{"type": "integer"},
+					},
+				}),
+				"400": errorResponse("Invalid paging parameters"),
+			},
+		},
+	}
+	item := map[string]any{
+		"parameters": idParam,
+		"get": map[string]any{
+			"summary": "Get a " + title,
+			"tags":    tags,
+			"responses": map[string]any{
+				"200": response(title, ref),
+				"404": errorResponse("Not found"),
+			},
+		},
+	}
+	if create {
+		list["post"] = map[string]any{
+			"summary":     "Create a " + title,
+			"tags":        tags,
+			"requestBody": map[string]any{"required": true, "content": jsonContent(ref)},
+			"responses": map[string]any{
+				"201": response("Created, the Location header holds the URL of the object", ref),
+				"400": errorResponse("Invalid object"),
+				"409": errorResponse("Already exists"),
+			},
+		}
+	}
+	if update {
+		item["put"] = map[string]any{
+			"summary":     "Update a " + title + ", fields missing from the body keep their value",
+			"tags":        tags,
+			"requestBody": map[string]any{"required": true, "content": jsonContent(ref)},
+			"responses": map[string]any{
+				"200": response(title, ref),
+				"400": errorResponse("Invalid object"),
+				"404": errorResponse("Not found"),
+			},
+		}
+	}
+	if delete {
+		item["delete"] = map[string]any{
+			"summary": "Delete a " + title,
+			"tags":    tags,
+			"responses": map[string]any{
+				"204": response("Deleted", nil),
+				"404": errorResponse("Not found"),
+				"409": errorResponse("In use"),
+			},
+		}
+	}
+	o.Paths[collection] = list
+	o.Paths[collection+"/{id}"] = item
+}
+
+func (o *openAPI) addQueryLog(path string) {
+	o.Paths[path] = map[string]any{
+		"get": map[string]any{
+			"summary": "Search the DNS query log, most recent queries first",
+			"tags":    []string{"querylog"},
+			"parameters": []map[string]any{
+				{"name": "client", "in": "query", "description": "Client IP address", "schema": map[string]string{"type": "string"}},
+				{"name": "domain", "in": "query", "description": "Domain name, includes its subdomains", "schema": map[string]string{"type": "string"}},
+				{"name": "from", "in": "query", "schema": map[string]string{"type": "string", "format": "date-time"}},
+				{"name": "to", "in": "query", "schema": map[string]string{"type": "string", "format": "date-time"}},
+				{"name": "offset", "in": "query", "schema": map[string]any{"type": "integer", "minimum": 0, "default": 0}},
+				{"name": "limit", "in": "query", "schema": map[string]any{"type": "integer", "minimum": 1, "maximum": apiMaxLimit, "default": apiDefaultLimit}},
+			},
+			"responses": map[string]any{
+				"200": response("Page of query log entries, More reports whether older entries exist", o.schema(reflect.TypeOf(QueryLogResponse{}))),
+				"400": errorResponse("Invalid search parameters"),
+			},
+		},
+	}
+}
+
+func (o *openAPI) addSingleton(path string, title string, sample any) {
+	tags := []string{strings.TrimPrefix(path, "/")}
+	ref := o.schema(reflect.TypeOf(sample))
+	o.Paths[path] = map[string]any{
+		"get": map[string]any{
+			"summary":   "Get the " + title,
+			"tags":      tags,
+			"responses": map[string]any{"200": response(title, ref)},
+		},
+		"put": map[string]any{
+			"summary":     "Update the " + title + ", fields missing from the body keep their value",
+			"tags":        tags,
+			"requestBody": map[string]any{"required": true, "content": jsonContent(ref)},
+			"responses": map[string]any{
+				"200": response(title, ref),
+				"400": errorResponse("Invalid " + title),
+			},
+		},
+	}
+}
+
+// schema returns the JSON schema of the type, named structs are added to the components and referenced
+func (o *openAPI) schema(t reflect.Type) any {
+	for t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+	switch {
+	case t == timeType:
+		return map[string]string{"type": "string", "format": "date-time"}
+	case t.Kind() == reflect.Bool:
+		return map[string]string{"type": "boolean"}
+	case t.Kind() >= reflect.Int && t.Kind() <= reflect.Uint64:
+		return map[string]string{"type": "integer"}
+	case t.Kind() == reflect.Float32 || t.Kind() == reflect.Float64:
+		return map[string]string{"type": "number"}
+	case t.Kind() == reflect.String:
+		return map[string]string{"type": "string"}
+	case t.Kind() == reflect.Slice && t.Elem().Kind() == reflect.Uint8:
+		return map[string]string{"type": "string", "format": "byte"}
+	case t.Kind() == reflect.Slice || t.Kind() == reflect.Array:
+		return map[string]any{"type": "array", "items": o.schema(t.Elem())}
+	case t.Kind() == reflect.Map:
+		return map[string]any{"type": "object", "additionalProperties": o.schema(t.Elem())}
+	case t.Kind() != reflect.Struct:
+		return map[string]string{}
+	}
+
+	schemas := o.Components["schemas"]
+	if t.Name() != "" {
+		if _, ok := schemas[t.Name()]; ok {
+			return schemaRef(t.Name())
+		}
+		// placeholder for recursive types
+		schemas[t.Name()] = nil
+	}
+	properties := make(map[string]any)
+	o.properties(t, properties)
+	s := map[string]any{"type": "object", "properties": properties}
+	if t.Name() == "" {
+		return s
+	}
+	schemas[t.Name()] = s
+	return schemaRef(t.Name())
+}
+
+// properties collects the JSON properties of the struct, fields of embedded structs are promoted
+// unless a field of the outer struct has the same name
+func (o *openAPI) properties(t reflect.Type, properties map[string]any) {
+	embedded := make([]reflect.Type, 0)
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		name, opts, _ := strings.Cut(f.Tag.Get("json"), ",")
+		if name == "-" && opts == "" {
+			continue
+		}
+		if f.Anonymous && name == "" {
+			embedded = append(embedded, f.Type)
+			continue
+		}
+		if !f.IsExported() {
+			continue
+		}
+		if name == "" {
+			name = f.Name
+		}
+		properties[name] = o.schema(f.Type)
+	}
+	for _, e := range embedded {
+		promoted := make(map[string]any)
+		o.properties(e, promoted)
+		for name, s := range promoted {
+			if _, ok := properties[name]; !ok {
+				properties[name] = s
+			}
+		}
+	}
+}
@@ -30,6 +30,7 @@ type WebControllers struct {
 	Stats     wcStats
 	Profiles  wcProfiles
 	DNSConfig wcServices
+	API       api
 }
 
 type Portal struct {
@@ -53,14 +54,15 @@ func InitPortal() *Portal {
 		fw:      firewall.LoadFirewallManager(),
 		wc:      WebControllers{},
 	}
-	p.fw.Init(p.db)
 	p.config = GlobalConfiguration{
 		settings: p.db.GetSettings(),
 	}
 	initDefaults(p)
+	p.fw.Init(p.db, p.config.settings)
 	p.security = security.InitSession(p.db, p.network, p.config.settings)
 	p.rules = *rules.Init(p.db, p.config.settings)
 	p.rules.InitDefaults()
+	p.rules.StartScheduler()
 	p.fw.SetActiveFirewall(p.config.settings.Firewall)
 	p.dns = *dns.InitDnsServer(p.fw, p.db, p.security, p.network, p.config.settings)
 	p.server = *initWebServer(60*time.Minute, p.interceptHandler)
@@ -71,11 +73,13 @@ func InitPortal() *Portal {
 	p.wc.Profiles = *wcProfilesInit(p)
 	p.wc.Stats = *wcStatsInit(p)
 	p.wc.DNSConfig = *wcServicesInit(p)
+	p.wc.API = *apiInit(p)
 	p.server.router.GET("/logout", p.logout)
 	p.server.router.GET("/ca", p.ca)
 	p.httpproxy.ApplyConfiguration()
 
 	webShellInit(p)
+	metricsInit(p)
 
 	return p
 }
@@ -119,6 +123,8 @@ type requestType struct {
 	accessprofiles  []string
 	accessprofile   string
 	reasoncode      uint16
+	category        string
+	blockedby       string
 }
 
 func (p *Portal) determineRequest(c *gin.Context) requestType {
@@ -143,10 +149,13 @@ func (p *Portal) determineRequest(c *gin.Context) requestType {
 		host = loc.Host
 		if host != ip {
 			fwr := p.db.GetDNSSession(ip, host+".", 1)
+			if fwr == nil {
+				fwr = p.db.GetDNSSession(ip, host+".", 28)
+			}
 			if fwr != nil {
 				ses, _ := p.security.GetSessionInfo(ip)
 				rt.sessionUser = ses.Username
-				rt.isSessionPage = host == "session" || host == "session."+p.config.settings.LocalDomain
+				rt.isSessionPage = host == "session" || host == "session."+p.config.settings.Snapshot().LocalDomain
 
 				if !fwr.IsLocal || rt.isSessionPage {
 					if !rt.resourceRequest {
@@ -177,6 +186,13 @@ func (p *Portal) determineRequest(c *gin.Context) requestType {
 							rt.serveTemplate = "portal_session"
 							rt.blocked = true
 							rt.reasoncode = fwr.ReasonCode
+							rt.blockedby = fwr.BlockedBy
+							if fwr.Category != "" {
+								rt.category = fwr.Category
+								if cat := p.db.GetDNSCategory(fwr.Category); cat != nil {
+									rt.category = cat.CategoryName
+								}
+							}
 
 						}
 
@@ -239,6 +255,15 @@ func (p *Portal) interceptHandler(c *gin.Context) {
 					} else {
 						err = fmt.Errorf("passwords do not match")
 					}
+					if err != nil {
+						p.server.HTML(c, "reset_password", gin.H{
+							"username": u.UserName,
+							"next":     c.Query("next"),
+							"error":    err,
+						})
+						c.Abort()
+						return
+					}
 				} else {
 					err = fmt.Errorf("password reset has expired")
 				}
@@ -268,7 +293,7 @@ func (p *Portal) interceptHandler(c *gin.Context) {
 						FullName: fullname,
 						Password: password,
 						Enabled:  true,
-						Role:     p.config.settings.DefaultRole,
+						Role:     p.config.settings.Snapshot().DefaultRole,
 					}); err == nil {
 						c.Redirect(http.StatusSeeOther, c.Request.URL.Path)
 					}
@@ -297,7 +322,18 @@ func (p *Portal) interceptHandler(c *gin.Context) {
 					})
 					c.Abort()
 					return
-				} else if u.Password == c.Request.FormValue("password") {
+				} else if p.db.VerifyPassword(u, c.Request.FormValue("password")) {
+					if p.db.IsPasswordExpired(u) {
+						u.PasswordReset = time.Now().Add(15 * time.Minute)
+						p.db.UpdateUser(u)
+						p.server.HTML(c, "reset_password", gin.H{
+							"username": u.UserName,
+							"next":     c.Query("next"),
+							"error":    fmt.Errorf("password has expired"),
+						})
+						c.Abort()
+						return
+					}
 					if rt.isAdminPortal {
 						if p.security.IsAllowedPortalAccess(u.UserName) {
 							token, exp, serr := p.server.CreateSessionToken(u.UserName)
@@ -325,11 +361,13 @@ func (p *Portal) interceptHandler(c *gin.Context) {
 					err = fmt.Errorf("access denied")
 				}
 			} else {
+				p.db.VerifyPassword(nil, c.Request.FormValue("password"))
 				err = fmt.Errorf("access denied")
 			}
 		}
 
-	} else if (rt.isAdminPortal && rt.sessionUser != "") || rt.resourceRequest {
+	} else if (rt.isAdminPortal && (rt.sessionUser != "" || strings.HasPrefix(c.Request.URL.Path, apiPrefix+"/") || c.Request.URL.Path == conf.GetString("path-metrics"))) || rt.resourceRequest {
+		// the api and the metrics authenticate their own requests and answer with JSON errors
 		c.Next()
 		return
 	}
@@ -348,12 +386,14 @@ func (p *Portal) interceptHandler(c *gin.Context) {
 		"next":           c.Query("next"),
 		"ip":             clientIP(c.Request),
 		"portal_address": portal_address,
-		"allow_register": rt.serveTemplate == "session_login" && p.config.settings.SelfRegEnabled,
+		"allow_register": rt.serveTemplate == "session_login" && p.config.settings.Snapshot().SelfRegEnabled,
 		"error":          err,
 		"message":        message,
 		"accessprofile":  rt.accessprofile,
 		"accessprofiles": rt.accessprofiles,
 		"reasoncode":     rt.reasoncode,
+		"category":       rt.category,
+		"blockedby":      rt.blockedby,
 		"sessionpage":    rt.isSessionPage,
 	})
 	if rt.serveTemplate != "portal_session" || c.Request.URL.Path != "/logout" {
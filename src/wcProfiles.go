@@ -220,6 +220,8 @@ func wcProfilesInit(p *Portal) *wcProfiles {
 		{0, "UDP"},
 		{1, "TCP"},
 		{2, "TCP over TLS"},
+		{3, "DNS over HTTPS"},
+		{4, "DNS over QUIC"},
 	}
 
 	p.server.router.GET("/profiles/roles/new", func(c *gin.Context) {
@@ -246,6 +248,7 @@ func wcProfilesInit(p *Portal) *wcProfiles {
 			DNSConfiguration:     c.PostForm("DNSConfiguration"),
 			DNSAddress:           strings.Trim(c.PostForm("DNSAddress"), " "),
 		}
+		readBlockResponse(c, &role.Access.BlockResponse)
 		t, err := strconv.Atoi(c.PostForm("DNSMode"))
 		if err == nil {
 			modeVal := reflect.ValueOf(t)
@@ -372,6 +375,7 @@ func wcProfilesInit(p *Portal) *wcProfiles {
 		role.DNSPrependDeviceName = c.PostForm("DNSPrependDeviceName") == "on"
 		role.DNSConfiguration = c.PostForm("DNSConfiguration")
 		role.DNSAddress = strings.Trim(c.PostForm("DNSAddress"), " ")
+		readBlockResponse(c, &role.Access.BlockResponse)
 
 		t, err := strconv.Atoi(c.PostForm("DNSMode"))
 		if err == nil {
@@ -674,7 +678,8 @@ func wcProfilesInit(p *Portal) *wcProfiles {
 			"action": "create",
 			"title":  "New Access Profile",
 			"model": gin.H{
-				"Profile": &db.AccessProfile{},
+				"Profile":    &db.AccessProfile{},
+				"Categories": p.db.GetDNSCategories(),
 			},
 		})
 	})
@@ -682,10 +687,14 @@ func wcProfilesInit(p *Portal) *wcProfiles {
 	p.server.router.POST("/profiles/accessprofiles/new", func(c *gin.Context) {
 		var err error
 		var profile = &db.AccessProfile{
-			Name:           c.PostForm("Name"),
-			BlockedDomains: parsedomains(c.PostForm("BlockedDomains")),
-			AllowedDomains: parsedomains(c.PostForm("AllowedDomains")),
+			Name:              c.PostForm("Name"),
+			BlockedDomains:    parsedomains(c.PostForm("BlockedDomains")),
+			AllowedDomains:    parsedomains(c.PostForm("AllowedDomains")),
+			AllowedCategories: c.PostFormArray("AllowedCategories"),
+			BlockedCategories: c.PostFormArray("BlockedCategories"),
+			SafeSearch:        c.PostForm("SafeSearch") == "on",
 		}
+		readBlockResponse(c, &profile.BlockResponse)
 
 		if c.PostForm("action") == "create" {
 			err = p.db.CreateAccessProfile(profile)
@@ -701,7 +710,8 @@ func wcProfilesInit(p *Portal) *wcProfiles {
 			"title":  "New Role",
 			"error":  err,
 			"model": gin.H{
-				"Profile": profile,
+				"Profile":    profile,
+				"Categories": p.db.GetDNSCategories(),
 			},
 		})
 	})
@@ -715,8 +725,9 @@ func wcProfilesInit(p *Portal) *wcProfiles {
 			"action": "edit",
 			"title":  "Edit Access Profile",
 			"model": gin.H{
-				"Profile": profile,
-				"action":  "Save",
+				"Profile":    profile,
+				"Categories": p.db.GetDNSCategories(),
+				"action":     "Save",
 			},
 		})
 	})
@@ -724,10 +735,16 @@ func wcProfilesInit(p *Portal) *wcProfiles {
 	p.server.router.POST("/profiles/accessprofile/:name", func(c *gin.Context) {
 		var profile = p.db.GetAccessProfile(c.Param("name"))
 
-		profile.AllowedDomains = parsedomains(c.PostForm("AllowedDomains"))
-		profile.BlockedDomains = parsedomains(c.PostForm("BlockedDomains"))
-
 		var err error
+		if profile != nil {
+			profile.AllowedDomains = parsedomains(c.PostForm("AllowedDomains"))
+			profile.BlockedDomains = parsedomains(c.PostForm("BlockedDomains"))
+			profile.AllowedCategories = c.PostFormArray("AllowedCategories")
+			profile.BlockedCategories = c.PostFormArray("BlockedCategories")
+			profile.SafeSearch = c.PostForm("SafeSearch") == "on"
+			readBlockResponse(c, &profile.BlockResponse)
+		}
+
 		if profile == nil {
 			err = fmt.Errorf("access profile %s does not exist", c.Param("name"))
 		} else if c.PostForm("action") == "edit" {
@@ -750,7 +767,8 @@ func wcProfilesInit(p *Portal) *wcProfiles {
 			"title":  "Edit Access Profile",
 			"error":  err,
 			"model": gin.H{
-				"Profile": profile,
+				"Profile":    profile,
+				"Categories": p.db.GetDNSCategories(),
 			},
 		})
 	})
@@ -800,3 +818,24 @@ func parsedomains(domains string) []string {
 	}
 	return result
 }
+
+// readBlockResponse reads the block mode and TTL of a role or access profile form
+func readBlockResponse(c *gin.Context, response *db.BlockResponse) {
+	response.Mode = db.BlockModeDefault
+	switch c.PostForm("BlockMode") {
+	case "1":
+		response.Mode = db.BlockModePortal
+	case "2":
+		response.Mode = db.BlockModeNXDomain
+	case "3":
+		response.Mode = db.BlockModeNoData
+	case "4":
+		response.Mode = db.BlockModeNullIP
+	case "5":
+		response.Mode = db.BlockModeRefused
+	}
+	response.TTL = 0
+	if x, err := strconv.ParseUint(c.PostForm("BlockTTL"), 10, 32); err == nil {
+		response.TTL = uint32(x)
+	}
+}
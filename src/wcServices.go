@@ -2,10 +2,13 @@ package main
 
 import (
 	"fmt"
+	"net"
 	"net/http"
 	"net/url"
-	"reflect"
+	"path"
 	"sleuth/internal/db"
+	"sleuth/internal/dns"
+	"sleuth/internal/rules"
 	"strconv"
 	"strings"
 	"time"
@@ -13,7 +16,6 @@ import (
 	"sort"
 
 	"github.com/gin-gonic/gin"
-	"github.com/robfig/cron/v3"
 )
 
 type wcServices struct {
@@ -143,7 +145,13 @@ func wcServicesInit(p *Portal) *wcServices {
 		}
 
 		rulesets := p.db.GetDNSRuleSets()
+		nextUpdate := make(map[string]time.Time)
+		lastError := make(map[string]string)
 		for i := range rulesets {
+			nextUpdate[rulesets[i].RuleSetId] = p.rules.NextUpdate(rulesets[i])
+			if h := rulesets[i].History; len(h) > 0 && !h[len(h)-1].Success {
+				lastError[rulesets[i].RuleSetId] = h[len(h)-1].Error
+			}
 			if rulesets[i].External == false {
 				rulesets[i].Source = ""
 				rulesets[i].Schedule = "Manual"
@@ -165,8 +173,10 @@ func wcServicesInit(p *Portal) *wcServices {
 
 		p.server.HTML(c, "services_dnsrulesets", gin.H{
 			"model": gin.H{
-				"RuleSets": rulesets,
-				"error":    err,
+				"RuleSets":   rulesets,
+				"NextUpdate": nextUpdate,
+				"LastError":  lastError,
+				"error":      err,
 			},
 		})
 	}
@@ -222,6 +232,7 @@ func wcServicesInit(p *Portal) *wcServices {
 			RuleSetName: c.PostForm("rulesetname"),
 			CategoryId:  c.PostForm("categoryid"),
 			Source:      c.PostForm("source"),
+			Format:      c.PostForm("format"),
 			Schedule:    c.PostForm("schedule"),
 			Enabled:     c.PostForm("enabled") == "on",
 			External:    c.PostForm("external") == "on",
@@ -229,7 +240,7 @@ func wcServicesInit(p *Portal) *wcServices {
 
 		var err error = nil
 		if ruleset.Schedule != "" {
-			_, err = cron.ParseStandard(ruleset.Schedule)
+			_, err = rules.ParseSchedule(ruleset.Schedule)
 			if err != nil {
 				err = fmt.Errorf("Update schedule: %w", err)
 			}
@@ -257,11 +268,16 @@ func wcServicesInit(p *Portal) *wcServices {
 	p.server.router.GET("/services/ruleset/:rulesetid", func(c *gin.Context) {
 		rulesetid := c.Param("rulesetid")
 		ruleset := p.db.GetDNSRuleSet(rulesetid)
+		var nextUpdate time.Time
+		if ruleset != nil {
+			nextUpdate = p.rules.NextUpdate(*ruleset)
+		}
 		p.server.HTML(c, "services_dnsruleset", gin.H{
 			"action": "edit",
 			"title":  "Edit DNS rule set",
 			"model": gin.H{
 				"RuleSet":    ruleset,
+				"NextUpdate": nextUpdate,
 				"Categories": p.db.GetDNSCategories(),
 			},
 		})
@@ -274,8 +290,8 @@ func wcServicesInit(p *Portal) *wcServices {
 			err = fmt.Errorf("DNS rule set %s does not exist", c.Param("rulesetid"))
 		}
 
-		if err == nil && rs.Schedule != "" {
-			_, err = cron.ParseStandard(rs.Schedule)
+		if err == nil && c.PostForm("schedule") != "" {
+			_, err = rules.ParseSchedule(c.PostForm("schedule"))
 			if err != nil {
 				err = fmt.Errorf("Update schedule: %w", err)
 			}
@@ -285,6 +301,7 @@ func wcServicesInit(p *Portal) *wcServices {
 			rs.RuleSetName = c.PostForm("rulesetname")
 			rs.CategoryId = c.PostForm("categoryid")
 			rs.Source = c.PostForm("source")
+			rs.Format = c.PostForm("format")
 			rs.Schedule = c.PostForm("schedule")
 			rs.Enabled = c.PostForm("enabled") == "on"
 			rs.External = c.PostForm("external") == "on"
@@ -295,9 +312,9 @@ func wcServicesInit(p *Portal) *wcServices {
 			c.Redirect(http.StatusSeeOther, "/services/rulesets")
 			c.Abort()
 		} else {
-			p.server.HTML(c, "services_dnscategory", gin.H{
+			p.server.HTML(c, "services_dnsruleset", gin.H{
 				"action": "edit",
-				"title":  "Edit DNS Category",
+				"title":  "Edit DNS rule set",
 				"error":  err.Error(),
 				"model": gin.H{
 					"RuleSet":    rs,
@@ -380,7 +397,7 @@ func wcServicesInit(p *Portal) *wcServices {
 	p.server.router.GET("/services/api", func(c *gin.Context) {
 
 		apis := []map[string]any{}
-		apis = append(apis, map[string]any{"api": "DomScan", "Enabled": p.config.settings.APIs.DomScan.Enabled})
+		apis = append(apis, map[string]any{"api": "DomScan", "Enabled": p.config.settings.Snapshot().APIs.DomScan.Enabled})
 
 		p.server.HTML(c, "services_apis", gin.H{
 			"title": "API Configuration",
@@ -394,7 +411,7 @@ func wcServicesInit(p *Portal) *wcServices {
 
 		p.server.HTML(c, "services_api_domscan", gin.H{
 			"title": "DomScan API Configuration",
-			"model": p.config.settings.APIs.DomScan,
+			"model": p.config.settings.Snapshot().APIs.DomScan,
 		})
 	})
 
@@ -413,10 +430,13 @@ func wcServicesInit(p *Portal) *wcServices {
 		}
 
 		if save {
-			p.config.settings.APIs.DomScan.Enabled = enabled
-			p.config.settings.APIs.DomScan.Key = key
-			p.config.settings.APIs.DomScan.Services.WebSiteCategorization = WebSiteCategorization
-			err = p.db.SaveSettings(*p.config.settings)
+			settings := p.config.settings.Snapshot()
+			settings.APIs.DomScan.Enabled = enabled
+			settings.APIs.DomScan.Key = key
+			settings.APIs.DomScan.Services.WebSiteCategorization = WebSiteCategorization
+			if err = p.db.SaveSettings(settings); err == nil {
+				p.config.settings.Update(func(s *db.Settings) { s.APIs.DomScan = settings.APIs.DomScan })
+			}
 			if err == nil {
 				c.Redirect(http.StatusSeeOther, c.Request.RequestURI)
 			}
@@ -446,6 +466,14 @@ func wcServicesInit(p *Portal) *wcServices {
 		{0, "UDP"},
 		{1, "TCP"},
 		{2, "TCP over TLS"},
+		{3, "DNS over HTTPS"},
+		{4, "DNS over QUIC"},
+	}
+
+	strategies := []TypeStruct{
+		{0, "Failover"},
+		{1, "Round-robin"},
+		{2, "Fastest response"},
 	}
 
 	p.server.router.GET("/services/dnsconfigurations", func(c *gin.Context) {
@@ -455,9 +483,23 @@ func wcServicesInit(p *Portal) *wcServices {
 			return profiles[i].Name < profiles[j].Name
 		})
 
+		stats := p.dns.UpstreamStats()
+		upstreams := make(map[string][]dns.UpstreamStat)
+		for _, profile := range profiles {
+			for _, u := range profile.GetUpstreams() {
+				stat, ok := stats[dns.UpstreamKey(u)]
+				if !ok {
+					stat = dns.UpstreamStat{DNSUpstream: u, Healthy: true}
+				}
+				upstreams[profile.ProfileId] = append(upstreams[profile.ProfileId], stat)
+			}
+		}
+
 		p.server.HTML(c, "services_dnsconfigurations", gin.H{
 			"model": gin.H{
-				"Profiles": profiles,
+				"Profiles":   profiles,
+				"Upstreams":  upstreams,
+				"Strategies": strategies,
 			},
 		})
 	})
@@ -467,31 +509,17 @@ func wcServicesInit(p *Portal) *wcServices {
 			"action": "create",
 			"title":  "New DNS Configuration",
 			"model": gin.H{
-				"Profile": make(map[string]interface{}),
-				"Types":   types,
+				"Profile":    make(map[string]interface{}),
+				"Types":      types,
+				"Strategies": strategies,
 			},
 		})
 	})
 
 	p.server.router.POST("/services/dnsconfigurations/new", func(c *gin.Context) {
-
-		var profile = &db.DNSConfiguration{
-			Name:    c.PostForm("name"),
-			Address: c.PostForm("address"),
-		}
-
-		t, err := strconv.Atoi(c.PostForm("type"))
+		var profile = &db.DNSConfiguration{}
+		err := readDNSConfiguration(c, profile)
 		if err == nil {
-			modeVal := reflect.ValueOf(t)
-
-			rv := reflect.ValueOf(&profile.Type).Elem()
-
-			if modeVal.Type().ConvertibleTo(rv.Type()) {
-				rv.Set(modeVal.Convert(rv.Type()))
-			} else if rv.Kind() >= reflect.Int && rv.Kind() <= reflect.Int64 {
-				rv.SetInt(int64(t))
-			}
-
 			err = p.db.CreateDNSConfiguration(profile)
 		}
 		if err == nil {
@@ -503,8 +531,10 @@ func wcServicesInit(p *Portal) *wcServices {
 				"title":  "New DNS Configuration",
 				"error":  err.Error(),
 				"model": gin.H{
-					"Profile": profile,
-					"Types":   types,
+					"Profile":    profile,
+					"Upstreams":  c.PostForm("upstreams"),
+					"Types":      types,
+					"Strategies": strategies,
 				},
 			})
 		}
@@ -517,8 +547,10 @@ func wcServicesInit(p *Portal) *wcServices {
 			"action": "edit",
 			"title":  "Edit DNS Configuration",
 			"model": gin.H{
-				"Profile": profile,
-				"Types":   types,
+				"Profile":    profile,
+				"Upstreams":  formatUpstreams(profile.GetUpstreams()),
+				"Types":      types,
+				"Strategies": strategies,
 			},
 		})
 	})
@@ -528,24 +560,8 @@ func wcServicesInit(p *Portal) *wcServices {
 		var err error
 		if profile == nil {
 			err = fmt.Errorf("DNS Configuration %s does not exist", c.Param("profileid"))
-		} else {
-			profile.Name = c.PostForm("name")
-			profile.Address = c.PostForm("address")
-
-			t, err := strconv.Atoi(c.PostForm("type"))
-			if err == nil {
-				modeVal := reflect.ValueOf(t)
-
-				rv := reflect.ValueOf(&profile.Type).Elem()
-
-				if modeVal.Type().ConvertibleTo(rv.Type()) {
-					rv.Set(modeVal.Convert(rv.Type()))
-				} else if rv.Kind() >= reflect.Int && rv.Kind() <= reflect.Int64 {
-					rv.SetInt(int64(t))
-				}
-
-				p.db.UpdateDNSConfiguration(profile)
-			}
+		} else if err = readDNSConfiguration(c, profile); err == nil {
+			err = p.db.UpdateDNSConfiguration(profile)
 		}
 
 		if err == nil {
@@ -557,8 +573,10 @@ func wcServicesInit(p *Portal) *wcServices {
 				"title":  "Edit DNS Configuration",
 				"error":  err.Error(),
 				"model": gin.H{
-					"Profile": profile,
-					"Types":   types,
+					"Profile":    profile,
+					"Upstreams":  c.PostForm("upstreams"),
+					"Types":      types,
+					"Strategies": strategies,
 				},
 			})
 		}
@@ -593,6 +611,498 @@ func wcServicesInit(p *Portal) *wcServices {
 		}
 	})
 
+	/**** Conditional Forwarders ****/
+
+	p.server.router.GET("/services/dnsforwarders", func(c *gin.Context) {
+		forwarders := p.db.GetDNSForwarders()
+
+		sort.Slice(forwarders, func(i, j int) bool {
+			return forwarders[i].Domain < forwarders[j].Domain
+		})
+
+		p.server.HTML(c, "services_dnsforwarders", gin.H{
+			"model": gin.H{
+				"Forwarders": forwarders,
+			},
+		})
+	})
+
+	p.server.router.GET("/services/dnsforwarders/new", func(c *gin.Context) {
+		p.server.HTML(c, "services_dnsforwarder", gin.H{
+			"action": "create",
+			"title":  "New Conditional Forwarder",
+			"model": gin.H{
+				"Forwarder": &db.DNSForwarder{Enabled: true},
+				"Types":     types,
+				"Roles":     p.db.GetRoles(),
+			},
+		})
+	})
+
+	p.server.router.POST("/services/dnsforwarders/new", func(c *gin.Context) {
+		var forwarder = &db.DNSForwarder{}
+		err := readDNSForwarder(c, forwarder)
+		if err == nil {
+			err = p.db.CreateDNSForwarder(forwarder)
+		}
+		if err == nil {
+			p.dns.ReloadForwarders()
+			c.Redirect(http.StatusSeeOther, "/services/dnsforwarders")
+			c.Abort()
+		} else {
+			p.server.HTML(c, "services_dnsforwarder", gin.H{
+				"action": "create",
+				"title":  "New Conditional Forwarder",
+				"error":  err.Error(),
+				"model": gin.H{
+					"Forwarder": forwarder,
+					"Upstreams": c.PostForm("upstreams"),
+					"Types":     types,
+					"Roles":     p.db.GetRoles(),
+				},
+			})
+		}
+	})
+
+	p.server.router.GET("/services/dnsforwarder/:forwarderid", func(c *gin.Context) {
+		forwarder := p.db.GetDNSForwarder(c.Param("forwarderid"))
+		upstreams := ""
+		if forwarder != nil {
+			upstreams = formatUpstreams(forwarder.Upstreams)
+		}
+		p.server.HTML(c, "services_dnsforwarder", gin.H{
+			"action": "edit",
+			"title":  "Edit Conditional Forwarder",
+			"model": gin.H{
+				"Forwarder": forwarder,
+				"Upstreams": upstreams,
+				"Types":     types,
+				"Roles":     p.db.GetRoles(),
+			},
+		})
+	})
+
+	p.server.router.POST("/services/dnsforwarder/:forwarderid", func(c *gin.Context) {
+		var forwarder = p.db.GetDNSForwarder(c.Param("forwarderid"))
+		var err error
+		if forwarder == nil {
+			err = fmt.Errorf("Conditional Forwarder %s does not exist", c.Param("forwarderid"))
+		} else if err = readDNSForwarder(c, forwarder); err == nil {
+			err = p.db.UpdateDNSForwarder(forwarder)
+		}
+
+		if err == nil {
+			p.dns.ReloadForwarders()
+			c.Redirect(http.StatusSeeOther, "/services/dnsforwarders")
+			c.Abort()
+		} else {
+			p.server.HTML(c, "services_dnsforwarder", gin.H{
+				"action": "edit",
+				"title":  "Edit Conditional Forwarder",
+				"error":  err.Error(),
+				"model": gin.H{
+					"Forwarder": forwarder,
+					"Upstreams": c.PostForm("upstreams"),
+					"Types":     types,
+					"Roles":     p.db.GetRoles(),
+				},
+			})
+		}
+	})
+
+	p.server.router.GET("/services/dnsforwarders/delete/:forwarderid", func(c *gin.Context) {
+		forwarder := p.db.GetDNSForwarder(c.Param("forwarderid"))
+		p.server.HTML(c, "services_dnsforwarder_delete", gin.H{
+			"action": "delete",
+			"title":  "Delete Conditional Forwarder",
+			"model": gin.H{
+				"Forwarder": forwarder,
+			},
+		})
+	})
+
+	p.server.router.POST("/services/dnsforwarders/delete/:forwarderid", func(c *gin.Context) {
+		err := p.db.DeleteDNSForwarder(c.Param("forwarderid"))
+		if err == nil {
+			p.dns.ReloadForwarders()
+			c.Redirect(http.StatusSeeOther, "/services/dnsforwarders")
+			c.Abort()
+		} else {
+			forwarder := p.db.GetDNSForwarder(c.Param("forwarderid"))
+			p.server.HTML(c, "services_dnsforwarder_delete", gin.H{
+				"action": "delete",
+				"title":  "Delete Conditional Forwarder",
+				"error":  err.Error(),
+				"model": gin.H{
+					"Forwarder": forwarder,
+				},
+			})
+		}
+	})
+
+	/**** Safe Search Mappings ****/
+
+	p.server.router.GET("/services/safesearch", func(c *gin.Context) {
+		mappings := p.db.GetSafeSearchMappings()
+
+		sort.Slice(mappings, func(i, j int) bool {
+			if mappings[i].Target == mappings[j].Target {
+				return mappings[i].Domain < mappings[j].Domain
+			}
+			return mappings[i].Target < mappings[j].Target
+		})
+
+		p.server.HTML(c, "services_safesearchmappings", gin.H{
+			"model": gin.H{
+				"Mappings": mappings,
+			},
+		})
+	})
+
+	p.server.router.GET("/services/safesearch/new", func(c *gin.Context) {
+		p.server.HTML(c, "services_safesearchmapping", gin.H{
+			"action": "create",
+			"title":  "New Safe Search Mapping",
+			"model": gin.H{
+				"Mapping": &db.SafeSearchMapping{Enabled: true},
+			},
+		})
+	})
+
+	p.server.router.POST("/services/safesearch/new", func(c *gin.Context) {
+		var mapping = &db.SafeSearchMapping{}
+		err := readSafeSearchMapping(c, mapping)
+		if err == nil {
+			err = p.db.CreateSafeSearchMapping(mapping)
+		}
+		if err == nil {
+			p.dns.ReloadSafeSearchMappings()
+			c.Redirect(http.StatusSeeOther, "/services/safesearch")
+			c.Abort()
+		} else {
+			p.server.HTML(c, "services_safesearchmapping", gin.H{
+				"action": "create",
+				"title":  "New Safe Search Mapping",
+				"error":  err.Error(),
+				"model": gin.H{
+					"Mapping": mapping,
+				},
+			})
+		}
+	})
+
+	p.server.router.GET("/services/safesearchmapping/:mappingid", func(c *gin.Context) {
+		mapping := p.db.GetSafeSearchMapping(c.Param("mappingid"))
+		p.server.HTML(c, "services_safesearchmapping", gin.H{
+			"action": "edit",
+			"title":  "Edit Safe Search Mapping",
+			"model": gin.H{
+				"Mapping": mapping,
+			},
+		})
+	})
+
+	p.server.router.POST("/services/safesearchmapping/:mappingid", func(c *gin.Context) {
+		var mapping = p.db.GetSafeSearchMapping(c.Param("mappingid"))
+		var err error
+		if mapping == nil {
+			err = fmt.Errorf("Safe Search Mapping %s does not exist", c.Param("mappingid"))
+		} else if err = readSafeSearchMapping(c, mapping); err == nil {
+			err = p.db.UpdateSafeSearchMapping(mapping)
+		}
+
+		if err == nil {
+			p.dns.ReloadSafeSearchMappings()
+			c.Redirect(http.StatusSeeOther, "/services/safesearch")
+			c.Abort()
+		} else {
+			p.server.HTML(c, "services_safesearchmapping", gin.H{
+				"action": "edit",
+				"title":  "Edit Safe Search Mapping",
+				"error":  err.Error(),
+				"model": gin.H{
+					"Mapping": mapping,
+				},
+			})
+		}
+	})
+
+	p.server.router.GET("/services/safesearch/delete/:mappingid", func(c *gin.Context) {
+		mapping := p.db.GetSafeSearchMapping(c.Param("mappingid"))
+		p.server.HTML(c, "services_safesearchmapping_delete", gin.H{
+			"action": "delete",
+			"title":  "Delete Safe Search Mapping",
+			"model": gin.H{
+				"Mapping": mapping,
+			},
+		})
+	})
+
+	p.server.router.POST("/services/safesearch/delete/:mappingid", func(c *gin.Context) {
+		err := p.db.DeleteSafeSearchMapping(c.Param("mappingid"))
+		if err == nil {
+			p.dns.ReloadSafeSearchMappings()
+			c.Redirect(http.StatusSeeOther, "/services/safesearch")
+			c.Abort()
+		} else {
+			mapping := p.db.GetSafeSearchMapping(c.Param("mappingid"))
+			p.server.HTML(c, "services_safesearchmapping_delete", gin.H{
+				"action": "delete",
+				"title":  "Delete Safe Search Mapping",
+				"error":  err.Error(),
+				"model": gin.H{
+					"Mapping": mapping,
+				},
+			})
+		}
+	})
+
+	/**** Bypass Endpoints ****/
+
+	p.server.router.GET("/services/bypassendpoints", func(c *gin.Context) {
+		endpoints := p.db.GetBypassEndpoints()
+
+		sort.Slice(endpoints, func(i, j int) bool {
+			return endpoints[i].Name < endpoints[j].Name
+		})
+
+		p.server.HTML(c, "services_bypassendpoints", gin.H{
+			"model": gin.H{
+				"Endpoints": endpoints,
+			},
+		})
+	})
+
+	p.server.router.GET("/services/bypassendpoints/new", func(c *gin.Context) {
+		p.server.HTML(c, "services_bypassendpoint", gin.H{
+			"action": "create",
+			"title":  "New Bypass Endpoint",
+			"model": gin.H{
+				"Endpoint": &db.BypassEndpoint{Enabled: true},
+			},
+		})
+	})
+
+	p.server.router.POST("/services/bypassendpoints/new", func(c *gin.Context) {
+		var endpoint = &db.BypassEndpoint{}
+		err := readBypassEndpoint(c, endpoint)
+		if err == nil {
+			err = p.db.CreateBypassEndpoint(endpoint)
+		}
+		if err == nil {
+			p.dns.ReloadBypassEndpoints()
+			err = p.fw.ApplyBypassRules()
+		}
+		if err == nil {
+			c.Redirect(http.StatusSeeOther, "/services/bypassendpoints")
+			c.Abort()
+		} else {
+			p.server.HTML(c, "services_bypassendpoint", gin.H{
+				"action": "create",
+				"title":  "New Bypass Endpoint",
+				"error":  err.Error(),
+				"model": gin.H{
+					"Endpoint": endpoint,
+				},
+			})
+		}
+	})
+
+	p.server.router.GET("/services/bypassendpoint/:endpointid", func(c *gin.Context) {
+		endpoint := p.db.GetBypassEndpoint(c.Param("endpointid"))
+		p.server.HTML(c, "services_bypassendpoint", gin.H{
+			"action": "edit",
+			"title":  "Edit Bypass Endpoint",
+			"model": gin.H{
+				"Endpoint": endpoint,
+			},
+		})
+	})
+
+	p.server.router.POST("/services/bypassendpoint/:endpointid", func(c *gin.Context) {
+		var endpoint = p.db.GetBypassEndpoint(c.Param("endpointid"))
+		var err error
+		if endpoint == nil {
+			err = fmt.Errorf("Bypass Endpoint %s does not exist", c.Param("endpointid"))
+		} else if err = readBypassEndpoint(c, endpoint); err == nil {
+			err = p.db.UpdateBypassEndpoint(endpoint)
+		}
+		if err == nil {
+			p.dns.ReloadBypassEndpoints()
+			err = p.fw.ApplyBypassRules()
+		}
+
+		if err == nil {
+			c.Redirect(http.StatusSeeOther, "/services/bypassendpoints")
+			c.Abort()
+		} else {
+			p.server.HTML(c, "services_bypassendpoint", gin.H{
+				"action": "edit",
+				"title":  "Edit Bypass Endpoint",
+				"error":  err.Error(),
+				"model": gin.H{
+					"Endpoint": endpoint,
+				},
+			})
+		}
+	})
+
+	p.server.router.GET("/services/bypassendpoints/delete/:endpointid", func(c *gin.Context) {
+		endpoint := p.db.GetBypassEndpoint(c.Param("endpointid"))
+		p.server.HTML(c, "services_bypassendpoint_delete", gin.H{
+			"action": "delete",
+			"title":  "Delete Bypass Endpoint",
+			"model": gin.H{
+				"Endpoint": endpoint,
+			},
+		})
+	})
+
+	p.server.router.POST("/services/bypassendpoints/delete/:endpointid", func(c *gin.Context) {
+		err := p.db.DeleteBypassEndpoint(c.Param("endpointid"))
+		if err == nil {
+			p.dns.ReloadBypassEndpoints()
+			err = p.fw.ApplyBypassRules()
+		}
+		if err == nil {
+			c.Redirect(http.StatusSeeOther, "/services/bypassendpoints")
+			c.Abort()
+		} else {
+			endpoint := p.db.GetBypassEndpoint(c.Param("endpointid"))
+			p.server.HTML(c, "services_bypassendpoint_delete", gin.H{
+				"action": "delete",
+				"title":  "Delete Bypass Endpoint",
+				"error":  err.Error(),
+				"model": gin.H{
+					"Endpoint": endpoint,
+				},
+			})
+		}
+	})
+
+	/**** Local DNS Records ****/
+
+	p.server.router.GET("/services/dnsrecords", func(c *gin.Context) {
+		records := p.db.GetDNSRecords()
+
+		sort.Slice(records, func(i, j int) bool {
+			if records[i].Name == records[j].Name {
+				return records[i].Type < records[j].Type
+			}
+			return records[i].Name < records[j].Name
+		})
+
+		p.server.HTML(c, "services_dnsrecords", gin.H{
+			"model": gin.H{
+				"Records": records,
+				"Zone":    localZone(p.config.settings),
+			},
+		})
+	})
+
+	p.server.router.GET("/services/dnsrecords/new", func(c *gin.Context) {
+		p.server.HTML(c, "services_dnsrecord", gin.H{
+			"action": "create",
+			"title":  "New DNS Record",
+			"model": gin.H{
+				"Record": &db.DNSRecord{Type: "CNAME"},
+				"Types":  dns.LocalRecordTypes,
+				"Zone":   localZone(p.config.settings),
+			},
+		})
+	})
+
+	p.server.router.POST("/services/dnsrecords/new", func(c *gin.Context) {
+		var record = &db.DNSRecord{}
+		err := readDNSRecord(c, record, localZone(p.config.settings))
+		if err == nil {
+			err = p.db.CreateDNSRecord(record)
+		}
+		if err == nil {
+			c.Redirect(http.StatusSeeOther, "/services/dnsrecords")
+			c.Abort()
+		} else {
+			p.server.HTML(c, "services_dnsrecord", gin.H{
+				"action": "create",
+				"title":  "New DNS Record",
+				"error":  err.Error(),
+				"model": gin.H{
+					"Record": record,
+					"Types":  dns.LocalRecordTypes,
+					"Zone":   localZone(p.config.settings),
+				},
+			})
+		}
+	})
+
+	p.server.router.GET("/services/dnsrecord/:recordid", func(c *gin.Context) {
+		record := p.db.GetDNSRecord(c.Param("recordid"))
+		p.server.HTML(c, "services_dnsrecord", gin.H{
+			"action": "edit",
+			"title":  "Edit DNS Record",
+			"model": gin.H{
+				"Record": record,
+				"Types":  dns.LocalRecordTypes,
+				"Zone":   localZone(p.config.settings),
+			},
+		})
+	})
+
+	p.server.router.POST("/services/dnsrecord/:recordid", func(c *gin.Context) {
+		var record = p.db.GetDNSRecord(c.Param("recordid"))
+		var err error
+		if record == nil {
+			err = fmt.Errorf("DNS Record %s does not exist", c.Param("recordid"))
+		} else if err = readDNSRecord(c, record, localZone(p.config.settings)); err == nil {
+			err = p.db.UpdateDNSRecord(record)
+		}
+
+		if err == nil {
+			c.Redirect(http.StatusSeeOther, "/services/dnsrecords")
+			c.Abort()
+		} else {
+			p.server.HTML(c, "services_dnsrecord", gin.H{
+				"action": "edit",
+				"title":  "Edit DNS Record",
+				"error":  err.Error(),
+				"model": gin.H{
+					"Record": record,
+					"Types":  dns.LocalRecordTypes,
+					"Zone":   localZone(p.config.settings),
+				},
+			})
+		}
+	})
+
+	p.server.router.GET("/services/dnsrecords/delete/:recordid", func(c *gin.Context) {
+		record := p.db.GetDNSRecord(c.Param("recordid"))
+		p.server.HTML(c, "services_dnsrecord_delete", gin.H{
+			"action": "delete",
+			"title":  "Delete DNS Record",
+			"model": gin.H{
+				"Record": record,
+			},
+		})
+	})
+
+	p.server.router.POST("/services/dnsrecords/delete/:recordid", func(c *gin.Context) {
+		err := p.db.DeleteDNSRecord(c.Param("recordid"))
+		if err == nil {
+			c.Redirect(http.StatusSeeOther, "/services/dnsrecords")
+			c.Abort()
+		} else {
+			record := p.db.GetDNSRecord(c.Param("recordid"))
+			p.server.HTML(c, "services_dnsrecord_delete", gin.H{
+				"action": "delete",
+				"title":  "Delete DNS Record",
+				"error":  err.Error(),
+				"model": gin.H{
+					"Record": record,
+				},
+			})
+		}
+	})
+
 	/**** Reverse Proxy ****/
 
 	p.server.router.GET("/services/httpproxies", func(c *gin.Context) {
@@ -995,3 +1505,170 @@ func wcServicesInit(p *Portal) *wcServices {
 
 	return s
 }
+
+// upstreamSchemes are the prefixes of the upstream types in the upstreams field, by type
+var upstreamSchemes = []db.UpstreamScheme{
+	{Prefix: "udp://", Mode: db.ModeUDP},
+	{Prefix: "tcp://", Mode: db.ModeTCP},
+	{Prefix: "tls://", Mode: db.ModeTLS},
+	{Prefix: "https://", Mode: db.ModeHTTPS},
+	{Prefix: "quic://", Mode: db.ModeQUIC},
+}
+
+// readDNSConfiguration reads the DNS configuration form, upstreams are entered one per line and use the
+// selected type unless prefixed with udp://, tcp://, tls://, https:// or quic://, only HTTPS upstreams have a path
+func readDNSConfiguration(c *gin.Context, profile *db.DNSConfiguration) error {
+	profile.Name = c.PostForm("name")
+	t, err := strconv.Atoi(c.PostForm("type"))
+	if err != nil || t < 0 || t >= len(upstreamSchemes) {
+		return fmt.Errorf("invalid type %q", c.PostForm("type"))
+	}
+	switch c.PostForm("strategy") {
+	case "1":
+		profile.Strategy = db.StrategyRoundRobin
+	case "2":
+		profile.Strategy = db.StrategyFastest
+	default:
+		profile.Strategy = db.StrategyFailover
+	}
+	profile.DNSSEC = c.PostForm("dnssec") == "on"
+
+	upstreams, err := readUpstreams(c.PostForm("upstreams"), t)
+	if err != nil {
+		return err
+	}
+	profile.Upstreams = upstreams
+	profile.Type = upstreams[0].Type
+	profile.Address = upstreams[0].Address
+	return nil
+}
+
+// readUpstreams parses the upstreams field, entries without a scheme use the default type
+func readUpstreams(text string, defaultType int) ([]db.DNSUpstream, error) {
+	upstreams := make([]db.DNSUpstream, 0)
+	for _, line := range strings.Split(text, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+		u := db.DNSUpstream{Type: upstreamSchemes[defaultType].Mode, Address: line}
+		for _, scheme := range upstreamSchemes {
+			if strings.HasPrefix(line, scheme.Prefix) {
+				u = db.DNSUpstream{Type: scheme.Mode, Address: strings.TrimPrefix(line, scheme.Prefix)}
+			}
+		}
+		host, _, _ := strings.Cut(u.Address, "/")
+		if u.Type != db.ModeHTTPS {
+			host = u.Address
+		}
+		if host == "" || strings.Contains(u.Address, "://") || strings.ContainsAny(host, " /") {
+			return nil, fmt.Errorf("invalid upstream %q", line)
+		}
+		upstreams = append(upstreams, u)
+	}
+	if len(upstreams) == 0 {
+		return nil, fmt.Errorf("upstream not specified")
+	}
+	return upstreams, nil
+}
+
+// formatUpstreams returns the upstreams as entered in the upstreams field
+func formatUpstreams(upstreams []db.DNSUpstream) string {
+	lines := make([]string, 0)
+	for _, u := range upstreams {
+		for _, scheme := range upstreamSchemes {
+			if scheme.Mode == u.Type {
+				lines = append(lines, scheme.Prefix+u.Address)
+			}
+		}
+	}
+	return strings.Join(lines, "\n")
+}
+
+// readDNSForwarder reads the conditional forwarder form, the domain is stored without the trailing dot
+func readDNSForwarder(c *gin.Context, forwarder *db.DNSForwarder) error {
+	forwarder.Domain = strings.Trim(strings.ToLower(strings.TrimSpace(c.PostForm("domain"))), ".")
+	forwarder.Roles = c.PostFormArray("roles")
+	forwarder.Enabled = c.PostForm("enabled") == "on"
+	if forwarder.Domain == "" || strings.ContainsAny(forwarder.Domain, " /") {
+		return fmt.Errorf("invalid domain %q", c.PostForm("domain"))
+	}
+	t, err := strconv.Atoi(c.PostForm("type"))
+	if err != nil || t < 0 || t >= len(upstreamSchemes) {
+		return fmt.Errorf("invalid type %q", c.PostForm("type"))
+	}
+	forwarder.Upstreams, err = readUpstreams(c.PostForm("upstreams"), t)
+	return err
+}
+
+// readBypassEndpoint reads the bypass endpoint form, domains and addresses are entered one per line
+func readBypassEndpoint(c *gin.Context, endpoint *db.BypassEndpoint) error {
+	endpoint.Name = strings.TrimSpace(c.PostForm("name"))
+	endpoint.Domains = parsedomains(c.PostForm("domains"))
+	endpoint.Addresses = parsedomains(c.PostForm("addresses"))
+	endpoint.Enabled = c.PostForm("enabled") == "on"
+	return checkBypassEndpoint(endpoint)
+}
+
+// checkBypassEndpoint normalises the domains and validates the addresses of the endpoint
+func checkBypassEndpoint(endpoint *db.BypassEndpoint) error {
+	if endpoint.Name == "" {
+		return fmt.Errorf("name is required")
+	}
+	for i := range endpoint.Domains {
+		endpoint.Domains[i] = strings.Trim(strings.ToLower(strings.TrimSpace(endpoint.Domains[i])), ".")
+		if endpoint.Domains[i] == "" || strings.ContainsAny(endpoint.Domains[i], " /*") {
+			return fmt.Errorf("invalid domain %q", endpoint.Domains[i])
+		}
+	}
+	for i := range endpoint.Addresses {
+		endpoint.Addresses[i] = strings.TrimSpace(endpoint.Addresses[i])
+		if net.ParseIP(endpoint.Addresses[i]) == nil {
+			return fmt.Errorf("invalid address %q", endpoint.Addresses[i])
+		}
+	}
+	return nil
+}
+
+// readSafeSearchMapping reads the safe search mapping form
+func readSafeSearchMapping(c *gin.Context, mapping *db.SafeSearchMapping) error {
+	mapping.Domain = c.PostForm("domain")
+	mapping.Target = c.PostForm("target")
+	mapping.Enabled = c.PostForm("enabled") == "on"
+	return checkSafeSearchMapping(mapping)
+}
+
+// checkSafeSearchMapping normalises and validates the domain pattern and the target of the mapping
+func checkSafeSearchMapping(mapping *db.SafeSearchMapping) error {
+	mapping.Domain = strings.Trim(strings.ToLower(strings.TrimSpace(mapping.Domain)), ".")
+	mapping.Target = strings.Trim(strings.ToLower(strings.TrimSpace(mapping.Target)), ".")
+	if _, err := path.Match(mapping.Domain, ""); err != nil || mapping.Domain == "" || strings.ContainsAny(mapping.Domain, " /") {
+		return fmt.Errorf("invalid domain %q", mapping.Domain)
+	}
+	if mapping.Target == "" || strings.ContainsAny(mapping.Target, " /*?[") {
+		return fmt.Errorf("invalid target %q", mapping.Target)
+	}
+	return nil
+}
+
+// localZone returns the fully qualified local domain
+func localZone(settings *db.Settings) string {
+	return strings.Trim(settings.Snapshot().LocalDomain, ".") + "."
+}
+
+// readDNSRecord reads the DNS record form and validates the record within the local domain
+func readDNSRecord(c *gin.Context, record *db.DNSRecord, zone string) error {
+	record.Name = strings.TrimSpace(c.PostForm("name"))
+	record.Type = c.PostForm("type")
+	record.Value = strings.TrimSpace(c.PostForm("value"))
+	record.TTL = 0
+	if ttl := strings.TrimSpace(c.PostForm("ttl")); ttl != "" {
+		t, err := strconv.ParseUint(ttl, 10, 32)
+		if err != nil {
+			return fmt.Errorf("invalid TTL %q", ttl)
+		}
+		record.TTL = uint32(t)
+	}
+	_, err := dns.LocalRecordRR(*record, zone)
+	return err
+}
@@ -3,7 +3,10 @@ package main
 import (
 	"net/http"
 	"reflect"
+	"sleuth/internal/db"
+	"sleuth/internal/firewall"
 	"strconv"
+	"strings"
 
 	"github.com/gin-gonic/gin"
 )
@@ -14,19 +17,20 @@ type wcSetup struct {
 
 func (s *wcSetup) render(c *gin.Context, err error) {
 	firewalls := s.portal.fw.AvailableFirewalls()
+	settings := s.portal.config.settings.Snapshot()
 	found := false
 	for _, m := range firewalls {
-		if m == s.portal.config.settings.Firewall {
+		if m == settings.Firewall {
 			found = true
 			break
 		}
 	}
 	if !found {
-		s.portal.config.settings.Firewall = "default"
+		settings.Firewall = "default"
 	}
 
 	s.portal.server.HTML(c, "settings", gin.H{
-		"model":     s.portal.config.settings,
+		"model":     &settings,
 		"roles":     s.portal.db.GetRoles(),
 		"firewalls": firewalls,
 		"err":       err,
@@ -43,15 +47,82 @@ func wcSetupInit(p *Portal) *wcSetup {
 	p.server.router.POST("/settings", func(c *gin.Context) {
 		mode, err := strconv.Atoi(c.PostForm("mode"))
 		if err == nil {
-			p.config.settings.DefaultRole = c.PostForm("default_role")
-			p.config.settings.SelfRegEnabled = c.PostForm("self_reg_enabled") == "on"
-			setfw := c.PostForm("firewall") != p.config.settings.Firewall
-			p.config.settings.Firewall = c.PostForm("firewall")
-			p.config.settings.FallbackDNS = c.PostForm("FallbackDNS")
-			p.config.settings.LocalDomain = c.PostForm("LocalDomain")
+			settings := p.config.settings.Snapshot()
+			settings.DefaultRole = c.PostForm("default_role")
+			settings.SelfRegEnabled = c.PostForm("self_reg_enabled") == "on"
+			setfw := c.PostForm("firewall") != settings.Firewall
+			settings.Firewall = c.PostForm("firewall")
+			settings.FallbackDNS = c.PostForm("FallbackDNS")
+			settings.LocalDomain = c.PostForm("LocalDomain")
+			if err = firewall.ValidateForwardingPools(c.PostForm("ForwardingPoolIPv4"), c.PostForm("ForwardingPoolIPv6")); err != nil {
+				setup.render(c, err)
+				return
+			}
+			setpools := c.PostForm("ForwardingPoolIPv4") != settings.ForwardingPoolIPv4 || c.PostForm("ForwardingPoolIPv6") != settings.ForwardingPoolIPv6
+			settings.ForwardingPoolIPv4 = c.PostForm("ForwardingPoolIPv4")
+			settings.ForwardingPoolIPv6 = c.PostForm("ForwardingPoolIPv6")
+			if x, perr := strconv.Atoi(c.PostForm("PasswordMinLength")); perr == nil && x > 0 {
+				settings.PasswordPolicy.MinLength = x
+			}
+			if x, perr := strconv.Atoi(c.PostForm("PasswordHistory")); perr == nil && x >= 0 {
+				settings.PasswordPolicy.History = x
+			}
+			if x, perr := strconv.Atoi(c.PostForm("PasswordExpiryDays")); perr == nil && x >= 0 {
+				settings.PasswordPolicy.ExpiryDays = x
+			}
+			settings.QueryLog.Enabled = c.PostForm("QueryLogEnabled") == "on"
+			if x, perr := strconv.Atoi(c.PostForm("QueryLogRetentionDays")); perr == nil && x > 0 {
+				settings.QueryLog.RetentionDays = x
+			}
+			settings.Cache.ServeStale = c.PostForm("CacheServeStale") == "on"
+			if x, perr := strconv.Atoi(c.PostForm("CacheStaleHours")); perr == nil && x > 0 {
+				settings.Cache.StaleHours = x
+			}
+			settings.Cache.Prefetch = c.PostForm("CachePrefetch") == "on"
+			if x, perr := strconv.Atoi(c.PostForm("CacheSizeMB")); perr == nil && x > 0 {
+				settings.Cache.SizeMB = x
+			}
+			if x, perr := strconv.Atoi(c.PostForm("CacheMinTTL")); perr == nil && x >= 0 {
+				settings.Cache.MinTTL = x
+			}
+			if x, perr := strconv.Atoi(c.PostForm("CacheMaxTTL")); perr == nil && x >= 0 {
+				settings.Cache.MaxTTL = x
+			}
+			switch c.PostForm("RebindingMode") {
+			case "1":
+				settings.Rebinding.Mode = db.RebindingStrip
+			case "2":
+				settings.Rebinding.Mode = db.RebindingBlock
+			default:
+				settings.Rebinding.Mode = db.RebindingOff
+			}
+			settings.Rebinding.AllowedDomains = parsedomains(strings.ToLower(c.PostForm("RebindingAllowedDomains")))
+			settings.RateLimit.Enabled = c.PostForm("RateLimitEnabled") == "on"
+			if x, perr := strconv.Atoi(c.PostForm("RateLimitClientQPS")); perr == nil && x > 0 {
+				settings.RateLimit.ClientQPS = x
+			}
+			if x, perr := strconv.Atoi(c.PostForm("RateLimitClientBurst")); perr == nil && x > 0 {
+				settings.RateLimit.ClientBurst = x
+			}
+			if x, perr := strconv.Atoi(c.PostForm("RateLimitSubnetQPS")); perr == nil && x >= 0 {
+				settings.RateLimit.SubnetQPS = x
+			}
+			if x, perr := strconv.Atoi(c.PostForm("RateLimitResponseQPS")); perr == nil && x >= 0 {
+				settings.RateLimit.ResponseQPS = x
+			}
+			if x, perr := strconv.Atoi(c.PostForm("RateLimitQuarantineDrops")); perr == nil && x >= 0 {
+				settings.RateLimit.QuarantineDrops = x
+			}
+			if x, perr := strconv.Atoi(c.PostForm("RateLimitQuarantineMinutes")); perr == nil && x > 0 {
+				settings.RateLimit.QuarantineMinutes = x
+			}
+			setbypass := settings.Bypass.Enabled != (c.PostForm("BypassEnabled") == "on") ||
+				settings.Bypass.RedirectDNS != (c.PostForm("BypassRedirectDNS") == "on")
+			settings.Bypass.Enabled = c.PostForm("BypassEnabled") == "on"
+			settings.Bypass.RedirectDNS = c.PostForm("BypassRedirectDNS") == "on"
 
-			// convert int to the enum type stored in p.config.settings.Mode using reflection
-			rv := reflect.ValueOf(&p.config.settings.Mode).Elem()
+			// convert int to the enum type stored in settings.Mode using reflection
+			rv := reflect.ValueOf(&settings.Mode).Elem()
 			modeVal := reflect.ValueOf(mode)
 			if modeVal.Type().ConvertibleTo(rv.Type()) {
 				rv.Set(modeVal.Convert(rv.Type()))
@@ -59,12 +130,20 @@ func wcSetupInit(p *Portal) *wcSetup {
 				rv.SetInt(int64(mode))
 			}
 
-			err = p.db.SaveSettings(*p.config.settings)
+			err = p.db.SaveSettings(settings)
 
 			if err == nil {
+				p.config.settings.Update(func(s *db.Settings) { *s = settings })
+				if setpools {
+					p.fw.FlushForwardingPools()
+				}
 				if setfw {
-					p.fw.SetActiveFirewall(p.config.settings.Firewall)
+					p.fw.SetActiveFirewall(settings.Firewall)
+				} else if setbypass {
+					err = p.fw.ApplyBypassRules()
 				}
+			}
+			if err == nil {
 				c.Redirect(http.StatusSeeOther, "/settings")
 				c.Abort()
 				return
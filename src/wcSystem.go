@@ -3,6 +3,8 @@ package main
 import (
 	"bufio"
 	"bytes"
+	"fmt"
+	"log"
 	"net/http"
 	"os"
 	"os/exec"
@@ -10,7 +12,11 @@ import (
 	"strings"
 	"time"
 
+	"sleuth/internal/constants"
+	"sleuth/internal/db"
+
 	"github.com/gin-gonic/gin"
+	mdns "github.com/miekg/dns"
 )
 
 type wcSystem struct {
@@ -90,9 +96,153 @@ func wcSystemInit(p *Portal) *wcSystem {
 		})
 	})
 
+	p.server.router.GET("/system/querylog", func(c *gin.Context) {
+		filter, err := parseQueryLogFilter(c)
+		var entries []db.QueryLogEntry
+		var more bool
+		if err == nil {
+			entries, more, err = p.db.SearchQueryLog(filter)
+		}
+		page := func(offset int) string {
+			query := c.Request.URL.Query()
+			query.Set("offset", strconv.Itoa(offset))
+			return "?" + query.Encode()
+		}
+		categories := make(map[string]string)
+		for _, cat := range p.db.GetDNSCategories() {
+			categories[cat.CategoryId] = cat.CategoryName
+		}
+		model := gin.H{
+			"Entries":    entries,
+			"Categories": categories,
+			"Filter":     filter,
+			"From":       c.Query("from"),
+			"To":         c.Query("to"),
+			"Reasons":    constants.AccessReasons,
+			"QTypes":     mdns.TypeToString,
+			"Rcodes":     mdns.RcodeToString,
+			"Enabled":    p.config.settings.Snapshot().QueryLog.Enabled,
+			"Error":      err,
+		}
+		if filter.Offset > 0 {
+			model["Previous"] = page(max(filter.Offset-filter.Limit, 0))
+		}
+		if more {
+			model["Next"] = page(filter.Offset + filter.Limit)
+		}
+		p.server.HTML(c, "system_querylog", gin.H{
+			"model": model,
+		})
+	})
+
+	p.server.router.GET("/system/throttled", func(c *gin.Context) {
+		p.server.HTML(c, "system_throttled", gin.H{
+			"model": gin.H{
+				"Clients": p.dns.ThrottledClients(),
+				"Now":     time.Now(),
+			},
+		})
+	})
+
+	p.server.router.POST("/system/throttled", func(c *gin.Context) {
+		if c.Request.FormValue("action") == "release" {
+			p.dns.ReleaseClient(c.Request.FormValue("IP"))
+		}
+		c.Redirect(http.StatusSeeOther, "/system/throttled")
+	})
+
+	dnsCache := func(c *gin.Context, err error) {
+		filter := c.Query("name")
+		stats := p.dns.AnswerCacheStats()
+		p.server.HTML(c, "system_dnscache", gin.H{
+			"model": gin.H{
+				"Stats":    stats,
+				"HitRatio": fmt.Sprintf("%.1f%%", stats.HitRatio()*100),
+				"Size":     fmt.Sprintf("%.1f / %d MB", float64(stats.Bytes)/(1<<20), stats.MaxBytes>>20),
+				"Entries":  p.dns.AnswerCacheEntries(filter, 200),
+				"Filter":   filter,
+				"QTypes":   mdns.TypeToString,
+				"Rcodes":   mdns.RcodeToString,
+				"Error":    err,
+			},
+		})
+	}
+
+	p.server.router.GET("/system/dnscache", func(c *gin.Context) {
+		dnsCache(c, nil)
+	})
+
+	p.server.router.POST("/system/dnscache", func(c *gin.Context) {
+		var err error
+		switch c.Request.FormValue("action") {
+		case "flush":
+			name := strings.TrimSpace(c.Request.FormValue("Name"))
+			if name == "" {
+				err = fmt.Errorf("Name required")
+				break
+			}
+			var flushed, expired int
+			if flushed, expired, err = p.dns.FlushAnswerCache(name); err == nil {
+				log.Printf("Flushed %d cached answers and %d client sessions of %s", flushed, expired, name)
+			}
+		case "flushall":
+			var flushed, expired int
+			if flushed, expired, err = p.dns.FlushAnswerCache(""); err == nil {
+				log.Printf("Flushed %d cached answers and %d client sessions", flushed, expired)
+			}
+		}
+		if err == nil {
+			c.Redirect(http.StatusSeeOther, "/system/dnscache")
+			return
+		}
+		dnsCache(c, err)
+	})
+
 	return s
 }
 
+// parseQueryLogFilter reads the client, domain, from, to, offset and limit query parameters, times are
+// RFC 3339 or local "2006-01-02T15:04" values
+func parseQueryLogFilter(c *gin.Context) (db.QueryLogFilter, error) {
+	filter := db.QueryLogFilter{
+		ClientIP: strings.TrimSpace(c.Query("client")),
+		Domain:   strings.TrimSpace(c.Query("domain")),
+		Limit:    apiDefaultLimit,
+	}
+	parseTime := func(name string) (time.Time, error) {
+		v := c.Query(name)
+		if v == "" {
+			return time.Time{}, nil
+		}
+		if t, err := time.Parse(time.RFC3339, v); err == nil {
+			return t, nil
+		}
+		t, err := time.ParseInLocation("2006-01-02T15:04", v, time.Local)
+		if err != nil {
+			return t, fmt.Errorf("invalid %s time %q", name, v)
+		}
+		return t, nil
+	}
+	var err error
+	if filter.From, err = parseTime("from"); err != nil {
+		return filter, err
+	}
+	if filter.To, err = parseTime("to"); err != nil {
+		return filter, err
+	}
+	if v := c.Query("offset"); v != "" {
+		if filter.Offset, err = strconv.Atoi(v); err != nil || filter.Offset < 0 {
+			return filter, fmt.Errorf("invalid offset %q", v)
+		}
+	}
+	if v := c.Query("limit"); v != "" {
+		if filter.Limit, err = strconv.Atoi(v); err != nil || filter.Limit < 1 || filter.Limit > apiMaxLimit {
+			return filter, fmt.Errorf("limit must be between 1 and %d", apiMaxLimit)
+		}
+	}
+	return filter, nil
+}
+
 func (wcSystem) GetNeighbours(p *Portal) []Neighbour {
 	devices := make(map[string]string)
 	for _, device := range p.db.GetDevices() {
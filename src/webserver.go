@@ -7,6 +7,7 @@ import (
 	"net"
 	"net/http"
 	"os"
+	"slices"
 	"strings"
 	"sync"
 	"time"
@@ -188,7 +189,8 @@ func initWebServer(ttl time.Duration, h gin.HandlerFunc) *WebServer {
 		"array": func(values ...interface{}) []interface{} {
 			return values
 		},
-		"join": strings.Join,
+		"join":     strings.Join,
+		"contains": slices.Contains[[]string],
 	})
 
 	if h != nil {
@@ -49,9 +49,6 @@ func webShellInit(p *Portal) *webShell {
 		c.Writer.Write([]byte("ok"))
 	})
 
-	// metrics endpoint
-	//router.Handle(pathMetrics, promhttp.Handler())
-
 	// version endpoint
 	/*router.HandleFunc("/version", func(w http.ResponseWriter, r *http.Request) {
 		w.WriteHeader(http.StatusOK)